@@ -0,0 +1,487 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mateosanchezl/go-vect/internal/config"
+	"github.com/mateosanchezl/go-vect/internal/portable"
+	"github.com/mateosanchezl/go-vect/internal/search/ivf"
+	"github.com/mateosanchezl/go-vect/internal/search/pq"
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+const usage = `usage: vect [command]
+
+Without a command vect starts the interactive TUI on the collection named by
+VECTOR_COLLECTION, or the default collection.
+
+commands:
+  tui [-collection NAME]
+        start the interactive TUI on a collection
+  collection list
+        list collections with their dimension, element type, model and size
+  collection create [-dim N] [-dtype T] NAME
+        create an empty collection
+  collection drop NAME
+        delete a collection and all of its files
+  collection rename OLD NEW
+        rename a collection
+  index train [-collection NAME] [-type ivf|pq] [-nlists N] [-m M] [-min-drift F] [-seed S]
+        train the IVF index, or the PQ codebooks, over the stored vectors
+  fsck [-collection NAME] [-repair]
+        check a collection's files for corruption, and with -repair fix what
+        can be fixed, moving unrecoverable records to quarantine.jsonl
+  snapshot [-collection NAME] DIR
+        write a point-in-time copy of a collection and its indexes to DIR
+  restore [-collection NAME] DIR
+        replace a collection with the snapshot in DIR
+  export [-collection NAME] [-format jsonl|npy] PATH
+        write a collection's records to PATH as JSONL, or as a .npy matrix
+        of vectors with the rest of each record in a .jsonl next to it
+  import [-collection NAME] [-normalize] PATH
+        append the records in a .jsonl or .npy file written by export, or
+        by other tools in the same formats`
+
+// Runs a non-interactive subcommand such as `vect index train`
+func runCommand(args []string) error {
+	switch args[0] {
+	case "tui":
+		fs := flag.NewFlagSet("tui", flag.ContinueOnError)
+		name := fs.String("collection", "", "collection to open, defaults to VECTOR_COLLECTION or the default collection")
+		err := fs.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		return runTUI(*name)
+	case "collection":
+		return collectionCmd(args[1:])
+	case "index":
+		return indexCmd(args[1:])
+	case "fsck":
+		return fsckCmd(args[1:])
+	case "snapshot", "restore":
+		return snapshotCmd(args[0], args[1:])
+	case "export":
+		return exportCmd(args[1:])
+	case "import":
+		return importCmd(args[1:])
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+func indexCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	switch args[0] {
+	case "train":
+		return indexTrainCmd(args[1:])
+	default:
+		return fmt.Errorf("unknown index command %q\n%s", args[0], usage)
+	}
+}
+
+// Trains (or retrains) the IVF index or the PQ codebooks. With -min-drift an
+// already trained IVF index is only retrained once enough vectors have
+// arrived since last time.
+func indexTrainCmd(args []string) error {
+	fs := flag.NewFlagSet("index train", flag.ContinueOnError)
+	name := fs.String("collection", "", "collection to train, defaults to VECTOR_COLLECTION or the default collection")
+	kind := fs.String("type", "ivf", "index to train: ivf or pq")
+	m := fs.Int("m", 0, "pq subspaces, must divide the dimension; defaults to dimension/8")
+	nlists := fs.Int("nlists", 0, "number of lists, defaults to the square root of the number of vectors")
+	minDrift := fs.Float64("min-drift", 0, "skip training unless at least this fraction of vectors arrived since the last training")
+	seed := fs.Uint64("seed", 0, "seed for sampling and k-means++")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	err = config.LoadEnv()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	return withStore(*name, func(store *storage.Store) error {
+		switch *kind {
+		case "ivf":
+			return trainIVF(store, *nlists, *minDrift, *seed)
+		case "pq":
+			return trainPQ(store, *m, *seed)
+		default:
+			return fmt.Errorf("unknown index type %q, expected ivf or pq", *kind)
+		}
+	})
+}
+
+// Opens the store of a collection for fn and closes it afterwards, returning
+// the first error
+func withStore(name string, fn func(store *storage.Store) error) error {
+	store, err := openStore(name)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	err = fn(store)
+	if cerr := store.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func trainIVF(store *storage.Store, nlists int, minDrift float64, seed uint64) error {
+	idx, err := ivf.Open(store, ivf.Config{NLists: nlists, Seed: seed})
+	if err != nil {
+		return fmt.Errorf("failed to open ivf index: %w", err)
+	}
+
+	if idx.Trained() && idx.Drift() < minDrift {
+		fmt.Printf("%.1f%% of vectors arrived since the last training, below -min-drift; not retraining\n", idx.Drift()*100)
+		return nil
+	}
+
+	err = idx.Train()
+	if err != nil {
+		return err
+	}
+
+	sizes := idx.ListSizes()
+	fmt.Printf("trained %d vectors into %d lists (smallest %d, largest %d)\n", idx.Len(), idx.NLists(), slices.Min(sizes), slices.Max(sizes))
+	return nil
+}
+
+func trainPQ(store *storage.Store, m int, seed uint64) error {
+	idx, err := pq.Open(store, pq.Config{M: m, Seed: seed})
+	if err != nil {
+		return fmt.Errorf("failed to open pq index: %w", err)
+	}
+
+	err = idx.Train()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("encoded %d vectors into %d-byte codes\n", idx.Len(), idx.CodeSize())
+	return nil
+}
+
+func collectionCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	err := config.LoadEnv()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	switch args[0] {
+	case "list":
+		return collectionListCmd()
+	case "create":
+		return collectionCreateCmd(args[1:])
+	case "drop":
+		if len(args) != 2 {
+			return fmt.Errorf("expected a collection name\n%s", usage)
+		}
+		err = catalog().Drop(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("dropped collection %q\n", args[1])
+		return nil
+	case "rename":
+		if len(args) != 3 {
+			return fmt.Errorf("expected the old and new collection names\n%s", usage)
+		}
+		err = catalog().Rename(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("renamed collection %q to %q\n", args[1], args[2])
+		return nil
+	default:
+		return fmt.Errorf("unknown collection command %q\n%s", args[0], usage)
+	}
+}
+
+func collectionListCmd() error {
+	infos, err := catalog().List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDIM\tDTYPE\tMODEL\tVECTORS")
+	for _, info := range infos {
+		if info.Dimension == 0 {
+			// The default collection before anything was stored in it
+			fmt.Fprintf(w, "%s\t-\t-\t-\t0\n", info.Name)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%d\n", info.Name, info.Dimension, info.DType, info.Model, info.Vectors)
+	}
+	return w.Flush()
+}
+
+func collectionCreateCmd(args []string) error {
+	fs := flag.NewFlagSet("collection create", flag.ContinueOnError)
+	dim := fs.Int("dim", 0, "vector dimension, defaults to 384")
+	dtype := fs.String("dtype", "", "element type: float32, int8, float16 or bfloat16; defaults to VECTOR_DTYPE")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a collection name\n%s", usage)
+	}
+
+	opts, err := storeOptions()
+	if err != nil {
+		return err
+	}
+	opts.Dimension = *dim
+	if *dtype != "" {
+		opts.DType, err = storage.ParseDType(*dtype)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = catalog().Create(fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created collection %q\n", fs.Arg(0))
+	return nil
+}
+
+// Checks a collection that is not open anywhere else, and optionally repairs it
+func fsckCmd(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	name := fs.String("collection", "", "collection to check, defaults to VECTOR_COLLECTION or the default collection")
+	repair := fs.Bool("repair", false, "repair the problems found, quarantining records that cannot be recovered")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	err = config.LoadEnv()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	dir := catalog().Dir(collectionName(*name))
+	_, err = os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to find collection %q: %w", collectionName(*name), err)
+	}
+
+	check := storage.Check
+	if *repair {
+		check = storage.Repair
+	}
+	report, err := check(dir)
+	if err != nil {
+		return err
+	}
+	for _, issue := range report.Issues {
+		fmt.Println(issue)
+	}
+	fmt.Printf("%d vectors, %d metadata lines, %d issues\n", report.Vectors, report.Records, len(report.Issues))
+	if report.OK() {
+		return nil
+	}
+	if !*repair {
+		return errors.New("store has issues, run vect fsck -repair with the store closed to fix them")
+	}
+
+	after, err := storage.Check(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("repaired, %d records quarantined\n", report.Quarantined)
+	if !after.OK() {
+		return fmt.Errorf("%d issues remain after repair", len(after.Issues))
+	}
+	return nil
+}
+
+// Snapshots a collection to a directory, or restores it from one
+func snapshotCmd(cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	name := fs.String("collection", "", "collection to use, defaults to VECTOR_COLLECTION or the default collection")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a snapshot directory\n%s", usage)
+	}
+
+	err = config.LoadEnv()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	return withStore(*name, func(store *storage.Store) error {
+		if cmd == "restore" {
+			err := store.Restore(fs.Arg(0))
+			if err != nil {
+				return err
+			}
+			n, err := store.Len()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("restored %d vectors from %s\n", n, fs.Arg(0))
+			return nil
+		}
+
+		m, err := store.Snapshot(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("wrote %d vectors and %d files to %s\n", m.Vectors, len(m.Files), fs.Arg(0))
+		return nil
+	})
+}
+
+// Path of the metadata written next to an exported .npy file
+func sidecarPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".jsonl"
+}
+
+func exportCmd(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	name := fs.String("collection", "", "collection to export, defaults to VECTOR_COLLECTION or the default collection")
+	format := fs.String("format", "jsonl", "jsonl, or npy for a matrix of vectors with a .jsonl sidecar")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected an output path\n%s", usage)
+	}
+	if *format != "jsonl" && *format != "npy" {
+		return fmt.Errorf("unknown format %q, expected jsonl or npy", *format)
+	}
+	path := fs.Arg(0)
+	if *format == "npy" && sidecarPath(path) == path {
+		return fmt.Errorf("%s would be overwritten by the metadata sidecar, use a .npy path", path)
+	}
+
+	err = config.LoadEnv()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	var n int
+	err = withStore(*name, func(store *storage.Store) error {
+		out, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", path, err)
+		}
+		defer out.Close()
+
+		if *format == "npy" {
+			meta, err := os.Create(sidecarPath(path))
+			if err != nil {
+				return fmt.Errorf("failed to create %s: %w", sidecarPath(path), err)
+			}
+			defer meta.Close()
+
+			n, err = portable.ExportNPY(store, out, meta)
+			if err != nil {
+				return err
+			}
+			err = meta.Close()
+			if err != nil {
+				return err
+			}
+		} else {
+			n, err = portable.ExportJSONL(store, out)
+			if err != nil {
+				return err
+			}
+		}
+		return out.Close()
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("exported %d records to %s\n", n, path)
+	return nil
+}
+
+func importCmd(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	name := fs.String("collection", "", "collection to import into, defaults to VECTOR_COLLECTION or the default collection")
+	normalize := fs.Bool("normalize", false, "scale vectors to unit length instead of refusing those that are not")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a file to import\n%s", usage)
+	}
+	path := fs.Arg(0)
+
+	err = config.LoadEnv()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer in.Close()
+
+	opts := portable.ImportOptions{Normalize: *normalize}
+	var n int
+	err = withStore(*name, func(store *storage.Store) error {
+		switch filepath.Ext(path) {
+		case ".npy":
+			// The sidecar is optional, without it records have no text
+			var meta io.Reader
+			f, err := os.Open(sidecarPath(path))
+			if err == nil {
+				defer f.Close()
+				meta = f
+			} else if !os.IsNotExist(err) {
+				return fmt.Errorf("failed to open %s: %w", sidecarPath(path), err)
+			}
+			n, err = portable.ImportNPY(store, in, meta, opts)
+			if err != nil {
+				return fmt.Errorf("imported %d records before failing: %w", n, err)
+			}
+		case ".jsonl", ".json":
+			var err error
+			n, err = portable.ImportJSONL(store, in, opts)
+			if err != nil {
+				return fmt.Errorf("imported %d records before failing: %w", n, err)
+			}
+		default:
+			return fmt.Errorf("cannot tell the format of %s, expected a .jsonl or .npy file", path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d records from %s\n", n, path)
+	return nil
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -12,9 +16,14 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 
 	"github.com/mateosanchezl/go-vect/internal/chunking"
+	"github.com/mateosanchezl/go-vect/internal/collection"
 	"github.com/mateosanchezl/go-vect/internal/config"
 	"github.com/mateosanchezl/go-vect/internal/embedding"
 	"github.com/mateosanchezl/go-vect/internal/search"
+	"github.com/mateosanchezl/go-vect/internal/search/bq"
+	"github.com/mateosanchezl/go-vect/internal/search/hnsw"
+	"github.com/mateosanchezl/go-vect/internal/search/ivf"
+	"github.com/mateosanchezl/go-vect/internal/search/pq"
 	"github.com/mateosanchezl/go-vect/internal/storage"
 )
 
@@ -34,6 +43,7 @@ const (
 	opEmbedFile
 	opSearch
 	opDeleteData
+	opSwitchCollection
 )
 
 type menuItem struct {
@@ -43,8 +53,11 @@ type menuItem struct {
 }
 
 type model struct {
-	chunker  chunking.Chunker
-	embedder embedding.EmbeddingModel
+	chunker    chunking.Chunker
+	embedder   embedding.EmbeddingModel
+	store      *storage.Store
+	collection string
+	searchOpts []search.Option
 
 	menu       []menuItem
 	menuIndex  int
@@ -72,18 +85,155 @@ type opErrorMsg struct {
 	err       error
 }
 
+// Sent once the store of the collection being switched to is open
+type collectionMsg struct {
+	name       string
+	store      *storage.Store
+	searchOpts []search.Option
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := runTUI(""); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Starts the interactive TUI on a collection, the configured one if empty
+func runTUI(name string) error {
 	if err := config.Load(); err != nil {
-		log.Fatal("failed to load config:", err)
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	name = collectionName(name)
+	store, err := openStore(name)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+
+	searchOpts, err := searchOptions(store)
+	if err != nil {
+		store.Close()
+		return fmt.Errorf("failed to open search index: %w", err)
+	}
+
+	final, err := tea.NewProgram(newModel(store, name, searchOpts...)).Run()
+	if err != nil {
+		store.Close()
+		return fmt.Errorf("failed to start TUI: %w", err)
+	}
+	// The TUI may have switched to another collection's store
+	switch m := final.(type) {
+	case model:
+		store = m.store
+	case *model:
+		store = m.store
+	}
+	return store.Close()
+}
+
+// Candidates rescored at full precision when searching quantized vectors
+const rescoreCandidates = 40
+
+// Options new collections are created with and existing ones are checked
+// against
+func storeOptions() (storage.Options, error) {
+	opts := storage.Options{Model: embedding.MiniLMModelName, KeepFloat32: config.KeepFloat32()}
+	if name := config.StorageDType(); name != "" {
+		dtype, err := storage.ParseDType(name)
+		if err != nil {
+			return storage.Options{}, err
+		}
+		opts.DType = dtype
+	}
+	if name := config.Verify(); name != "" {
+		mode, err := storage.ParseVerifyMode(name)
+		if err != nil {
+			return storage.Options{}, err
+		}
+		opts.Verify = mode
 	}
+	return opts, nil
+}
 
-	initial := newModel()
-	if _, err := tea.NewProgram(initial).Run(); err != nil {
-		log.Fatal("failed to start TUI:", err)
+// Name of the collection to use, falling back to the configured one and then
+// the default
+func collectionName(name string) string {
+	if name == "" {
+		name = config.Collection()
+	}
+	if name == "" {
+		name = collection.Default
 	}
+	return name
 }
 
-func newModel() model {
+func catalog() *collection.Catalog {
+	return collection.New(config.DbDir())
+}
+
+// Opens a collection's store in the configured data directory
+func openStore(name string) (*storage.Store, error) {
+	opts, err := storeOptions()
+	if err != nil {
+		return nil, err
+	}
+	return catalog().Open(collectionName(name), opts)
+}
+
+// Picks the search path from config, opening the index it needs
+func searchOptions(store *storage.Store) ([]search.Option, error) {
+	var opts []search.Option
+	if store.Header().DType != storage.DTypeFloat32 && store.HasFloat32() {
+		opts = append(opts, search.Rescore(rescoreCandidates))
+	}
+	if n := config.ContextWindow(); n > 0 {
+		opts = append(opts, search.WithWindow(n))
+	}
+
+	switch config.SearchIndex() {
+	case "exact":
+		return append(opts, search.Exact()), nil
+	case "hnsw":
+		idx, err := hnsw.Open(store, hnsw.Config{})
+		if err != nil {
+			return nil, err
+		}
+		return append(opts, search.WithIndex(idx)), nil
+	case "ivf":
+		idx, err := ivf.Open(store, ivf.Config{})
+		if err != nil {
+			return nil, err
+		}
+		return append(opts, search.WithIndex(idx)), nil
+	case "bq":
+		idx, err := bq.Open(store, bq.Config{})
+		if err != nil {
+			return nil, err
+		}
+		return append(opts, search.WithIndex(idx)), nil
+	case "pq":
+		idx, err := pq.Open(store, pq.Config{})
+		if err != nil {
+			return nil, err
+		}
+		// PQ scores are rough, so float32 stores always rescore the best candidates
+		if store.Header().DType == storage.DTypeFloat32 {
+			opts = append(opts, search.Rescore(rescoreCandidates))
+		}
+		return append(opts, search.WithIndex(idx)), nil
+	default:
+		return nil, fmt.Errorf("unknown search index %q", config.SearchIndex())
+	}
+}
+
+func newModel(store *storage.Store, collectionName string, searchOpts ...search.Option) model {
 	ti := textinput.New()
 	ti.Prompt = "> "
 	ti.CharLimit = 0
@@ -91,13 +241,17 @@ func newModel() model {
 	ti.Blur()
 
 	return model{
-		chunker:  &chunking.DelimiterChunker{Delimiter: "."},
-		embedder: &embedding.MiniLM{},
+		chunker:    &chunking.DelimiterChunker{Delimiter: "."},
+		embedder:   &embedding.MiniLM{},
+		store:      store,
+		collection: collectionName,
+		searchOpts: searchOpts,
 		menu: []menuItem{
 			{title: "Embed Text", description: "Chunk, embed, and store text", action: opEmbedText},
 			{title: "Embed File", description: "Read a file, chunk it, and store embeddings", action: opEmbedFile},
 			{title: "Search", description: "Search stored embeddings by text query", action: opSearch},
-			{title: "Delete Data", description: "Clear all stored embeddings and metadata", action: opDeleteData},
+			{title: "Switch Collection", description: "Embed into and search another collection", action: opSwitchCollection},
+			{title: "Delete Data", description: "Clear the collection's embeddings and metadata", action: opDeleteData},
 		},
 		stage: stageMenu,
 		input: ti,
@@ -168,6 +322,16 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		m.activeOp = opNone
 
+	case collectionMsg:
+		m.loading = false
+		m.loadingMessage = ""
+		m.activeOp = opNone
+		m.err = m.store.Close()
+		m.store = msg.store
+		m.collection = msg.name
+		m.searchOpts = msg.searchOpts
+		m.statusLines = []string{fmt.Sprintf("Switched to collection %q", msg.name)}
+
 	case opErrorMsg:
 		m.loading = false
 		m.loadingMessage = ""
@@ -181,7 +345,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 func (m model) View() string {
 	var b strings.Builder
 
-	b.WriteString("go-vect\n")
+	b.WriteString(fmt.Sprintf("go-vect · collection %s\n", m.collection))
 	b.WriteString("────────\n")
 	b.WriteString("Use ↑/↓ or j/k to navigate, Enter to run, q to quit.\n\n")
 
@@ -225,13 +389,29 @@ func (m model) View() string {
 		b.WriteString("\nSearch Results:\n")
 		for i, r := range m.results {
 			b.WriteString(fmt.Sprintf("%d) cos=%.4f\n", i+1, r.CosSim))
-			b.WriteString(fmt.Sprintf("   %s\n", r.Text))
+			if r.Meta.Source != "" {
+				b.WriteString(fmt.Sprintf("   %s\n", resultLocation(r.Meta)))
+			}
+			text := r.Text
+			if r.Context != "" {
+				text = r.Context
+			}
+			b.WriteString(fmt.Sprintf("   %s\n", text))
 		}
 	}
 
 	return b.String()
 }
 
+// Where a search result came from, e.g. "file:///notes/a.md chunk 3, bytes 120-180"
+func resultLocation(md storage.EmbeddingMetaData) string {
+	loc := fmt.Sprintf("%s chunk %d", md.Source, md.Chunk)
+	if md.Span != nil {
+		loc += fmt.Sprintf(", bytes %d-%d", md.Span.ByteStart, md.Span.ByteEnd)
+	}
+	return loc
+}
+
 func (m *model) handleMenuSelection() (tea.Model, tea.Cmd) {
 	if len(m.menu) == 0 {
 		return m, nil
@@ -249,11 +429,13 @@ func (m *model) handleMenuSelection() (tea.Model, tea.Cmd) {
 		m.setInputMode("Enter file path to embed:", "/path/to/file.txt", opEmbedFile)
 	case opSearch:
 		m.setInputMode("Enter search query:", "What would you like to find?", opSearch)
+	case opSwitchCollection:
+		m.setInputMode("Enter collection name:", collection.Default, opSwitchCollection)
 	case opDeleteData:
 		m.loading = true
 		m.loadingMessage = "Deleting stored vectors…"
 		m.activeOp = opDeleteData
-		return m, deleteDataCmd()
+		return m, deleteDataCmd(m.store)
 	}
 
 	return m, nil
@@ -282,19 +464,24 @@ func (m *model) prepareForExecution(message string) {
 func (m model) commandForInput(value string) (tea.Cmd, string, error) {
 	switch m.activeOp {
 	case opEmbedText:
-		return embedTextCmd(m.chunker, m.embedder, value), "Embedding text…", nil
+		return embedTextCmd(m.store, m.chunker, m.embedder, value), "Embedding text…", nil
 	case opEmbedFile:
-		return embedFileCmd(m.chunker, m.embedder, value), "Embedding file…", nil
+		return embedFileCmd(m.store, m.chunker, m.embedder, value), "Embedding file…", nil
 	case opSearch:
-		return searchCmd(m.embedder, value), "Searching…", nil
+		return searchCmd(m.store, m.embedder, value, m.searchOpts), "Searching…", nil
+	case opSwitchCollection:
+		if value == m.collection {
+			return nil, "", fmt.Errorf("already using collection %q", value)
+		}
+		return switchCollectionCmd(value), "Opening collection…", nil
 	default:
 		return nil, "", errors.New("no action selected")
 	}
 }
 
-func embedTextCmd(chunker chunking.Chunker, embedder embedding.EmbeddingModel, text string) tea.Cmd {
+func embedTextCmd(store *storage.Store, chunker chunking.Chunker, embedder embedding.EmbeddingModel, text string) tea.Cmd {
 	return func() tea.Msg {
-		lines, err := runEmbedding(chunker, embedder, text)
+		lines, err := runEmbedding(store, chunker, embedder, text, "")
 		if err != nil {
 			return opErrorMsg{operation: opEmbedText, err: err}
 		}
@@ -302,7 +489,7 @@ func embedTextCmd(chunker chunking.Chunker, embedder embedding.EmbeddingModel, t
 	}
 }
 
-func embedFileCmd(chunker chunking.Chunker, embedder embedding.EmbeddingModel, path string) tea.Cmd {
+func embedFileCmd(store *storage.Store, chunker chunking.Chunker, embedder embedding.EmbeddingModel, path string) tea.Cmd {
 	return func() tea.Msg {
 		cleanPath := strings.TrimSpace(path)
 		if cleanPath == "" {
@@ -314,7 +501,7 @@ func embedFileCmd(chunker chunking.Chunker, embedder embedding.EmbeddingModel, p
 			return opErrorMsg{operation: opEmbedFile, err: fmt.Errorf("failed to read file: %w", err)}
 		}
 
-		lines, err := runEmbedding(chunker, embedder, string(data))
+		lines, err := runEmbedding(store, chunker, embedder, string(data), fileURI(cleanPath))
 		if err != nil {
 			return opErrorMsg{operation: opEmbedFile, err: err}
 		}
@@ -323,14 +510,14 @@ func embedFileCmd(chunker chunking.Chunker, embedder embedding.EmbeddingModel, p
 	}
 }
 
-func searchCmd(embedder embedding.EmbeddingModel, query string) tea.Cmd {
+func searchCmd(store *storage.Store, embedder embedding.EmbeddingModel, query string, opts []search.Option) tea.Cmd {
 	return func() tea.Msg {
 		q := strings.TrimSpace(query)
 		if q == "" {
 			return opErrorMsg{operation: opSearch, err: errors.New("query cannot be empty")}
 		}
 
-		results, err := search.SearchTopKSimilar(q, 10, embedder)
+		results, err := search.SearchTopKSimilar(store, q, 10, embedder, opts...)
 		if err != nil {
 			return opErrorMsg{operation: opSearch, err: fmt.Errorf("failed to search: %w", err)}
 		}
@@ -340,16 +527,33 @@ func searchCmd(embedder embedding.EmbeddingModel, query string) tea.Cmd {
 	}
 }
 
-func deleteDataCmd() tea.Cmd {
+func switchCollectionCmd(name string) tea.Cmd {
 	return func() tea.Msg {
-		if err := storage.ClearData(); err != nil {
+		store, err := openStore(name)
+		if err != nil {
+			return opErrorMsg{operation: opSwitchCollection, err: fmt.Errorf("failed to open collection: %w", err)}
+		}
+		searchOpts, err := searchOptions(store)
+		if err != nil {
+			store.Close()
+			return opErrorMsg{operation: opSwitchCollection, err: fmt.Errorf("failed to open search index: %w", err)}
+		}
+		return collectionMsg{name: name, store: store, searchOpts: searchOpts}
+	}
+}
+
+func deleteDataCmd(store *storage.Store) tea.Cmd {
+	return func() tea.Msg {
+		if err := store.Clear(); err != nil {
 			return opErrorMsg{operation: opDeleteData, err: fmt.Errorf("failed to clear data: %w", err)}
 		}
 		return opResultMsg{operation: opDeleteData, lines: []string{"Successfully deleted stored vectors."}}
 	}
 }
 
-func runEmbedding(chunker chunking.Chunker, embedder embedding.EmbeddingModel, text string) ([]string, error) {
+// Chunks, embeds and upserts a document. source is the URI it was read from,
+// empty for text typed into the TUI.
+func runEmbedding(store *storage.Store, chunker chunking.Chunker, embedder embedding.EmbeddingModel, text, source string) ([]string, error) {
 	clean := strings.TrimSpace(text)
 	if clean == "" {
 		return nil, errors.New("no text provided to embed")
@@ -360,26 +564,63 @@ func runEmbedding(chunker chunking.Chunker, embedder embedding.EmbeddingModel, t
 		return nil, errors.New("chunker produced no chunks")
 	}
 
-	start := time.Now()
-	embeddings, err := embedder.EmbedBatch(chunks)
+	// Spans are located in the untrimmed text so they match the original file
+	spans, err := chunking.Locate(text, chunks)
 	if err != nil {
-		return nil, fmt.Errorf("failed to embed batch: %w", err)
+		return nil, fmt.Errorf("failed to locate chunks: %w", err)
 	}
-	embedElapsed := time.Since(start)
 
-	lines := []string{fmt.Sprintf("Embedded %d chunks in %s", len(chunks), embedElapsed)}
-	for i, e := range embeddings {
-		lines = append(lines, fmt.Sprintf("Chunk %d embedding length: %d", i+1, len(e)))
+	sum := sha256.Sum256([]byte(text))
+	docID := hex.EncodeToString(sum[:16])
+	ingestedAt := time.Now().UTC()
+	metas := make([]storage.EmbeddingMetaData, len(chunks))
+	for i, chunk := range chunks {
+		span := storage.Span(spans[i])
+		metas[i] = storage.EmbeddingMetaData{
+			Text:       chunk,
+			Source:     source,
+			DocID:      docID,
+			Chunk:      i,
+			Span:       &span,
+			IngestedAt: ingestedAt,
+		}
 	}
 
-	storeStart := time.Now()
-	for i, e := range embeddings {
-		if err := storage.StoreEmbedding(e, chunks[i]); err != nil {
-			return nil, fmt.Errorf("failed to store embedding: %w", err)
-		}
+	// Re-embedding a file replaces its chunks. Typed text is keyed by its
+	// content, so entering the same text twice stores it once.
+	key := source
+	if key == "" {
+		key = docID
+	}
+
+	var embedElapsed time.Duration
+	embed := func(texts []string) ([]embedding.EmbeddingVector, error) {
+		start := time.Now()
+		defer func() { embedElapsed += time.Since(start) }()
+		return embedder.EmbedBatch(texts)
+	}
+
+	start := time.Now()
+	doc := storage.Document{ID: docID, Source: source, Text: text}
+	res, err := store.UpsertDocument(key, doc, metas, embed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store embeddings: %w", err)
+	}
+	storeElapsed := time.Since(start) - embedElapsed
+
+	lines := []string{
+		fmt.Sprintf("Embedded %d of %d chunks in %s", res.Embedded, len(chunks), embedElapsed),
+		fmt.Sprintf("Kept %d unchanged chunks, moved %d and removed %d stale ones", res.Kept, res.Rewritten, res.Removed),
+		fmt.Sprintf("Stored embeddings in %s", storeElapsed),
 	}
-	storeElapsed := time.Since(storeStart)
-	lines = append(lines, fmt.Sprintf("Stored embeddings in %s", storeElapsed))
 
 	return lines, nil
 }
+
+// file:// URI of a path, made absolute when possible
+func fileURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
@@ -0,0 +1,40 @@
+package chunking
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Location of a chunk in the text it was cut from, as half-open byte and rune
+// ranges
+type Span struct {
+	ByteStart int
+	ByteEnd   int
+	RuneStart int
+	RuneEnd   int
+}
+
+// Finds where each chunk sits in text. Chunks must appear in text in order,
+// as they do for every chunker in this package.
+func Locate(text string, chunks []string) ([]Span, error) {
+	spans := make([]Span, len(chunks))
+	byteCursor, runeCursor := 0, 0
+	for i, chunk := range chunks {
+		idx := strings.Index(text[byteCursor:], chunk)
+		if idx < 0 {
+			return nil, fmt.Errorf("chunk %d does not appear in the text after chunk %d", i, i-1)
+		}
+
+		start := byteCursor + idx
+		runeStart := runeCursor + utf8.RuneCountInString(text[byteCursor:start])
+		spans[i] = Span{
+			ByteStart: start,
+			ByteEnd:   start + len(chunk),
+			RuneStart: runeStart,
+			RuneEnd:   runeStart + utf8.RuneCountInString(chunk),
+		}
+		byteCursor, runeCursor = spans[i].ByteEnd, spans[i].RuneEnd
+	}
+	return spans, nil
+}
@@ -0,0 +1,50 @@
+package chunking
+
+import "testing"
+
+func TestLocateFixedChunks(t *testing.T) {
+	text := "  héllo wörld"
+	chunker := FixedChunker{ChunkSize: 4}
+	chunks := chunker.Chunk(text[2:])
+
+	spans, err := Locate(text, chunks)
+	if err != nil {
+		t.Fatalf("Locate: %v", err)
+	}
+
+	expected := []Span{
+		{ByteStart: 2, ByteEnd: 7, RuneStart: 2, RuneEnd: 6},
+		{ByteStart: 7, ByteEnd: 12, RuneStart: 6, RuneEnd: 10},
+		{ByteStart: 12, ByteEnd: 15, RuneStart: 10, RuneEnd: 13},
+	}
+	if len(spans) != len(expected) {
+		t.Fatalf("expected %d spans, got %d", len(expected), len(spans))
+	}
+	for i, span := range spans {
+		if span != expected[i] {
+			t.Errorf("span %d: expected %+v, got %+v", i, expected[i], span)
+		}
+		if text[span.ByteStart:span.ByteEnd] != chunks[i] {
+			t.Errorf("span %d covers %q, expected %q", i, text[span.ByteStart:span.ByteEnd], chunks[i])
+		}
+	}
+}
+
+func TestLocateRepeatedDelimitedChunks(t *testing.T) {
+	text := "a,b,a"
+	chunker := DelimiterChunker{Delimiter: ","}
+
+	spans, err := Locate(text, chunker.Chunk(text))
+	if err != nil {
+		t.Fatalf("Locate: %v", err)
+	}
+	if spans[2].ByteStart != 4 {
+		t.Fatalf("expected the second %q at byte 4, got %d", "a", spans[2].ByteStart)
+	}
+}
+
+func TestLocateRejectsForeignChunks(t *testing.T) {
+	if _, err := Locate("abc", []string{"b", "a"}); err == nil {
+		t.Fatalf("expected error for chunks out of order")
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Package collection keeps several named stores under one data directory.
+
+Each collection is a complete storage.Store in its own directory, with its
+own data.bin, metadata.jsonl and indexes, so collections can differ in
+dimension, element type and model. The default collection is the store at the
+root of the data directory, where go-vect kept its only store before
+collections existed. Every other collection lives in collections/<name>.
+*/
+package collection
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+const (
+	Default = "default"
+	subDir  = "collections"
+)
+
+var (
+	ErrNotFound    = errors.New("collection: no such collection")
+	ErrExists      = errors.New("collection: collection already exists")
+	ErrInvalidName = errors.New("collection: names must be 1-64 letters, digits, '.', '_' or '-', not starting with a '.'")
+	ErrDefault     = errors.New("collection: the default collection cannot be dropped or renamed, clear it instead")
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,63}$`)
+
+// The collections under one data directory
+type Catalog struct {
+	root string
+}
+
+// Summary of a collection, read from its header
+type Info struct {
+	Name      string
+	Dimension int
+	DType     storage.DType
+	Model     string
+	Vectors   int // Vectors on disk, deleted ones included until compaction
+}
+
+func New(root string) *Catalog {
+	return &Catalog{root: root}
+}
+
+func validName(name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// Directory the named collection's store lives in
+func (c *Catalog) Dir(name string) string {
+	if name == Default {
+		return c.root
+	}
+	return filepath.Join(c.root, subDir, name)
+}
+
+func (c *Catalog) exists(name string) bool {
+	if name == Default {
+		return true
+	}
+	info, err := os.Stat(c.Dir(name))
+	return err == nil && info.IsDir()
+}
+
+// Creates a collection, writing its header with the dimension, element type
+// and model in opts
+func (c *Catalog) Create(name string, opts storage.Options) error {
+	err := validName(name)
+	if err != nil {
+		return err
+	}
+	if c.exists(name) {
+		return fmt.Errorf("%w: %q", ErrExists, name)
+	}
+
+	store, err := storage.Open(c.Dir(name), opts)
+	if err != nil {
+		os.RemoveAll(c.Dir(name))
+		return fmt.Errorf("failed to create collection %q: %w", name, err)
+	}
+	return store.Close()
+}
+
+// Opens the store of an existing collection. The default collection is
+// created on first use, like the single store was.
+func (c *Catalog) Open(name string, opts storage.Options) (*storage.Store, error) {
+	err := validName(name)
+	if err != nil {
+		return nil, err
+	}
+	if !c.exists(name) {
+		return nil, fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	return storage.Open(c.Dir(name), opts)
+}
+
+// Lists every collection by name, the default one included
+func (c *Catalog) List() ([]Info, error) {
+	names := []string{Default}
+	entries, err := os.ReadDir(filepath.Join(c.root, subDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read collections: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() && validName(e.Name()) == nil {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names[1:])
+
+	out := make([]Info, 0, len(names))
+	for _, name := range names {
+		info := Info{Name: name}
+		h, n, err := storage.Describe(c.Dir(name))
+		if err == nil {
+			info.Dimension, info.DType, info.Model, info.Vectors = h.Dimension, h.DType, h.Model, n
+		} else if name != Default || !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read collection %q: %w", name, err)
+		}
+		out = append(out, info)
+	}
+	return out, nil
+}
+
+// Deletes a collection and every file in it. The store must not be open.
+func (c *Catalog) Drop(name string) error {
+	err := validName(name)
+	if err != nil {
+		return err
+	}
+	if name == Default {
+		return ErrDefault
+	}
+	if !c.exists(name) {
+		return fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+
+	err = os.RemoveAll(c.Dir(name))
+	if err != nil {
+		return fmt.Errorf("failed to drop collection %q: %w", name, err)
+	}
+	return nil
+}
+
+// Renames a collection. The store must not be open.
+func (c *Catalog) Rename(from, to string) error {
+	for _, name := range []string{from, to} {
+		err := validName(name)
+		if err != nil {
+			return err
+		}
+		if name == Default {
+			return ErrDefault
+		}
+	}
+	if !c.exists(from) {
+		return fmt.Errorf("%w: %q", ErrNotFound, from)
+	}
+	if c.exists(to) {
+		return fmt.Errorf("%w: %q", ErrExists, to)
+	}
+
+	err := os.Rename(c.Dir(from), c.Dir(to))
+	if err != nil {
+		return fmt.Errorf("failed to rename collection %q: %w", from, err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package collection
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+func TestCreateListDropRename(t *testing.T) {
+	c := New(t.TempDir())
+
+	if err := c.Create("docs", storage.Options{Dimension: 4, Model: "model-a"}); err != nil {
+		t.Fatalf("Create docs: %v", err)
+	}
+	if err := c.Create("tickets", storage.Options{Dimension: 8, DType: storage.DTypeInt8}); err != nil {
+		t.Fatalf("Create tickets: %v", err)
+	}
+	if err := c.Create("docs", storage.Options{Dimension: 4}); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+
+	infos, err := c.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(infos) != 3 || infos[0].Name != Default || infos[1].Name != "docs" || infos[2].Name != "tickets" {
+		t.Fatalf("expected default, docs and tickets, got %+v", infos)
+	}
+	if infos[1].Dimension != 4 || infos[1].Model != "model-a" || infos[2].Dimension != 8 || infos[2].DType != storage.DTypeInt8 {
+		t.Fatalf("unexpected collection details %+v", infos)
+	}
+
+	if err := c.Rename("docs", "handbook"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, err := c.Open("docs", storage.Options{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for the old name, got %v", err)
+	}
+	store, err := c.Open("handbook", storage.Options{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if store.Dimension() != 4 {
+		t.Fatalf("expected the renamed collection to keep dimension 4, got %d", store.Dimension())
+	}
+	store.Close()
+
+	if err := c.Drop("tickets"); err != nil {
+		t.Fatalf("Drop: %v", err)
+	}
+	if err := c.Drop("tickets"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	infos, err = c.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(infos) != 2 || infos[1].Name != "handbook" {
+		t.Fatalf("expected default and handbook, got %+v", infos)
+	}
+}
+
+func TestCollectionsAreIsolated(t *testing.T) {
+	c := New(t.TempDir())
+	for _, name := range []string{"a", "b"} {
+		if err := c.Create(name, storage.Options{Dimension: 2}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	a, err := c.Open("a", storage.Options{})
+	if err != nil {
+		t.Fatalf("Open a: %v", err)
+	}
+	defer a.Close()
+	b, err := c.Open("b", storage.Options{})
+	if err != nil {
+		t.Fatalf("Open b: %v", err)
+	}
+	defer b.Close()
+
+	if _, err := a.Append(embedding.EmbeddingVector{1, 0}, "in a"); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if _, err := b.Append(embedding.EmbeddingVector{0, 1}, "in b"); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := a.Clear(); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+
+	if n, _ := a.Len(); n != 0 {
+		t.Fatalf("expected a to be empty after clearing, got %d", n)
+	}
+	rec, err := b.Get(0)
+	if err != nil || rec.Meta.Text != "in b" {
+		t.Fatalf("expected b to be untouched, got %+v, %v", rec.Meta, err)
+	}
+}
+
+func TestDefaultCollectionAndNames(t *testing.T) {
+	root := t.TempDir()
+	c := New(root)
+
+	if c.Dir(Default) != root {
+		t.Fatalf("expected the default collection at the root, got %s", c.Dir(Default))
+	}
+	store, err := c.Open(Default, storage.Options{Dimension: 2})
+	if err != nil {
+		t.Fatalf("Open default: %v", err)
+	}
+	store.Close()
+
+	if err := c.Drop(Default); !errors.Is(err, ErrDefault) {
+		t.Fatalf("expected ErrDefault dropping, got %v", err)
+	}
+	if err := c.Create("x", storage.Options{Dimension: 2}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := c.Rename("x", Default); !errors.Is(err, ErrDefault) {
+		t.Fatalf("expected ErrDefault renaming, got %v", err)
+	}
+
+	for _, name := range []string{"", ".", "..", "../escape", "a/b", ".hidden"} {
+		if err := c.Create(name, storage.Options{}); !errors.Is(err, ErrInvalidName) {
+			t.Fatalf("expected ErrInvalidName for %q, got %v", name, err)
+		}
+	}
+}
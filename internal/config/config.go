@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"sync"
 
 	"github.com/sugarme/tokenizer"
@@ -16,6 +17,8 @@ import (
 	"github.com/joho/godotenv"
 )
 
+const DefaultDbDir = "internal/db"
+
 var (
 	ortInitOnce sync.Once
 	tkInitOnce  sync.Once
@@ -38,6 +41,18 @@ func Load() (err error) {
 	return nil
 }
 
+// Loads .env, if there is one, without initialising the tokenizer or ONNX
+// runtime. For commands that only work with vectors already stored.
+func LoadEnv() error {
+	if _, err := os.Stat(".env"); err == nil {
+		err = godotenv.Load()
+		if err != nil {
+			return fmt.Errorf("failed loading env: %w", err)
+		}
+	}
+	return initDbDir()
+}
+
 func initEnv() error {
 	err := initTokenizer()
 	if err != nil {
@@ -49,9 +64,9 @@ func initEnv() error {
 		return fmt.Errorf("failed to initialize ONNX runtime: %w", err)
 	}
 
-	err = initDbPaths()
+	err = initDbDir()
 	if err != nil {
-		return fmt.Errorf("failed to initialize database paths: %w", err)
+		return fmt.Errorf("failed to initialize database directory: %w", err)
 	}
 
 	err = initModelPath()
@@ -62,25 +77,66 @@ func initEnv() error {
 	return nil
 }
 
-func initDbPaths() error {
-	vectorDbPath := os.Getenv("VECTOR_DB_PATH")
-	metadataDbPath := os.Getenv("METADATA_DB_PATH")
-
-	if vectorDbPath == "" {
-		err := os.Setenv("VECTOR_DB_PATH", "internal/db/data.bin")
+func initDbDir() error {
+	if os.Getenv("VECTOR_DB_DIR") == "" {
+		err := os.Setenv("VECTOR_DB_DIR", DefaultDbDir)
 		if err != nil {
-			return fmt.Errorf("failed to set vector db path: %w", err)
+			return fmt.Errorf("failed to set vector db directory: %w", err)
 		}
 	}
+	return nil
+}
 
-	if metadataDbPath == "" {
-		err := os.Setenv("METADATA_DB_PATH", "internal/db/metadata.jsonl")
-		if err != nil {
-			return fmt.Errorf("failed to set metadata db path: %w", err)
-		}
+// Directory the store lives in, falls back to DefaultDbDir when unset
+func DbDir() string {
+	dir := os.Getenv("VECTOR_DB_DIR")
+	if dir == "" {
+		return DefaultDbDir
 	}
+	return dir
+}
 
-	return nil
+// Collection the TUI and commands work on when none is given. Empty means the
+// default collection, the store at the root of DbDir.
+func Collection() string {
+	return os.Getenv("VECTOR_COLLECTION")
+}
+
+// Search path the TUI uses: "exact" (default), "hnsw", "ivf", "bq" or "pq"
+func SearchIndex() string {
+	idx := os.Getenv("VECTOR_SEARCH_INDEX")
+	if idx == "" {
+		return "exact"
+	}
+	return idx
+}
+
+// Element type new stores are created with: "float32", "int8", "float16" or
+// "bfloat16". Empty means float32 for new stores and whatever the header says
+// for existing ones.
+func StorageDType() string {
+	return os.Getenv("VECTOR_DTYPE")
+}
+
+// Whether new quantized stores keep full-precision copies for rescoring
+func KeepFloat32() bool {
+	return os.Getenv("VECTOR_KEEP_FLOAT32") == "true"
+}
+
+// Neighbouring chunks shown on either side of each search hit, read from
+// VECTOR_CONTEXT_WINDOW. 0 (default) shows just the hit.
+func ContextWindow() int {
+	n, err := strconv.Atoi(os.Getenv("VECTOR_CONTEXT_WINDOW"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// What reads do with records that fail their checksum: "strict" (default)
+// fails the search, "lenient" leaves the records out of the results
+func Verify() string {
+	return os.Getenv("VECTOR_VERIFY")
 }
 
 func initTokenizer() error {
@@ -26,6 +26,9 @@ var (
 	modelOutputNames = []string{"last_hidden_state"}
 )
 
+// Identity recorded in the store header for vectors produced by MiniLM
+const MiniLMModelName = "sentence-transformers/all-MiniLM-L6-v2"
+
 type MiniLM struct{}
 
 func (m *MiniLM) Embed(chunk string) (embedding EmbeddingVector, err error) {
@@ -0,0 +1,49 @@
+package portable
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+// Writes every live record to w as a JSONL line with its vector, returning
+// the number of records written
+func ExportJSONL(store storage.VectorStore, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	n := 0
+	err := eachRecord(store, func(rec Record) error {
+		n++
+		return enc.Encode(rec)
+	})
+	if err != nil {
+		return n, fmt.Errorf("failed to export records: %w", err)
+	}
+	return n, nil
+}
+
+// Appends the records in JSONL read from r, returning how many were
+// appended. Records are appended a batch at a time, so on error the batches
+// before the bad record are already in the store.
+func ImportJSONL(store storage.VectorStore, r io.Reader, opts ImportOptions) (int, error) {
+	im := newImporter(store, opts)
+	dec := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var rec Record
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return im.count, fmt.Errorf("failed to decode record %d: %w", n, err)
+		}
+
+		err = im.add(n, rec)
+		if err != nil {
+			return im.count, err
+		}
+	}
+	return im.count, im.flush()
+}
@@ -0,0 +1,233 @@
+package portable
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+/*
+.npy layout, as written by numpy.save:
+
+	0   magic "\x93NUMPY"
+	6   format version, major u8 and minor u8
+	8   header length, u16 for version 1 and u32 for versions 2 and 3
+	..  header, a Python dict literal padded with spaces and a newline so the
+	    data starts on a 64-byte boundary
+	..  data, row after row for C order
+
+Exports are version 1.0 little-endian float32 matrices of shape (records,
+dimension). Imports also take float64 matrices, which is what numpy produces
+unless told otherwise.
+*/
+
+var npyMagic = []byte("\x93NUMPY")
+
+const (
+	npyAlign = 64
+	// numpy writes headers of a few hundred bytes, longer ones are
+	// refused rather than allocated
+	npyMaxHeader = 64 << 10
+)
+
+var (
+	ErrInvalidNPY = errors.New("portable: not a supported .npy file")
+
+	npyDescr   = regexp.MustCompile(`'descr':\s*'([^']*)'`)
+	npyFortran = regexp.MustCompile(`'fortran_order':\s*(True|False)`)
+	npyShape   = regexp.MustCompile(`'shape':\s*\(([^)]*)\)`)
+)
+
+// Writes the vectors of every live record to npy as a float32 matrix, and the
+// rest of each record to meta as JSONL, returning the number of records. The
+// header needs the row count, which is only known once every record has been
+// read, so the rows are held in memory until then.
+func ExportNPY(store storage.VectorStore, npy, meta io.Writer) (int, error) {
+	enc := json.NewEncoder(meta)
+	var data []byte
+	n := 0
+	err := eachRecord(store, func(rec Record) error {
+		n++
+		for _, x := range rec.Vector {
+			data = binary.LittleEndian.AppendUint32(data, math.Float32bits(x))
+		}
+		rec.Vector = nil
+		return enc.Encode(rec)
+	})
+	if err != nil {
+		return n, fmt.Errorf("failed to export records: %w", err)
+	}
+
+	w := bufio.NewWriter(npy)
+	_, err = w.Write(npyHeader(n, store.Dimension()))
+	if err != nil {
+		return n, fmt.Errorf("failed to write npy header: %w", err)
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return n, fmt.Errorf("failed to write npy data: %w", err)
+	}
+	return n, w.Flush()
+}
+
+func npyHeader(rows, dim int) []byte {
+	dict := fmt.Sprintf("{'descr': '<f4', 'fortran_order': False, 'shape': (%d, %d), }", rows, dim)
+	prefix := len(npyMagic) + 4
+	pad := npyAlign - (prefix+len(dict)+1)%npyAlign
+	if pad == npyAlign {
+		pad = 0
+	}
+	header := dict + string(bytes.Repeat([]byte{' '}, pad)) + "\n"
+
+	out := append([]byte{}, npyMagic...)
+	out = append(out, 1, 0)
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(header)))
+	return append(out, header...)
+}
+
+// Shape and element type of a .npy matrix
+type npyInfo struct {
+	rows, cols int
+	float64    bool
+}
+
+func readNPYHeader(r io.Reader) (npyInfo, error) {
+	prefix := make([]byte, len(npyMagic)+2)
+	_, err := io.ReadFull(r, prefix)
+	if err != nil || !bytes.Equal(prefix[:len(npyMagic)], npyMagic) {
+		return npyInfo{}, fmt.Errorf("%w: missing magic", ErrInvalidNPY)
+	}
+
+	var size int
+	switch major := prefix[len(npyMagic)]; major {
+	case 1:
+		var n uint16
+		err = binary.Read(r, binary.LittleEndian, &n)
+		size = int(n)
+	case 2, 3:
+		var n uint32
+		err = binary.Read(r, binary.LittleEndian, &n)
+		size = int(n)
+	default:
+		return npyInfo{}, fmt.Errorf("%w: unknown format version %d", ErrInvalidNPY, major)
+	}
+	if err != nil {
+		return npyInfo{}, fmt.Errorf("%w: truncated header", ErrInvalidNPY)
+	}
+	if size > npyMaxHeader {
+		return npyInfo{}, fmt.Errorf("%w: header of %d bytes", ErrInvalidNPY, size)
+	}
+	header := make([]byte, size)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return npyInfo{}, fmt.Errorf("%w: truncated header", ErrInvalidNPY)
+	}
+
+	var info npyInfo
+	descr := npyDescr.FindSubmatch(header)
+	switch {
+	case descr == nil:
+		return npyInfo{}, fmt.Errorf("%w: no descr in header", ErrInvalidNPY)
+	case string(descr[1]) == "<f8":
+		info.float64 = true
+	case string(descr[1]) != "<f4":
+		return npyInfo{}, fmt.Errorf("%w: element type %s, expected little-endian float32 or float64", ErrInvalidNPY, descr[1])
+	}
+	if m := npyFortran.FindSubmatch(header); m == nil || string(m[1]) != "False" {
+		return npyInfo{}, fmt.Errorf("%w: only C-ordered arrays are supported", ErrInvalidNPY)
+	}
+
+	shape := npyShape.FindSubmatch(header)
+	if shape == nil {
+		return npyInfo{}, fmt.Errorf("%w: no shape in header", ErrInvalidNPY)
+	}
+	var dims []int
+	for _, field := range bytes.Split(shape[1], []byte(",")) {
+		field = bytes.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+		d, err := strconv.Atoi(string(field))
+		if err != nil || d < 0 {
+			return npyInfo{}, fmt.Errorf("%w: invalid shape %s", ErrInvalidNPY, shape[1])
+		}
+		dims = append(dims, d)
+	}
+	if len(dims) != 2 {
+		return npyInfo{}, fmt.Errorf("%w: shape (%s) is not a matrix", ErrInvalidNPY, shape[1])
+	}
+	info.rows, info.cols = dims[0], dims[1]
+	return info, nil
+}
+
+// Appends the rows of the matrix read from npy, with the rest of each record
+// read from the sidecar JSONL in meta. meta may be nil, which stores the
+// vectors without text. Returns how many records were appended; as with
+// ImportJSONL, on error the batches before the bad row are already in the
+// store.
+func ImportNPY(store storage.VectorStore, npy, meta io.Reader, opts ImportOptions) (int, error) {
+	r := bufio.NewReader(npy)
+	info, err := readNPYHeader(r)
+	if err != nil {
+		return 0, err
+	}
+	if info.cols != store.Dimension() {
+		return 0, fmt.Errorf("%w: matrix has %d columns, store has %d dimensions", ErrInvalidVector, info.cols, store.Dimension())
+	}
+
+	var dec *json.Decoder
+	if meta != nil {
+		dec = json.NewDecoder(meta)
+	}
+
+	size := 4
+	if info.float64 {
+		size = 8
+	}
+	row := make([]byte, info.cols*size)
+	im := newImporter(store, opts)
+	for n := 1; n <= info.rows; n++ {
+		_, err = io.ReadFull(r, row)
+		if err != nil {
+			return im.count, fmt.Errorf("%w: row %d of %d is missing", ErrInvalidNPY, n, info.rows)
+		}
+
+		var rec Record
+		if dec != nil {
+			err = dec.Decode(&rec)
+			if errors.Is(err, io.EOF) {
+				return im.count, fmt.Errorf("metadata ends before row %d of %d", n, info.rows)
+			}
+			if err != nil {
+				return im.count, fmt.Errorf("failed to decode metadata for row %d: %w", n, err)
+			}
+		}
+
+		rec.Vector = make([]float32, info.cols)
+		for i := range rec.Vector {
+			if info.float64 {
+				rec.Vector[i] = float32(math.Float64frombits(binary.LittleEndian.Uint64(row[i*8:])))
+			} else {
+				rec.Vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(row[i*4:]))
+			}
+		}
+		err = im.add(n, rec)
+		if err != nil {
+			return im.count, err
+		}
+	}
+
+	if dec != nil && dec.More() {
+		return im.count, fmt.Errorf("metadata has more records than the matrix has rows (%d)", info.rows)
+	}
+	return im.count, im.flush()
+}
@@ -0,0 +1,178 @@
+/*
+Package portable moves records in and out of a store in formats other tools
+read: JSONL with one record per line, vector included, or a NumPy .npy matrix
+of vectors with the rest of each record in a sidecar JSONL, row i of the
+matrix going with line i.
+
+Exports write live records in position order, with the full-precision copy
+of each vector when the store keeps one. Imports check every vector's length
+and norm and then go through Store.AppendBatchMeta in batches, so they are
+logged and indexed like any other append. IDs in imported files are not kept,
+the store hands out new ones.
+*/
+package portable
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+const (
+	defaultBatchSize = 256
+	defaultTolerance = 1e-3
+)
+
+var ErrInvalidVector = errors.New("portable: invalid vector")
+
+// One record as exported. Metadata keys match the field names filters use.
+type Record struct {
+	ID         uint64         `json:"id,omitempty"`
+	Text       string         `json:"text"`
+	Source     string         `json:"source,omitempty"`
+	DocID      string         `json:"doc_id,omitempty"`
+	Key        string         `json:"key,omitempty"`
+	Hash       string         `json:"hash,omitempty"`
+	Chunk      int            `json:"chunk,omitempty"`
+	Span       *Span          `json:"span,omitempty"`
+	IngestedAt time.Time      `json:"ingested_at,omitzero"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Vector     []float32      `json:"vector,omitempty"` // Left out of .npy sidecars
+}
+
+// Location of a record in its original document, as in storage.Span
+type Span struct {
+	ByteStart int `json:"byte_start"`
+	ByteEnd   int `json:"byte_end"`
+	RuneStart int `json:"rune_start"`
+	RuneEnd   int `json:"rune_end"`
+}
+
+// Configures an import
+type ImportOptions struct {
+	// Scale vectors to unit length instead of refusing those that are not
+	Normalize bool
+	// How far a vector's norm may be from 1, defaults to 1e-3
+	Tolerance float64
+	// Records appended per transaction, defaults to 256
+	BatchSize int
+}
+
+func (o ImportOptions) withDefaults() ImportOptions {
+	if o.Tolerance <= 0 {
+		o.Tolerance = defaultTolerance
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaultBatchSize
+	}
+	return o
+}
+
+func fromMeta(md storage.EmbeddingMetaData) Record {
+	rec := Record{
+		ID:         md.ID,
+		Text:       md.Text,
+		Source:     md.Source,
+		DocID:      md.DocID,
+		Key:        md.Key,
+		Hash:       md.Hash,
+		Chunk:      md.Chunk,
+		IngestedAt: md.IngestedAt,
+		Attributes: md.Attributes,
+	}
+	if md.Span != nil {
+		span := Span(*md.Span)
+		rec.Span = &span
+	}
+	return rec
+}
+
+func (r Record) meta() storage.EmbeddingMetaData {
+	md := storage.EmbeddingMetaData{
+		Text:       r.Text,
+		Source:     r.Source,
+		DocID:      r.DocID,
+		Key:        r.Key,
+		Hash:       r.Hash,
+		Chunk:      r.Chunk,
+		IngestedAt: r.IngestedAt,
+		Attributes: r.Attributes,
+	}
+	if r.Span != nil {
+		span := storage.Span(*r.Span)
+		md.Span = &span
+	}
+	return md
+}
+
+// Calls fn with every live record in position order, vector included
+func eachRecord(store storage.VectorStore, fn func(rec Record) error) error {
+	return store.IterateRecords(func(r storage.Record) error {
+		rec := fromMeta(r.Meta)
+		rec.Vector = r.Vector
+		return fn(rec)
+	})
+}
+
+// Collects records and appends them a batch at a time
+type importer struct {
+	store storage.VectorStore
+	opts  ImportOptions
+	now   time.Time
+
+	vecs  []embedding.EmbeddingVector
+	metas []storage.EmbeddingMetaData
+	count int
+}
+
+func newImporter(store storage.VectorStore, opts ImportOptions) *importer {
+	return &importer{store: store, opts: opts.withDefaults(), now: time.Now().UTC()}
+}
+
+// Checks the record read from line n (from 1) and queues it
+func (im *importer) add(n int, rec Record) error {
+	v := embedding.EmbeddingVector(rec.Vector)
+	if len(v) != im.store.Dimension() {
+		return fmt.Errorf("%w: record %d has %d dimensions, store has %d", ErrInvalidVector, n, len(v), im.store.Dimension())
+	}
+	for _, x := range v {
+		if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) {
+			return fmt.Errorf("%w: record %d has NaN or infinite components", ErrInvalidVector, n)
+		}
+	}
+	mag := float64(v.Mag())
+	if mag == 0 {
+		return fmt.Errorf("%w: record %d is the zero vector", ErrInvalidVector, n)
+	}
+	if math.Abs(mag-1) > im.opts.Tolerance && !im.opts.Normalize {
+		return fmt.Errorf("%w: record %d has norm %.4f, expected 1 (import with normalisation to scale it)", ErrInvalidVector, n, mag)
+	}
+
+	md := rec.meta()
+	if md.IngestedAt.IsZero() {
+		md.IngestedAt = im.now
+	}
+	im.vecs = append(im.vecs, v)
+	im.metas = append(im.metas, md)
+	if len(im.vecs) >= im.opts.BatchSize {
+		return im.flush()
+	}
+	return nil
+}
+
+func (im *importer) flush() error {
+	if len(im.vecs) == 0 {
+		return nil
+	}
+	_, err := im.store.AppendBatchMeta(im.vecs, im.metas)
+	if err != nil {
+		return fmt.Errorf("failed to append imported records: %w", err)
+	}
+	im.count += len(im.vecs)
+	im.vecs, im.metas = im.vecs[:0], im.metas[:0]
+	return nil
+}
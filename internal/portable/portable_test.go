@@ -0,0 +1,354 @@
+package portable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+const testDim = 8
+
+func openStore(t *testing.T, opts storage.Options) *storage.Store {
+	t.Helper()
+	opts.Dimension = testDim
+	store, err := storage.Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func unitVectors(n int) []embedding.EmbeddingVector {
+	rng := rand.New(rand.NewPCG(1, 2))
+	out := make([]embedding.EmbeddingVector, n)
+	for i := range out {
+		v := make(embedding.EmbeddingVector, testDim)
+		for j := range v {
+			v[j] = float32(rng.NormFloat64())
+		}
+		v.Normalise()
+		out[i] = v
+	}
+	return out
+}
+
+// Fills a store with records carrying every kind of metadata and deletes the
+// second one
+func filledStore(t *testing.T, opts storage.Options) *storage.Store {
+	t.Helper()
+	store := openStore(t, opts)
+	vecs := unitVectors(5)
+	metas := make([]storage.EmbeddingMetaData, len(vecs))
+	for i := range metas {
+		metas[i] = storage.EmbeddingMetaData{
+			Text:       fmt.Sprintf("chunk %d", i),
+			Source:     "notes.md",
+			DocID:      "notes",
+			Chunk:      i,
+			Span:       &storage.Span{ByteStart: i * 10, ByteEnd: i*10 + 9, RuneStart: i * 10, RuneEnd: i*10 + 9},
+			IngestedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+			Attributes: map[string]any{"lang": "en", "page": float64(i)},
+		}
+	}
+	ids, err := store.AppendBatchMeta(vecs, metas)
+	if err != nil {
+		t.Fatalf("AppendBatchMeta: %v", err)
+	}
+	if err := store.Delete(ids[1]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	return store
+}
+
+// Checks that dst holds the live records of src with their metadata, and
+// vectors within tol of each other
+func assertSameRecords(t *testing.T, src, dst *storage.Store, tol float64) {
+	t.Helper()
+	var want, got []Record
+	collect := func(out *[]Record) func(Record) error {
+		return func(rec Record) error {
+			rec.ID = 0
+			rec.Vector = append([]float32(nil), rec.Vector...)
+			*out = append(*out, rec)
+			return nil
+		}
+	}
+	if err := eachRecord(src, collect(&want)); err != nil {
+		t.Fatalf("read source: %v", err)
+	}
+	if err := eachRecord(dst, collect(&got)); err != nil {
+		t.Fatalf("read import: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d records, got %d", len(want), len(got))
+	}
+
+	for i := range want {
+		w, g := want[i], got[i]
+		if g.Text != w.Text || g.Source != w.Source || g.DocID != w.DocID || g.Chunk != w.Chunk || !g.IngestedAt.Equal(w.IngestedAt) {
+			t.Fatalf("record %d: expected %+v, got %+v", i, w, g)
+		}
+		if g.Span == nil || *g.Span != *w.Span {
+			t.Fatalf("record %d: expected span %+v, got %+v", i, w.Span, g.Span)
+		}
+		if fmt.Sprint(g.Attributes) != fmt.Sprint(w.Attributes) {
+			t.Fatalf("record %d: expected attributes %v, got %v", i, w.Attributes, g.Attributes)
+		}
+		for j := range w.Vector {
+			if math.Abs(float64(g.Vector[j]-w.Vector[j])) > tol {
+				t.Fatalf("record %d: expected vector %v, got %v", i, w.Vector, g.Vector)
+			}
+		}
+	}
+}
+
+func TestJSONLRoundTrip(t *testing.T) {
+	src := filledStore(t, storage.Options{})
+	var buf bytes.Buffer
+	n, err := ExportJSONL(src, &buf)
+	if err != nil {
+		t.Fatalf("ExportJSONL: %v", err)
+	}
+	if n != 4 || strings.Count(buf.String(), "\n") != 4 {
+		t.Fatalf("expected 4 lines for 4 live records, got %d records:\n%s", n, buf.String())
+	}
+
+	dst := openStore(t, storage.Options{})
+	n, err = ImportJSONL(dst, &buf, ImportOptions{BatchSize: 3})
+	if err != nil {
+		t.Fatalf("ImportJSONL: %v", err)
+	}
+	if n != 4 {
+		t.Fatalf("expected 4 records imported, got %d", n)
+	}
+	assertSameRecords(t, src, dst, 1e-6)
+}
+
+func TestNPYRoundTrip(t *testing.T) {
+	// Quantized with full-precision copies, which are what gets exported
+	src := filledStore(t, storage.Options{DType: storage.DTypeInt8, KeepFloat32: true})
+	var npy, meta bytes.Buffer
+	n, err := ExportNPY(src, &npy, &meta)
+	if err != nil {
+		t.Fatalf("ExportNPY: %v", err)
+	}
+	if n != 4 {
+		t.Fatalf("expected 4 records exported, got %d", n)
+	}
+
+	b := npy.Bytes()
+	headerLen := int(binary.LittleEndian.Uint16(b[8:10]))
+	if (10+headerLen)%npyAlign != 0 || len(b) != 10+headerLen+4*testDim*4 {
+		t.Fatalf("unexpected layout: header %d bytes, file %d bytes", headerLen, len(b))
+	}
+	if !strings.Contains(string(b[10:10+headerLen]), "'shape': (4, 8)") {
+		t.Fatalf("unexpected header %q", b[10:10+headerLen])
+	}
+	if strings.Contains(meta.String(), "vector") {
+		t.Fatalf("expected the sidecar to leave vectors out, got %s", meta.String())
+	}
+
+	dst := openStore(t, storage.Options{})
+	n, err = ImportNPY(dst, &npy, &meta, ImportOptions{})
+	if err != nil {
+		t.Fatalf("ImportNPY: %v", err)
+	}
+	if n != 4 {
+		t.Fatalf("expected 4 records imported, got %d", n)
+	}
+	assertSameRecords(t, src, dst, 1e-6)
+}
+
+func TestNPYExportSkipsCorruptMetadata(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.Open(dir, storage.Options{Dimension: testDim})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	if _, err := store.AppendBatch(unitVectors(3), []string{"chunk 0", "chunk 1", "chunk 2"}); err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+	store.Close()
+	path := filepath.Join(dir, "metadata.jsonl")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, bytes.Replace(b, []byte("chunk 1"), []byte("chunk 7"), 1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	lenient, err := storage.Open(dir, storage.Options{Dimension: testDim, Verify: storage.VerifyLenient})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer lenient.Close()
+	var npy, meta bytes.Buffer
+	n, err := ExportNPY(lenient, &npy, &meta)
+	if err != nil || n != 2 {
+		t.Fatalf("expected the 2 intact records exported, got %d, %v", n, err)
+	}
+	if !strings.Contains(npy.String(), "'shape': (2, 8)") || strings.Contains(meta.String(), "chunk 7") {
+		t.Fatalf("expected the corrupt record left out of both files, got sidecar %s", meta.String())
+	}
+}
+
+func TestExportPairsRecordsAcrossCompaction(t *testing.T) {
+	src := filledStore(t, storage.Options{DType: storage.DTypeInt8, KeepFloat32: true})
+	vecs := unitVectors(5)
+
+	// Compacting moves every record after the deleted one down a position
+	var texts []string
+	err := eachRecord(src, func(rec Record) error {
+		if len(texts) == 0 {
+			if _, err := src.Compact(); err != nil {
+				return err
+			}
+		}
+		texts = append(texts, rec.Text)
+		var i int
+		fmt.Sscanf(rec.Text, "chunk %d", &i)
+		for j := range rec.Vector {
+			if math.Abs(float64(rec.Vector[j]-vecs[i][j])) > 1e-6 {
+				return fmt.Errorf("%q came with the vector of another record", rec.Text)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("eachRecord: %v", err)
+	}
+	if len(texts) != 4 {
+		t.Fatalf("expected the 4 live records, got %v", texts)
+	}
+}
+
+// Builds a version 1.0 .npy file of float64 rows, as numpy.save writes by
+// default
+func float64NPY(rows [][]float64) []byte {
+	dict := fmt.Sprintf("{'descr': '<f8', 'fortran_order': False, 'shape': (%d, %d), }", len(rows), len(rows[0]))
+	pad := npyAlign - (10+len(dict)+1)%npyAlign
+	header := dict + strings.Repeat(" ", pad%npyAlign) + "\n"
+
+	out := append([]byte("\x93NUMPY"), 1, 0)
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(header)))
+	out = append(out, header...)
+	for _, row := range rows {
+		for _, x := range row {
+			out = binary.LittleEndian.AppendUint64(out, math.Float64bits(x))
+		}
+	}
+	return out
+}
+
+func TestImportNPYFloat64WithoutSidecar(t *testing.T) {
+	rows := make([][]float64, 3)
+	for i := range rows {
+		rows[i] = make([]float64, testDim)
+		rows[i][i] = 1
+	}
+
+	store := openStore(t, storage.Options{})
+	n, err := ImportNPY(store, bytes.NewReader(float64NPY(rows)), nil, ImportOptions{})
+	if err != nil {
+		t.Fatalf("ImportNPY: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 records imported, got %d", n)
+	}
+	rec, err := store.Get(2)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if rec.Vector[2] != 1 || rec.Meta.IngestedAt.IsZero() {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+}
+
+func TestImportNPYRejectsMismatchedSidecar(t *testing.T) {
+	rows := [][]float64{{1, 0, 0, 0, 0, 0, 0, 0}, {0, 1, 0, 0, 0, 0, 0, 0}}
+	for _, meta := range []string{`{"text":"one"}`, `{"text":"one"}{"text":"two"}{"text":"three"}`} {
+		store := openStore(t, storage.Options{})
+		if _, err := ImportNPY(store, bytes.NewReader(float64NPY(rows)), strings.NewReader(meta), ImportOptions{}); err == nil {
+			t.Fatalf("expected sidecar %s to be refused for 2 rows", meta)
+		}
+		if n, _ := store.Len(); n != 0 {
+			t.Fatalf("expected nothing to be appended, got %d records", n)
+		}
+	}
+
+	store := openStore(t, storage.Options{})
+	bad := bytes.Replace(float64NPY(rows), []byte("(2, 8)"), []byte("(2, 4)"), 1)
+	if _, err := ImportNPY(store, bytes.NewReader(bad), nil, ImportOptions{}); !errors.Is(err, ErrInvalidVector) {
+		t.Fatalf("expected ErrInvalidVector for the wrong dimension, got %v", err)
+	}
+}
+
+func TestImportNPYRejectsBadHeaders(t *testing.T) {
+	rows := [][]float64{{1, 0, 0, 0, 0, 0, 0, 0}}
+	huge := append([]byte("\x93NUMPY\x02\x00"), 0xff, 0xff, 0xff, 0xff)
+	negative := bytes.Replace(float64NPY(rows), []byte("(1, 8)"), []byte("(-1, 8)"), 1)
+	for _, file := range [][]byte{huge, negative} {
+		store := openStore(t, storage.Options{})
+		if _, err := ImportNPY(store, bytes.NewReader(file), nil, ImportOptions{}); !errors.Is(err, ErrInvalidNPY) {
+			t.Fatalf("expected ErrInvalidNPY for %q, got %v", file[:min(len(file), 40)], err)
+		}
+	}
+}
+
+func TestImportChecksVectors(t *testing.T) {
+	unit := `[1,0,0,0,0,0,0,0]`
+	cases := map[string]string{
+		"wrong dimension": `[1,0,0,0]`,
+		"not normalised":  `[3,4,0,0,0,0,0,0]`,
+		"zero":            `[0,0,0,0,0,0,0,0]`,
+		"missing":         ``,
+	}
+	for name, vec := range cases {
+		store := openStore(t, storage.Options{})
+		in := fmt.Sprintf("{\"text\":\"ok\",\"vector\":%s}\n{\"text\":\"bad\"", unit)
+		if vec != "" {
+			in += `,"vector":` + vec
+		}
+		in += "}\n"
+
+		n, err := ImportJSONL(store, strings.NewReader(in), ImportOptions{})
+		if !errors.Is(err, ErrInvalidVector) {
+			t.Fatalf("%s: expected ErrInvalidVector, got %v", name, err)
+		}
+		if !strings.Contains(err.Error(), "record 2") {
+			t.Fatalf("%s: expected the error to name the record, got %v", name, err)
+		}
+		if n != 0 {
+			t.Fatalf("%s: expected nothing to be appended, got %d", name, n)
+		}
+	}
+}
+
+func TestImportNormalize(t *testing.T) {
+	store := openStore(t, storage.Options{})
+	in := `{"text":"long","vector":[3,4,0,0,0,0,0,0]}`
+	n, err := ImportJSONL(store, strings.NewReader(in), ImportOptions{Normalize: true})
+	if err != nil || n != 1 {
+		t.Fatalf("expected the vector to be scaled and imported, got %d, %v", n, err)
+	}
+	rec, err := store.Get(0)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if math.Abs(float64(rec.Vector[0])-0.6) > 1e-6 || math.Abs(float64(rec.Vector[1])-0.8) > 1e-6 {
+		t.Fatalf("expected a unit vector, got %v", rec.Vector)
+	}
+}
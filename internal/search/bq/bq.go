@@ -0,0 +1,212 @@
+/*
+Package bq implements binary quantization: a 1-bit-per-dimension copy of every
+vector, keeping only the sign of each component, so a 384-dim embedding takes
+48 bytes.
+
+A search first ranks every vector by the Hamming distance between its bits
+and the query's, which is a handful of XORs and popcounts per vector, and
+then rescores the best k*oversample candidates exactly against the float32
+vectors in data.bin. The oversampling factor trades latency for recall.
+
+The index attaches to a storage.Store, is extended on every append and is
+serialised next to data.bin as bq.idx.
+*/
+package bq
+
+import (
+	"fmt"
+	"math/bits"
+	"path/filepath"
+	"sync"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+	"github.com/mateosanchezl/go-vect/internal/search"
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+const FileName = "bq.idx"
+
+const defaultOversample = 4
+
+type Config struct {
+	Oversample int // Candidates rescored per result wanted, defaults to 4
+}
+
+func (c Config) withDefaults() Config {
+	if c.Oversample <= 0 {
+		c.Oversample = defaultOversample
+	}
+	return c
+}
+
+type Index struct {
+	cfg   Config
+	dim   int
+	words int // uint64s per code
+	path  string
+	store *storage.Store
+
+	mu    sync.RWMutex // Held for writing by Add and Reset, so searches can run alongside appends
+	codes []uint64     // Sign bits of every indexed vector, words-strided by position
+}
+
+// Loads the codes saved in the store's directory, or starts afresh, and
+// attaches the index to the store so it catches up with any unindexed vectors
+// and follows future appends
+func Open(store *storage.Store, cfg Config) (*Index, error) {
+	idx := &Index{
+		cfg:   cfg.withDefaults(),
+		dim:   store.Dimension(),
+		words: (store.Dimension() + 63) / 64,
+		path:  filepath.Join(store.Dir(), FileName),
+		store: store,
+	}
+
+	err := idx.load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.AttachIndex(idx)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (x *Index) Config() Config {
+	return x.cfg
+}
+
+// Number of positions in the index
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.len()
+}
+
+func (x *Index) len() int {
+	return len(x.codes) / x.words
+}
+
+// Drops every code
+func (x *Index) Reset() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.codes = x.codes[:0]
+	return nil
+}
+
+// Appends the sign bits of the vector at position pos, which must be the next
+// unindexed position
+func (x *Index) Add(pos int, v embedding.EmbeddingVector) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if pos != x.len() {
+		return fmt.Errorf("bq: expected position %d, got %d", x.len(), pos)
+	}
+	if len(v) != x.dim {
+		return fmt.Errorf("bq: vector must be of length %d, got %d", x.dim, len(v))
+	}
+
+	x.codes = append(x.codes, make([]uint64, x.words)...)
+	encode(v, x.codes[pos*x.words:])
+	return nil
+}
+
+// Sets bit i of code for every positive component i of v
+func encode(v []float32, code []uint64) {
+	for i, f := range v {
+		if f > 0 {
+			code[i/64] |= 1 << (i % 64)
+		}
+	}
+}
+
+// Finds the k positions most similar to query using the configured
+// oversampling factor
+func (x *Index) Search(query embedding.EmbeddingVector, k int, accept func(pos int) bool) ([]search.SimilarityResult, error) {
+	return x.SearchOversample(query, k, x.cfg.Oversample, accept)
+}
+
+// Like Search with an explicit oversampling factor
+func (x *Index) SearchOversample(query embedding.EmbeddingVector, k int, oversample int, accept func(pos int) bool) ([]search.SimilarityResult, error) {
+	if len(query) != x.dim {
+		return nil, fmt.Errorf("bq: query must be of length %d, got %d", x.dim, len(query))
+	}
+	if x.Len() == 0 || k <= 0 {
+		return []search.SimilarityResult{}, nil
+	}
+
+	// The view is opened first, the store's lock comes before the index's
+	view, err := x.store.View()
+	if err != nil {
+		return nil, err
+	}
+	defer view.Close()
+
+	x.mu.RLock()
+	candidates := x.prefilter(query, k*max(oversample, 1), accept)
+	x.mu.RUnlock()
+
+	results := search.MinHeap{}
+	results.Init(k)
+	for _, c := range candidates {
+		if c.Pos >= view.Len() {
+			// Appended since the view was opened
+			continue
+		}
+		ok, err := view.Verify(c.Pos)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		sim, err := view.At(c.Pos).NormedCosineSimilarity(query)
+		if err != nil {
+			return nil, err
+		}
+		results.Insert(search.SimilarityResult{CosSim: sim, Pos: c.Pos})
+	}
+
+	results.Sort()
+	return results.H, nil
+}
+
+// The n accepted positions closest to query in Hamming distance. Scores are
+// negated distances so the shared MinHeap keeps the closest.
+func (x *Index) prefilter(query []float32, n int, accept func(pos int) bool) []search.SimilarityResult {
+	q := make([]uint64, x.words)
+	encode(query, q)
+
+	nearest := search.MinHeap{}
+	nearest.Init(n)
+	for pos := range x.len() {
+		if accept != nil && !accept(pos) {
+			continue
+		}
+		code := x.codes[pos*x.words : (pos+1)*x.words]
+		d := 0
+		for i, w := range code {
+			d += bits.OnesCount64(w ^ q[i])
+		}
+		nearest.Insert(search.SimilarityResult{CosSim: -float32(d), Pos: pos})
+	}
+	return nearest.H
+}
+
+// The index searched with a different oversampling factor, for passing to
+// search.WithIndex on a single call
+func (x *Index) Oversampled(oversample int) search.Index {
+	return oversampled{x, oversample}
+}
+
+type oversampled struct {
+	idx        *Index
+	oversample int
+}
+
+func (o oversampled) Search(query embedding.EmbeddingVector, k int, accept func(pos int) bool) ([]search.SimilarityResult, error) {
+	return o.idx.SearchOversample(query, k, o.oversample, accept)
+}
@@ -0,0 +1,149 @@
+package bq
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/search"
+	"github.com/mateosanchezl/go-vect/internal/search/searchtest"
+)
+
+const testDim = 384
+
+func TestEncodeKeepsSigns(t *testing.T) {
+	v := make([]float32, 70)
+	v[0], v[1], v[63], v[64], v[69] = 1, -1, 0.5, 2, 0.1
+	code := make([]uint64, 2)
+	encode(v, code)
+
+	if code[0] != 1|1<<63 || code[1] != 1|1<<5 {
+		t.Fatalf("unexpected code %064b %064b", code[1], code[0])
+	}
+}
+
+// Measures recall@k of the Hamming prefilter plus rescoring against the
+// brute-force path, for a few oversampling factors
+func TestRecallAgainstExactSearch(t *testing.T) {
+	store := searchtest.OpenStore(t, t.TempDir(), testDim)
+	defer store.Close()
+
+	idx, err := Open(store, Config{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	vecs := searchtest.ClusteredVectors(2050, testDim, 50, 1, 7)
+	searchtest.FillStore(t, store, vecs[:2000])
+
+	const k = 10
+	recall := map[int]float64{}
+	for _, oversample := range []int{1, 4, 10} {
+		recall[oversample] = searchtest.Recall(t, store, vecs[2000:], k, search.WithIndex(idx.Oversampled(oversample)))
+		t.Logf("recall@%d with oversample %d = %.3f", k, oversample, recall[oversample])
+	}
+
+	if recall[10] < 0.95 || recall[10] < recall[1] {
+		t.Fatalf("expected oversampling to lift recall@%d to at least 0.95, got %v", k, recall)
+	}
+}
+
+func TestSearchRespectsAccept(t *testing.T) {
+	store := searchtest.OpenStore(t, t.TempDir(), testDim)
+	defer store.Close()
+
+	searchtest.FillStore(t, store, searchtest.RandomVectors(300, testDim, 3))
+	idx, err := Open(store, Config{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	results, err := idx.Search(searchtest.RandomVectors(1, testDim, 4)[0], 10, func(pos int) bool { return pos%2 == 0 })
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(results) != 10 {
+		t.Fatalf("expected 10 results, got %d", len(results))
+	}
+	for i, r := range results {
+		if r.Pos%2 != 0 {
+			t.Fatalf("result %d at position %d was not accepted", i, r.Pos)
+		}
+		if i > 0 && r.CosSim > results[i-1].CosSim {
+			t.Fatalf("results not sorted by similarity")
+		}
+	}
+}
+
+func TestIndexPersistsAndFollowsCompaction(t *testing.T) {
+	dir := t.TempDir()
+	store := searchtest.OpenStore(t, dir, testDim)
+	idx, err := Open(store, Config{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	vecs := searchtest.RandomVectors(200, testDim, 5)
+	searchtest.FillStore(t, store, vecs)
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, FileName)); err != nil {
+		t.Fatalf("expected index file to be saved on close: %v", err)
+	}
+
+	store = searchtest.OpenStore(t, dir, testDim)
+	defer store.Close()
+	idx, err = Open(store, Config{})
+	if err != nil {
+		t.Fatalf("reopen index: %v", err)
+	}
+	if idx.Len() != 200 {
+		t.Fatalf("expected 200 saved codes, got %d", idx.Len())
+	}
+
+	id, _ := store.ID(0)
+	if err := store.Delete(id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if idx.Len() != 199 {
+		t.Fatalf("expected index to be rebuilt with 199 codes, got %d", idx.Len())
+	}
+
+	// The vector that was at position 1 now lives at position 0
+	results, err := idx.Search(vecs[1], 1, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if results[0].Pos != 0 {
+		t.Fatalf("expected exact match at position 0 after compaction, got %d", results[0].Pos)
+	}
+}
+
+// Compares the Hamming prefilter plus rescoring with a full heap scan over
+// the float32 vectors, leaving out the metadata lookups both paths share
+func BenchmarkSearch(b *testing.B) {
+	store := searchtest.OpenStore(b, b.TempDir(), testDim)
+	defer store.Close()
+
+	idx, err := Open(store, Config{})
+	if err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+	vecs := searchtest.ClusteredVectors(20000, testDim, 200, 1, 11)
+	searchtest.FillStore(b, store, vecs)
+	q := searchtest.ClusteredVectors(1, testDim, 200, 1, 11)[0]
+
+	searchtest.BenchmarkExact(b, vecs, q)
+	for _, oversample := range []int{1, 4, 10} {
+		b.Run(fmt.Sprintf("bq/oversample=%d", oversample), func(b *testing.B) {
+			for range b.N {
+				if _, err := idx.SearchOversample(q, 10, oversample, nil); err != nil {
+					b.Fatalf("Search: %v", err)
+				}
+			}
+		})
+	}
+}
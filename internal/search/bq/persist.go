@@ -0,0 +1,149 @@
+package bq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+/*
+bq.idx layout (little-endian):
+
+	magic "BQIX" | version u16 | reserved u16 | dim u32 | count u32
+	ID of the record at position count-1 u64
+	codes: count × ceil(dim/64) × u64
+	crc32 of everything above u32
+*/
+
+const fileVersion = 1
+
+const fixedSize = 24
+
+var fileMagic = []byte("BQIX")
+
+var ErrCorruptIndex = errors.New("bq: corrupt index file")
+
+// Writes the codes to the index file, replacing it atomically
+func (x *Index) Save() error {
+	var buf bytes.Buffer
+	_, err := x.WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+
+	tmp := x.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create index file: %w", err)
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write index file: %w", err)
+	}
+
+	err = os.Rename(tmp, x.path)
+	if err != nil {
+		return fmt.Errorf("failed to replace index file: %w", err)
+	}
+	return nil
+}
+
+// Serialises the codes
+func (x *Index) WriteTo(w io.Writer) (int64, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	le := binary.LittleEndian
+	buf := make([]byte, 0, fixedSize+len(x.codes)*8+4)
+
+	buf = append(buf, fileMagic...)
+	buf = le.AppendUint16(buf, fileVersion)
+	buf = le.AppendUint16(buf, 0)
+	buf = le.AppendUint32(buf, uint32(x.dim))
+	buf = le.AppendUint32(buf, uint32(x.len()))
+	buf = le.AppendUint64(buf, x.lastID())
+	for _, c := range x.codes {
+		buf = le.AppendUint64(buf, c)
+	}
+	buf = le.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ID of the last indexed record. Positions move when a store is compacted,
+// so saved codes are only reused if this still matches.
+func (x *Index) lastID() uint64 {
+	id, _ := x.store.ID(x.len() - 1)
+	return id
+}
+
+// Reads codes written by WriteTo
+func (x *Index) readFrom(data []byte) (lastID uint64, err error) {
+	le := binary.LittleEndian
+	if len(data) < fixedSize+4 || !bytes.Equal(data[:4], fileMagic) {
+		return 0, ErrCorruptIndex
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != le.Uint32(data[len(data)-4:]) {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrCorruptIndex)
+	}
+	if v := le.Uint16(body[4:6]); v != fileVersion {
+		return 0, fmt.Errorf("%w: unsupported version %d", ErrCorruptIndex, v)
+	}
+
+	dim := int(le.Uint32(body[8:12]))
+	count := int(le.Uint32(body[12:16]))
+	lastID = le.Uint64(body[16:24])
+	if dim != x.dim {
+		return 0, fmt.Errorf("%w: built for %d-dim vectors, store holds %d", ErrCorruptIndex, dim, x.dim)
+	}
+	if len(body)-fixedSize != count*x.words*8 {
+		return 0, fmt.Errorf("%w: expected %d codes", ErrCorruptIndex, count)
+	}
+
+	codes := make([]uint64, count*x.words)
+	for i := range codes {
+		codes[i] = le.Uint64(body[fixedSize+i*8:])
+	}
+	x.codes = codes
+	return lastID, nil
+}
+
+// Loads the saved codes. A missing, corrupt or outdated file leaves the index
+// empty so it is rebuilt from the store.
+func (x *Index) load() error {
+	data, err := os.ReadFile(x.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read index file: %w", err)
+	}
+
+	lastID, err := x.readFrom(data)
+	if err != nil {
+		return x.Reset()
+	}
+
+	n, err := x.store.Len()
+	if err != nil {
+		return err
+	}
+	if x.Len() > n || (x.Len() > 0 && x.lastID() != lastID) {
+		// Saved before a clear or compaction moved the positions
+		return x.Reset()
+	}
+	return nil
+}
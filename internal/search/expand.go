@@ -0,0 +1,168 @@
+package search
+
+import (
+	"errors"
+	"maps"
+	"strings"
+
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+/*
+Context expansion of search results.
+
+A chunk on its own is often too little to answer from, so results can carry
+the document the chunk came from (WithParents), or the chunk together with
+its neighbours in the document (WithWindow). Neighbours are the live chunks
+with the same DocID and the next ordinals either side, stopping at the first
+one missing. The text of a window is cut from the parent document by the
+chunks' spans when the document is stored, so overlap between chunks isn't
+repeated, and is otherwise the chunk texts joined by newlines, as it is when
+the document has changed since its chunks were located in it.
+
+Neighbours are looked up by DocID and ordinal through each store's
+DocumentChunks, so a window costs a lookup per chunk in it rather than a read
+of every record's metadata.
+*/
+
+// Sets Parent on every result to the document its chunk came from, when the
+// store holds it
+func WithParents() Option {
+	return func(o *options) {
+		o.parents = true
+	}
+}
+
+// Sets Window and Context on every result to its chunk with up to n
+// neighbouring chunks of the same document on either side
+func WithWindow(n int) Option {
+	return func(o *options) {
+		o.window = n
+	}
+}
+
+// Fills in the parents and windows of results, looking documents and chunks
+// up across stores
+func expand(stores []storage.VectorStore, results []TopKSearchResult, o options) error {
+	if (!o.parents && o.window <= 0) || len(results) == 0 {
+		return nil
+	}
+
+	docs := map[string]*storage.Document{}
+	parent := func(id string) (*storage.Document, error) {
+		if doc, ok := docs[id]; ok {
+			return doc, nil
+		}
+		var found *storage.Document
+		for _, store := range stores {
+			doc, err := store.Document(id)
+			if errors.Is(err, storage.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			found = &doc
+			break
+		}
+		docs[id] = found
+		return found, nil
+	}
+
+	contents := map[string]string{}
+	for i := range results {
+		r := &results[i]
+		var doc *storage.Document
+		if r.Meta.DocID != "" {
+			var err error
+			doc, err = parent(r.Meta.DocID)
+			if err != nil {
+				return err
+			}
+		}
+		if o.parents {
+			r.Parent = doc
+		}
+		if o.window <= 0 {
+			continue
+		}
+
+		var byChunk map[int]storage.EmbeddingMetaData
+		if r.Meta.DocID != "" {
+			var err error
+			byChunk, err = siblings(stores, r.Meta, o.window)
+			if err != nil {
+				return err
+			}
+		}
+		r.Window = window(r.Meta, byChunk, o.window)
+		content, ok := contents[r.Meta.DocID]
+		if !ok && doc != nil {
+			// Left empty when a file Source can no longer be read
+			content, _ = doc.Content()
+			contents[r.Meta.DocID] = content
+		}
+		r.Context = windowText(r.Window, content)
+	}
+	return nil
+}
+
+// Live chunks of hit's document up to n ordinals either side of it, by
+// ordinal
+func siblings(stores []storage.VectorStore, hit storage.EmbeddingMetaData, n int) (map[int]storage.EmbeddingMetaData, error) {
+	byChunk := map[int]storage.EmbeddingMetaData{}
+	for _, store := range stores {
+		chunks, err := store.DocumentChunks(hit.DocID, hit.Chunk-n, hit.Chunk+n)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(byChunk, chunks)
+	}
+	return byChunk, nil
+}
+
+// The hit with up to n chunks on either side, in order
+func window(hit storage.EmbeddingMetaData, byChunk map[int]storage.EmbeddingMetaData, n int) []storage.EmbeddingMetaData {
+	var before, after []storage.EmbeddingMetaData
+	for c := hit.Chunk - 1; c >= hit.Chunk-n; c-- {
+		md, ok := byChunk[c]
+		if !ok || hit.DocID == "" {
+			break
+		}
+		before = append(before, md)
+	}
+	for c := hit.Chunk + 1; c <= hit.Chunk+n; c++ {
+		md, ok := byChunk[c]
+		if !ok || hit.DocID == "" {
+			break
+		}
+		after = append(after, md)
+	}
+
+	out := make([]storage.EmbeddingMetaData, 0, len(before)+1+len(after))
+	for i := len(before) - 1; i >= 0; i-- {
+		out = append(out, before[i])
+	}
+	out = append(out, hit)
+	return append(out, after...)
+}
+
+// Text of a window, cut from the document's content when every chunk is
+// found there at its span
+func windowText(win []storage.EmbeddingMetaData, content string) string {
+	spanned := content != ""
+	for _, md := range win {
+		sp := md.Span
+		spanned = spanned && sp != nil && sp.ByteStart >= 0 && sp.ByteStart <= sp.ByteEnd &&
+			sp.ByteEnd <= len(content) && content[sp.ByteStart:sp.ByteEnd] == md.Text
+	}
+	if spanned && win[0].Span.ByteStart <= win[len(win)-1].Span.ByteEnd {
+		return content[win[0].Span.ByteStart:win[len(win)-1].Span.ByteEnd]
+	}
+
+	texts := make([]string, len(win))
+	for i, md := range win {
+		texts[i] = md.Text
+	}
+	return strings.Join(texts, "\n")
+}
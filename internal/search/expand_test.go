@@ -0,0 +1,84 @@
+package search
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+// Stores text split at ". " as chunks of one document, chunk i along axis i
+func storeDocument(t *testing.T, store *storage.Store, doc storage.Document, keep bool) []uint64 {
+	t.Helper()
+	if keep {
+		if err := store.PutDocument(doc); err != nil {
+			t.Fatalf("PutDocument: %v", err)
+		}
+	}
+	var metas []storage.EmbeddingMetaData
+	var vecs []embedding.EmbeddingVector
+	start := 0
+	for i, part := range strings.SplitAfter(doc.Text, ". ") {
+		text := strings.TrimSpace(part)
+		metas = append(metas, storage.EmbeddingMetaData{
+			Text:  text,
+			DocID: doc.ID,
+			Chunk: i,
+			Span:  &storage.Span{ByteStart: start, ByteEnd: start + len(text)},
+		})
+		vecs = append(vecs, basisVector(i, 1))
+		start += len(part)
+	}
+	ids, err := store.AppendBatchMeta(vecs, metas)
+	if err != nil {
+		t.Fatalf("AppendBatchMeta: %v", err)
+	}
+	return ids
+}
+
+func TestSearchExpandsHitsWithContext(t *testing.T) {
+	store, _ := setupSearchStore(t)
+	doc := storage.Document{ID: "d", Text: "Alpha one. Beta two. Gamma three. Delta four. Epsilon five."}
+	ids := storeDocument(t, store, doc, true)
+	if err := store.Delete(ids[3]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	model := &fakeModel{vector: basisVector(1, 1)}
+	results, err := SearchTopKSimilar(store, "q", 1, model, WithParents(), WithWindow(1))
+	if err != nil {
+		t.Fatalf("SearchTopKSimilar: %v", err)
+	}
+	r := results[0]
+	if r.Parent == nil || *r.Parent != doc {
+		t.Fatalf("expected parent %+v, got %+v", doc, r.Parent)
+	}
+	if len(r.Window) != 3 || r.Context != "Alpha one. Beta two. Gamma three." {
+		t.Fatalf("expected the hit with a chunk either side, got %d chunks, %q", len(r.Window), r.Context)
+	}
+
+	// The deleted chunk ends the window
+	model.vector = basisVector(2, 1)
+	results, err = SearchTopKSimilar(store, "q", 1, model, WithWindow(2))
+	if err != nil {
+		t.Fatalf("SearchTopKSimilar: %v", err)
+	}
+	if r := results[0]; r.Parent != nil || r.Context != "Alpha one. Beta two. Gamma three." {
+		t.Fatalf("expected the window to stop at the deleted chunk, got %+v", r)
+	}
+}
+
+func TestSearchWindowWithoutItsDocument(t *testing.T) {
+	store, _ := setupSearchStore(t)
+	storeDocument(t, store, storage.Document{ID: "d", Text: "Alpha one. Beta two. Gamma three."}, false)
+
+	model := &fakeModel{vector: basisVector(2, 1)}
+	results, err := SearchTopKSimilar(store, "q", 1, model, WithParents(), WithWindow(1))
+	if err != nil {
+		t.Fatalf("SearchTopKSimilar: %v", err)
+	}
+	if r := results[0]; r.Parent != nil || r.Context != "Beta two.\nGamma three." {
+		t.Fatalf("expected the chunk texts joined, got %+v", r)
+	}
+}
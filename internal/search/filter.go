@@ -0,0 +1,374 @@
+package search
+
+import (
+	"math/bits"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+/*
+Metadata filters restrict a search to the records whose metadata matches an
+expression, e.g.
+
+	And(Eq("source", "file:///docs/handbook.md"), In("lang", "en", "de"))
+	Gt("ingested_at", "2026-01-01")
+
+Fields name the metadata the store keeps for every record: "id", "text",
+"source", "doc_id", "key", "chunk" and "ingested_at". Any other name is looked
+up in the record's attributes. Numbers compare as float64 whatever their Go type,
+and ingested_at compares against time.Time values or RFC 3339 / yyyy-mm-dd
+strings. Values of different kinds never match.
+
+Filters read the store's MetaTable, which keeps the decoded metadata between
+searches, so a search only decodes the metadata appended since the last one.
+Metadata a lenient store found corrupt matches no filter.
+*/
+
+// A predicate over record metadata
+type Filter interface {
+	Match(md storage.EmbeddingMetaData) bool
+}
+
+// Only searches records matching f
+func WithFilter(f Filter) Option {
+	return func(o *options) {
+		o.filter = f
+	}
+}
+
+type eqFilter struct {
+	field string
+	value any
+}
+
+func (f eqFilter) Match(md storage.EmbeddingMetaData) bool {
+	v, ok := fieldValue(md, f.field)
+	return ok && equal(v, f.value)
+}
+
+// Matches records where field equals value
+func Eq(field string, value any) Filter {
+	return eqFilter{field: field, value: filterValue(field, value)}
+}
+
+// Matches records where field is set to something other than value
+func Neq(field string, value any) Filter {
+	return And(Exists(field), Not(Eq(field, value)))
+}
+
+type inFilter struct {
+	field  string
+	values []any
+}
+
+func (f inFilter) Match(md storage.EmbeddingMetaData) bool {
+	v, ok := fieldValue(md, f.field)
+	if !ok {
+		return false
+	}
+	return slices.ContainsFunc(f.values, func(x any) bool { return equal(v, x) })
+}
+
+// Matches records where field equals any of values
+func In(field string, values ...any) Filter {
+	f := inFilter{field: field, values: make([]any, len(values))}
+	for i, v := range values {
+		f.values[i] = filterValue(field, v)
+	}
+	return f
+}
+
+type rangeFilter struct {
+	field      string
+	lo, hi     any // nil when unbounded
+	loIncluded bool
+	hiIncluded bool
+}
+
+func (f rangeFilter) Match(md storage.EmbeddingMetaData) bool {
+	v, ok := fieldValue(md, f.field)
+	if !ok {
+		return false
+	}
+	if f.lo != nil {
+		c, ok := compare(v, f.lo)
+		if !ok || c < 0 || (c == 0 && !f.loIncluded) {
+			return false
+		}
+	}
+	if f.hi != nil {
+		c, ok := compare(v, f.hi)
+		if !ok || c > 0 || (c == 0 && !f.hiIncluded) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches records where lo <= field < hi. A nil bound is left open.
+func Range(field string, lo, hi any) Filter {
+	return rangeFilter{field: field, lo: filterValue(field, lo), hi: filterValue(field, hi), loIncluded: true}
+}
+
+func Gt(field string, value any) Filter {
+	return rangeFilter{field: field, lo: filterValue(field, value)}
+}
+
+func Gte(field string, value any) Filter {
+	return rangeFilter{field: field, lo: filterValue(field, value), loIncluded: true}
+}
+
+func Lt(field string, value any) Filter {
+	return rangeFilter{field: field, hi: filterValue(field, value)}
+}
+
+func Lte(field string, value any) Filter {
+	return rangeFilter{field: field, hi: filterValue(field, value), hiIncluded: true}
+}
+
+type existsFilter struct {
+	field string
+}
+
+func (f existsFilter) Match(md storage.EmbeddingMetaData) bool {
+	_, ok := fieldValue(md, f.field)
+	return ok
+}
+
+// Matches records where field is set
+func Exists(field string) Filter {
+	return existsFilter{field: field}
+}
+
+type andFilter []Filter
+
+func (f andFilter) Match(md storage.EmbeddingMetaData) bool {
+	for _, sub := range f {
+		if !sub.Match(md) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches records matching every filter. And() matches everything.
+func And(filters ...Filter) Filter {
+	return andFilter(filters)
+}
+
+type orFilter []Filter
+
+func (f orFilter) Match(md storage.EmbeddingMetaData) bool {
+	for _, sub := range f {
+		if sub.Match(md) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches records matching at least one filter. Or() matches nothing.
+func Or(filters ...Filter) Filter {
+	return orFilter(filters)
+}
+
+type notFilter struct {
+	f Filter
+}
+
+func (f notFilter) Match(md storage.EmbeddingMetaData) bool {
+	return !f.f.Match(md)
+}
+
+func Not(f Filter) Filter {
+	return notFilter{f: f}
+}
+
+// Value of a metadata field, normalised for comparison, and whether it is set
+func fieldValue(md storage.EmbeddingMetaData, field string) (any, bool) {
+	switch field {
+	case "id":
+		return float64(md.ID), true
+	case "text":
+		return md.Text, true
+	case "source":
+		return md.Source, md.Source != ""
+	case "doc_id":
+		return md.DocID, md.DocID != ""
+	case "key":
+		return md.Key, md.Key != ""
+	case "chunk":
+		return float64(md.Chunk), true
+	case "ingested_at":
+		return md.IngestedAt, !md.IngestedAt.IsZero()
+	default:
+		v, ok := md.Attributes[field]
+		return normalise(v), ok
+	}
+}
+
+// Normalises a value given to a filter constructor. Strings compared against
+// ingested_at are parsed once here rather than for every record.
+func filterValue(field string, v any) any {
+	if s, ok := v.(string); ok && field == "ingested_at" {
+		for _, layout := range []string{time.RFC3339Nano, time.DateOnly} {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t
+			}
+		}
+	}
+	return normalise(v)
+}
+
+// Widens every numeric type to float64, the type JSON decodes numbers into
+func normalise(v any) any {
+	switch x := v.(type) {
+	case int:
+		return float64(x)
+	case int8:
+		return float64(x)
+	case int16:
+		return float64(x)
+	case int32:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case uint:
+		return float64(x)
+	case uint8:
+		return float64(x)
+	case uint16:
+		return float64(x)
+	case uint32:
+		return float64(x)
+	case uint64:
+		return float64(x)
+	case float32:
+		return float64(x)
+	default:
+		return v
+	}
+}
+
+// Orders two normalised values of the same kind
+func compare(a, b any) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		default:
+			return 0, true
+		}
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	case time.Time:
+		y, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		return x.Compare(y), true
+	default:
+		return 0, false
+	}
+}
+
+func equal(a, b any) bool {
+	if c, ok := compare(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Sample size used to estimate how many records a filter matches
+const filterSample = 512
+
+// Below this estimated fraction of matching records a filter is applied up
+// front through a bitmap and only the matching records are scored
+const selectiveFraction = 0.05
+
+// A filter bound to the metadata of a store
+type filterPlan struct {
+	filter Filter
+	table  *storage.MetaTable
+
+	// Live matching positions, only built for selective filters
+	bitmap []uint64
+}
+
+func newFilterPlan(store storage.VectorStore, f Filter) (*filterPlan, error) {
+	table, err := store.MetaTable()
+	if err != nil {
+		return nil, err
+	}
+	p := &filterPlan{filter: f, table: table}
+
+	n := table.Len()
+	if n == 0 {
+		return p, nil
+	}
+	step := max(n/filterSample, 1)
+	sampled, matched := 0, 0
+	for pos := 0; pos < n; pos += step {
+		sampled++
+		if p.matchMeta(pos) {
+			matched++
+		}
+	}
+	if float64(matched) > selectiveFraction*float64(sampled) {
+		return p, nil
+	}
+
+	p.bitmap = make([]uint64, (n+63)/64)
+	for pos := range n {
+		if !store.IsDeleted(pos) && p.matchMeta(pos) {
+			p.bitmap[pos/64] |= 1 << (pos % 64)
+		}
+	}
+	return p, nil
+}
+
+// Corrupt metadata left out by a lenient store matches nothing, not even Not
+func (p *filterPlan) matchMeta(pos int) bool {
+	md, ok := p.table.At(pos)
+	return ok && p.filter.Match(md)
+}
+
+// Whether matching positions were collected up front
+func (p *filterPlan) selective() bool {
+	return p.bitmap != nil
+}
+
+func (p *filterPlan) match(pos int) bool {
+	if pos >= p.table.Len() {
+		return false
+	}
+	if p.bitmap != nil {
+		return p.bitmap[pos/64]&(1<<(pos%64)) != 0
+	}
+	return p.matchMeta(pos)
+}
+
+// Calls fn for each position set in the bitmap, in order
+func (p *filterPlan) each(fn func(pos int)) {
+	for w, word := range p.bitmap {
+		for word != 0 {
+			fn(w*64 + bits.TrailingZeros64(word))
+			word &= word - 1
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package search
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+func TestFilterMatch(t *testing.T) {
+	md := storage.EmbeddingMetaData{
+		ID:         4,
+		Text:       "hello",
+		Source:     "file:///docs/handbook.md",
+		Chunk:      2,
+		IngestedAt: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC),
+		Attributes: map[string]any{"lang": "en", "page": float64(12), "draft": false},
+	}
+
+	cases := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{"eq source", Eq("source", "file:///docs/handbook.md"), true},
+		{"eq attribute", Eq("lang", "de"), false},
+		{"eq int against float attribute", Eq("page", 12), true},
+		{"eq bool", Eq("draft", false), true},
+		{"neq", Neq("lang", "de"), true},
+		{"neq missing field", Neq("author", "x"), false},
+		{"in", In("lang", "en", "de"), true},
+		{"in miss", In("lang", "fr", "de"), false},
+		{"in chunk", In("chunk", 1, 2, 3), true},
+		{"range", Range("page", 10, 20), true},
+		{"range upper bound excluded", Range("page", 0, 12), false},
+		{"range open", Range("page", nil, 13), true},
+		{"gt date", Gt("ingested_at", "2026-01-01"), true},
+		{"lt timestamp", Lt("ingested_at", "2026-02-01T00:00:00Z"), false},
+		{"lte time", Lte("ingested_at", md.IngestedAt), true},
+		{"gte kind mismatch", Gte("lang", 3), false},
+		{"exists", Exists("page"), true},
+		{"exists unset", Exists("doc_id"), false},
+		{"and", And(Eq("lang", "en"), Gt("chunk", 1)), true},
+		{"and miss", And(Eq("lang", "en"), Gt("chunk", 2)), false},
+		{"or", Or(Eq("lang", "de"), Eq("id", 4)), true},
+		{"not", Not(Exists("author")), true},
+		{"empty and", And(), true},
+		{"empty or", Or(), false},
+	}
+	for _, c := range cases {
+		if got := c.filter.Match(md); got != c.want {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+// Stores vectors tagged with lang "en" or "de" and a page number. Only every
+// 40th record is on a page below 10, so a filter on it is selective.
+func openTaggedStore(t *testing.T, vecs []embedding.EmbeddingVector) *storage.Store {
+	t.Helper()
+	store, err := storage.Open(t.TempDir(), storage.Options{Dimension: testVectorLength})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	metas := make([]storage.EmbeddingMetaData, len(vecs))
+	for i := range metas {
+		lang := "en"
+		if i%2 == 1 {
+			lang = "de"
+		}
+		page := 10 + i%40
+		if i%40 == 0 {
+			page = i % 10
+		}
+		metas[i] = storage.EmbeddingMetaData{
+			Text:       fmt.Sprintf("doc-%d", i),
+			Attributes: map[string]any{"lang": lang, "page": page},
+		}
+	}
+	if _, err := store.AppendBatchMeta(vecs, metas); err != nil {
+		t.Fatalf("AppendBatchMeta: %v", err)
+	}
+	return store
+}
+
+// Top k of a filtered search worked out by hand from the stored vectors
+func filteredTopK(t *testing.T, store *storage.Store, q embedding.EmbeddingVector, k int, f Filter) []SimilarityResult {
+	t.Helper()
+	metas, err := store.MetaData()
+	if err != nil {
+		t.Fatalf("MetaData: %v", err)
+	}
+
+	mh := MinHeap{}
+	mh.Init(k)
+	err = store.Iterate(func(pos int, v embedding.EmbeddingVector) error {
+		if f.Match(metas[pos]) {
+			sim, _ := v.NormedCosineSimilarity(q)
+			mh.Insert(SimilarityResult{CosSim: sim, Pos: pos})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Iterate: %v", err)
+	}
+	mh.Sort()
+	return mh.H
+}
+
+// A brute-force Index, so the index path can be tested without an ANN package
+type scanIndex struct {
+	store *storage.Store
+}
+
+func (x scanIndex) Search(q embedding.EmbeddingVector, k int, accept func(pos int) bool) ([]SimilarityResult, error) {
+	mh := MinHeap{}
+	mh.Init(k)
+	err := x.store.Iterate(func(pos int, v embedding.EmbeddingVector) error {
+		if accept(pos) {
+			sim, _ := v.NormedCosineSimilarity(q)
+			mh.Insert(SimilarityResult{CosSim: sim, Pos: pos})
+		}
+		return nil
+	})
+	mh.Sort()
+	return mh.H, err
+}
+
+func TestFilteredSearchMatchesFilteredScan(t *testing.T) {
+	vecs := randomUnitVectors(2000, 1)
+	store := openTaggedStore(t, vecs)
+
+	// Deleted records never come back, whatever the filter says
+	for pos := 0; pos < 200; pos += 2 {
+		id, _ := store.ID(pos)
+		if err := store.Delete(id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+
+	filters := map[string]Filter{
+		"broad":     Eq("lang", "de"),
+		"selective": And(Lt("page", 10), In("lang", "en", "de")),
+		"negated":   Not(Or(Eq("lang", "en"), Lt("page", 20))),
+	}
+	const k = 10
+	for name, f := range filters {
+		plan, err := newFilterPlan(store, f)
+		if err != nil {
+			t.Fatalf("%s: newFilterPlan: %v", name, err)
+		}
+		if (name == "selective") != plan.selective() {
+			t.Fatalf("%s: expected selective to be %v", name, name == "selective")
+		}
+
+		for i, q := range randomUnitVectors(5, 2) {
+			want := filteredTopK(t, store, q, k, f)
+			for _, opt := range []Option{Exact(), WithIndex(scanIndex{store: store})} {
+				got, err := SearchTopKSimilar(store, "q", k, &fakeModel{vector: q}, WithFilter(f), opt)
+				if err != nil {
+					t.Fatalf("%s: SearchTopKSimilar: %v", name, err)
+				}
+				if len(got) != len(want) {
+					t.Fatalf("%s query %d: expected %d results, got %d", name, i, len(want), len(got))
+				}
+				for j := range want {
+					if got[j].Meta.ID == 0 || got[j].Text != fmt.Sprintf("doc-%d", want[j].Pos) {
+						t.Fatalf("%s query %d result %d: expected doc-%d, got %s", name, i, j, want[j].Pos, got[j].Text)
+					}
+					if !f.Match(got[j].Meta) {
+						t.Fatalf("%s query %d result %d does not match the filter: %+v", name, i, j, got[j].Meta)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestFilterMatchingNothing(t *testing.T) {
+	store := openTaggedStore(t, randomUnitVectors(100, 3))
+
+	results, err := SearchTopKSimilar(store, "q", 5, &fakeModel{vector: randomUnitVectors(1, 4)[0]}, WithFilter(Eq("lang", "fr")))
+	if err != nil {
+		t.Fatalf("SearchTopKSimilar: %v", err)
+	}
+	if len(results) != 0 {
+		t.Fatalf("expected no results, got %d", len(results))
+	}
+}
+
+// A lenient store leaves corrupt metadata out of filtering, so it cannot
+// match a negated filter and crowd out a record that does
+func TestFilterSkipsCorruptMetadata(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.Open(dir, storage.Options{Dimension: testVectorLength})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	metas := []storage.EmbeddingMetaData{{Text: "torn", Source: "a"}, {Text: "kept", Source: "a"}, {Text: "other", Source: "b"}}
+	vecs := []embedding.EmbeddingVector{basisVector(0, 1), basisVector(0, 0.9), basisVector(1, 1)}
+	vecs[1][1] = 0.1
+	if _, err := store.AppendBatchMeta(vecs, metas); err != nil {
+		t.Fatalf("AppendBatchMeta: %v", err)
+	}
+	store.Close()
+	md, _ := os.ReadFile(filepath.Join(dir, "metadata.jsonl"))
+	os.WriteFile(filepath.Join(dir, "metadata.jsonl"), []byte(strings.Replace(string(md), `"torn"`, `"tom!"`, 1)), 0o644)
+
+	store, err = storage.Open(dir, storage.Options{Verify: storage.VerifyLenient})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer store.Close()
+	results, err := SearchTopKSimilar(store, "q", 1, &fakeModel{vector: basisVector(0, 1)}, WithFilter(Not(Eq("source", "b"))))
+	if err != nil {
+		t.Fatalf("SearchTopKSimilar: %v", err)
+	}
+	if len(results) != 1 || results[0].Text != "kept" {
+		t.Fatalf("expected the intact match, got %+v", results)
+	}
+}
@@ -74,3 +74,8 @@ func (mh *MinHeap) Sort() {
 		mh.bubbleDown(r)
 	}
 }
+
+// Reports whether Insert would keep a result with this similarity
+func (mh *MinHeap) Admits(sim float32) bool {
+	return mh.K > 0 && (len(mh.H) < mh.K || sim > mh.H[0].CosSim)
+}
@@ -0,0 +1,378 @@
+/*
+Package hnsw implements a Hierarchical Navigable Small World graph for
+approximate nearest-neighbour search over normalised embeddings.
+
+Vectors live on several layers of a proximity graph. Upper layers are sparse
+and let a query jump across the corpus quickly, layer 0 holds every vector.
+Searches walk greedily down from the top layer and finish with a beam search
+of width efSearch on layer 0. See Malkov & Yashunin, "Efficient and robust
+approximate nearest neighbor search using Hierarchical Navigable Small World
+graphs".
+
+The index attaches to a storage.Store, is extended on every append and is
+serialised next to data.bin as hnsw.idx.
+*/
+package hnsw
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+	"github.com/mateosanchezl/go-vect/internal/search"
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+const FileName = "hnsw.idx"
+
+const (
+	defaultM              = 16
+	defaultEfConstruction = 200
+	defaultEfSearch       = 64
+)
+
+type Config struct {
+	M              int    // Neighbours kept per node on upper layers, layer 0 keeps 2*M. Defaults to 16.
+	EfConstruction int    // Beam width while inserting. Defaults to 200.
+	EfSearch       int    // Beam width while searching, raised to k if smaller. Defaults to 64.
+	Seed           uint64 // Seed for level assignment, so builds are reproducible
+}
+
+func (c Config) withDefaults() Config {
+	if c.M <= 0 {
+		c.M = defaultM
+	}
+	if c.EfConstruction <= 0 {
+		c.EfConstruction = defaultEfConstruction
+	}
+	if c.EfSearch <= 0 {
+		c.EfSearch = defaultEfSearch
+	}
+	return c
+}
+
+type Index struct {
+	cfg   Config
+	dim   int
+	path  string         // Where Save writes to, empty for an in-memory index
+	store *storage.Store // Store the index is attached to, nil for an in-memory index
+
+	mu      sync.RWMutex // Held for writing by Add and Reset, so searches can run alongside appends
+	vectors []float32    // Copies of every indexed vector, dim-strided by position
+	links   [][][]int32  // links[pos][layer] holds the neighbours of pos on that layer
+
+	entry    int // Entry point on the top layer, -1 when empty
+	maxLevel int
+
+	rng       *rand.Rand
+	levelMult float64
+}
+
+// Creates an empty in-memory index for vectors of length dim
+func New(dim int, cfg Config) *Index {
+	cfg = cfg.withDefaults()
+	return &Index{
+		cfg:       cfg,
+		dim:       dim,
+		entry:     -1,
+		rng:       rand.New(rand.NewPCG(cfg.Seed, cfg.Seed^0x9e3779b97f4a7c15)),
+		levelMult: 1 / math.Log(float64(cfg.M)),
+	}
+}
+
+// Loads the index saved in the store's directory, or starts a new one, and
+// attaches it to the store so it catches up with any unindexed vectors and
+// follows future appends. A saved graph keeps the M and efConstruction it was
+// built with.
+func Open(store *storage.Store, cfg Config) (*Index, error) {
+	idx := New(store.Dimension(), cfg)
+	idx.path = filepath.Join(store.Dir(), FileName)
+	idx.store = store
+
+	err := idx.load(store)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.AttachIndex(idx)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (x *Index) Config() Config {
+	return x.cfg
+}
+
+// Number of positions in the graph
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.links)
+}
+
+// Drops every node
+func (x *Index) Reset() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.vectors = x.vectors[:0]
+	x.links = x.links[:0]
+	x.entry = -1
+	x.maxLevel = 0
+	return nil
+}
+
+// Inserts the vector at position pos, which must be the next unindexed position
+func (x *Index) Add(pos int, v embedding.EmbeddingVector) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if pos != len(x.links) {
+		return fmt.Errorf("hnsw: expected position %d, got %d", len(x.links), pos)
+	}
+	if len(v) != x.dim {
+		return fmt.Errorf("hnsw: vector must be of length %d, got %d", x.dim, len(v))
+	}
+
+	level := x.randomLevel()
+	x.vectors = append(x.vectors, v...)
+	x.links = append(x.links, make([][]int32, level+1))
+
+	if x.entry < 0 {
+		x.entry = pos
+		x.maxLevel = level
+		return nil
+	}
+
+	q := x.vector(pos)
+	ep := x.entry
+	for l := x.maxLevel; l > level; l-- {
+		ep = x.greedy(q, ep, l)
+	}
+
+	eps := []int{ep}
+	for l := min(level, x.maxLevel); l >= 0; l-- {
+		candidates := x.searchLayer(q, eps, x.cfg.EfConstruction, l, nil)
+		neighbours := x.selectNeighbours(candidates, x.maxLinks(l))
+
+		x.links[pos][l] = make([]int32, len(neighbours))
+		for i, n := range neighbours {
+			x.links[pos][l][i] = int32(n.Pos)
+			x.connect(n.Pos, pos, l)
+		}
+
+		eps = eps[:0]
+		for _, c := range candidates {
+			eps = append(eps, c.Pos)
+		}
+	}
+
+	if level > x.maxLevel {
+		x.entry = pos
+		x.maxLevel = level
+	}
+	return nil
+}
+
+// Finds the k positions most similar to query using the configured efSearch
+func (x *Index) Search(query embedding.EmbeddingVector, k int, accept func(pos int) bool) ([]search.SimilarityResult, error) {
+	return x.SearchEf(query, k, x.cfg.EfSearch, accept)
+}
+
+// Like Search with an explicit beam width
+func (x *Index) SearchEf(query embedding.EmbeddingVector, k int, ef int, accept func(pos int) bool) ([]search.SimilarityResult, error) {
+	if len(query) != x.dim {
+		return nil, fmt.Errorf("hnsw: query must be of length %d, got %d", x.dim, len(query))
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if x.entry < 0 || k <= 0 {
+		return []search.SimilarityResult{}, nil
+	}
+
+	ep := x.entry
+	for l := x.maxLevel; l > 0; l-- {
+		ep = x.greedy(query, ep, l)
+	}
+
+	results := x.searchLayer(query, []int{ep}, max(ef, k), 0, accept)
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results, nil
+}
+
+func (x *Index) vector(pos int) []float32 {
+	return x.vectors[pos*x.dim : (pos+1)*x.dim]
+}
+
+func (x *Index) similarity(q []float32, pos int) float32 {
+	return dot(q, x.vector(pos))
+}
+
+func (x *Index) maxLinks(layer int) int {
+	if layer == 0 {
+		return 2 * x.cfg.M
+	}
+	return x.cfg.M
+}
+
+func (x *Index) randomLevel() int {
+	return int(-math.Log(1-x.rng.Float64()) * x.levelMult)
+}
+
+// Walks to the most similar neighbour on a layer until no neighbour improves
+func (x *Index) greedy(q []float32, ep int, layer int) int {
+	best := x.similarity(q, ep)
+	for changed := true; changed; {
+		changed = false
+		for _, n := range x.links[ep][layer] {
+			if sim := x.similarity(q, int(n)); sim > best {
+				best, ep, changed = sim, int(n), true
+			}
+		}
+	}
+	return ep
+}
+
+// Beam search on a single layer. Returns up to ef accepted positions, most
+// similar first. Rejected positions are still traversed so a selective accept
+// doesn't cut the graph apart.
+func (x *Index) searchLayer(q []float32, eps []int, ef int, layer int, accept func(pos int) bool) []search.SimilarityResult {
+	visited := make([]uint64, (len(x.links)+63)/64)
+	candidates := &maxHeap{}
+
+	results := search.MinHeap{}
+	results.Init(ef)
+
+	for _, ep := range eps {
+		visited[ep/64] |= 1 << (ep % 64)
+		r := search.SimilarityResult{CosSim: x.similarity(q, ep), Pos: ep}
+		heap.Push(candidates, r)
+		if accept == nil || accept(ep) {
+			results.Insert(r)
+		}
+	}
+
+	for candidates.Len() > 0 {
+		c := heap.Pop(candidates).(search.SimilarityResult)
+		if len(results.H) == ef && c.CosSim < results.H[0].CosSim {
+			break // Nothing left can improve the results
+		}
+
+		for _, n := range x.links[c.Pos][layer] {
+			pos := int(n)
+			if visited[pos/64]&(1<<(pos%64)) != 0 {
+				continue
+			}
+			visited[pos/64] |= 1 << (pos % 64)
+
+			r := search.SimilarityResult{CosSim: x.similarity(q, pos), Pos: pos}
+			if len(results.H) < ef || r.CosSim > results.H[0].CosSim {
+				heap.Push(candidates, r)
+				if accept == nil || accept(pos) {
+					results.Insert(r)
+				}
+			}
+		}
+	}
+
+	results.Sort()
+	return results.H
+}
+
+// Picks up to m neighbours from candidates (most similar first), preferring
+// ones that aren't already covered by a closer pick. This keeps links spread
+// across clusters instead of all pointing into the nearest one.
+func (x *Index) selectNeighbours(candidates []search.SimilarityResult, m int) []search.SimilarityResult {
+	if len(candidates) <= m {
+		return candidates
+	}
+
+	selected := make([]search.SimilarityResult, 0, m)
+	var pruned []search.SimilarityResult
+	for _, c := range candidates {
+		if len(selected) == m {
+			break
+		}
+		diverse := true
+		for _, s := range selected {
+			if dot(x.vector(c.Pos), x.vector(s.Pos)) > c.CosSim {
+				diverse = false
+				break
+			}
+		}
+		if diverse {
+			selected = append(selected, c)
+		} else {
+			pruned = append(pruned, c)
+		}
+	}
+
+	for _, p := range pruned {
+		if len(selected) == m {
+			break
+		}
+		selected = append(selected, p)
+	}
+	return selected
+}
+
+// Adds a link from -> to on a layer, pruning from's links if it has too many
+func (x *Index) connect(from, to int, layer int) {
+	links := append(x.links[from][layer], int32(to))
+	if len(links) <= x.maxLinks(layer) {
+		x.links[from][layer] = links
+		return
+	}
+
+	v := x.vector(from)
+	candidates := make([]search.SimilarityResult, len(links))
+	for i, n := range links {
+		candidates[i] = search.SimilarityResult{CosSim: x.similarity(v, int(n)), Pos: int(n)}
+	}
+	slices.SortFunc(candidates, func(a, b search.SimilarityResult) int {
+		switch {
+		case a.CosSim > b.CosSim:
+			return -1
+		case a.CosSim < b.CosSim:
+			return 1
+		}
+		return 0
+	})
+
+	kept := x.selectNeighbours(candidates, x.maxLinks(layer))
+	links = links[:0]
+	for _, k := range kept {
+		links = append(links, int32(k.Pos))
+	}
+	x.links[from][layer] = links
+}
+
+func dot(a, b []float32) float32 {
+	var t float32
+	for i := range a {
+		t += a[i] * b[i]
+	}
+	return t
+}
+
+// Max-heap of candidates by similarity
+type maxHeap []search.SimilarityResult
+
+func (h maxHeap) Len() int           { return len(h) }
+func (h maxHeap) Less(i, j int) bool { return h[i].CosSim > h[j].CosSim }
+func (h maxHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *maxHeap) Push(x any)        { *h = append(*h, x.(search.SimilarityResult)) }
+func (h *maxHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
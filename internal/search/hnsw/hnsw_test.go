@@ -0,0 +1,279 @@
+package hnsw
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+	"github.com/mateosanchezl/go-vect/internal/search"
+	"github.com/mateosanchezl/go-vect/internal/search/searchtest"
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+const testDim = 32
+
+// Measures recall@k of the HNSW path against the brute-force path
+func TestRecallAgainstExactSearch(t *testing.T) {
+	store := searchtest.OpenStore(t, t.TempDir(), testDim)
+	defer store.Close()
+
+	idx, err := Open(store, Config{Seed: 1})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	searchtest.FillStore(t, store, searchtest.RandomVectors(3000, testDim, 7))
+
+	const k = 10
+	recall := searchtest.Recall(t, store, searchtest.RandomVectors(50, testDim, 99), k, search.WithIndex(idx))
+	t.Logf("recall@%d = %.3f", k, recall)
+	if recall < 0.9 {
+		t.Fatalf("expected recall@%d of at least 0.9, got %.3f", k, recall)
+	}
+}
+
+func TestSearchRespectsAccept(t *testing.T) {
+	idx := New(testDim, Config{Seed: 1})
+	for i, v := range searchtest.RandomVectors(500, testDim, 3) {
+		if err := idx.Add(i, v); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	results, err := idx.Search(searchtest.RandomVectors(1, testDim, 4)[0], 10, func(pos int) bool { return pos%2 == 0 })
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(results) != 10 {
+		t.Fatalf("expected 10 results, got %d", len(results))
+	}
+	for i, r := range results {
+		if r.Pos%2 != 0 {
+			t.Fatalf("result %d at position %d was not accepted", i, r.Pos)
+		}
+		if i > 0 && r.CosSim > results[i-1].CosSim {
+			t.Fatalf("results not sorted by similarity")
+		}
+	}
+}
+
+func TestAddRejectsOutOfOrderPositions(t *testing.T) {
+	idx := New(testDim, Config{})
+	if err := idx.Add(1, searchtest.RandomVectors(1, testDim, 1)[0]); err == nil {
+		t.Fatalf("expected error when skipping a position")
+	}
+}
+
+func TestIndexPersistsAcrossReopen(t *testing.T) {
+	dir := t.TempDir()
+	store := searchtest.OpenStore(t, dir, testDim)
+	idx, err := Open(store, Config{M: 8, Seed: 1})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	searchtest.FillStore(t, store, searchtest.RandomVectors(400, testDim, 5))
+
+	q := searchtest.RandomVectors(1, testDim, 6)[0]
+	before, err := idx.Search(q, 5, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, FileName)); err != nil {
+		t.Fatalf("expected index file to be saved on close: %v", err)
+	}
+
+	store = searchtest.OpenStore(t, dir, testDim)
+	defer store.Close()
+
+	loaded, err := Open(store, Config{})
+	if err != nil {
+		t.Fatalf("reopen index: %v", err)
+	}
+	if loaded.Len() != 400 {
+		t.Fatalf("expected saved graph with 400 nodes, got %d", loaded.Len())
+	}
+	if loaded.Config().M != 8 {
+		t.Fatalf("expected saved graph to keep M=8, got %d", loaded.Config().M)
+	}
+
+	after, err := loaded.Search(q, 5, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	for i := range before {
+		if before[i].Pos != after[i].Pos {
+			t.Fatalf("result %d differs after reload: %d vs %d", i, before[i].Pos, after[i].Pos)
+		}
+	}
+}
+
+func TestIndexFollowsAppendsAndCompaction(t *testing.T) {
+	dir := t.TempDir()
+	store := searchtest.OpenStore(t, dir, testDim)
+	defer store.Close()
+
+	vecs := searchtest.RandomVectors(200, testDim, 8)
+	searchtest.FillStore(t, store, vecs[:100])
+
+	// Attaching catches up with what is already stored
+	idx, err := Open(store, Config{Seed: 1})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if idx.Len() != 100 {
+		t.Fatalf("expected index to catch up to 100 vectors, got %d", idx.Len())
+	}
+
+	searchtest.FillStore(t, store, vecs[100:])
+	if idx.Len() != 200 {
+		t.Fatalf("expected index to follow appends to 200 vectors, got %d", idx.Len())
+	}
+
+	id, _ := store.ID(0)
+	if err := store.Delete(id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if idx.Len() != 199 {
+		t.Fatalf("expected index to be rebuilt with 199 vectors, got %d", idx.Len())
+	}
+
+	// The vector that was at position 1 now lives at position 0
+	results, err := idx.Search(vecs[1], 1, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if results[0].Pos != 0 {
+		t.Fatalf("expected exact match at position 0 after compaction, got %d", results[0].Pos)
+	}
+}
+
+// Searches run while another goroutine appends and deletes. Run with -race.
+func TestSearchDuringAppends(t *testing.T) {
+	store := searchtest.OpenStore(t, t.TempDir(), testDim)
+	defer store.Close()
+	vecs := searchtest.RandomVectors(300, testDim, 5)
+	searchtest.FillStore(t, store, vecs[:50])
+
+	idx, err := Open(store, Config{Seed: 1})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		defer close(done)
+		for i := 50; i < len(vecs); i += 10 {
+			texts := make([]string, 10)
+			ids, err := store.AppendBatch(vecs[i:i+10], texts)
+			if err == nil {
+				err = store.Delete(ids[0])
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	model := &searchtest.FixedModel{Vector: vecs[0]}
+	for searching := true; searching; {
+		select {
+		case err, ok := <-done:
+			if ok {
+				t.Fatalf("append: %v", err)
+			}
+			searching = false
+		default:
+		}
+
+		results, err := search.SearchTopKSimilar(store, "q", 5, model, search.WithIndex(idx))
+		if err != nil {
+			t.Fatalf("SearchTopKSimilar: %v", err)
+		}
+		if len(results) == 0 || results[0].Text != "doc-0" {
+			t.Fatalf("expected doc-0 first, got %+v", results)
+		}
+	}
+
+	if idx.Len() != len(vecs) {
+		t.Fatalf("expected %d indexed positions, got %d", len(vecs), idx.Len())
+	}
+}
+
+// Compares graph search with a full heap scan over the same vectors, leaving
+// out the metadata lookups both paths share
+func BenchmarkSearch(b *testing.B) {
+	vecs := searchtest.RandomVectors(20000, testDim, 11)
+	idx := New(testDim, Config{Seed: 1})
+	for i, v := range vecs {
+		if err := idx.Add(i, v); err != nil {
+			b.Fatalf("Add: %v", err)
+		}
+	}
+	q := searchtest.RandomVectors(1, testDim, 12)[0]
+
+	searchtest.BenchmarkExact(b, vecs, q)
+	b.Run("hnsw", func(b *testing.B) {
+		for range b.N {
+			if _, err := idx.Search(q, 10, nil); err != nil {
+				b.Fatalf("Search: %v", err)
+			}
+		}
+	})
+}
+
+// Every segment of a segmented store gets its own graph, merged ones included
+func TestSegmentsSearchThroughTheirIndexes(t *testing.T) {
+	dir := t.TempDir()
+	segs, err := storage.OpenSegmented(dir, storage.SegmentOptions{
+		Options:     storage.Options{Dimension: testDim},
+		SegmentSize: 50,
+		MergeFactor: 2,
+		ManualMerge: true,
+		OpenIndex: func(store *storage.Store) (storage.Index, error) {
+			return Open(store, Config{})
+		},
+	})
+	if err != nil {
+		t.Fatalf("OpenSegmented: %v", err)
+	}
+	defer segs.Close()
+
+	vecs := searchtest.RandomVectors(120, testDim, 5)
+	for i, v := range vecs {
+		md := []storage.EmbeddingMetaData{{Text: fmt.Sprintf("doc-%d", i)}}
+		if _, err := segs.AppendBatchMeta([]embedding.EmbeddingVector{v}, md); err != nil {
+			t.Fatalf("AppendBatchMeta: %v", err)
+		}
+	}
+	if merged, err := segs.Merge(); err != nil || !merged {
+		t.Fatalf("expected a merge, got %v, %v", merged, err)
+	}
+
+	segs.WithSegments(func(list []*storage.Segment) error {
+		for _, seg := range list {
+			n, _ := seg.Store.Len()
+			if idx, ok := seg.Index.(*Index); !ok || idx.Len() != n {
+				t.Fatalf("expected an HNSW index over all %d records of each segment", n)
+			}
+		}
+		return nil
+	})
+	for i := range 10 {
+		model := &searchtest.FixedModel{Vector: vecs[i*11]}
+		got, err := search.SearchSegments(segs, "q", 1, model)
+		if err != nil {
+			t.Fatalf("SearchSegments: %v", err)
+		}
+		if want := fmt.Sprintf("doc-%d", i*11); len(got) != 1 || got[0].Text != want {
+			t.Fatalf("expected %s to find itself, got %+v", want, got)
+		}
+	}
+}
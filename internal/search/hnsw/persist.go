@@ -0,0 +1,214 @@
+package hnsw
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+/*
+hnsw.idx layout (little-endian). Vectors are not duplicated on disk, they are
+read back from the store when the graph is loaded.
+
+	magic "HNSW" | version u16 | M u16 | efConstruction u32 | dim u32
+	count u32 | entry i32 | maxLevel i32 | ID of the record at position count-1 u64
+	per node: level u8, then per layer 0..level: n u16, n × neighbour u32
+	crc32 of everything above u32
+*/
+
+const fileVersion = 1
+
+var fileMagic = []byte("HNSW")
+
+var ErrCorruptIndex = errors.New("hnsw: corrupt index file")
+
+// Writes the graph to the index file, replacing it atomically
+func (x *Index) Save() error {
+	if x.path == "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	_, err := x.WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+
+	tmp := x.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create index file: %w", err)
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write index file: %w", err)
+	}
+
+	err = os.Rename(tmp, x.path)
+	if err != nil {
+		return fmt.Errorf("failed to replace index file: %w", err)
+	}
+	return nil
+}
+
+// Serialises the graph without its vectors
+func (x *Index) WriteTo(w io.Writer) (int64, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+
+	buf.Write(fileMagic)
+	buf.Write(le.AppendUint16(nil, fileVersion))
+	buf.Write(le.AppendUint16(nil, uint16(x.cfg.M)))
+	buf.Write(le.AppendUint32(nil, uint32(x.cfg.EfConstruction)))
+	buf.Write(le.AppendUint32(nil, uint32(x.dim)))
+	buf.Write(le.AppendUint32(nil, uint32(len(x.links))))
+	buf.Write(le.AppendUint32(nil, uint32(int32(x.entry))))
+	buf.Write(le.AppendUint32(nil, uint32(int32(x.maxLevel))))
+	buf.Write(le.AppendUint64(nil, x.lastID()))
+
+	for _, layers := range x.links {
+		buf.WriteByte(byte(len(layers) - 1))
+		for _, links := range layers {
+			buf.Write(le.AppendUint16(nil, uint16(len(links))))
+			for _, n := range links {
+				buf.Write(le.AppendUint32(nil, uint32(n)))
+			}
+		}
+	}
+
+	buf.Write(le.AppendUint32(nil, crc32.ChecksumIEEE(buf.Bytes())))
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// ID of the last indexed record. Positions move when a store is compacted,
+// so a saved graph is only reused if this still matches.
+func (x *Index) lastID() uint64 {
+	if x.store == nil {
+		return 0
+	}
+	id, _ := x.store.ID(len(x.links) - 1)
+	return id
+}
+
+// Reads a graph written by WriteTo. Vectors must be supplied separately.
+func (x *Index) readFrom(data []byte) (lastID uint64, err error) {
+	le := binary.LittleEndian
+	if len(data) < 40 || !bytes.Equal(data[:4], fileMagic) {
+		return 0, ErrCorruptIndex
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != le.Uint32(data[len(data)-4:]) {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrCorruptIndex)
+	}
+	if v := le.Uint16(body[4:6]); v != fileVersion {
+		return 0, fmt.Errorf("%w: unsupported version %d", ErrCorruptIndex, v)
+	}
+
+	m := int(le.Uint16(body[6:8]))
+	efc := int(le.Uint32(body[8:12]))
+	dim := int(le.Uint32(body[12:16]))
+	count := int(le.Uint32(body[16:20]))
+	entry := int(int32(le.Uint32(body[20:24])))
+	maxLevel := int(int32(le.Uint32(body[24:28])))
+	if dim != x.dim {
+		return 0, fmt.Errorf("%w: built for %d-dim vectors, store holds %d", ErrCorruptIndex, dim, x.dim)
+	}
+
+	lastID = le.Uint64(body[28:36])
+
+	r := bufio.NewReader(bytes.NewReader(body[36:]))
+	links := make([][][]int32, count)
+	for pos := range count {
+		level, err := r.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("%w: truncated node %d", ErrCorruptIndex, pos)
+		}
+		links[pos] = make([][]int32, int(level)+1)
+		for l := range links[pos] {
+			var n uint16
+			err = binary.Read(r, le, &n)
+			if err != nil {
+				return 0, fmt.Errorf("%w: truncated node %d", ErrCorruptIndex, pos)
+			}
+			links[pos][l] = make([]int32, n)
+			err = binary.Read(r, le, links[pos][l])
+			if err != nil {
+				return 0, fmt.Errorf("%w: truncated node %d", ErrCorruptIndex, pos)
+			}
+			for _, nb := range links[pos][l] {
+				if int(nb) >= count {
+					return 0, fmt.Errorf("%w: node %d links to missing node %d", ErrCorruptIndex, pos, nb)
+				}
+			}
+		}
+	}
+	if count > 0 && (entry < 0 || entry >= count) {
+		return 0, fmt.Errorf("%w: invalid entry point %d", ErrCorruptIndex, entry)
+	}
+
+	x.cfg.M = m
+	x.cfg.EfConstruction = efc
+	x.links = links
+	x.entry = entry
+	x.maxLevel = maxLevel
+	if count == 0 {
+		x.entry = -1
+	}
+	return lastID, nil
+}
+
+// Loads the saved graph and the vectors it covers. A missing, corrupt or
+// outdated file leaves the index empty so it is rebuilt from the store.
+func (x *Index) load(store *storage.Store) error {
+	data, err := os.ReadFile(x.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read index file: %w", err)
+	}
+
+	lastID, err := x.readFrom(data)
+	if err != nil {
+		return x.Reset()
+	}
+	if x.Len() > 0 && x.lastID() != lastID {
+		// Saved before a clear or compaction moved the positions
+		return x.Reset()
+	}
+
+	view, err := store.View()
+	if err != nil {
+		return err
+	}
+	defer view.Close()
+
+	if x.Len() > view.Len() {
+		return x.Reset()
+	}
+
+	x.vectors = make([]float32, 0, x.Len()*x.dim)
+	for pos := range x.Len() {
+		x.vectors = append(x.vectors, view.At(pos)...)
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+/*
+Package ivf implements an inverted-file (IVF-Flat) index for approximate
+nearest-neighbour search over normalised embeddings.
+
+k-means splits the vectors into nlists clusters. Every vector is kept, in full,
+in the posting list of its nearest centroid, and a search only scans the
+nprobe lists whose centroids are closest to the query. It is far cheaper to
+build than an HNSW graph, at the cost of some recall when nprobe is small.
+
+Until it is trained the index holds a single list and searches scan all of
+it. New appends are assigned to the nearest existing centroid, so as the data
+drifts away from what the index was trained on the lists become unbalanced
+and it should be retrained with Train.
+
+The index attaches to a storage.Store and is serialised next to data.bin as
+ivf.idx.
+*/
+package ivf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"path/filepath"
+	"sync"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+	"github.com/mateosanchezl/go-vect/internal/search"
+	"github.com/mateosanchezl/go-vect/internal/search/kmeans"
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+const FileName = "ivf.idx"
+
+const (
+	defaultNProbe        = 8
+	defaultSamplePerList = 256
+)
+
+var ErrNothingToTrain = errors.New("ivf: no vectors to train on")
+
+type Config struct {
+	NLists     int    // Clusters to train, defaults to sqrt of the number of vectors
+	NProbe     int    // Lists scanned per search, defaults to 8
+	MaxIter    int    // k-means iterations, see kmeans.Config
+	SampleSize int    // Vectors k-means is trained on, defaults to 256 per list
+	Seed       uint64 // Seed for sampling and k-means++, so training is reproducible
+}
+
+func (c Config) withDefaults() Config {
+	if c.NProbe <= 0 {
+		c.NProbe = defaultNProbe
+	}
+	return c
+}
+
+// A posting list: positions and full copies of their vectors, dim-strided
+type list struct {
+	positions []int32
+	vectors   []float32
+}
+
+type Index struct {
+	cfg   Config
+	dim   int
+	path  string         // Where Save writes to, empty for an in-memory index
+	store *storage.Store // Store the index is attached to, nil for an in-memory index
+
+	mu        sync.RWMutex // Held for writing by Add, Reset and Train, so searches can run alongside appends
+	centroids []float32    // NLists*dim, empty while untrained
+	lists     []list       // One per centroid, or a single list while untrained
+	count     int          // Number of positions indexed
+	trained   int          // Number of positions covered by the last training
+}
+
+// Creates an empty, untrained in-memory index for vectors of length dim
+func New(dim int, cfg Config) *Index {
+	return &Index{
+		cfg:   cfg.withDefaults(),
+		dim:   dim,
+		lists: make([]list, 1),
+	}
+}
+
+// Loads the index saved in the store's directory, or starts a new untrained
+// one, and attaches it to the store so it catches up with any unindexed
+// vectors and follows future appends
+func Open(store *storage.Store, cfg Config) (*Index, error) {
+	idx := New(store.Dimension(), cfg)
+	idx.path = filepath.Join(store.Dir(), FileName)
+	idx.store = store
+
+	err := idx.load(store)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.AttachIndex(idx)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (x *Index) Config() Config {
+	return x.cfg
+}
+
+// Number of positions in the index
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.count
+}
+
+// Number of centroids, 0 while untrained
+func (x *Index) NLists() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.nlists()
+}
+
+func (x *Index) nlists() int {
+	return len(x.centroids) / x.dim
+}
+
+func (x *Index) Trained() bool {
+	return x.NLists() > 0
+}
+
+// Sizes of the posting lists, useful to spot imbalance after drift
+func (x *Index) ListSizes() []int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	sizes := make([]int, len(x.lists))
+	for i, l := range x.lists {
+		sizes[i] = len(l.positions)
+	}
+	return sizes
+}
+
+// Fraction of indexed vectors that were appended after the last training and
+// so never influenced the centroids. 1 for an untrained index.
+func (x *Index) Drift() float64 {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if x.count == 0 {
+		return 0
+	}
+	if x.nlists() == 0 {
+		return 1
+	}
+	return float64(max(x.count-x.trained, 0)) / float64(x.count)
+}
+
+// Empties every posting list. Centroids are kept, so an index rebuilt after
+// a compaction stays trained.
+func (x *Index) Reset() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for i := range x.lists {
+		x.lists[i].positions = x.lists[i].positions[:0]
+		x.lists[i].vectors = x.lists[i].vectors[:0]
+	}
+	x.count = 0
+	return nil
+}
+
+// Assigns the vector at position pos, which must be the next unindexed
+// position, to the list of its nearest centroid
+func (x *Index) Add(pos int, v embedding.EmbeddingVector) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if pos != x.count {
+		return fmt.Errorf("ivf: expected position %d, got %d", x.count, pos)
+	}
+	if len(v) != x.dim {
+		return fmt.Errorf("ivf: vector must be of length %d, got %d", x.dim, len(v))
+	}
+
+	x.assign(int32(pos), v)
+	x.count++
+	return nil
+}
+
+func (x *Index) assign(pos int32, v []float32) {
+	c := 0
+	if x.nlists() > 0 {
+		c, _ = kmeans.Nearest(x.centroids, x.dim, v)
+	}
+	x.lists[c].positions = append(x.lists[c].positions, pos)
+	x.lists[c].vectors = append(x.lists[c].vectors, v...)
+}
+
+// Trains the centroids with k-means++ over the indexed vectors and moves every
+// vector to the list of its new nearest centroid. Deleted records of the
+// attached store are left out of training. Appends wait until training is
+// done.
+func (x *Index) Train() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	n := x.count
+	nlists := x.cfg.NLists
+	if nlists <= 0 {
+		nlists = max(int(math.Sqrt(float64(n))), 1)
+	}
+
+	// Flatten the lists back into position order
+	all := make([]float32, n*x.dim)
+	for _, l := range x.lists {
+		for i, pos := range l.positions {
+			copy(all[int(pos)*x.dim:], l.vectors[i*x.dim:(i+1)*x.dim])
+		}
+	}
+
+	live := make([]int, 0, n)
+	for pos := range n {
+		if x.store == nil || !x.store.IsDeleted(pos) {
+			live = append(live, pos)
+		}
+	}
+	if len(live) == 0 {
+		return ErrNothingToTrain
+	}
+	nlists = min(nlists, len(live))
+
+	rng := rand.New(rand.NewPCG(x.cfg.Seed, x.cfg.Seed^0x6a09e667f3bcc909))
+	sampleSize := x.cfg.SampleSize
+	if sampleSize <= 0 {
+		sampleSize = defaultSamplePerList * nlists
+	}
+	if len(live) > sampleSize {
+		rng.Shuffle(len(live), func(i, j int) { live[i], live[j] = live[j], live[i] })
+		live = live[:max(sampleSize, nlists)]
+	}
+
+	sample := make([]float32, 0, len(live)*x.dim)
+	for _, pos := range live {
+		sample = append(sample, all[pos*x.dim:(pos+1)*x.dim]...)
+	}
+
+	centroids, err := kmeans.Train(sample, x.dim, kmeans.Config{K: nlists, MaxIter: x.cfg.MaxIter, Seed: x.cfg.Seed})
+	if err != nil {
+		return fmt.Errorf("failed to train centroids: %w", err)
+	}
+
+	x.centroids = centroids
+	x.lists = make([]list, nlists)
+	for pos := range n {
+		x.assign(int32(pos), all[pos*x.dim:(pos+1)*x.dim])
+	}
+	x.trained = n
+	return nil
+}
+
+// Finds the k positions most similar to query using the configured nprobe
+func (x *Index) Search(query embedding.EmbeddingVector, k int, accept func(pos int) bool) ([]search.SimilarityResult, error) {
+	return x.SearchNProbe(query, k, x.cfg.NProbe, accept)
+}
+
+// Like Search with an explicit number of lists to scan
+func (x *Index) SearchNProbe(query embedding.EmbeddingVector, k int, nprobe int, accept func(pos int) bool) ([]search.SimilarityResult, error) {
+	if len(query) != x.dim {
+		return nil, fmt.Errorf("ivf: query must be of length %d, got %d", x.dim, len(query))
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if x.count == 0 || k <= 0 {
+		return []search.SimilarityResult{}, nil
+	}
+
+	results := search.MinHeap{}
+	results.Init(k)
+	for _, c := range x.probe(query, nprobe) {
+		l := x.lists[c]
+		for i, pos := range l.positions {
+			if accept != nil && !accept(int(pos)) {
+				continue
+			}
+			sim := dot(query, l.vectors[i*x.dim:(i+1)*x.dim])
+			results.Insert(search.SimilarityResult{CosSim: sim, Pos: int(pos)})
+		}
+	}
+
+	results.Sort()
+	return results.H, nil
+}
+
+// Lists to scan for query: the nprobe with the closest centroids
+func (x *Index) probe(query []float32, nprobe int) []int {
+	if x.nlists() == 0 {
+		return []int{0}
+	}
+
+	// Ranked with the same heap as the results, scoring by negative distance
+	nearest := search.MinHeap{}
+	nearest.Init(min(max(nprobe, 1), x.nlists()))
+	for c := range x.nlists() {
+		d := kmeans.SquaredDistance(query, x.centroids[c*x.dim:(c+1)*x.dim])
+		nearest.Insert(search.SimilarityResult{CosSim: -d, Pos: c})
+	}
+
+	out := make([]int, len(nearest.H))
+	for i, r := range nearest.H {
+		out[i] = r.Pos
+	}
+	return out
+}
+
+func dot(a, b []float32) float32 {
+	var t float32
+	for i := range a {
+		t += a[i] * b[i]
+	}
+	return t
+}
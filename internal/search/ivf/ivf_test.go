@@ -0,0 +1,238 @@
+package ivf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/search"
+	"github.com/mateosanchezl/go-vect/internal/search/searchtest"
+)
+
+const testDim = 32
+
+// Measures recall@k of the IVF path against the brute-force path
+func TestRecallAgainstExactSearch(t *testing.T) {
+	store := searchtest.OpenStore(t, t.TempDir(), testDim)
+	defer store.Close()
+
+	idx, err := Open(store, Config{NProbe: 8, Seed: 1})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	// Queries come from the same topics as the data but aren't stored
+	vecs := searchtest.ClusteredVectors(3050, testDim, 40, 0.5, 7)
+	searchtest.FillStore(t, store, vecs[:3000])
+	if err := idx.Train(); err != nil {
+		t.Fatalf("Train: %v", err)
+	}
+	if idx.NLists() != 54 {
+		t.Fatalf("expected sqrt(3000) lists, got %d", idx.NLists())
+	}
+
+	const k = 10
+	recall := searchtest.Recall(t, store, vecs[3000:], k, search.WithIndex(idx))
+	t.Logf("recall@%d with nprobe=8 = %.3f", k, recall)
+	if recall < 0.9 {
+		t.Fatalf("expected recall@%d of at least 0.9, got %.3f", k, recall)
+	}
+}
+
+func TestUntrainedIndexScansEverything(t *testing.T) {
+	idx := New(testDim, Config{NProbe: 1})
+	vecs := searchtest.ClusteredVectors(200, testDim, 5, 0.5, 3)
+	for i, v := range vecs {
+		if err := idx.Add(i, v); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if idx.Trained() || idx.Drift() != 1 {
+		t.Fatalf("expected an untrained index with full drift")
+	}
+
+	results, err := idx.Search(vecs[123], 1, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if results[0].Pos != 123 {
+		t.Fatalf("expected exact match at 123, got %d", results[0].Pos)
+	}
+}
+
+func TestSearchRespectsAccept(t *testing.T) {
+	idx := New(testDim, Config{NLists: 8, NProbe: 8, Seed: 1})
+	for i, v := range searchtest.ClusteredVectors(500, testDim, 8, 0.5, 3) {
+		if err := idx.Add(i, v); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if err := idx.Train(); err != nil {
+		t.Fatalf("Train: %v", err)
+	}
+
+	results, err := idx.Search(searchtest.ClusteredVectors(1, testDim, 8, 0.5, 4)[0], 10, func(pos int) bool { return pos%2 == 0 })
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(results) != 10 {
+		t.Fatalf("expected 10 results, got %d", len(results))
+	}
+	for i, r := range results {
+		if r.Pos%2 != 0 {
+			t.Fatalf("result %d at position %d was not accepted", i, r.Pos)
+		}
+		if i > 0 && r.CosSim > results[i-1].CosSim {
+			t.Fatalf("results not sorted by similarity")
+		}
+	}
+}
+
+func TestAppendsGoToNearestCentroid(t *testing.T) {
+	store := searchtest.OpenStore(t, t.TempDir(), testDim)
+	defer store.Close()
+
+	vecs := searchtest.ClusteredVectors(600, testDim, 6, 0.5, 5)
+	searchtest.FillStore(t, store, vecs[:500])
+
+	idx, err := Open(store, Config{NLists: 6, NProbe: 1, Seed: 1})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := idx.Train(); err != nil {
+		t.Fatalf("Train: %v", err)
+	}
+
+	searchtest.FillStore(t, store, vecs[500:])
+	if idx.Len() != 600 {
+		t.Fatalf("expected index to follow appends to 600 vectors, got %d", idx.Len())
+	}
+	if d := idx.Drift(); d < 0.16 || d > 0.17 {
+		t.Fatalf("expected drift of 100/600, got %.3f", d)
+	}
+
+	// Probing a single list still finds appended vectors, since each query
+	// lands in the same list its vector was assigned to
+	for pos := 500; pos < 600; pos++ {
+		results, err := idx.Search(vecs[pos], 1, nil)
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(results) == 0 || results[0].Pos != pos {
+			t.Fatalf("expected appended vector %d to be found with nprobe=1, got %v", pos, results)
+		}
+	}
+}
+
+func TestIndexPersistsAcrossReopen(t *testing.T) {
+	dir := t.TempDir()
+	store := searchtest.OpenStore(t, dir, testDim)
+	idx, err := Open(store, Config{NLists: 10, Seed: 1})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	searchtest.FillStore(t, store, searchtest.ClusteredVectors(400, testDim, 10, 0.5, 5))
+	if err := idx.Train(); err != nil {
+		t.Fatalf("Train: %v", err)
+	}
+
+	q := searchtest.ClusteredVectors(1, testDim, 10, 0.5, 6)[0]
+	before, err := idx.Search(q, 5, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, FileName)); err != nil {
+		t.Fatalf("expected index file to be saved on close: %v", err)
+	}
+
+	store = searchtest.OpenStore(t, dir, testDim)
+	defer store.Close()
+
+	loaded, err := Open(store, Config{})
+	if err != nil {
+		t.Fatalf("reopen index: %v", err)
+	}
+	if loaded.Len() != 400 || loaded.NLists() != 10 {
+		t.Fatalf("expected saved index with 400 vectors in 10 lists, got %d in %d", loaded.Len(), loaded.NLists())
+	}
+
+	after, err := loaded.Search(q, 5, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	for i := range before {
+		if before[i].Pos != after[i].Pos {
+			t.Fatalf("result %d differs after reload: %d vs %d", i, before[i].Pos, after[i].Pos)
+		}
+	}
+}
+
+func TestCompactionKeepsCentroids(t *testing.T) {
+	store := searchtest.OpenStore(t, t.TempDir(), testDim)
+	defer store.Close()
+
+	vecs := searchtest.ClusteredVectors(300, testDim, 6, 0.5, 8)
+	searchtest.FillStore(t, store, vecs)
+	idx, err := Open(store, Config{NLists: 6, Seed: 1})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := idx.Train(); err != nil {
+		t.Fatalf("Train: %v", err)
+	}
+
+	id, _ := store.ID(0)
+	if err := store.Delete(id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if idx.Len() != 299 || idx.NLists() != 6 {
+		t.Fatalf("expected 299 vectors in 6 lists after compaction, got %d in %d", idx.Len(), idx.NLists())
+	}
+
+	// The vector that was at position 1 now lives at position 0
+	results, err := idx.Search(vecs[1], 1, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if results[0].Pos != 0 {
+		t.Fatalf("expected exact match at position 0 after compaction, got %d", results[0].Pos)
+	}
+}
+
+func TestTrainOnEmptyIndex(t *testing.T) {
+	if err := New(testDim, Config{}).Train(); err != ErrNothingToTrain {
+		t.Fatalf("expected ErrNothingToTrain, got %v", err)
+	}
+}
+
+// Compares scanning nprobe lists with a full heap scan over the same vectors
+func BenchmarkSearch(b *testing.B) {
+	vecs := searchtest.ClusteredVectors(20000, testDim, 100, 0.5, 11)
+	idx := New(testDim, Config{Seed: 1})
+	for i, v := range vecs {
+		if err := idx.Add(i, v); err != nil {
+			b.Fatalf("Add: %v", err)
+		}
+	}
+	if err := idx.Train(); err != nil {
+		b.Fatalf("Train: %v", err)
+	}
+	q := searchtest.ClusteredVectors(1, testDim, 100, 0.5, 12)[0]
+
+	searchtest.BenchmarkExact(b, vecs, q)
+	for _, nprobe := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("ivf/nprobe=%d", nprobe), func(b *testing.B) {
+			for range b.N {
+				if _, err := idx.SearchNProbe(q, 10, nprobe, nil); err != nil {
+					b.Fatalf("Search: %v", err)
+				}
+			}
+		})
+	}
+}
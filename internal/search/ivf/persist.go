@@ -0,0 +1,228 @@
+package ivf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+/*
+ivf.idx layout (little-endian). Vectors are not duplicated on disk, they are
+read back from the store when the index is loaded.
+
+	magic "IVFF" | version u16 | reserved u16 | dim u32 | centroid count u32
+	list count u32 | count u32 | trained u32 | ID of the record at position count-1 u64
+	centroids: centroid count × dim × f32
+	per list: n u32, n × position u32
+	crc32 of everything above u32
+*/
+
+const fileVersion = 1
+
+const fixedSize = 36
+
+var fileMagic = []byte("IVFF")
+
+var ErrCorruptIndex = errors.New("ivf: corrupt index file")
+
+// Writes the centroids and posting lists to the index file, replacing it
+// atomically
+func (x *Index) Save() error {
+	if x.path == "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	_, err := x.WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+
+	tmp := x.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create index file: %w", err)
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write index file: %w", err)
+	}
+
+	err = os.Rename(tmp, x.path)
+	if err != nil {
+		return fmt.Errorf("failed to replace index file: %w", err)
+	}
+	return nil
+}
+
+// Serialises the index without its vectors
+func (x *Index) WriteTo(w io.Writer) (int64, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+
+	buf.Write(fileMagic)
+	buf.Write(le.AppendUint16(nil, fileVersion))
+	buf.Write(le.AppendUint16(nil, 0))
+	buf.Write(le.AppendUint32(nil, uint32(x.dim)))
+	buf.Write(le.AppendUint32(nil, uint32(x.nlists())))
+	buf.Write(le.AppendUint32(nil, uint32(len(x.lists))))
+	buf.Write(le.AppendUint32(nil, uint32(x.count)))
+	buf.Write(le.AppendUint32(nil, uint32(x.trained)))
+	buf.Write(le.AppendUint64(nil, x.lastID()))
+
+	for _, c := range x.centroids {
+		buf.Write(le.AppendUint32(nil, math.Float32bits(c)))
+	}
+	for _, l := range x.lists {
+		buf.Write(le.AppendUint32(nil, uint32(len(l.positions))))
+		for _, pos := range l.positions {
+			buf.Write(le.AppendUint32(nil, uint32(pos)))
+		}
+	}
+
+	buf.Write(le.AppendUint32(nil, crc32.ChecksumIEEE(buf.Bytes())))
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// ID of the last indexed record. Positions move when a store is compacted,
+// so saved posting lists are only reused if this still matches.
+func (x *Index) lastID() uint64 {
+	if x.store == nil {
+		return 0
+	}
+	id, _ := x.store.ID(x.count - 1)
+	return id
+}
+
+// Reads an index written by WriteTo. The posting lists come back with
+// positions only, vectors must be filled in separately.
+func (x *Index) readFrom(data []byte) (lastID uint64, err error) {
+	le := binary.LittleEndian
+	if len(data) < fixedSize+4 || !bytes.Equal(data[:4], fileMagic) {
+		return 0, ErrCorruptIndex
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != le.Uint32(data[len(data)-4:]) {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrCorruptIndex)
+	}
+	if v := le.Uint16(body[4:6]); v != fileVersion {
+		return 0, fmt.Errorf("%w: unsupported version %d", ErrCorruptIndex, v)
+	}
+
+	dim := int(le.Uint32(body[8:12]))
+	ncentroids := int(le.Uint32(body[12:16]))
+	nlists := int(le.Uint32(body[16:20]))
+	count := int(le.Uint32(body[20:24]))
+	trained := int(le.Uint32(body[24:28]))
+	lastID = le.Uint64(body[28:36])
+	if dim != x.dim {
+		return 0, fmt.Errorf("%w: built for %d-dim vectors, store holds %d", ErrCorruptIndex, dim, x.dim)
+	}
+	if nlists != max(ncentroids, 1) {
+		return 0, fmt.Errorf("%w: %d lists for %d centroids", ErrCorruptIndex, nlists, ncentroids)
+	}
+
+	p := body[fixedSize:]
+	if len(p) < ncentroids*dim*4 {
+		return 0, fmt.Errorf("%w: truncated centroids", ErrCorruptIndex)
+	}
+	var centroids []float32
+	if ncentroids > 0 {
+		centroids = make([]float32, ncentroids*dim)
+		for i := range centroids {
+			centroids[i] = math.Float32frombits(le.Uint32(p[i*4:]))
+		}
+	}
+	p = p[ncentroids*dim*4:]
+
+	lists := make([]list, nlists)
+	seen := 0
+	for i := range lists {
+		if len(p) < 4 {
+			return 0, fmt.Errorf("%w: truncated list %d", ErrCorruptIndex, i)
+		}
+		n := int(le.Uint32(p))
+		p = p[4:]
+		if len(p) < n*4 {
+			return 0, fmt.Errorf("%w: truncated list %d", ErrCorruptIndex, i)
+		}
+		lists[i].positions = make([]int32, n)
+		for j := range n {
+			pos := int32(le.Uint32(p[j*4:]))
+			if pos < 0 || int(pos) >= count {
+				return 0, fmt.Errorf("%w: list %d holds missing position %d", ErrCorruptIndex, i, pos)
+			}
+			lists[i].positions[j] = pos
+		}
+		p = p[n*4:]
+		seen += n
+	}
+	if seen != count || len(p) != 0 {
+		return 0, fmt.Errorf("%w: lists hold %d positions, expected %d", ErrCorruptIndex, seen, count)
+	}
+
+	x.centroids = centroids
+	x.lists = lists
+	x.count = count
+	x.trained = trained
+	return lastID, nil
+}
+
+// Loads the saved index and the vectors it covers. A missing or corrupt file
+// leaves the index untrained. If the store's positions have moved since the
+// file was saved the centroids are kept and the lists rebuilt from the store.
+func (x *Index) load(store *storage.Store) error {
+	data, err := os.ReadFile(x.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read index file: %w", err)
+	}
+
+	lastID, err := x.readFrom(data)
+	if err != nil {
+		return nil
+	}
+	if x.count > 0 && x.lastID() != lastID {
+		// Saved before a clear or compaction moved the positions
+		return x.Reset()
+	}
+
+	view, err := store.View()
+	if err != nil {
+		return err
+	}
+	defer view.Close()
+
+	if x.count > view.Len() {
+		return x.Reset()
+	}
+
+	for i, l := range x.lists {
+		x.lists[i].vectors = make([]float32, 0, len(l.positions)*x.dim)
+		for _, pos := range l.positions {
+			x.lists[i].vectors = append(x.lists[i].vectors, view.At(int(pos))...)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+/*
+Package kmeans clusters flat float32 vectors with Lloyd's algorithm and
+k-means++ seeding. It is shared by the IVF and product quantization indexes.
+
+Vectors are passed as a single dim-strided slice to avoid an allocation per
+vector, and centroids come back the same way.
+*/
+package kmeans
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+)
+
+const defaultMaxIter = 25
+
+var ErrTooFewVectors = errors.New("kmeans: fewer vectors than clusters")
+
+type Config struct {
+	K       int    // Number of clusters
+	MaxIter int    // Upper bound on Lloyd iterations, defaults to 25
+	Seed    uint64 // Seed for k-means++ seeding, so training is reproducible
+}
+
+// Clusters the n = len(data)/dim vectors in data into cfg.K groups and returns
+// the K*dim centroids. Training stops early once no assignment changes.
+func Train(data []float32, dim int, cfg Config) ([]float32, error) {
+	if dim <= 0 || len(data)%dim != 0 {
+		return nil, fmt.Errorf("kmeans: data length %d is not a multiple of dimension %d", len(data), dim)
+	}
+	n := len(data) / dim
+	if cfg.K <= 0 {
+		return nil, fmt.Errorf("kmeans: invalid cluster count %d", cfg.K)
+	}
+	if n < cfg.K {
+		return nil, fmt.Errorf("%w: %d vectors for %d clusters", ErrTooFewVectors, n, cfg.K)
+	}
+	if cfg.MaxIter <= 0 {
+		cfg.MaxIter = defaultMaxIter
+	}
+
+	rng := rand.New(rand.NewPCG(cfg.Seed, cfg.Seed^0x2545f4914f6cdd1d))
+	centroids := seed(data, dim, cfg.K, rng)
+
+	assign := make([]int, n)
+	for i := range assign {
+		assign[i] = -1
+	}
+	sums := make([]float64, cfg.K*dim)
+	counts := make([]int, cfg.K)
+
+	for range cfg.MaxIter {
+		changed := 0
+		for i := range n {
+			c, _ := Nearest(centroids, dim, data[i*dim:(i+1)*dim])
+			if c != assign[i] {
+				assign[i] = c
+				changed++
+			}
+		}
+		if changed == 0 {
+			break
+		}
+
+		clear(sums)
+		clear(counts)
+		for i, c := range assign {
+			counts[c]++
+			for j, x := range data[i*dim : (i+1)*dim] {
+				sums[c*dim+j] += float64(x)
+			}
+		}
+
+		for c := range cfg.K {
+			if counts[c] == 0 {
+				// Re-seed an empty cluster on a random vector
+				p := rng.IntN(n)
+				copy(centroids[c*dim:(c+1)*dim], data[p*dim:(p+1)*dim])
+				continue
+			}
+			for j := range dim {
+				centroids[c*dim+j] = float32(sums[c*dim+j] / float64(counts[c]))
+			}
+		}
+	}
+
+	return centroids, nil
+}
+
+// k-means++: each new centroid is a vector picked with probability
+// proportional to its squared distance from the closest centroid so far
+func seed(data []float32, dim int, k int, rng *rand.Rand) []float32 {
+	n := len(data) / dim
+	centroids := make([]float32, 0, k*dim)
+
+	first := rng.IntN(n)
+	centroids = append(centroids, data[first*dim:(first+1)*dim]...)
+
+	dists := make([]float64, n)
+	for i := range n {
+		dists[i] = float64(SquaredDistance(data[i*dim:(i+1)*dim], centroids[:dim]))
+	}
+
+	for c := 1; c < k; c++ {
+		total := 0.0
+		for _, d := range dists {
+			total += d
+		}
+
+		next := rng.IntN(n)
+		if total > 0 {
+			target := rng.Float64() * total
+			for i, d := range dists {
+				target -= d
+				if target <= 0 {
+					next = i
+					break
+				}
+			}
+		}
+
+		v := data[next*dim : (next+1)*dim]
+		centroids = append(centroids, v...)
+		for i := range n {
+			d := float64(SquaredDistance(data[i*dim:(i+1)*dim], v))
+			dists[i] = math.Min(dists[i], d)
+		}
+	}
+
+	return centroids
+}
+
+// Index of the centroid closest to v and its squared distance
+func Nearest(centroids []float32, dim int, v []float32) (int, float32) {
+	best := -1
+	bestDist := float32(math.Inf(1))
+	for c := range len(centroids) / dim {
+		d := SquaredDistance(v, centroids[c*dim:(c+1)*dim])
+		if d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best, bestDist
+}
+
+func SquaredDistance(a, b []float32) float32 {
+	var t float32
+	for i := range a {
+		d := a[i] - b[i]
+		t += d * d
+	}
+	return t
+}
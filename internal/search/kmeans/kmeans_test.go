@@ -0,0 +1,49 @@
+package kmeans
+
+import (
+	"errors"
+	"math/rand/v2"
+	"testing"
+)
+
+// Three tight blobs far apart should each get their own centroid
+func TestTrainFindsSeparatedClusters(t *testing.T) {
+	centres := [][]float32{{10, 0}, {0, 10}, {-10, -10}}
+	rng := rand.New(rand.NewPCG(1, 1))
+
+	var data []float32
+	for range 100 {
+		for _, c := range centres {
+			data = append(data, c[0]+float32(rng.NormFloat64()*0.1), c[1]+float32(rng.NormFloat64()*0.1))
+		}
+	}
+
+	centroids, err := Train(data, 2, Config{K: 3, Seed: 42})
+	if err != nil {
+		t.Fatalf("Train: %v", err)
+	}
+	if len(centroids) != 6 {
+		t.Fatalf("expected 3 centroids of dim 2, got %d floats", len(centroids))
+	}
+
+	seen := map[int]bool{}
+	for _, c := range centres {
+		idx, dist := Nearest(centroids, 2, c)
+		if dist > 0.1 {
+			t.Fatalf("no centroid near %v (closest at squared distance %v)", c, dist)
+		}
+		seen[idx] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected each blob to map to its own centroid, got %v", seen)
+	}
+}
+
+func TestTrainRejectsTooFewVectors(t *testing.T) {
+	if _, err := Train([]float32{1, 2, 3, 4}, 2, Config{K: 3}); !errors.Is(err, ErrTooFewVectors) {
+		t.Fatalf("expected ErrTooFewVectors, got %v", err)
+	}
+	if _, err := Train([]float32{1, 2, 3}, 2, Config{K: 1}); err == nil {
+		t.Fatalf("expected error for ragged data")
+	}
+}
@@ -0,0 +1,177 @@
+package pq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+)
+
+/*
+pq.idx layout (little-endian):
+
+	magic "PQIX" | version u16 | M u16 | dim u32 | count u32 | trained u8
+	reserved 3 bytes | ID of the record at position count-1 u64
+	codebooks: M × 256 × (dim/M) × f32, only when trained
+	codes: count × M bytes, only when trained
+	crc32 of everything above u32
+*/
+
+const fileVersion = 1
+
+const fixedSize = 28
+
+var fileMagic = []byte("PQIX")
+
+var ErrCorruptIndex = errors.New("pq: corrupt index file")
+
+// Writes the codebooks and codes to the index file, replacing it atomically
+func (x *Index) Save() error {
+	var buf bytes.Buffer
+	_, err := x.WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+
+	tmp := x.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create index file: %w", err)
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write index file: %w", err)
+	}
+
+	err = os.Rename(tmp, x.path)
+	if err != nil {
+		return fmt.Errorf("failed to replace index file: %w", err)
+	}
+	return nil
+}
+
+// Serialises the codebooks and codes
+func (x *Index) WriteTo(w io.Writer) (int64, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	le := binary.LittleEndian
+	buf := make([]byte, 0, fixedSize+len(x.codebooks)*4+len(x.codes)+4)
+
+	buf = append(buf, fileMagic...)
+	buf = le.AppendUint16(buf, fileVersion)
+	buf = le.AppendUint16(buf, uint16(x.cfg.M))
+	buf = le.AppendUint32(buf, uint32(x.dim))
+	buf = le.AppendUint32(buf, uint32(x.count))
+	if x.trained() {
+		buf = append(buf, 1, 0, 0, 0)
+	} else {
+		buf = append(buf, 0, 0, 0, 0)
+	}
+	buf = le.AppendUint64(buf, x.lastID())
+	for _, f := range x.codebooks {
+		buf = le.AppendUint32(buf, math.Float32bits(f))
+	}
+	buf = append(buf, x.codes...)
+	buf = le.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ID of the last indexed record. Positions move when a store is compacted,
+// so saved codes are only reused if this still matches.
+func (x *Index) lastID() uint64 {
+	id, _ := x.store.ID(x.count - 1)
+	return id
+}
+
+// Reads an index written by WriteTo
+func (x *Index) readFrom(data []byte) (lastID uint64, err error) {
+	le := binary.LittleEndian
+	if len(data) < fixedSize+4 || !bytes.Equal(data[:4], fileMagic) {
+		return 0, ErrCorruptIndex
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != le.Uint32(data[len(data)-4:]) {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrCorruptIndex)
+	}
+	if v := le.Uint16(body[4:6]); v != fileVersion {
+		return 0, fmt.Errorf("%w: unsupported version %d", ErrCorruptIndex, v)
+	}
+
+	m := int(le.Uint16(body[6:8]))
+	dim := int(le.Uint32(body[8:12]))
+	count := int(le.Uint32(body[12:16]))
+	trained := body[16] == 1
+	lastID = le.Uint64(body[20:28])
+	if dim != x.dim {
+		return 0, fmt.Errorf("%w: built for %d-dim vectors, store holds %d", ErrCorruptIndex, dim, x.dim)
+	}
+	if m <= 0 || dim%m != 0 {
+		return 0, fmt.Errorf("%w: %d subspaces do not divide dimension %d", ErrCorruptIndex, m, dim)
+	}
+
+	p := body[fixedSize:]
+	var codebooks []float32
+	var codes []byte
+	if trained {
+		booksLen := m * ksub * (dim / m)
+		if len(p) != booksLen*4+count*m {
+			return 0, fmt.Errorf("%w: expected %d codebook floats and %d codes", ErrCorruptIndex, booksLen, count)
+		}
+		codebooks = make([]float32, booksLen)
+		for i := range codebooks {
+			codebooks[i] = math.Float32frombits(le.Uint32(p[i*4:]))
+		}
+		codes = append([]byte(nil), p[booksLen*4:]...)
+	} else if len(p) != 0 {
+		return 0, fmt.Errorf("%w: untrained index holds data", ErrCorruptIndex)
+	}
+
+	x.cfg.M = m
+	x.dsub = dim / m
+	x.codebooks = codebooks
+	x.codes = codes
+	x.count = count
+	return lastID, nil
+}
+
+// Loads the saved index. A missing or corrupt file leaves the index
+// untrained. If the store's positions have moved since the file was saved the
+// codebooks are kept and the codes rebuilt from the store.
+func (x *Index) load() error {
+	data, err := os.ReadFile(x.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read index file: %w", err)
+	}
+
+	lastID, err := x.readFrom(data)
+	if err != nil {
+		return nil
+	}
+
+	n, err := x.store.Len()
+	if err != nil {
+		return err
+	}
+	if x.count > n || (x.count > 0 && x.lastID() != lastID) {
+		// Saved before a clear or compaction moved the positions
+		return x.Reset()
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+/*
+Package pq implements product quantization for compressed vector search.
+
+Each vector is split into M contiguous subvectors and every subvector is
+replaced by the index of its nearest centroid in a per-subspace codebook of up
+to 256 entries trained with k-means, so a vector is stored in M bytes. With
+the default M of dim/8 a 384-dim embedding takes 48 bytes.
+
+Searches use asymmetric distance computation: the query is not quantized.
+Instead a lookup table holds the dot product of each query subvector with
+every centroid of its subspace, and the score of a stored vector is the sum
+of M table entries picked by its codes.
+
+The index attaches to a storage.Store. It has to be trained before it can
+encode anything. After that new appends are encoded with the existing
+codebooks. It is serialised next to data.bin as pq.idx.
+*/
+package pq
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+	"github.com/mateosanchezl/go-vect/internal/search"
+	"github.com/mateosanchezl/go-vect/internal/search/kmeans"
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+const FileName = "pq.idx"
+
+// Centroids per subspace, so every code fits in a byte
+const ksub = 256
+
+const (
+	defaultSubDim     = 8
+	defaultSampleSize = 10000
+	defaultMaxIter    = 15
+)
+
+var (
+	ErrNotTrained     = errors.New("pq: index is not trained, run vect index train -type pq")
+	ErrNothingToTrain = errors.New("pq: no vectors to train on")
+)
+
+type Config struct {
+	M          int    // Subspaces, must divide the dimension. Defaults to dim/8.
+	SampleSize int    // Vectors the codebooks are trained on, defaults to 10000
+	MaxIter    int    // k-means iterations per subspace, defaults to 15
+	Seed       uint64 // Seed for sampling and k-means++, so training is reproducible
+}
+
+func (c Config) withDefaults(dim int) Config {
+	if c.M <= 0 {
+		c.M = max(dim/defaultSubDim, 1)
+	}
+	if c.SampleSize <= 0 {
+		c.SampleSize = defaultSampleSize
+	}
+	if c.MaxIter <= 0 {
+		c.MaxIter = defaultMaxIter
+	}
+	return c
+}
+
+type Index struct {
+	cfg   Config
+	dim   int
+	dsub  int // Length of each subvector
+	path  string
+	store *storage.Store
+
+	mu        sync.RWMutex // Held for writing by Add, Reset and the end of Train, so searches can run alongside appends
+	codebooks []float32    // M × ksub × dsub, empty while untrained
+	codes     []byte       // M codes per position, empty while untrained
+	count     int          // Number of positions indexed
+}
+
+// Loads the index saved in the store's directory, or starts a new untrained
+// one, and attaches it to the store so it follows future appends. A saved
+// index keeps the M it was trained with.
+func Open(store *storage.Store, cfg Config) (*Index, error) {
+	cfg = cfg.withDefaults(store.Dimension())
+	if store.Dimension()%cfg.M != 0 {
+		return nil, fmt.Errorf("pq: %d subspaces do not divide dimension %d", cfg.M, store.Dimension())
+	}
+
+	idx := &Index{
+		cfg:   cfg,
+		dim:   store.Dimension(),
+		dsub:  store.Dimension() / cfg.M,
+		path:  filepath.Join(store.Dir(), FileName),
+		store: store,
+	}
+
+	err := idx.load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.AttachIndex(idx)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (x *Index) Config() Config {
+	return x.cfg
+}
+
+// Number of positions in the index
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.count
+}
+
+func (x *Index) Trained() bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.trained()
+}
+
+func (x *Index) trained() bool {
+	return len(x.codebooks) > 0
+}
+
+// Bytes each encoded vector takes up
+func (x *Index) CodeSize() int {
+	return x.cfg.M
+}
+
+// Drops every code. Codebooks are kept, so an index rebuilt after a
+// compaction stays trained.
+func (x *Index) Reset() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.codes = x.codes[:0]
+	x.count = 0
+	return nil
+}
+
+// Encodes the vector at position pos, which must be the next unindexed
+// position. Untrained indexes only count it, Train encodes it later.
+func (x *Index) Add(pos int, v embedding.EmbeddingVector) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if pos != x.count {
+		return fmt.Errorf("pq: expected position %d, got %d", x.count, pos)
+	}
+	if len(v) != x.dim {
+		return fmt.Errorf("pq: vector must be of length %d, got %d", x.dim, len(v))
+	}
+
+	if x.trained() {
+		x.codes = append(x.codes, x.encode(v)...)
+	}
+	x.count++
+	return nil
+}
+
+func (x *Index) codebook(m int) []float32 {
+	return x.codebooks[m*ksub*x.dsub : (m+1)*ksub*x.dsub]
+}
+
+func (x *Index) encode(v []float32) []byte {
+	code := make([]byte, x.cfg.M)
+	for m := range x.cfg.M {
+		c, _ := kmeans.Nearest(x.codebook(m), x.dsub, v[m*x.dsub:(m+1)*x.dsub])
+		code[m] = byte(c)
+	}
+	return code
+}
+
+// Trains a codebook per subspace over a sample of the store's live vectors,
+// then encodes every indexed position. Subspaces are trained in parallel, and
+// appends carry on while they are.
+func (x *Index) Train() error {
+	view, err := x.store.View()
+	if err != nil {
+		return err
+	}
+	defer func() { view.Close() }()
+
+	n := min(x.Len(), view.Len())
+	live := make([]int, 0, n)
+	for pos := range n {
+		if !x.store.IsDeleted(pos) {
+			live = append(live, pos)
+		}
+	}
+	if len(live) == 0 {
+		return ErrNothingToTrain
+	}
+
+	rng := rand.New(rand.NewPCG(x.cfg.Seed, x.cfg.Seed^0xbb67ae8584caa73b))
+	if len(live) > x.cfg.SampleSize {
+		rng.Shuffle(len(live), func(i, j int) { live[i], live[j] = live[j], live[i] })
+		live = live[:x.cfg.SampleSize]
+	}
+	k := min(ksub, len(live))
+
+	codebooks := make([]float32, x.cfg.M*ksub*x.dsub)
+	errs := make([]error, x.cfg.M)
+	subspaces := make(chan int)
+	var wg sync.WaitGroup
+	for range runtime.GOMAXPROCS(0) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sample := make([]float32, 0, len(live)*x.dsub)
+			for m := range subspaces {
+				sample = sample[:0]
+				for _, pos := range live {
+					sample = append(sample, view.At(pos)[m*x.dsub:(m+1)*x.dsub]...)
+				}
+				centroids, err := kmeans.Train(sample, x.dsub, kmeans.Config{K: k, MaxIter: x.cfg.MaxIter, Seed: x.cfg.Seed + uint64(m)})
+				if err != nil {
+					errs[m] = err
+					continue
+				}
+				// Unused slots stay zero when there are fewer than 256 vectors
+				copy(codebooks[m*ksub*x.dsub:], centroids)
+			}
+		}()
+	}
+	for m := range x.cfg.M {
+		subspaces <- m
+	}
+	close(subspaces)
+	wg.Wait()
+
+	err = errors.Join(errs...)
+	if err != nil {
+		return fmt.Errorf("failed to train codebooks: %w", err)
+	}
+
+	// Positions appended while training need a view that covers them. The
+	// store's lock comes before the index's, so the view is opened first.
+	for {
+		x.mu.Lock()
+		if x.count <= view.Len() {
+			break
+		}
+		x.mu.Unlock()
+
+		view.Close()
+		view, err = x.store.View()
+		if err != nil {
+			return err
+		}
+	}
+	defer x.mu.Unlock()
+
+	x.codebooks = codebooks
+	x.codes = make([]byte, 0, x.count*x.cfg.M)
+	for pos := range x.count {
+		x.codes = append(x.codes, x.encode(view.At(pos))...)
+	}
+	return nil
+}
+
+// Finds the k positions with the highest approximate dot product with query
+func (x *Index) Search(query embedding.EmbeddingVector, k int, accept func(pos int) bool) ([]search.SimilarityResult, error) {
+	if len(query) != x.dim {
+		return nil, fmt.Errorf("pq: query must be of length %d, got %d", x.dim, len(query))
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if x.count == 0 || k <= 0 {
+		return []search.SimilarityResult{}, nil
+	}
+	if !x.trained() {
+		return nil, ErrNotTrained
+	}
+
+	lut := x.lookupTable(query)
+
+	results := search.MinHeap{}
+	results.Init(k)
+	for pos := range x.count {
+		if accept != nil && !accept(pos) {
+			continue
+		}
+		code := x.codes[pos*x.cfg.M : (pos+1)*x.cfg.M]
+		var sim float32
+		for m, c := range code {
+			sim += lut[m*ksub+int(c)]
+		}
+		results.Insert(search.SimilarityResult{CosSim: sim, Pos: pos})
+	}
+
+	results.Sort()
+	return results.H, nil
+}
+
+// Dot product of each query subvector with every centroid of its subspace
+func (x *Index) lookupTable(query []float32) []float32 {
+	lut := make([]float32, x.cfg.M*ksub)
+	for m := range x.cfg.M {
+		q := query[m*x.dsub : (m+1)*x.dsub]
+		book := x.codebook(m)
+		for c := range ksub {
+			centroid := book[c*x.dsub : (c+1)*x.dsub]
+			var t float32
+			for i := range q {
+				t += q[i] * centroid[i]
+			}
+			lut[m*ksub+c] = t
+		}
+	}
+	return lut
+}
@@ -0,0 +1,156 @@
+package pq
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/search"
+	"github.com/mateosanchezl/go-vect/internal/search/searchtest"
+)
+
+const testDim = 64
+
+// Measures recall@k of PQ lookup-table search against the brute-force path,
+// on its own and with the top candidates rescored at full precision
+func TestRecallAgainstExactSearch(t *testing.T) {
+	store := searchtest.OpenStore(t, t.TempDir(), testDim)
+	defer store.Close()
+
+	idx, err := Open(store, Config{M: 16, Seed: 1})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	vecs := searchtest.ClusteredVectors(3050, testDim, 40, 0.5, 7)
+	searchtest.FillStore(t, store, vecs[:3000])
+	if err := idx.Train(); err != nil {
+		t.Fatalf("Train: %v", err)
+	}
+	if idx.CodeSize() != 16 {
+		t.Fatalf("expected 16-byte codes, got %d", idx.CodeSize())
+	}
+
+	const k = 10
+	recall := func(opts ...search.Option) float64 {
+		return searchtest.Recall(t, store, vecs[3000:], k, append(opts, search.WithIndex(idx))...)
+	}
+
+	plain := recall()
+	rescored := recall(search.Rescore(10 * k))
+	t.Logf("recall@%d = %.3f, rescoring top %d = %.3f", k, plain, 10*k, rescored)
+	if plain < 0.35 || rescored < 0.95 {
+		t.Fatalf("expected recall@%d of at least 0.35 and 0.95 rescored, got %.3f and %.3f", k, plain, rescored)
+	}
+}
+
+func TestUntrainedIndexRefusesToSearch(t *testing.T) {
+	store := searchtest.OpenStore(t, t.TempDir(), testDim)
+	defer store.Close()
+
+	searchtest.FillStore(t, store, searchtest.ClusteredVectors(10, testDim, 2, 0.5, 1))
+	idx, err := Open(store, Config{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if idx.Len() != 10 || idx.Trained() {
+		t.Fatalf("expected 10 unencoded positions, got %d (trained %v)", idx.Len(), idx.Trained())
+	}
+	if _, err := idx.Search(searchtest.ClusteredVectors(1, testDim, 2, 0.5, 1)[0], 1, nil); !errors.Is(err, ErrNotTrained) {
+		t.Fatalf("expected ErrNotTrained, got %v", err)
+	}
+}
+
+func TestOpenRejectsUnevenSubspaces(t *testing.T) {
+	store := searchtest.OpenStore(t, t.TempDir(), testDim)
+	defer store.Close()
+
+	if _, err := Open(store, Config{M: 7}); err == nil {
+		t.Fatalf("expected error for 7 subspaces of a 64-dim vector")
+	}
+}
+
+func TestIndexPersistsAndEncodesAppends(t *testing.T) {
+	dir := t.TempDir()
+	store := searchtest.OpenStore(t, dir, testDim)
+	idx, err := Open(store, Config{M: 16, Seed: 1})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	vecs := searchtest.ClusteredVectors(600, testDim, 10, 0.5, 5)
+	searchtest.FillStore(t, store, vecs[:500])
+	if err := idx.Train(); err != nil {
+		t.Fatalf("Train: %v", err)
+	}
+	searchtest.FillStore(t, store, vecs[500:])
+
+	before, err := idx.Search(vecs[550], 5, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, FileName)); err != nil {
+		t.Fatalf("expected index file to be saved on close: %v", err)
+	}
+
+	store = searchtest.OpenStore(t, dir, testDim)
+	defer store.Close()
+	loaded, err := Open(store, Config{})
+	if err != nil {
+		t.Fatalf("reopen index: %v", err)
+	}
+	if loaded.Len() != 600 || loaded.Config().M != 16 {
+		t.Fatalf("expected 600 codes with M=16, got %d with M=%d", loaded.Len(), loaded.Config().M)
+	}
+
+	after, err := loaded.Search(vecs[550], 5, nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	for i := range before {
+		if before[i].Pos != after[i].Pos {
+			t.Fatalf("result %d differs after reload: %d vs %d", i, before[i].Pos, after[i].Pos)
+		}
+	}
+
+	// Compaction re-encodes with the codebooks already trained
+	id, _ := store.ID(0)
+	if err := store.Delete(id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if loaded.Len() != 599 || !loaded.Trained() {
+		t.Fatalf("expected 599 codes after compaction, got %d (trained %v)", loaded.Len(), loaded.Trained())
+	}
+}
+
+// Compares lookup-table search over the codes with a full heap scan over the
+// same float32 vectors, leaving out the metadata lookups both paths share
+func BenchmarkSearch(b *testing.B) {
+	store := searchtest.OpenStore(b, b.TempDir(), testDim)
+	defer store.Close()
+
+	idx, err := Open(store, Config{Seed: 1})
+	if err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+	vecs := searchtest.ClusteredVectors(20000, testDim, 100, 0.5, 11)
+	searchtest.FillStore(b, store, vecs)
+	if err := idx.Train(); err != nil {
+		b.Fatalf("Train: %v", err)
+	}
+	q := searchtest.ClusteredVectors(1, testDim, 100, 0.5, 12)[0]
+
+	searchtest.BenchmarkExact(b, vecs, q)
+	b.Run("pq", func(b *testing.B) {
+		for range b.N {
+			if _, err := idx.Search(q, 10, nil); err != nil {
+				b.Fatalf("Search: %v", err)
+			}
+		}
+	})
+}
@@ -1,11 +1,7 @@
 package search
 
 import (
-	"encoding/binary"
-	"encoding/json"
-	"math"
-	"os"
-	"strings"
+	"errors"
 
 	"github.com/mateosanchezl/go-vect/internal/embedding"
 	"github.com/mateosanchezl/go-vect/internal/storage"
@@ -19,12 +15,63 @@ type SimilarityResult struct {
 type TopKSearchResult struct {
 	CosSim float32
 	Text   string
+	Meta   storage.EmbeddingMetaData // Where the chunk came from, Text included
+
+	Parent  *storage.Document           // Document the chunk came from, with WithParents
+	Window  []storage.EmbeddingMetaData // The chunk and its neighbours in order, with WithWindow
+	Context string                      // Text of Window, with WithWindow
 }
 
-func SearchTopKSimilar(query string, k int, model embedding.EmbeddingModel) (results []TopKSearchResult, err error) {
-	evs, err := readVectors()
-	if err != nil {
-		return nil, err
+// An approximate nearest-neighbour index over the vectors of a store. Search
+// returns up to k positions most similar to the normalised query, best first,
+// only considering positions for which accept returns true.
+type Index interface {
+	Search(query embedding.EmbeddingVector, k int, accept func(pos int) bool) ([]SimilarityResult, error)
+}
+
+type options struct {
+	index   Index
+	exact   bool
+	rescore int
+	filter  Filter
+	parents bool
+	window  int
+}
+
+// Configures a single call to SearchTopKSimilar
+type Option func(*options)
+
+// Searches with an approximate index instead of scanning every vector
+func WithIndex(idx Index) Option {
+	return func(o *options) {
+		o.index = idx
+	}
+}
+
+// Scans every vector with the brute-force path. This is the default, except
+// for SearchSegments, where it skips the segments' own indexes.
+func Exact() Option {
+	return func(o *options) {
+		o.index = nil
+		o.exact = true
+	}
+}
+
+// Collects the top n candidates (at least k) from the quantized vectors or
+// index and reorders them by their full-precision similarity, which needs a
+// store that can return float32 vectors. n <= 0 turns rescoring off.
+func Rescore(n int) Option {
+	return func(o *options) {
+		o.rescore = n
+	}
+}
+
+// Embeds query and returns the k records of store most similar to it, best
+// first. store may be a file-backed Store or an in-memory MemStore.
+func SearchTopKSimilar(store storage.VectorStore, query string, k int, model embedding.EmbeddingModel, opts ...Option) (results []TopKSearchResult, err error) {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
 	}
 
 	qv, err := model.Embed(query)
@@ -33,87 +80,169 @@ func SearchTopKSimilar(query string, k int, model embedding.EmbeddingModel) (res
 	}
 	qv.Normalise()
 
-	mh := MinHeap{}
-	mh.Init(k)
-	for i, cv := range evs {
-		sim, err := cv.NormedCosineSimilarity(qv)
-		mh.Insert(SimilarityResult{CosSim: sim, Pos: i})
+	top, err := topK(store, o.index, qv, k, o)
+	if err != nil {
+		return nil, err
+	}
+	results, err = fetch(store, top)
+	if err != nil {
+		return nil, err
+	}
+	return results, expand([]storage.VectorStore{store}, results, o)
+}
+
+// Scores the store against a normalised query, returning the best k
+// positions, through idx unless it is nil
+func topK(store storage.VectorStore, idx Index, qv embedding.EmbeddingVector, k int, o options) (top []SimilarityResult, err error) {
+	candidates := k
+	if o.rescore > 0 {
+		candidates = max(o.rescore, k)
+	}
+
+	var plan *filterPlan
+	if o.filter != nil {
+		plan, err = newFilterPlan(store, o.filter)
 		if err != nil {
 			return nil, err
 		}
 	}
-	mh.Sort()
 
-	md, err := readMetadata()
+	switch {
+	case plan != nil && plan.selective():
+		// Few records match, scoring just those beats any index
+		top, err = bitmapTopK(store, qv, candidates, plan)
+	case idx != nil:
+		accept := func(pos int) bool { return !store.IsDeleted(pos) }
+		if plan != nil {
+			accept = func(pos int) bool { return !store.IsDeleted(pos) && plan.match(pos) }
+		}
+		top, err = idx.Search(qv, candidates, accept)
+	default:
+		var accept func(pos int) bool
+		if plan != nil {
+			accept = plan.match
+		}
+		top, err = exactTopK(store, qv, candidates, accept)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	out := make([]TopKSearchResult, k)
-	for i, rs := range mh.H {
-		var record storage.EmbeddingMetaData
-		json.Unmarshal([]byte(md[rs.Pos]), &record)
-		out[i] = TopKSearchResult{
-			Text:   record.Text,
-			CosSim: rs.CosSim,
+	if o.rescore > 0 {
+		return rescore(store, qv, top, k)
+	}
+	return top, nil
+}
+
+// Reads the records behind scored positions
+func fetch(store storage.VectorStore, top []SimilarityResult) ([]TopKSearchResult, error) {
+	out := make([]TopKSearchResult, 0, len(top))
+	for _, rs := range top {
+		record, err := store.Get(rs.Pos)
+		var corrupt *storage.ErrCorruptRecord
+		if errors.As(err, &corrupt) && store.Lenient() {
+			continue
+		}
+		if errors.Is(err, storage.ErrNotFound) {
+			// Deleted by another writer since it was scored
+			continue
+		}
+		if err != nil {
+			return nil, err
 		}
+		out = append(out, TopKSearchResult{
+			Text:   record.Meta.Text,
+			CosSim: rs.CosSim,
+			Meta:   record.Meta,
+		})
 	}
 
 	return out, nil
 }
 
-func readVectors() (evs []embedding.EmbeddingVector, err error) {
-	evs = []embedding.EmbeddingVector{}
-
-	data, err := os.ReadFile(os.Getenv("VECTOR_DB_PATH"))
+// Brute-force scan over every live vector in the store. Quantized vectors are
+// scored in place rather than widened first. Each vector's checksum is checked
+// before it is scored. accept, if set, is only asked about vectors that score
+// high enough to enter the heap.
+func exactTopK(store storage.VectorStore, qv embedding.EmbeddingVector, k int, accept func(pos int) bool) ([]SimilarityResult, error) {
+	view, err := store.View()
 	if err != nil {
-		return evs, err
+		return nil, err
 	}
+	defer view.Close()
 
-	bytesPerVect := 384 * 4
-
-	n := len(data) / bytesPerVect
-	ofs := 0
-
-	for range n {
-		vect := []float32{}
-		for i := 0; i < bytesPerVect; i += 4 {
-			fl_bytes := data[ofs+i : ofs+i+4]
-			bits := binary.LittleEndian.Uint32(fl_bytes)
-			vf := math.Float32frombits(bits)
-			vect = append(vect, vf)
+	mh := MinHeap{}
+	mh.Init(k)
+	score := view.Scorer(qv)
+	// Positions come from the store so deleted records leave gaps
+	for pos := range view.Len() {
+		if store.IsDeleted(pos) {
+			continue
 		}
-		v, err := embedding.NewVector(vect, 384)
+		ok, err := view.Verify(pos)
 		if err != nil {
-			return evs, err
+			return nil, err
+		}
+		if !ok {
+			continue
 		}
-		evs = append(evs, v)
-		ofs += bytesPerVect
+		sim := score(pos)
+		if !mh.Admits(sim) || (accept != nil && !accept(pos)) {
+			continue
+		}
+		mh.Insert(SimilarityResult{CosSim: sim, Pos: pos})
 	}
+	mh.Sort()
 
-	return evs, nil
+	return mh.H, nil
 }
 
-func readMetadata() (lines []string, err error) {
-	md, err := os.ReadFile(os.Getenv("METADATA_DB_PATH"))
+// Scores only the positions in a selective filter's bitmap
+func bitmapTopK(store storage.VectorStore, qv embedding.EmbeddingVector, k int, plan *filterPlan) ([]SimilarityResult, error) {
+	view, err := store.View()
 	if err != nil {
-		if os.IsNotExist(err) {
-			_, err = os.Create(os.Getenv("METADATA_DB_PATH")) // Create file if it doesn't exist
-			if err != nil {
-				return nil, err
-			}
-			return []string{}, nil
-		}
+		return nil, err
 	}
+	defer view.Close()
 
-	if len(md) == 0 {
-		return []string{}, nil
+	mh := MinHeap{}
+	mh.Init(k)
+	score := view.Scorer(qv)
+	n := view.Len()
+	plan.each(func(pos int) {
+		if pos >= n || err != nil {
+			return
+		}
+		var ok bool
+		ok, err = view.Verify(pos)
+		if ok {
+			mh.Insert(SimilarityResult{CosSim: score(pos), Pos: pos})
+		}
+	})
+	if err != nil {
+		return nil, err
 	}
+	mh.Sort()
+
+	return mh.H, nil
+}
 
-	lines = strings.Split(strings.TrimSpace(string(md)), "\n")
-	if len(lines) == 0 {
-		return []string{}, nil
+// Rescores candidates against full-precision vectors, keeping the best k
+func rescore(store storage.VectorStore, qv embedding.EmbeddingVector, candidates []SimilarityResult, k int) ([]SimilarityResult, error) {
+	mh := MinHeap{}
+	mh.Init(k)
+	for _, c := range candidates {
+		v, err := store.Float32(c.Pos)
+		if err != nil {
+			return nil, err
+		}
+		sim, err := v.NormedCosineSimilarity(qv)
+		if err != nil {
+			return nil, err
+		}
+		mh.Insert(SimilarityResult{CosSim: sim, Pos: c.Pos})
 	}
+	mh.Sort()
 
-	return lines, nil
+	return mh.H, nil
 }
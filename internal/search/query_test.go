@@ -2,6 +2,9 @@ package search
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
 	"strings"
@@ -13,14 +16,15 @@ import (
 
 const testVectorLength = 384
 
-func setupSearchEnv(t *testing.T) (string, string) {
+func setupSearchStore(t *testing.T) (*storage.Store, string) {
 	t.Helper()
 	dir := t.TempDir()
-	vectorPath := filepath.Join(dir, "vectors.bin")
-	metaPath := filepath.Join(dir, "metadata.jsonl")
-	t.Setenv("VECTOR_DB_PATH", vectorPath)
-	t.Setenv("METADATA_DB_PATH", metaPath)
-	return vectorPath, metaPath
+	store, err := storage.Open(dir, storage.Options{Dimension: testVectorLength})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, filepath.Join(dir, "metadata.jsonl")
 }
 
 func basisVector(idx int, value float32) embedding.EmbeddingVector {
@@ -29,39 +33,63 @@ func basisVector(idx int, value float32) embedding.EmbeddingVector {
 	return v
 }
 
-func TestReadMetadataCreatesFileWhenMissing(t *testing.T) {
-	_, metaPath := setupSearchEnv(t)
+func TestSearchEmptyStore(t *testing.T) {
+	store, metaPath := setupSearchStore(t)
 
-	lines, err := readMetadata()
+	results, err := SearchTopKSimilar(store, "q", 3, &fakeModel{vector: basisVector(0, 1)})
 	if err != nil {
-		t.Fatalf("readMetadata: %v", err)
+		t.Fatalf("SearchTopKSimilar: %v", err)
 	}
-	if len(lines) != 0 {
-		t.Fatalf("expected no metadata lines, got %d", len(lines))
+	if len(results) != 0 {
+		t.Fatalf("expected no results, got %d", len(results))
 	}
 
 	if _, err := os.Stat(metaPath); err != nil {
-		t.Fatalf("metadata file should exist after readMetadata: %v", err)
+		t.Fatalf("metadata file should exist after opening the store: %v", err)
 	}
 }
 
-func TestReadVectorsReturnsStoredEmbeddings(t *testing.T) {
-	_, _ = setupSearchEnv(t)
+func TestSearchReturnsStoredEmbedding(t *testing.T) {
+	store, _ := setupSearchStore(t)
 
 	vec := basisVector(0, 1)
-	if err := storage.StoreEmbedding(vec, "doc"); err != nil {
-		t.Fatalf("StoreEmbedding: %v", err)
+	if _, err := store.Append(vec, "doc"); err != nil {
+		t.Fatalf("Append: %v", err)
 	}
 
-	evs, err := readVectors()
+	results, err := SearchTopKSimilar(store, "q", 5, &fakeModel{vector: basisVector(0, 1)})
 	if err != nil {
-		t.Fatalf("readVectors: %v", err)
+		t.Fatalf("SearchTopKSimilar: %v", err)
 	}
-	if len(evs) != 1 {
-		t.Fatalf("expected 1 embedding, got %d", len(evs))
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+	if results[0].Text != "doc" || results[0].CosSim < 0.9999 {
+		t.Fatalf("expected exact match on doc, got %+v", results[0])
+	}
+}
+
+func TestSearchResultsCarryMetadata(t *testing.T) {
+	store, _ := setupSearchStore(t)
+
+	md := storage.EmbeddingMetaData{
+		Text:   "chunk",
+		Source: "file:///notes/a.md",
+		Chunk:  2,
+		Span:   &storage.Span{ByteStart: 10, ByteEnd: 15, RuneStart: 10, RuneEnd: 15},
+	}
+	ids, err := store.AppendBatchMeta([]embedding.EmbeddingVector{basisVector(0, 1)}, []storage.EmbeddingMetaData{md})
+	if err != nil {
+		t.Fatalf("AppendBatchMeta: %v", err)
+	}
+
+	results, err := SearchTopKSimilar(store, "q", 1, &fakeModel{vector: basisVector(0, 1)})
+	if err != nil {
+		t.Fatalf("SearchTopKSimilar: %v", err)
 	}
-	if len(evs[0]) != testVectorLength {
-		t.Fatalf("expected embedding length %d, got %d", testVectorLength, len(evs[0]))
+	got := results[0].Meta
+	if got.ID != ids[0] || got.Source != md.Source || got.Chunk != 2 || got.Span == nil || got.Span.ByteEnd != 15 {
+		t.Fatalf("expected result metadata %+v, got %+v", md, got)
 	}
 }
 
@@ -81,7 +109,7 @@ func (f *fakeModel) EmbedBatch(chunks []string) ([]embedding.EmbeddingVector, er
 }
 
 func TestSearchTopKSimilarReturnsSortedResults(t *testing.T) {
-	_, metaPath := setupSearchEnv(t)
+	store, metaPath := setupSearchStore(t)
 
 	docs := []struct {
 		vector embedding.EmbeddingVector
@@ -93,8 +121,8 @@ func TestSearchTopKSimilarReturnsSortedResults(t *testing.T) {
 	}
 
 	for _, doc := range docs {
-		if err := storage.StoreEmbedding(doc.vector, doc.text); err != nil {
-			t.Fatalf("StoreEmbedding %s: %v", doc.text, err)
+		if _, err := store.Append(doc.vector, doc.text); err != nil {
+			t.Fatalf("Append %s: %v", doc.text, err)
 		}
 	}
 
@@ -102,7 +130,7 @@ func TestSearchTopKSimilarReturnsSortedResults(t *testing.T) {
 	queryVec[0] = 0.5
 	model := &fakeModel{vector: queryVec}
 
-	results, err := SearchTopKSimilar("q", 2, model)
+	results, err := SearchTopKSimilar(store, "q", 2, model)
 	if err != nil {
 		t.Fatalf("SearchTopKSimilar: %v", err)
 	}
@@ -137,6 +165,249 @@ func TestSearchTopKSimilarReturnsSortedResults(t *testing.T) {
 	}
 }
 
+func TestSearchTopKSimilarSkipsDeleted(t *testing.T) {
+	store, _ := setupSearchStore(t)
+
+	closest, err := store.Append(basisVector(0, 1), "closest")
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if _, err := store.Append(basisVector(1, 1), "other"); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := store.Delete(closest); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	results, err := SearchTopKSimilar(store, "q", 2, &fakeModel{vector: basisVector(0, 1)})
+	if err != nil {
+		t.Fatalf("SearchTopKSimilar: %v", err)
+	}
+	if len(results) != 1 || results[0].Text != "other" {
+		t.Fatalf("expected only the live record, got %+v", results)
+	}
+}
+
+func TestSearchChecksumModes(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.Open(dir, storage.Options{Dimension: testVectorLength})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	for i, text := range []string{"bit rot", "torn", "intact", "unrelated"} {
+		if _, err := store.Append(basisVector(i/3, 1), text); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	headerSize := store.Header().Size
+	store.Close()
+
+	// Corrupt a byte of the first vector and the text of the second record
+	data, _ := os.ReadFile(filepath.Join(dir, "data.bin"))
+	data[headerSize+1] ^= 0x10
+	os.WriteFile(filepath.Join(dir, "data.bin"), data, 0o644)
+	md, _ := os.ReadFile(filepath.Join(dir, "metadata.jsonl"))
+	os.WriteFile(filepath.Join(dir, "metadata.jsonl"), []byte(strings.Replace(string(md), `"torn"`, `"tom!"`, 1)), 0o644)
+
+	model := &fakeModel{vector: basisVector(0, 1)}
+	for _, mode := range []storage.VerifyMode{storage.VerifyStrict, storage.VerifyLenient} {
+		store, err := storage.Open(dir, storage.Options{Verify: mode})
+		if err != nil {
+			t.Fatalf("open store: %v", err)
+		}
+		defer store.Close()
+
+		for _, opt := range []Option{Exact(), WithIndex(scanIndex{store: store})} {
+			results, err := SearchTopKSimilar(store, "q", 2, model, opt)
+			if mode == storage.VerifyStrict {
+				var corrupt *storage.ErrCorruptRecord
+				if !errors.As(err, &corrupt) || corrupt.Pos != 0 {
+					t.Fatalf("strict: expected record 0 to be reported corrupt, got %v", err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("lenient: SearchTopKSimilar: %v", err)
+			}
+			if len(results) != 1 || results[0].Text != "intact" {
+				t.Fatalf("lenient: expected only the intact record, got %+v", results)
+			}
+		}
+	}
+}
+
+func randomUnitVectors(n int, seed uint64) []embedding.EmbeddingVector {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	out := make([]embedding.EmbeddingVector, n)
+	for i := range out {
+		v := make(embedding.EmbeddingVector, testVectorLength)
+		for j := range v {
+			v[j] = float32(rng.NormFloat64())
+		}
+		v.Normalise()
+		out[i] = v
+	}
+	return out
+}
+
+func openFilledStore(t testing.TB, opts storage.Options, vecs []embedding.EmbeddingVector) *storage.Store {
+	t.Helper()
+	opts.Dimension = testVectorLength
+	store, err := storage.Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	texts := make([]string, len(vecs))
+	for i := range texts {
+		texts[i] = fmt.Sprintf("doc-%d", i)
+	}
+	if _, err := store.AppendBatch(vecs, texts); err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+	return store
+}
+
+// Measures how much recall@10 int8 storage loses against float32, with and
+// without rescoring the top candidates at full precision
+func TestInt8RecallAgainstFloat32(t *testing.T) {
+	vecs := randomUnitVectors(2000, 1)
+	exactStore := openFilledStore(t, storage.Options{}, vecs)
+	int8Store := openFilledStore(t, storage.Options{DType: storage.DTypeInt8, KeepFloat32: true}, vecs)
+
+	const k = 10
+	queries := randomUnitVectors(50, 2)
+	recall := func(opts ...Option) float64 {
+		hits := 0
+		for _, q := range queries {
+			model := &fakeModel{vector: q}
+			want, err := SearchTopKSimilar(exactStore, "q", k, model)
+			if err != nil {
+				t.Fatalf("float32 search: %v", err)
+			}
+			got, err := SearchTopKSimilar(int8Store, "q", k, model, opts...)
+			if err != nil {
+				t.Fatalf("int8 search: %v", err)
+			}
+
+			expected := map[string]bool{}
+			for _, r := range want {
+				expected[r.Text] = true
+			}
+			for _, r := range got {
+				if expected[r.Text] {
+					hits++
+				}
+			}
+		}
+		return float64(hits) / float64(k*len(queries))
+	}
+
+	plain := recall()
+	rescored := recall(Rescore(4 * k))
+	t.Logf("int8 recall@%d = %.3f, rescoring top %d = %.3f", k, plain, 4*k, rescored)
+	if plain < 0.9 {
+		t.Fatalf("expected int8 recall@%d of at least 0.9, got %.3f", k, plain)
+	}
+	if rescored < 0.99 {
+		t.Fatalf("expected rescored recall@%d of at least 0.99, got %.3f", k, rescored)
+	}
+}
+
+func TestHalfPrecisionRecallAgainstFloat32(t *testing.T) {
+	vecs := randomUnitVectors(2000, 1)
+	exactStore := openFilledStore(t, storage.Options{}, vecs)
+	queries := randomUnitVectors(50, 2)
+
+	const k = 10
+	for _, dtype := range []storage.DType{storage.DTypeFloat16, storage.DTypeBFloat16} {
+		halfStore := openFilledStore(t, storage.Options{DType: dtype}, vecs)
+		hits := 0
+		for _, q := range queries {
+			model := &fakeModel{vector: q}
+			want, err := SearchTopKSimilar(exactStore, "q", k, model)
+			if err != nil {
+				t.Fatalf("float32 search: %v", err)
+			}
+			got, err := SearchTopKSimilar(halfStore, "q", k, model)
+			if err != nil {
+				t.Fatalf("%s search: %v", dtype, err)
+			}
+
+			expected := map[string]bool{}
+			for _, r := range want {
+				expected[r.Text] = true
+			}
+			for _, r := range got {
+				if expected[r.Text] {
+					hits++
+				}
+			}
+		}
+		recall := float64(hits) / float64(k*len(queries))
+		t.Logf("%s recall@%d = %.3f", dtype, k, recall)
+		if recall < 0.98 {
+			t.Fatalf("expected %s recall@%d of at least 0.98, got %.3f", dtype, k, recall)
+		}
+	}
+}
+
+func TestRescoreNeedsFullPrecisionVectors(t *testing.T) {
+	store := openFilledStore(t, storage.Options{DType: storage.DTypeInt8}, randomUnitVectors(5, 3))
+
+	_, err := SearchTopKSimilar(store, "q", 2, &fakeModel{vector: randomUnitVectors(1, 4)[0]}, Rescore(4))
+	if !errors.Is(err, storage.ErrNoFloat32) {
+		t.Fatalf("expected ErrNoFloat32, got %v", err)
+	}
+}
+
+// Compares the brute-force scan over each element type of data file
+func BenchmarkExactTopK(b *testing.B) {
+	vecs := randomUnitVectors(20000, 5)
+	q := randomUnitVectors(1, 6)[0]
+
+	for _, dtype := range []storage.DType{storage.DTypeFloat32, storage.DTypeInt8, storage.DTypeFloat16, storage.DTypeBFloat16} {
+		store := openFilledStore(b, storage.Options{DType: dtype}, vecs)
+		b.Run(dtype.String(), func(b *testing.B) {
+			for range b.N {
+				if _, err := exactTopK(store, q, 10, nil); err != nil {
+					b.Fatalf("exactTopK: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSearchTopKSimilar(b *testing.B) {
+	store, err := storage.Open(b.TempDir(), storage.Options{Dimension: testVectorLength})
+	if err != nil {
+		b.Fatalf("open store: %v", err)
+	}
+	defer store.Close()
+
+	const n = 10000
+	vecs := make([]embedding.EmbeddingVector, n)
+	texts := make([]string, n)
+	for i := range vecs {
+		vecs[i] = basisVector(i%testVectorLength, 1)
+		vecs[i][(i+1)%testVectorLength] = float32(i%7) / 7
+		texts[i] = "doc"
+	}
+	if _, err := store.AppendBatch(vecs, texts); err != nil {
+		b.Fatalf("AppendBatch: %v", err)
+	}
+
+	model := &fakeModel{vector: basisVector(3, 1)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := SearchTopKSimilar(store, "q", 10, model); err != nil {
+			b.Fatalf("SearchTopKSimilar: %v", err)
+		}
+	}
+}
+
 func splitTrim(s string) []string {
 	s = strings.TrimSpace(s)
 	if s == "" {
@@ -144,3 +415,41 @@ func splitTrim(s string) []string {
 	}
 	return strings.Split(s, "\n")
 }
+
+// Searching an in-memory store goes through the same paths as a file-backed
+// one, without writing anything to disk
+func TestSearchMemStore(t *testing.T) {
+	store, err := storage.NewMemStore(storage.Options{Dimension: testVectorLength, DType: storage.DTypeInt8, KeepFloat32: true})
+	if err != nil {
+		t.Fatalf("NewMemStore: %v", err)
+	}
+	defer store.Close()
+
+	metas := []storage.EmbeddingMetaData{
+		{Text: "pasted one", Source: "paste"},
+		{Text: "pasted two", Source: "paste"},
+		{Text: "other", Source: "elsewhere"},
+	}
+	vecs := []embedding.EmbeddingVector{basisVector(0, 1), basisVector(1, 1), basisVector(0, 0.9)}
+	vecs[2][1] = 0.1
+	if _, err := store.AppendBatchMeta(vecs, metas); err != nil {
+		t.Fatalf("AppendBatchMeta: %v", err)
+	}
+
+	model := &fakeModel{vector: basisVector(0, 1)}
+	results, err := SearchTopKSimilar(store, "q", 2, model, Rescore(3))
+	if err != nil {
+		t.Fatalf("SearchTopKSimilar: %v", err)
+	}
+	if len(results) != 2 || results[0].Text != "pasted one" || results[1].Text != "other" {
+		t.Fatalf("unexpected results %+v", results)
+	}
+
+	results, err = SearchTopKSimilar(store, "q", 2, model, WithFilter(Eq("source", "paste")))
+	if err != nil {
+		t.Fatalf("SearchTopKSimilar: %v", err)
+	}
+	if len(results) != 2 || results[0].Text != "pasted one" || results[1].Text != "pasted two" {
+		t.Fatalf("expected the filter to apply, got %+v", results)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Package searchtest holds the fixtures the tests of the ANN index packages
+share: synthetic vectors, a model that embeds every query as a fixed vector,
+stores filled with numbered texts, and recall against the exact search path.
+*/
+package searchtest
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+	"github.com/mateosanchezl/go-vect/internal/search"
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+// n normalised vectors drawn uniformly from the unit sphere
+func RandomVectors(n, dim int, seed uint64) []embedding.EmbeddingVector {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	out := make([]embedding.EmbeddingVector, n)
+	for i := range out {
+		v := make(embedding.EmbeddingVector, dim)
+		for j := range v {
+			v[j] = float32(rng.NormFloat64())
+		}
+		v.Normalise()
+		out[i] = v
+	}
+	return out
+}
+
+// Normalised vectors scattered around a number of random topics, which is
+// closer to real embeddings than uniform noise. Each component of a topic is
+// drawn from N(0, 1) and each vector adds noise of the given spread to its
+// topic.
+func ClusteredVectors(n, dim, topics int, spread float64, seed uint64) []embedding.EmbeddingVector {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	centres := make([][]float32, topics)
+	for i := range centres {
+		centres[i] = make([]float32, dim)
+		for j := range centres[i] {
+			centres[i][j] = float32(rng.NormFloat64())
+		}
+	}
+
+	out := make([]embedding.EmbeddingVector, n)
+	for i := range out {
+		c := centres[rng.IntN(topics)]
+		v := make(embedding.EmbeddingVector, dim)
+		for j := range v {
+			v[j] = c[j] + float32(rng.NormFloat64()*spread)
+		}
+		v.Normalise()
+		out[i] = v
+	}
+	return out
+}
+
+// Embeds every query as Vector
+type FixedModel struct {
+	Vector embedding.EmbeddingVector
+}
+
+func (f *FixedModel) Embed(chunk string) (embedding.EmbeddingVector, error) {
+	out := make(embedding.EmbeddingVector, len(f.Vector))
+	copy(out, f.Vector)
+	return out, nil
+}
+
+func (f *FixedModel) EmbedBatch(chunks []string) ([]embedding.EmbeddingVector, error) {
+	return nil, nil
+}
+
+// Opens a float32 store of dimension dim in dir. Closing it is left to the
+// test, which may want to reopen it.
+func OpenStore(t testing.TB, dir string, dim int) *storage.Store {
+	t.Helper()
+	store, err := storage.Open(dir, storage.Options{Dimension: dim})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	return store
+}
+
+// Appends vecs with the texts "doc-0", "doc-1" and so on
+func FillStore(t testing.TB, store *storage.Store, vecs []embedding.EmbeddingVector) {
+	t.Helper()
+	texts := make([]string, len(vecs))
+	for i := range texts {
+		texts[i] = fmt.Sprintf("doc-%d", i)
+	}
+	if _, err := store.AppendBatch(vecs, texts); err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+}
+
+// Recall@k of searching store with opts against the exact path, over queries
+func Recall(t testing.TB, store *storage.Store, queries []embedding.EmbeddingVector, k int, opts ...search.Option) float64 {
+	t.Helper()
+	hits := 0
+	for _, q := range queries {
+		model := &FixedModel{Vector: q}
+		exact, err := search.SearchTopKSimilar(store, "q", k, model, search.Exact())
+		if err != nil {
+			t.Fatalf("exact search: %v", err)
+		}
+		approx, err := search.SearchTopKSimilar(store, "q", k, model, opts...)
+		if err != nil {
+			t.Fatalf("approximate search: %v", err)
+		}
+
+		want := map[string]bool{}
+		for _, r := range exact {
+			want[r.Text] = true
+		}
+		for _, r := range approx {
+			if want[r.Text] {
+				hits++
+			}
+		}
+	}
+	return float64(hits) / float64(k*len(queries))
+}
+
+// Runs an "exact" sub-benchmark of a full heap scan for the top 10 of vecs,
+// the baseline the index benchmarks compare against. Metadata lookups are
+// left out, as the search paths share them.
+func BenchmarkExact(b *testing.B, vecs []embedding.EmbeddingVector, q embedding.EmbeddingVector) {
+	b.Run("exact", func(b *testing.B) {
+		for range b.N {
+			mh := search.MinHeap{}
+			mh.Init(10)
+			for i, v := range vecs {
+				sim, _ := v.NormedCosineSimilarity(q)
+				mh.Insert(search.SimilarityResult{CosSim: sim, Pos: i})
+			}
+			mh.Sort()
+		}
+	})
+}
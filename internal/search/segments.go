@@ -0,0 +1,87 @@
+package search
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+// Searches every segment of a segmented store at once and merges their top k
+// into one. A segment is searched through its own index when it has one that
+// implements Index, unless Exact is given; WithIndex is ignored. Filters and
+// rescoring apply per segment, while parents and windows are looked up
+// across all of them.
+func SearchSegments(segs *storage.Segmented, query string, k int, model embedding.EmbeddingModel, opts ...Option) ([]TopKSearchResult, error) {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	qv, err := model.Embed(query)
+	if err != nil {
+		return nil, err
+	}
+	qv.Normalise()
+
+	var out []TopKSearchResult
+	err = segs.WithSegments(func(list []*storage.Segment) error {
+		found := make([][]TopKSearchResult, len(list))
+		errs := make([]error, len(list))
+		var wg sync.WaitGroup
+		for i, seg := range list {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var idx Index
+				if si, ok := seg.Index.(Index); ok && !o.exact {
+					idx = si
+				}
+				top, err := topK(seg.Store, idx, qv, k, o)
+				if err == nil {
+					found[i], err = fetch(seg.Store, top)
+				}
+				errs[i] = err
+			}()
+		}
+		wg.Wait()
+		err := errors.Join(errs...)
+		if err != nil {
+			return err
+		}
+
+		out = mergeResults(found, k)
+		// Neighbouring chunks may sit in other segments
+		stores := make([]storage.VectorStore, len(list))
+		for i, seg := range list {
+			stores[i] = seg.Store
+		}
+		return expand(stores, out, o)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// The best k of the results of every segment
+func mergeResults(found [][]TopKSearchResult, k int) []TopKSearchResult {
+	// Pos indexes the flattened per-segment results
+	var all []TopKSearchResult
+	mh := MinHeap{}
+	mh.Init(k)
+	for _, rs := range found {
+		for _, r := range rs {
+			mh.Insert(SimilarityResult{CosSim: r.CosSim, Pos: len(all)})
+			all = append(all, r)
+		}
+	}
+	mh.Sort()
+
+	out := make([]TopKSearchResult, len(mh.H))
+	for i, rs := range mh.H {
+		out[i] = all[rs.Pos]
+	}
+	return out
+}
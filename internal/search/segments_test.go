@@ -0,0 +1,79 @@
+package search
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+	"github.com/mateosanchezl/go-vect/internal/storage"
+)
+
+// Searching a store split into segments finds what searching it whole does
+func TestSearchSegmentsMatchesOneStore(t *testing.T) {
+	segs, err := storage.OpenSegmented(t.TempDir(), storage.SegmentOptions{
+		Options:     storage.Options{Dimension: testVectorLength},
+		SegmentSize: 7,
+		MergeFactor: 2,
+		ManualMerge: true,
+	})
+	if err != nil {
+		t.Fatalf("OpenSegmented: %v", err)
+	}
+	defer segs.Close()
+	whole, _ := setupSearchStore(t)
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range 30 {
+		v := make(embedding.EmbeddingVector, testVectorLength)
+		for j := range 8 {
+			v[j] = float32(rng.NormFloat64())
+		}
+		md := []storage.EmbeddingMetaData{{Text: fmt.Sprintf("doc-%d", i)}}
+		if _, err := segs.AppendBatchMeta([]embedding.EmbeddingVector{v}, md); err != nil {
+			t.Fatalf("AppendBatchMeta: %v", err)
+		}
+		if _, err := whole.AppendBatchMeta([]embedding.EmbeddingVector{v}, md); err != nil {
+			t.Fatalf("AppendBatchMeta: %v", err)
+		}
+	}
+	for _, id := range []uint64{3, 11, 20} {
+		if err := segs.Delete(id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if err := whole.Delete(id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+
+	texts := func(results []TopKSearchResult) []string {
+		var out []string
+		for _, r := range results {
+			out = append(out, r.Text)
+		}
+		return out
+	}
+	model := &fakeModel{vector: basisVector(0, 1)}
+	want, err := SearchTopKSimilar(whole, "q", 5, model)
+	if err != nil {
+		t.Fatalf("SearchTopKSimilar: %v", err)
+	}
+	for _, step := range []string{"before merging", "after merging"} {
+		got, err := SearchSegments(segs, "q", 5, model)
+		if err != nil {
+			t.Fatalf("SearchSegments %s: %v", step, err)
+		}
+		if !slices.Equal(texts(got), texts(want)) {
+			t.Fatalf("%s: expected %v, got %v", step, texts(want), texts(got))
+		}
+		if _, err := segs.Merge(); err != nil {
+			t.Fatalf("Merge: %v", err)
+		}
+	}
+
+	got, err := SearchSegments(segs, "q", 3, model, WithFilter(Eq("text", "doc-7")))
+	if err != nil || !slices.Equal(texts(got), []string{"doc-7"}) {
+		t.Fatalf("expected the filter to apply in every segment, got %v, %v", texts(got), err)
+	}
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+)
+
+/*
+Checksums catch bit rot and partial writes before they turn into silently
+wrong scores.
+
+Stores created by this version set flagChecksums in the header, and every
+record in data.bin is then followed by the CRC-32C of the record's bytes as a
+little-endian u32. Every metadata line ends with a "CRC" field holding the
+CRC-32C of the line as it would read without that field:
+
+	{"ID":1,"Offset":1540,"Text":"hello","CRC":2274148462}
+
+covers {"ID":1,"Offset":1540,"Text":"hello"}. The JSON decoder ignores the
+field, so the lines stay plain metadata to anything reading them.
+
+Stores written before checksums existed are read unchecked, apart from
+metadata lines appended since, and are upgraded when compacted.
+*/
+
+const checksumSize = 4
+
+var (
+	crcTable        = crc32.MakeTable(crc32.Castagnoli)
+	lineChecksumKey = []byte(`,"CRC":`)
+)
+
+// What reads do with a record that fails its checksum
+type VerifyMode uint8
+
+const (
+	VerifyStrict  VerifyMode = iota // Fail with *ErrCorruptRecord
+	VerifyLenient                   // Leave the record out of search results and carry on
+)
+
+func (m VerifyMode) String() string {
+	switch m {
+	case VerifyStrict:
+		return "strict"
+	case VerifyLenient:
+		return "lenient"
+	default:
+		return fmt.Sprintf("verify(%d)", uint8(m))
+	}
+}
+
+// Parses the name of a verify mode, as returned by String
+func ParseVerifyMode(name string) (VerifyMode, error) {
+	for _, m := range []VerifyMode{VerifyStrict, VerifyLenient} {
+		if m.String() == name {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("storage: unknown verify mode %q", name)
+}
+
+// A record whose vector or metadata line does not match its checksum. Use
+// errors.As to get at the position.
+type ErrCorruptRecord struct {
+	Pos  int
+	File string // data.bin or metadata.jsonl
+}
+
+func (e *ErrCorruptRecord) Error() string {
+	return fmt.Sprintf("storage: record %d is corrupt, checksum mismatch in %s", e.Pos, e.File)
+}
+
+// Appends the checksum of a vector record to it
+func appendRecordChecksum(rec []byte) []byte {
+	return binary.LittleEndian.AppendUint32(rec, crc32.Checksum(rec, crcTable))
+}
+
+// Whether a vector record followed by its checksum is intact
+func validRecord(rec []byte) bool {
+	n := len(rec) - checksumSize
+	return n >= 0 && binary.LittleEndian.Uint32(rec[n:]) == crc32.Checksum(rec[:n], crcTable)
+}
+
+// Adds the CRC field to a JSON object encoded without it
+func appendLineChecksum(obj []byte) []byte {
+	sum := crc32.Checksum(obj, crcTable)
+	out := append(obj[:len(obj)-1:len(obj)-1], lineChecksumKey...)
+	out = strconv.AppendUint(out, uint64(sum), 10)
+	return append(out, '}')
+}
+
+// Checks the CRC field of a metadata line. present is false for lines
+// written before checksums existed.
+func checkLine(line []byte) (present, ok bool) {
+	line = bytes.TrimSpace(line)
+	i := bytes.LastIndex(line, lineChecksumKey)
+	if i < 0 || line[len(line)-1] != '}' {
+		return false, false
+	}
+	sum, err := strconv.ParseUint(string(line[i+len(lineChecksumKey):len(line)-1]), 10, 32)
+	if err != nil {
+		return false, false
+	}
+
+	want := crc32.Update(crc32.Checksum(line[:i], crcTable), crcTable, []byte{'}'})
+	return true, uint32(sum) == want
+}
+
+// Checks the vector record at pos, read with its checksum if the store keeps
+// them
+func (s *Store) checkRecord(pos int, rec []byte) error {
+	if s.header.Checksums && !validRecord(rec) {
+		return &ErrCorruptRecord{Pos: pos, File: vectorFileName}
+	}
+	return nil
+}
+
+// Checks the metadata line at pos. Lines without a checksum only pass in
+// stores from before checksums existed.
+func (s *Store) checkMetadataLine(pos int, line string) error {
+	present, ok := checkLine([]byte(line))
+	if ok || (!present && !s.header.Checksums) {
+		return nil
+	}
+	return &ErrCorruptRecord{Pos: pos, File: metadataFileName}
+}
+
+// Whether search leaves corrupt records out rather than failing
+func (s *Store) Lenient() bool {
+	return s.verify == VerifyLenient
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+// Flips one bit of the file at offset
+func flipBit(t *testing.T, path string, offset int64) {
+	t.Helper()
+	editFile(t, path, func(b []byte) []byte {
+		b[offset] ^= 0x10
+		return b
+	})
+}
+
+func openChecksumStore(t *testing.T, dir string, mode VerifyMode) *Store {
+	t.Helper()
+	store, err := Open(dir, Options{Dimension: embeddingSize, Verify: mode})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestLineChecksumRoundTrip(t *testing.T) {
+	line, err := encodeMetaData(EmbeddingMetaData{ID: 3, Text: `quotes " and ,"CRC":1}`, Attributes: map[string]any{"CRC": 5}})
+	if err != nil {
+		t.Fatalf("encodeMetaData: %v", err)
+	}
+	if present, ok := checkLine(line); !present || !ok {
+		t.Fatalf("expected a valid checksum on %s", line)
+	}
+
+	var md EmbeddingMetaData
+	if err := json.Unmarshal(line, &md); err != nil || md.ID != 3 {
+		t.Fatalf("expected the line to stay plain metadata, got %+v, %v", md, err)
+	}
+
+	if present, ok := checkLine(bytes.Replace(line, []byte("quotes"), []byte("qvotes"), 1)); !present || ok {
+		t.Fatalf("expected an edited line to fail its checksum")
+	}
+	if present, _ := checkLine([]byte(`{"ID":1,"Offset":1536,"Text":"old"}`)); present {
+		t.Fatalf("expected a line from before checksums to have none")
+	}
+}
+
+func TestCorruptVectorIsReported(t *testing.T) {
+	dir := t.TempDir()
+	writeFsckStore(t, dir, 3)
+	flipBit(t, filepath.Join(dir, vectorFileName), int64(testHeaderSize+testRecordSize+9))
+
+	store := openChecksumStore(t, dir, VerifyStrict)
+	var corrupt *ErrCorruptRecord
+	if _, err := store.Get(1); !errors.As(err, &corrupt) || corrupt.Pos != 1 || corrupt.File != vectorFileName {
+		t.Fatalf("expected record 1 to be corrupt in %s, got %v", vectorFileName, err)
+	}
+	if _, err := store.Float32(1); !errors.As(err, &corrupt) {
+		t.Fatalf("expected Float32 to check the record, got %v", err)
+	}
+	if _, err := store.Get(2); err != nil {
+		t.Fatalf("expected record 2 to be intact, got %v", err)
+	}
+
+	err := store.Iterate(func(pos int, v embedding.EmbeddingVector) error { return nil })
+	if !errors.As(err, &corrupt) || corrupt.Pos != 1 {
+		t.Fatalf("expected strict Iterate to stop at record 1, got %v", err)
+	}
+	if err := store.Delete(3); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Compact(); !errors.As(err, &corrupt) {
+		t.Fatalf("expected Compact to refuse the corrupt record, got %v", err)
+	}
+	store.Close()
+
+	lenient := openChecksumStore(t, dir, VerifyLenient)
+	var seen []int
+	err = lenient.Iterate(func(pos int, v embedding.EmbeddingVector) error {
+		seen = append(seen, pos)
+		return nil
+	})
+	if err != nil || len(seen) != 1 || seen[0] != 0 {
+		t.Fatalf("expected lenient Iterate to skip record 1, got %v, %v", seen, err)
+	}
+}
+
+func TestCorruptMetadataLineIsReported(t *testing.T) {
+	dir := t.TempDir()
+	writeFsckStore(t, dir, 3)
+	editFile(t, filepath.Join(dir, metadataFileName), func(b []byte) []byte {
+		return bytes.Replace(b, []byte(`"doc-2"`), []byte(`"doc-7"`), 1)
+	})
+
+	store := openChecksumStore(t, dir, VerifyStrict)
+	var corrupt *ErrCorruptRecord
+	if _, err := store.Get(2); !errors.As(err, &corrupt) || corrupt.Pos != 2 || corrupt.File != metadataFileName {
+		t.Fatalf("expected record 2 to be corrupt in %s, got %v", metadataFileName, err)
+	}
+	if _, err := store.MetaData(); !errors.As(err, &corrupt) {
+		t.Fatalf("expected strict MetaData to fail, got %v", err)
+	}
+	store.Close()
+
+	lenient := openChecksumStore(t, dir, VerifyLenient)
+	metas, err := lenient.MetaData()
+	if err != nil {
+		t.Fatalf("MetaData: %v", err)
+	}
+	if metas[2].ID != 3 || metas[2].Text != "" || metas[1].Text != "doc-1" {
+		t.Fatalf("expected only the corrupt line to be left empty, got %+v", metas)
+	}
+
+	report, err := Check(dir)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Pos != 2 {
+		t.Fatalf("expected fsck to flag record 2, got %v", report.Issues)
+	}
+}
+
+func TestCompactAddsChecksumsToOlderStores(t *testing.T) {
+	dir := t.TempDir()
+	h := newVectorHeader(embeddingSize, DTypeFloat32, "")
+	h.Checksums = false
+
+	data := h.encode()
+	var md []byte
+	for i, text := range []string{"a", "b"} {
+		data = append(data, vectorToByteSlice(newSparseVector(map[int]float32{i: 1}))...)
+		line, _ := json.Marshal(EmbeddingMetaData{ID: uint64(i + 1), Offset: (i + 1) * embeddingSize * 4, Text: text})
+		md = append(append(md, line...), '\n')
+	}
+	if err := os.WriteFile(filepath.Join(dir, vectorFileName), data, 0o644); err != nil {
+		t.Fatalf("write data: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, metadataFileName), md, 0o644); err != nil {
+		t.Fatalf("write metadata: %v", err)
+	}
+
+	store := openChecksumStore(t, dir, VerifyStrict)
+	if rec, err := store.Get(1); err != nil || rec.Meta.Text != "b" {
+		t.Fatalf("expected unchecked records to read as before, got %+v, %v", rec.Meta, err)
+	}
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if !store.Header().Checksums {
+		t.Fatalf("expected compaction to turn checksums on")
+	}
+	rec, err := store.Get(1)
+	if err != nil || rec.Meta.Text != "b" || rec.Meta.Offset != 2*testRecordSize || rec.Vector[1] != 1 {
+		t.Fatalf("expected record 1 to survive the upgrade, got %+v, %v", rec.Meta, err)
+	}
+	if report, err := Check(dir); err != nil || !report.OK() {
+		t.Fatalf("expected a clean store after the upgrade, got %v, %v", report, err)
+	}
+}
@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+Parent documents of the stored chunks.
+
+Chunks name their document by DocID and sit in it at Chunk and Span.
+documents.jsonl holds the documents themselves, one JSON line each with the
+same checksum as metadata lines, so search can hand back the whole document
+or the text around a hit instead of a lone chunk.
+
+UpsertDocument writes a document after the chunks pointing at it, under the
+same write lock, so a crash leaves at worst chunks whose document is missing,
+which search treats like chunks without one. Writing a document that is
+already stored under the same ID does nothing, and writing a different one
+under the ID appends it, the last line winning. Compaction drops documents no
+live chunk refers to, and Clear drops them all.
+
+Documents are looked up through an index from ID to line, built on the first
+lookup and extended as the file grows. Lines are checked against the ID they
+are looked up by, so a file replaced by another process is reindexed.
+*/
+
+const documentsFileName = "documents.jsonl"
+
+var ErrEmptyDocumentID = errors.New("storage: document ID must not be empty")
+
+// The full text of a document whose chunks are stored
+type Document struct {
+	ID     string // DocID of the document's chunks
+	Source string `json:",omitempty"` // URI the document was read from
+	Text   string `json:",omitempty"` // Full text, empty when Source points at it instead
+}
+
+// The text of the document, read from its file:// Source if it wasn't stored
+func (d Document) Content() (string, error) {
+	if d.Text != "" || d.Source == "" {
+		return d.Text, nil
+	}
+	u, err := url.Parse(d.Source)
+	if err != nil || u.Scheme != "file" {
+		return "", fmt.Errorf("storage: document %s has no text and no file source", d.ID)
+	}
+	b, err := os.ReadFile(filepath.FromSlash(u.Path))
+	if err != nil {
+		return "", fmt.Errorf("failed to read document %s: %w", d.ID, err)
+	}
+	return string(b), nil
+}
+
+// Where each document's line starts in documents.jsonl
+type docIndex struct {
+	mu  sync.Mutex
+	at  map[string]int64
+	end int64 // How far the file has been indexed
+}
+
+func (x *docIndex) reset() {
+	x.at, x.end = nil, 0
+}
+
+func (s *Store) documentsPath() string {
+	return filepath.Join(s.dir, documentsFileName)
+}
+
+// Stores doc as the parent of the chunks whose DocID is doc.ID. Compaction
+// drops documents without live chunks, so the chunks should follow soon;
+// UpsertDocument writes both together.
+func (s *Store) PutDocument(doc Document) error {
+	if doc.ID == "" {
+		return ErrEmptyDocumentID
+	}
+	err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer s.unlock()
+	return s.putDocument(doc)
+}
+
+// Like PutDocument, with the store locked for writing
+func (s *Store) putDocument(doc Document) error {
+	stored, err := s.document(doc.ID)
+	if err == nil && stored == doc {
+		return nil
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	line, err := encodeDocument(doc)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.documentsPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", documentsFileName, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	if info.Size() > 0 {
+		// Starts a fresh line after a write torn by a crash
+		last := make([]byte, 1)
+		r, err := os.Open(s.documentsPath())
+		if err == nil {
+			_, err = r.ReadAt(last, info.Size()-1)
+			r.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", documentsFileName, err)
+		}
+		if last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+	err = writeAndSync(f, line)
+	if err != nil {
+		return fmt.Errorf("failed to write document: %w", err)
+	}
+
+	s.docs.mu.Lock()
+	if s.docs.at != nil && s.docs.end == info.Size() && line[0] != '\n' {
+		s.docs.at[doc.ID] = info.Size()
+		s.docs.end += int64(len(line))
+	}
+	s.docs.mu.Unlock()
+	return nil
+}
+
+func encodeDocument(doc Document) ([]byte, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode document: %w", err)
+	}
+	return append(appendLineChecksum(b), '\n'), nil
+}
+
+// The document stored under id, or ErrNotFound
+func (s *Store) Document(id string) (Document, error) {
+	err := s.rlock()
+	if err != nil {
+		return Document{}, err
+	}
+	defer s.runlock()
+	return s.document(id)
+}
+
+// The live chunks of the document docID with ordinals from first to last, by
+// ordinal. When several live records claim an ordinal the last one wins.
+func (s *Store) DocumentChunks(docID string, first, last int) (map[int]EmbeddingMetaData, error) {
+	err := s.rlock()
+	if err != nil {
+		return nil, err
+	}
+	defer s.runlock()
+
+	table, err := s.metaTable()
+	if err != nil {
+		return nil, err
+	}
+	return s.metaCache.chunks(table, docID, first, last, s.isDeleted), nil
+}
+
+// Like Document, with the store locked
+func (s *Store) document(id string) (Document, error) {
+	f, err := os.Open(s.documentsPath())
+	if os.IsNotExist(err) {
+		return Document{}, ErrNotFound
+	}
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to open %s: %w", documentsFileName, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	s.docs.mu.Lock()
+	defer s.docs.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		err = s.docs.catchUp(f, info.Size())
+		if err != nil {
+			return Document{}, err
+		}
+		off, ok := s.docs.at[id]
+		if !ok {
+			return Document{}, ErrNotFound
+		}
+
+		doc, err := readDocument(f, off, info.Size())
+		if err == nil && doc.ID == id {
+			return doc, nil
+		}
+		if attempt > 0 {
+			if err == nil {
+				err = fmt.Errorf("storage: line of document %s in %s holds another document", id, documentsFileName)
+			}
+			return Document{}, err
+		}
+		// Replaced since it was indexed
+		s.docs.reset()
+	}
+}
+
+// Indexes the lines of f past the end of the index
+func (x *docIndex) catchUp(f *os.File, size int64) error {
+	if x.at == nil || size < x.end {
+		x.at, x.end = map[string]int64{}, 0
+	}
+	if size == x.end {
+		return nil
+	}
+
+	tail := make([]byte, size-x.end)
+	_, err := f.ReadAt(tail, x.end)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read %s: %w", documentsFileName, err)
+	}
+	for {
+		n := bytes.IndexByte(tail, '\n') + 1
+		if n == 0 {
+			// A torn last line is indexed once it is complete
+			return nil
+		}
+		var line struct{ ID string }
+		if json.Unmarshal(tail[:n], &line) == nil && line.ID != "" {
+			x.at[line.ID] = x.end
+		}
+		x.end += int64(n)
+		tail = tail[n:]
+	}
+}
+
+func readDocument(f *os.File, off, size int64) (Document, error) {
+	line, err := readLineAt(f, off, size)
+	if err != nil {
+		return Document{}, err
+	}
+	line = bytes.TrimSpace(line)
+	if _, ok := checkLine(line); !ok {
+		return Document{}, fmt.Errorf("storage: document at offset %d is corrupt, checksum mismatch in %s", off, documentsFileName)
+	}
+
+	var doc Document
+	err = json.Unmarshal(line, &doc)
+	if err != nil {
+		return Document{}, fmt.Errorf("failed to decode document: %w", err)
+	}
+	return doc, nil
+}
+
+// Rewrites documents.jsonl with just the documents live chunks refer to.
+// Called by Compact with the store locked for writing.
+func (s *Store) compactDocuments() error {
+	lines, err := s.readMetadataLines()
+	if err != nil {
+		return err
+	}
+	live := map[string]bool{}
+	var order []string
+	for pos, line := range lines[:min(len(lines), len(s.ids))] {
+		var md struct{ DocID string }
+		if s.isDeleted(pos) || json.Unmarshal([]byte(line), &md) != nil || md.DocID == "" || live[md.DocID] {
+			continue
+		}
+		live[md.DocID] = true
+		order = append(order, md.DocID)
+	}
+
+	var out []byte
+	for _, id := range order {
+		doc, err := s.document(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		line, err := encodeDocument(doc)
+		if err != nil {
+			return err
+		}
+		out = append(out, line...)
+	}
+
+	s.docs.mu.Lock()
+	s.docs.reset()
+	s.docs.mu.Unlock()
+	path := s.documentsPath()
+	if len(out) == 0 {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", documentsFileName, err)
+		}
+		return nil
+	}
+	err = writeFileSynced(path+compactSuffix, out)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+compactSuffix, path)
+	if err != nil {
+		return fmt.Errorf("failed to replace %s: %w", documentsFileName, err)
+	}
+	return nil
+}
+
+// Drops every document. Called by Clear with the store locked for writing.
+func (s *Store) clearDocuments() error {
+	s.docs.mu.Lock()
+	s.docs.reset()
+	s.docs.mu.Unlock()
+	err := os.Remove(s.documentsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", documentsFileName, err)
+	}
+	return nil
+}
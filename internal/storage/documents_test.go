@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+func TestPutAndGetDocuments(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+	path := filepath.Join(store.dir, documentsFileName)
+
+	if _, err := store.Document("a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound before any document, got %v", err)
+	}
+	if err := store.PutDocument(Document{Text: "no ID"}); !errors.Is(err, ErrEmptyDocumentID) {
+		t.Fatalf("expected ErrEmptyDocumentID, got %v", err)
+	}
+
+	a := Document{ID: "a", Source: "file:///a.md", Text: "first. second."}
+	b := Document{ID: "b", Text: "other"}
+	for _, doc := range []Document{a, b} {
+		if err := store.PutDocument(doc); err != nil {
+			t.Fatalf("PutDocument: %v", err)
+		}
+	}
+	info, _ := os.Stat(path)
+	if err := store.PutDocument(a); err != nil {
+		t.Fatalf("PutDocument: %v", err)
+	}
+	if again, _ := os.Stat(path); again.Size() != info.Size() {
+		t.Fatal("expected putting an identical document to write nothing")
+	}
+
+	changed := Document{ID: "a", Text: "rewritten"}
+	if err := store.PutDocument(changed); err != nil {
+		t.Fatalf("PutDocument: %v", err)
+	}
+	for _, want := range []Document{changed, b} {
+		got, err := store.Document(want.ID)
+		if err != nil || got != want {
+			t.Fatalf("expected %+v, got %+v, %v", want, got, err)
+		}
+	}
+
+	// Another process rewriting the file is noticed by the ID check
+	other := Document{ID: "a", Text: "replaced"}
+	line, _ := encodeDocument(other)
+	if err := os.WriteFile(path, line, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Document("a"); err != nil || got != other {
+		t.Fatalf("expected %+v after the file was replaced, got %+v, %v", other, got, err)
+	}
+	if _, err := store.Document("b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected b to be gone, got %v", err)
+	}
+}
+
+func TestDocumentContentReadsFileSources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "doc.txt")
+	if err := os.WriteFile(path, []byte("from disk"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	doc := Document{ID: "d", Source: "file://" + filepath.ToSlash(path)}
+	if text, err := doc.Content(); err != nil || text != "from disk" {
+		t.Fatalf("expected the file's text, got %q, %v", text, err)
+	}
+	doc.Source = "https://example.com/doc"
+	if _, err := doc.Content(); err == nil {
+		t.Fatal("expected a document without text or a file source to fail")
+	}
+}
+
+func TestUpsertDocumentLinksChunks(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+	emb := &fakeEmbedder{}
+
+	doc := Document{ID: "d1", Text: "one. two."}
+	if _, err := store.UpsertDocument("k", doc, chunkMetas("one.", "two."), emb.embed); err != nil {
+		t.Fatalf("UpsertDocument: %v", err)
+	}
+	metas, _ := store.MetaData()
+	for _, md := range metas {
+		if md.DocID != "d1" {
+			t.Fatalf("expected chunks to point at d1, got %q", md.DocID)
+		}
+	}
+	if got, err := store.Document("d1"); err != nil || got != doc {
+		t.Fatalf("expected %+v, got %+v, %v", doc, got, err)
+	}
+	if _, err := store.UpsertDocument("k", Document{}, nil, emb.embed); !errors.Is(err, ErrEmptyDocumentID) {
+		t.Fatalf("expected ErrEmptyDocumentID, got %v", err)
+	}
+
+	// A new version of the document replaces the old one at compaction
+	next := Document{ID: "d2", Text: "one. three."}
+	if _, err := store.UpsertDocument("k", next, chunkMetas("one.", "three."), emb.embed); err != nil {
+		t.Fatalf("UpsertDocument: %v", err)
+	}
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if _, err := store.Document("d1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected compaction to drop d1, got %v", err)
+	}
+	if got, err := store.Document("d2"); err != nil || got != next {
+		t.Fatalf("expected %+v, got %+v, %v", next, got, err)
+	}
+
+	other := openShared(t, store.dir)
+	if got, err := other.Document("d2"); err != nil || got != next {
+		t.Fatalf("expected another handle to read %+v, got %+v, %v", next, got, err)
+	}
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+	if _, err := store.Document("d2"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected Clear to drop d2, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(store.dir, documentsFileName)); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got %v", documentsFileName, err)
+	}
+}
+
+func TestMemStoreSavesDocuments(t *testing.T) {
+	mem := newTestMemStore(t, Options{Dimension: embeddingSize})
+	doc := Document{ID: "d", Source: "paste", Text: "kept"}
+	if err := mem.PutDocument(doc); err != nil {
+		t.Fatalf("PutDocument: %v", err)
+	}
+	if got, err := mem.Document("d"); err != nil || got != doc {
+		t.Fatalf("expected %+v, got %+v, %v", doc, got, err)
+	}
+
+	dir := t.TempDir()
+	if err := mem.Save(dir); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	file := openShared(t, dir)
+	if got, err := file.Document("d"); err != nil || got != doc {
+		t.Fatalf("expected %+v after saving, got %+v, %v", doc, got, err)
+	}
+}
+
+func TestDocumentChunksLooksUpOrdinals(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+	metas := chunkMetas("zero", "one", "two", "three")
+	metas = append(metas, EmbeddingMetaData{Text: "one again", DocID: "doc", Chunk: 1})
+	metas = append(metas, EmbeddingMetaData{Text: "elsewhere", DocID: "other", Chunk: 2})
+	vecs := make([]embedding.EmbeddingVector, len(metas))
+	for i := range vecs {
+		vecs[i] = newSparseVector(map[int]float32{i: 1})
+	}
+	ids, err := store.AppendBatchMeta(vecs, metas)
+	if err != nil {
+		t.Fatalf("AppendBatchMeta: %v", err)
+	}
+	if err := store.Delete(ids[2]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	texts := func() map[int]string {
+		t.Helper()
+		chunks, err := store.DocumentChunks("doc", 0, 2)
+		if err != nil {
+			t.Fatalf("DocumentChunks: %v", err)
+		}
+		out := map[int]string{}
+		for chunk, md := range chunks {
+			out[chunk] = md.Text
+		}
+		return out
+	}
+	want := map[int]string{0: "zero", 1: "one again"}
+	if got := texts(); !maps.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	if err := store.Delete(ids[4]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	want[1] = "one"
+	if got := texts(); !maps.Equal(got, want) {
+		t.Fatalf("expected %v after compaction, got %v", want, got)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package storage
+
+import "os"
+
+func flock(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func funlock(f *os.File) error {
+	return nil
+}
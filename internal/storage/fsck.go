@@ -0,0 +1,645 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+/*
+Offline consistency checks for a store directory, and repairs for what they
+find. Both work on the raw files rather than an open Store, since a store with
+a corrupt metadata line cannot be opened at all, and neither may run while the
+store is open.
+
+Check reports:
+  - files left behind by an interrupted compaction or restore
+  - a pending or torn WAL entry
+  - torn tails: a partial record at the end of data.bin or data.f32, or an
+    unterminated line at the end of a JSONL file
+  - vectors and metadata lines that fail their checksum
+  - metadata lines that are not valid JSON, and duplicate record IDs
+  - offsets in metadata.jsonl that are not the end offset of their vector
+  - vectors without metadata and metadata without a vector
+  - vectors with NaN or infinite components
+  - data.f32 disagreeing with data.bin
+
+Repair finishes or rolls back an interrupted compaction or restore, replays
+the WAL, cuts torn tails, rebuilds offsets, and moves records it cannot trust
+to quarantine.jsonl, together with their raw metadata line and vector bytes.
+The surviving records keep their IDs.
+*/
+
+const quarantineFileName = "quarantine.jsonl"
+
+// Suffix of the files written by Compact before they replace the originals
+const compactSuffix = ".compact"
+
+// Suffix of the files written by Repair before they replace the originals
+const repairSuffix = ".fsck"
+
+// A single problem found by Check
+type Issue struct {
+	File    string // Name of the file within the store directory
+	Pos     int    // Position of the record concerned, -1 if it is not about one record
+	Problem string
+	Fix     string // What Repair does about it
+}
+
+func (i Issue) String() string {
+	where := i.File
+	if i.Pos >= 0 {
+		where = fmt.Sprintf("%s, record %d", i.File, i.Pos)
+	}
+	return fmt.Sprintf("%s: %s (%s)", where, i.Problem, i.Fix)
+}
+
+// Result of checking a store directory
+type Report struct {
+	Header  VectorHeader
+	Vectors int // Whole records in data.bin
+	Records int // Lines in metadata.jsonl
+	Issues  []Issue
+
+	Quarantined int // Records moved to quarantine.jsonl by Repair
+}
+
+// Whether no problems were found
+func (r *Report) OK() bool {
+	return len(r.Issues) == 0
+}
+
+func (r *Report) add(file string, pos int, fix, format string, args ...any) {
+	r.Issues = append(r.Issues, Issue{File: file, Pos: pos, Problem: fmt.Sprintf(format, args...), Fix: fix})
+}
+
+// One record as found on disk
+type fsckRecord struct {
+	line []byte // Raw metadata line, nil if the record has none
+	md   EmbeddingMetaData
+	vec  []byte // Raw vector record with its checksum, nil if the record has none
+	f32  []byte // Full-precision copy, nil unless data.f32 is kept
+
+	bad string // Why the record is quarantined, empty if it is kept
+}
+
+type fsckState struct {
+	dir    string
+	report *Report
+	header VectorHeader
+
+	records    []fsckRecord
+	tombstones []uint64
+	dropF32    bool // data.f32 cannot be trusted and is dropped
+
+	compactLeftovers bool
+	restoreLeftovers bool
+	pendingWAL       bool
+}
+
+// Checks the store in dir for inconsistencies without changing anything.
+// Writers in other processes wait until the check is done.
+func Check(dir string) (*Report, error) {
+	release, err := lockDir(dir, false, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	st, err := scan(dir)
+	if err != nil {
+		return nil, err
+	}
+	return st.report, nil
+}
+
+// Checks the store in dir and repairs what it can, returning the problems
+// found before the repair. Other processes using the store wait until the
+// repair is done, and reload the repaired files.
+func Repair(dir string) (*Report, error) {
+	release, err := lockDir(dir, true, true)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	before, err := scan(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if before.compactLeftovers {
+		err = finishCompaction(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if before.restoreLeftovers {
+		err = finishRestore(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if before.pendingWAL {
+		err = replayWAL(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The files may have changed, so the rest works from a fresh scan
+	st, err := scan(dir)
+	if err != nil {
+		return nil, err
+	}
+	if st.report.OK() {
+		return before.report, nil
+	}
+
+	quarantined, err := st.rewriteFiles()
+	if err != nil {
+		return nil, err
+	}
+	before.report.Quarantined = quarantined
+	return before.report, nil
+}
+
+func scan(dir string) (*fsckState, error) {
+	st := &fsckState{dir: dir, report: &Report{}}
+	r := st.report
+
+	for _, name := range []string{vectorFileName, metadataFileName, float32FileName} {
+		if _, err := os.Stat(filepath.Join(dir, name+compactSuffix)); err == nil {
+			r.add(name+compactSuffix, -1, "compaction finished or rolled back", "left behind by an interrupted compaction")
+			st.compactLeftovers = true
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, restoreMarkerFileName)); err == nil {
+		r.add(restoreMarkerFileName, -1, "restore finished", "left behind by an interrupted restore")
+		st.restoreLeftovers = true
+	} else if staged, _ := filepath.Glob(filepath.Join(dir, "*"+restoreSuffix)); len(staged) > 0 {
+		r.add(filepath.Base(staged[0]), -1, "removed", "staged by a restore that never started")
+		st.restoreLeftovers = true
+	}
+
+	walData, err := os.ReadFile(filepath.Join(dir, walFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read wal: %w", err)
+	}
+	if len(walData) > 0 {
+		st.pendingWAL = true
+		if _, err := decodeWALEntry(walData); err != nil {
+			r.add(walFileName, -1, "discarded", "torn entry from an append that never started")
+		} else {
+			r.add(walFileName, -1, "replayed", "holds an append that was never confirmed")
+		}
+	}
+	if st.compactLeftovers || st.restoreLeftovers || st.pendingWAL {
+		// Opening the store would resolve these, what is on disk now is
+		// about to change
+		return st, st.checkHeaderOnly()
+	}
+
+	vecData, err := st.readVectors()
+	if err != nil {
+		return nil, err
+	}
+	lines, err := st.readJSONL(metadataFileName)
+	if err != nil {
+		return nil, err
+	}
+	r.Vectors = len(vecData) / st.header.recordSize()
+	r.Records = len(lines)
+
+	st.buildRecords(vecData, lines)
+	err = st.readFloat32()
+	if err != nil {
+		return nil, err
+	}
+	st.checkVectors()
+
+	tombLines, err := st.readJSONL(tombstoneFileName)
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range tombLines {
+		var ts tombstone
+		if json.Unmarshal(line, &ts) != nil || ts.ID == 0 {
+			r.add(tombstoneFileName, -1, "dropped", "line %d is not a valid tombstone", i+1)
+			continue
+		}
+		st.tombstones = append(st.tombstones, ts.ID)
+	}
+
+	for pos, rec := range st.records {
+		if rec.bad == "" {
+			continue
+		}
+		file := metadataFileName
+		if rec.line == nil {
+			file = vectorFileName
+		}
+		r.add(file, pos, "moved to "+quarantineFileName, "%s", rec.bad)
+	}
+	return st, nil
+}
+
+func (st *fsckState) checkHeaderOnly() error {
+	file, err := os.Open(filepath.Join(st.dir, vectorFileName))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", vectorFileName, err)
+	}
+	defer file.Close()
+
+	st.header, err = readVectorHeader(file, defaultDimension)
+	st.report.Header = st.header
+	return err
+}
+
+// Reads the header and the whole records of data.bin, noting a torn tail
+func (st *fsckState) readVectors() ([]byte, error) {
+	err := st.checkHeaderOnly()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(st.dir, vectorFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", vectorFileName, err)
+	}
+	body := data[st.header.Size:]
+
+	size := st.header.recordSize()
+	if tail := len(body) % size; tail != 0 {
+		st.report.add(vectorFileName, -1, "truncated", "torn tail of %d bytes after the last whole %d-byte record", tail, size)
+		body = body[:len(body)-tail]
+	}
+	return body, nil
+}
+
+// Reads the non-empty lines of a JSONL file, noting an unterminated last line
+func (st *fsckState) readJSONL(name string) ([][]byte, error) {
+	data, err := os.ReadFile(filepath.Join(st.dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+
+	var lines [][]byte
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			if json.Valid(data) {
+				st.report.add(name, -1, "newline added", "last line is not terminated")
+				lines = append(lines, data)
+			} else {
+				st.report.add(name, -1, "truncated", "torn final line of %d bytes", len(data))
+			}
+			break
+		}
+		if len(bytes.TrimSpace(data[:i])) > 0 {
+			lines = append(lines, data[:i])
+		} else if len(data) > i+1 {
+			st.report.add(name, -1, "removed", "blank line after line %d", len(lines))
+		}
+		data = data[i+1:]
+	}
+	return lines, nil
+}
+
+// Pairs vectors with metadata lines by position and checks every line
+func (st *fsckState) buildRecords(vecData []byte, lines [][]byte) {
+	size := st.header.recordSize()
+	n := max(len(vecData)/size, len(lines))
+	st.records = make([]fsckRecord, n)
+
+	seen := map[uint64]int{}
+	for pos := range st.records {
+		rec := &st.records[pos]
+		if (pos+1)*size <= len(vecData) {
+			rec.vec = vecData[pos*size : (pos+1)*size]
+		}
+		if pos < len(lines) {
+			rec.line = lines[pos]
+		}
+
+		switch {
+		case rec.vec == nil:
+			rec.bad = "metadata line has no vector in " + vectorFileName
+		case rec.line == nil:
+			rec.bad = "vector has no metadata line in " + metadataFileName
+		}
+		if rec.line == nil {
+			continue
+		}
+
+		err := json.Unmarshal(rec.line, &rec.md)
+		if err != nil {
+			rec.bad = fmt.Sprintf("metadata line is not valid JSON: %v", err)
+			rec.md.ID = salvageID(rec.line)
+			continue
+		}
+		if present, ok := checkLine(rec.line); present && !ok {
+			rec.bad = "metadata line fails its checksum"
+		} else if !present && st.header.Checksums {
+			rec.bad = "metadata line has no checksum"
+		}
+		if rec.md.ID == 0 {
+			rec.md.ID = uint64(pos) + 1 // Written before records had IDs
+		}
+		if first, ok := seen[rec.md.ID]; ok {
+			rec.bad = fmt.Sprintf("ID %d was already used by record %d", rec.md.ID, first)
+			continue
+		}
+		seen[rec.md.ID] = pos
+
+		if want := (pos + 1) * size; rec.md.Offset != want && rec.bad == "" {
+			st.report.add(metadataFileName, pos, "rebuilt", "offset %d, expected %d", rec.md.Offset, want)
+		}
+	}
+}
+
+var idPattern = regexp.MustCompile(`"ID":(\d+)`)
+
+// Recovers the ID from a metadata line that no longer parses, or 0 if it is
+// gone too
+func salvageID(line []byte) uint64 {
+	m := idPattern.FindSubmatch(line)
+	if m == nil {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(m[1]), 10, 64)
+	return id
+}
+
+// Pairs full-precision copies with records, dropping data.f32 if it does not
+// match data.bin
+func (st *fsckState) readFloat32() error {
+	path := filepath.Join(st.dir, float32FileName)
+	if !st.header.Float32Copy {
+		if _, err := os.Stat(path); err == nil {
+			st.report.add(float32FileName, -1, "removed", "store does not keep full-precision copies")
+		}
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		st.report.add(float32FileName, -1, "copies dropped, rescoring disabled", "missing although the header says full-precision copies are kept")
+		st.dropF32 = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", float32FileName, err)
+	}
+
+	size := st.header.Dimension * 4
+	if len(data) != st.report.Vectors*size {
+		st.report.add(float32FileName, -1, "copies dropped, rescoring disabled", "holds %d bytes, expected %d for %d vectors", len(data), st.report.Vectors*size, st.report.Vectors)
+		st.dropF32 = true
+		return nil
+	}
+	for pos := range st.records {
+		if (pos+1)*size <= len(data) {
+			st.records[pos].f32 = data[pos*size : (pos+1)*size]
+		}
+	}
+	return nil
+}
+
+// Flags vectors that fail their checksum or have NaN or infinite components,
+// which poison every score
+func (st *fsckState) checkVectors() {
+	for pos := range st.records {
+		rec := &st.records[pos]
+		if rec.vec == nil || rec.bad != "" {
+			continue
+		}
+		if st.header.Checksums && !validRecord(rec.vec) {
+			rec.bad = "vector record fails its checksum"
+			continue
+		}
+		payload := rec.vec[:st.header.DType.recordSize(st.header.Dimension)]
+		for _, x := range decodeVector(st.header.DType, payload, st.header.Dimension) {
+			if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) {
+				rec.bad = "vector has NaN or infinite components"
+				break
+			}
+		}
+	}
+}
+
+// A quarantined record, as written to quarantine.jsonl
+type quarantined struct {
+	Pos      int
+	Problem  string
+	Time     time.Time
+	Metadata string `json:",omitempty"` // Raw metadata line
+	Vector   []byte `json:",omitempty"` // Raw vector record, base64 in JSON
+}
+
+// Writes the trusted records to fresh files and swaps them in, moving the
+// rest to quarantine.jsonl
+func (st *fsckState) rewriteFiles() (int, error) {
+	h := st.header
+	if h.Legacy() {
+		h = newVectorHeader(h.Dimension, h.DType, h.Model)
+	}
+	if st.dropF32 {
+		h.Float32Copy = false
+	}
+
+	var vecOut, mdOut, f32Out, tsOut, qOut bytes.Buffer
+	vecOut.Write(h.encode())
+
+	now := time.Now().UTC()
+	size := h.recordSize()
+	kept, bad := 0, 0
+	var maxKept, maxBad, prevID uint64
+	for pos, rec := range st.records {
+		if rec.bad != "" {
+			q, err := json.Marshal(quarantined{Pos: pos, Problem: rec.bad, Time: now, Metadata: string(rec.line), Vector: rec.vec})
+			if err != nil {
+				return 0, fmt.Errorf("failed to encode quarantined record: %w", err)
+			}
+			qOut.Write(append(q, '\n'))
+			// IDs grow with position, so a record whose ID is lost had at least
+			// the one after its predecessor's
+			prevID = max(prevID+1, rec.md.ID)
+			maxBad = max(maxBad, prevID)
+			bad++
+			continue
+		}
+
+		kept++
+		md := rec.md
+		md.Offset = kept * size
+		line, err := encodeMetaData(md)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode metadata: %w", err)
+		}
+		mdOut.Write(line)
+		if h.Checksums && !st.header.Checksums {
+			vecOut.Write(appendRecordChecksum(bytes.Clone(rec.vec)))
+		} else {
+			vecOut.Write(rec.vec)
+		}
+		if h.Float32Copy {
+			f32Out.Write(rec.f32)
+		}
+		maxKept = max(maxKept, md.ID)
+		prevID = md.ID
+	}
+
+	for _, id := range st.tombstones {
+		b, _ := json.Marshal(tombstone{ID: id})
+		tsOut.Write(append(b, '\n'))
+	}
+	if maxBad > maxKept {
+		// Keep the ID watermark so quarantined IDs are never handed out again
+		b, _ := json.Marshal(tombstone{ID: maxBad})
+		tsOut.Write(append(b, '\n'))
+	}
+
+	if bad > 0 {
+		f, err := os.OpenFile(filepath.Join(st.dir, quarantineFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open %s: %w", quarantineFileName, err)
+		}
+		_, err = f.Write(qOut.Bytes())
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to write %s: %w", quarantineFileName, err)
+		}
+	}
+
+	outputs := []struct {
+		name string
+		data []byte
+	}{
+		{vectorFileName, vecOut.Bytes()},
+		{metadataFileName, mdOut.Bytes()},
+		{tombstoneFileName, tsOut.Bytes()},
+	}
+	if h.Float32Copy {
+		outputs = append(outputs, struct {
+			name string
+			data []byte
+		}{float32FileName, f32Out.Bytes()})
+	}
+
+	for _, out := range outputs {
+		err := writeFileSynced(filepath.Join(st.dir, out.name+repairSuffix), out.data)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// Rebuilt from the repaired metadata when the store is next opened
+	err := os.Remove(filepath.Join(st.dir, offsetsFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to remove %s: %w", offsetsFileName, err)
+	}
+	for _, out := range outputs {
+		path := filepath.Join(st.dir, out.name)
+		err := os.Rename(path+repairSuffix, path)
+		if err != nil {
+			return 0, fmt.Errorf("failed to replace %s: %w", out.name, err)
+		}
+	}
+	if !h.Float32Copy {
+		err := os.Remove(filepath.Join(st.dir, float32FileName))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("failed to remove %s: %w", float32FileName, err)
+		}
+	}
+	return bad, nil
+}
+
+func writeFileSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Base(path), err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// Resolves a compaction that stopped part way. Compact renames data.bin, then
+// metadata.jsonl, then data.f32 into place, so a compacted data.bin still
+// waiting means nothing was replaced yet and the originals are kept, while a
+// missing one means the remaining files have to follow it. Opening a store
+// and catching up with other processes call it with the store locked for
+// writing, so the files are never read half replaced.
+func finishCompaction(dir string) error {
+	tmp := func(name string) string { return filepath.Join(dir, name+compactSuffix) }
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	// documents.jsonl is replaced last and only loses documents, so a
+	// rewrite left behind is never needed
+	err := os.Remove(tmp(documentsFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", filepath.Base(tmp(documentsFileName)), err)
+	}
+
+	names := []string{vectorFileName, metadataFileName, float32FileName}
+	if exists(tmp(vectorFileName)) {
+		for _, name := range names {
+			err := os.Remove(tmp(name))
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove %s: %w", filepath.Base(tmp(name)), err)
+			}
+		}
+		return nil
+	}
+
+	for _, name := range names[1:] {
+		if !exists(tmp(name)) {
+			continue
+		}
+		err := os.Rename(tmp(name), filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("failed to replace %s: %w", name, err)
+		}
+	}
+	// Tombstones for the compacted records are left alone, they are harmless
+	// and may hold the ID watermark
+	return nil
+}
+
+// Replays or discards the pending WAL entry, as opening the store would
+func replayWAL(dir string) error {
+	s := &Store{dir: dir}
+	err := s.openFiles()
+	if err != nil {
+		return err
+	}
+	return errors.Join(s.recover(), s.closeFiles())
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+// Writes n records with texts doc-0, doc-1, ... and closes the store
+func writeFsckStore(t *testing.T, dir string, n int) {
+	t.Helper()
+	store, err := Open(dir, Options{Dimension: embeddingSize})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	vecs := make([]embedding.EmbeddingVector, n)
+	texts := make([]string, n)
+	for i := range vecs {
+		vecs[i] = newSparseVector(map[int]float32{i % embeddingSize: 1})
+		texts[i] = "doc-" + string(rune('0'+i))
+	}
+	if _, err := store.AppendBatch(vecs, texts); err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func editFile(t *testing.T, path string, edit func([]byte) []byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	if err := os.WriteFile(path, edit(data), 0o644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+// Repairs dir, checks it is clean afterwards and opens it
+func repairAndOpen(t *testing.T, dir string) (*Report, *Store) {
+	t.Helper()
+	report, err := Repair(dir)
+	if err != nil {
+		t.Fatalf("Repair: %v", err)
+	}
+	after, err := Check(dir)
+	if err != nil {
+		t.Fatalf("Check after repair: %v", err)
+	}
+	if !after.OK() {
+		t.Fatalf("expected a clean store after repair, got %v", after.Issues)
+	}
+
+	store, err := Open(dir, Options{Dimension: embeddingSize})
+	if err != nil {
+		t.Fatalf("open after repair: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return report, store
+}
+
+func TestCheckCleanStore(t *testing.T) {
+	dir := t.TempDir()
+	writeFsckStore(t, dir, 3)
+
+	report, err := Check(dir)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if !report.OK() || report.Vectors != 3 || report.Records != 3 {
+		t.Fatalf("expected 3 consistent records, got %+v", report)
+	}
+}
+
+func TestRepairCutsTornTails(t *testing.T) {
+	dir := t.TempDir()
+	writeFsckStore(t, dir, 3)
+	appendGarbage(vectorFileName, 700)(t, dir)
+	editFile(t, filepath.Join(dir, metadataFileName), func(b []byte) []byte {
+		return append(b, `{"ID":4,"Off`...)
+	})
+
+	report, err := Check(dir)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if len(report.Issues) != 2 || report.Issues[0].Fix != "truncated" || report.Issues[1].Fix != "truncated" {
+		t.Fatalf("expected two torn tails, got %v", report.Issues)
+	}
+
+	report, store := repairAndOpen(t, dir)
+	if report.Quarantined != 0 {
+		t.Fatalf("expected nothing quarantined, got %d", report.Quarantined)
+	}
+	if n, _ := store.Len(); n != 3 {
+		t.Fatalf("expected 3 records after repair, got %d", n)
+	}
+}
+
+func TestRepairQuarantinesCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+	writeFsckStore(t, dir, 4)
+	editFile(t, filepath.Join(dir, metadataFileName), func(b []byte) []byte {
+		lines := strings.Split(string(b), "\n")
+		lines[1] = `{"ID":2,"Offset":3072,"Text":"doc-1"` // Missing brace
+		return []byte(strings.Join(lines, "\n"))
+	})
+
+	if _, err := Open(dir, Options{Dimension: embeddingSize}); err == nil {
+		t.Fatalf("expected the corrupt line to stop the store from opening")
+	}
+
+	report, store := repairAndOpen(t, dir)
+	if report.Quarantined != 1 || report.Issues[0].Pos != 1 {
+		t.Fatalf("expected record 1 to be quarantined, got %+v", report)
+	}
+
+	// The surviving records keep their IDs and texts
+	for pos, want := range []struct {
+		id   uint64
+		text string
+	}{{1, "doc-0"}, {3, "doc-2"}, {4, "doc-3"}} {
+		rec, err := store.Get(pos)
+		if err != nil {
+			t.Fatalf("Get(%d): %v", pos, err)
+		}
+		if rec.Meta.ID != want.id || rec.Meta.Text != want.text {
+			t.Fatalf("position %d: expected ID %d %q, got %d %q", pos, want.id, want.text, rec.Meta.ID, rec.Meta.Text)
+		}
+		if rec.Meta.Offset != (pos+1)*testRecordSize {
+			t.Fatalf("position %d: expected rebuilt offset %d, got %d", pos, (pos+1)*testRecordSize, rec.Meta.Offset)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, quarantineFileName))
+	if err != nil {
+		t.Fatalf("read quarantine: %v", err)
+	}
+	var q quarantined
+	if err := json.Unmarshal(bytes.TrimSpace(data), &q); err != nil {
+		t.Fatalf("decode quarantine: %v", err)
+	}
+	if q.Pos != 1 || !strings.Contains(q.Metadata, "doc-1") || len(q.Vector) != testRecordSize {
+		t.Fatalf("expected the raw record in quarantine, got %+v", q)
+	}
+}
+
+func TestRepairKeepsIDWatermarkOfQuarantinedTail(t *testing.T) {
+	dir := t.TempDir()
+	writeFsckStore(t, dir, 3)
+	editFile(t, filepath.Join(dir, metadataFileName), func(b []byte) []byte {
+		return bytes.Replace(b, []byte(`"Text":"doc-2"`), []byte(`"Text":doc-2`), 1)
+	})
+
+	_, store := repairAndOpen(t, dir)
+	id, err := store.Append(newSparseVector(map[int]float32{9: 1}), "new")
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if id != 4 {
+		t.Fatalf("expected quarantined ID 3 not to be reused, got %d", id)
+	}
+}
+
+func TestRepairRebuildsOffsetsAndMissingVectors(t *testing.T) {
+	dir := t.TempDir()
+	writeFsckStore(t, dir, 3)
+	editFile(t, filepath.Join(dir, metadataFileName), func(b []byte) []byte {
+		lines := bytes.SplitAfter(b, []byte("\n"))
+		wrong, _ := encodeMetaData(EmbeddingMetaData{ID: 1, Offset: 7, Text: "doc-0"})
+		orphan, _ := encodeMetaData(EmbeddingMetaData{ID: 4, Offset: 4 * testRecordSize, Text: "orphan"})
+		return bytes.Join([][]byte{wrong, lines[1], lines[2], orphan}, nil)
+	})
+
+	report, err := Check(dir)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if len(report.Issues) != 2 || report.Issues[0].Fix != "rebuilt" || report.Issues[1].Pos != 3 {
+		t.Fatalf("expected a bad offset and an orphaned line, got %v", report.Issues)
+	}
+
+	report, store := repairAndOpen(t, dir)
+	if report.Quarantined != 1 {
+		t.Fatalf("expected the orphaned line to be quarantined, got %d", report.Quarantined)
+	}
+	rec, err := store.Get(0)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if rec.Meta.Offset != testRecordSize {
+		t.Fatalf("expected rebuilt offset %d, got %d", testRecordSize, rec.Meta.Offset)
+	}
+}
+
+func TestRepairFinishesInterruptedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, Options{Dimension: embeddingSize})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ids, err := store.AppendBatch([]embedding.EmbeddingVector{
+		newSparseVector(map[int]float32{0: 1}),
+		newSparseVector(map[int]float32{1: 1}),
+	}, []string{"gone", "kept"})
+	if err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+	if err := store.Delete(ids[0]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	// Crash after data.bin was replaced but before metadata.jsonl was
+	vecTmp := filepath.Join(dir, vectorFileName+compactSuffix)
+	mdTmp := filepath.Join(dir, metadataFileName+compactSuffix)
+	if err := store.writeCompacted(vecTmp, mdTmp, ""); err != nil {
+		t.Fatalf("writeCompacted: %v", err)
+	}
+	store.Close()
+	if err := os.Rename(vecTmp, filepath.Join(dir, vectorFileName)); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+
+	report, reopened := repairAndOpen(t, dir)
+	if report.Issues[0].File != metadataFileName+compactSuffix {
+		t.Fatalf("expected the leftover metadata to be reported, got %v", report.Issues)
+	}
+	rec, err := reopened.Get(0)
+	if err != nil || rec.Meta.Text != "kept" {
+		t.Fatalf("expected the compacted record, got %+v, %v", rec.Meta, err)
+	}
+}
+
+func TestRepairReplaysPendingWAL(t *testing.T) {
+	dir := t.TempDir()
+	writeFsckStore(t, dir, 1)
+	store, err := Open(dir, Options{Dimension: embeddingSize})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	crashAt = func(step txStep) bool { return step == txVectorsSynced }
+	t.Cleanup(func() { crashAt = nil })
+	if _, err := store.Append(newSparseVector(map[int]float32{1: 1}), "in flight"); err != errSimulatedCrash {
+		t.Fatalf("expected simulated crash, got %v", err)
+	}
+	crashAt = nil
+	store.Close()
+
+	report, err := Check(dir)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Fix != "replayed" {
+		t.Fatalf("expected a pending wal entry, got %v", report.Issues)
+	}
+
+	_, reopened := repairAndOpen(t, dir)
+	if n, _ := reopened.Len(); n != 2 {
+		t.Fatalf("expected the logged append to be replayed, got %d records", n)
+	}
+}
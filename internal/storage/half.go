@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+)
+
+/*
+Half-precision element types.
+
+float16 is IEEE 754 binary16: 1 sign bit, 5 exponent bits and 10 mantissa
+bits, about three significant decimal digits over ±65504. Components of a
+normalised embedding are well inside that range, so only precision is lost.
+
+bfloat16 keeps the 8 exponent bits of a float32 and cuts the mantissa to 7
+bits. It is the top half of a float32, which makes it cheap to convert but
+less precise than float16 for values near 1.
+
+Both are stored as little-endian u16s, 768 bytes for a 384-dim vector, and
+rounded to nearest even on write. They are scored without widening the whole
+vector first, see dotFloat16 and dotBFloat16.
+*/
+
+// Converts a float32 to IEEE binary16, rounding to nearest even
+func float32ToFloat16(f float32) uint16 {
+	b := math.Float32bits(f)
+	sign := uint16(b>>16) & 0x8000
+	exp := int32(b>>23) & 0xff
+	mant := b & 0x7fffff
+
+	switch {
+	case exp == 0xff:
+		// Inf stays Inf, NaN keeps a mantissa bit so it stays NaN
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exp-127 > 15:
+		return sign | 0x7c00
+	case exp-127 >= -14:
+		// Normal range, the carry of a rounded-up mantissa bumps the exponent
+		h := uint32(exp-127+15)<<10 | mant>>13
+		h += roundBit(mant, 13)
+		return sign | uint16(h)
+	case exp-127 >= -25:
+		// Subnormal, shift the implicit leading 1 into the mantissa
+		mant |= 0x800000
+		shift := uint32(-(exp - 127) - 14 + 13)
+		h := mant >> shift
+		h += roundBit(mant, shift)
+		return sign | uint16(h)
+	default:
+		return sign
+	}
+}
+
+// 1 if dropping the low shift bits of m should round the rest up, with ties
+// going to even
+func roundBit(m uint32, shift uint32) uint32 {
+	half := uint32(1) << (shift - 1)
+	rest := m & (1<<shift - 1)
+	if rest > half || (rest == half && m&(1<<shift) != 0) {
+		return 1
+	}
+	return 0
+}
+
+// Widens an IEEE binary16 to a float32
+func float16ToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+
+	switch {
+	case exp == 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	case exp == 0:
+		if mant == 0 {
+			return math.Float32frombits(sign)
+		}
+		// Subnormal, normalise it for float32
+		e := uint32(127 - 15 + 1)
+		for mant&0x400 == 0 {
+			mant <<= 1
+			e--
+		}
+		return math.Float32frombits(sign | e<<23 | (mant&0x3ff)<<13)
+	default:
+		return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+	}
+}
+
+// Every float16 widened, so decoding and scoring are a table lookup
+var float16Table = sync.OnceValue(func() []float32 {
+	t := make([]float32, 1<<16)
+	for i := range t {
+		t[i] = float16ToFloat32(uint16(i))
+	}
+	return t
+})
+
+// Converts a float32 to bfloat16, rounding to nearest even
+func float32ToBFloat16(f float32) uint16 {
+	b := math.Float32bits(f)
+	if b&0x7f800000 == 0x7f800000 && b&0x7fffff != 0 {
+		return uint16(b>>16) | 0x40
+	}
+	b += 0x7fff + (b>>16)&1
+	return uint16(b >> 16)
+}
+
+func bfloat16ToFloat32(h uint16) float32 {
+	return math.Float32frombits(uint32(h) << 16)
+}
+
+// Encodes v as a record of little-endian float16s
+func encodeFloat16(v []float32) []byte {
+	out := make([]byte, len(v)*2)
+	for i, x := range v {
+		binary.LittleEndian.PutUint16(out[i*2:], float32ToFloat16(x))
+	}
+	return out
+}
+
+func encodeBFloat16(v []float32) []byte {
+	out := make([]byte, len(v)*2)
+	for i, x := range v {
+		binary.LittleEndian.PutUint16(out[i*2:], float32ToBFloat16(x))
+	}
+	return out
+}
+
+// Widens a float16 record, writing len(out) components
+func decodeFloat16(rec []byte, out []float32) {
+	table := float16Table()
+	for i := range out {
+		out[i] = table[binary.LittleEndian.Uint16(rec[i*2:])]
+	}
+}
+
+func decodeBFloat16(rec []byte, out []float32) {
+	for i := range out {
+		out[i] = bfloat16ToFloat32(binary.LittleEndian.Uint16(rec[i*2:]))
+	}
+}
+
+// Dot product of a float32 query with a float16 record
+func dotFloat16(q []float32, rec []byte, table []float32) float32 {
+	rec = rec[:len(q)*2]
+	var s0, s1 float32
+	i := 0
+	for ; i+2 <= len(q); i += 2 {
+		s0 += q[i] * table[uint16(rec[i*2])|uint16(rec[i*2+1])<<8]
+		s1 += q[i+1] * table[uint16(rec[i*2+2])|uint16(rec[i*2+3])<<8]
+	}
+	for ; i < len(q); i++ {
+		s0 += q[i] * table[uint16(rec[i*2])|uint16(rec[i*2+1])<<8]
+	}
+	return s0 + s1
+}
+
+// Dot product of a float32 query with a bfloat16 record
+func dotBFloat16(q []float32, rec []byte) float32 {
+	rec = rec[:len(q)*2]
+	var s0, s1 float32
+	i := 0
+	for ; i+2 <= len(q); i += 2 {
+		s0 += q[i] * math.Float32frombits(uint32(rec[i*2])<<16|uint32(rec[i*2+1])<<24)
+		s1 += q[i+1] * math.Float32frombits(uint32(rec[i*2+2])<<16|uint32(rec[i*2+3])<<24)
+	}
+	for ; i < len(q); i++ {
+		s0 += q[i] * math.Float32frombits(uint32(rec[i*2])<<16|uint32(rec[i*2+1])<<24)
+	}
+	return s0 + s1
+}
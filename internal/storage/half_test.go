@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+func TestFloat16Conversion(t *testing.T) {
+	cases := []struct {
+		f float32
+		h uint16
+	}{
+		{0, 0x0000},
+		{1, 0x3c00},
+		{-2, 0xc000},
+		{0.5, 0x3800},
+		{65504, 0x7bff},
+		{1e6, 0x7c00},                         // Overflows to Inf
+		{float32(math.Ldexp(1, -24)), 0x0001}, // Smallest subnormal
+		{float32(math.Ldexp(1, -26)), 0x0000}, // Underflows to zero
+		{1 + 1.0/2048, 0x3c00},                // Tie rounds to even
+		{1 + 3.0/2048, 0x3c02},                // Tie rounds to even, upwards
+		{float32(math.Inf(-1)), 0xfc00},
+	}
+	for _, c := range cases {
+		if got := float32ToFloat16(c.f); got != c.h {
+			t.Errorf("float32ToFloat16(%v) = %#04x, want %#04x", c.f, got, c.h)
+		}
+	}
+
+	if h := float32ToFloat16(float32(math.NaN())); !math.IsNaN(float64(float16ToFloat32(h))) {
+		t.Errorf("NaN did not survive a round trip, got %#04x", h)
+	}
+
+	// Every finite float16 widens to a float32 that narrows back to itself
+	for i := range 1 << 16 {
+		h := uint16(i)
+		f := float16ToFloat32(h)
+		if math.IsNaN(float64(f)) {
+			continue
+		}
+		if got := float32ToFloat16(f); got != h {
+			t.Fatalf("%#04x widened to %v and narrowed to %#04x", h, f, got)
+		}
+	}
+}
+
+func TestBFloat16Conversion(t *testing.T) {
+	cases := []struct {
+		f float32
+		h uint16
+	}{
+		{1, 0x3f80},
+		{-2, 0xc000},
+		{1 + 1.0/256, 0x3f80}, // Tie rounds to even
+		{1 + 3.0/256, 0x3f82}, // Tie rounds to even, upwards
+	}
+	for _, c := range cases {
+		if got := float32ToBFloat16(c.f); got != c.h {
+			t.Errorf("float32ToBFloat16(%v) = %#04x, want %#04x", c.f, got, c.h)
+		}
+	}
+	if h := float32ToBFloat16(float32(math.NaN())); !math.IsNaN(float64(bfloat16ToFloat32(h))) {
+		t.Errorf("NaN did not survive a round trip, got %#04x", h)
+	}
+}
+
+func TestHalfKernels(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	v := randomUnitVector(rng)
+	q := randomUnitVector(rng)
+
+	var exact float32
+	for i := range v {
+		exact += q[i] * v[i]
+	}
+
+	for _, dtype := range []DType{DTypeFloat16, DTypeBFloat16} {
+		rec := encodeVector(dtype, v)
+		if len(rec) != 768 {
+			t.Fatalf("expected a 768-byte %s record for 384 dims, got %d", dtype, len(rec))
+		}
+		back := decodeVector(dtype, rec, len(v))
+
+		var want float32
+		for i := range v {
+			want += q[i] * back[i]
+		}
+		var got float32
+		if dtype == DTypeFloat16 {
+			got = dotFloat16(q, rec, float16Table())
+		} else {
+			got = dotBFloat16(q, rec)
+		}
+		if abs(got-want) > 1e-5 {
+			t.Fatalf("%s kernel gave %v, widened dot gave %v", dtype, got, want)
+		}
+		if abs(got-exact) > 2e-3 {
+			t.Fatalf("%s dot %v too far from exact %v", dtype, got, exact)
+		}
+	}
+}
+
+func TestHalfStoreIsHalfSize(t *testing.T) {
+	for _, dtype := range []DType{DTypeFloat16, DTypeBFloat16} {
+		dir := t.TempDir()
+		store, err := Open(dir, Options{Dimension: embeddingSize, DType: dtype})
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+
+		rng := rand.New(rand.NewPCG(3, 4))
+		vecs := make([]embedding.EmbeddingVector, 100)
+		texts := make([]string, len(vecs))
+		for i := range vecs {
+			vecs[i] = randomUnitVector(rng)
+			texts[i] = "doc"
+		}
+		if _, err := store.AppendBatch(vecs, texts); err != nil {
+			t.Fatalf("AppendBatch: %v", err)
+		}
+
+		info, err := os.Stat(filepath.Join(dir, vectorFileName))
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		if vectorBytes := int(info.Size()) - store.Header().Size; vectorBytes != 100*(embeddingSize*2+checksumSize) {
+			t.Fatalf("expected %d bytes of %s vectors, got %d", 100*(embeddingSize*2+checksumSize), dtype, vectorBytes)
+		}
+
+		view, err := store.View()
+		if err != nil {
+			t.Fatalf("View: %v", err)
+		}
+		sim, _ := view.At(42).NormedCosineSimilarity(vecs[42])
+		if sim < 0.9999 {
+			t.Fatalf("expected widened %s vector to match the original, similarity %v", dtype, sim)
+		}
+		view.Close()
+		store.Close()
+
+		// Records of one type are never read as another
+		for _, other := range []DType{DTypeFloat32, DTypeInt8, DTypeFloat16, DTypeBFloat16} {
+			if other == dtype {
+				continue
+			}
+			if _, err := Open(dir, Options{DType: other}); !errors.Is(err, ErrIncompatibleHeader) {
+				t.Fatalf("expected ErrIncompatibleHeader opening %s as %s, got %v", dtype, other, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+Every data.bin written by this version starts with a self-describing header so
+the file can be validated before any vectors are read from it.
+
+Layout (little-endian), padded with zeros to a multiple of 64 bytes so the
+vectors that follow stay aligned:
+
+	0   magic "GVEC"
+	4   format version u16
+	6   element type u8
+	7   flags u8, bit 0 set when float32 copies are kept in data.f32, bit 1
+	    when every record is followed by its checksum, see checksum.go
+	8   dimension u32
+	12  total header size u32
+	16  model identity length u16
+	18  reserved, zero
+	32  model identity bytes
+
+Quantized element types still take their parameters from each record, see
+quant.go, so the header only has to say which type the records are. Half
+precision records are plain 2-byte elements, see half.go.
+
+Files written before the header existed are raw float32 vectors from byte 0.
+They are still readable as the legacy format and are upgraded on compaction.
+*/
+
+const (
+	flagFloat32Copy = 1 << 0
+	flagChecksums   = 1 << 1
+)
+
+const (
+	headerVersion   = 1
+	headerFixedSize = 32
+	headerAlign     = 64
+)
+
+var headerMagic = []byte("GVEC")
+
+var (
+	ErrUnrecognisedFile   = errors.New("storage: data file is not a go-vect vector file")
+	ErrIncompatibleHeader = errors.New("storage: vector file does not match store options")
+)
+
+// Element type of the stored vectors
+type DType uint8
+
+const (
+	DTypeFloat32  DType = 1
+	DTypeInt8     DType = 2 // Scalar quantized with a scale and offset per vector
+	DTypeFloat16  DType = 3 // IEEE half precision, see half.go
+	DTypeBFloat16 DType = 4 // Top 16 bits of a float32
+)
+
+func (d DType) String() string {
+	switch d {
+	case DTypeFloat32:
+		return "float32"
+	case DTypeInt8:
+		return "int8"
+	case DTypeFloat16:
+		return "float16"
+	case DTypeBFloat16:
+		return "bfloat16"
+	default:
+		return fmt.Sprintf("dtype(%d)", uint8(d))
+	}
+}
+
+// Bytes a single element of this type takes up on disk
+func (d DType) Size() int {
+	switch d {
+	case DTypeFloat32:
+		return 4
+	case DTypeInt8:
+		return 1
+	case DTypeFloat16, DTypeBFloat16:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// Bytes a whole vector of length dim takes up on disk
+func (d DType) recordSize(dim int) int {
+	switch d {
+	case DTypeInt8:
+		return int8RecordSize(dim)
+	default:
+		return dim * d.Size()
+	}
+}
+
+// Parses the name of an element type, as returned by String
+func ParseDType(name string) (DType, error) {
+	for _, d := range []DType{DTypeFloat32, DTypeInt8, DTypeFloat16, DTypeBFloat16} {
+		if d.String() == name {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("storage: unknown element type %q", name)
+}
+
+type VectorHeader struct {
+	Version   uint16
+	DType     DType
+	Dimension int
+	Model     string // Identity of the embedding model that produced the vectors
+	Size      int    // Bytes the header takes up on disk, 0 for legacy files
+
+	Float32Copy bool // Full-precision copies of quantized vectors are kept for rescoring
+	Checksums   bool // Every record in data.bin is followed by its CRC-32C
+}
+
+// Bytes a whole record takes up in the data file, checksum included
+func (h VectorHeader) recordSize() int {
+	size := h.DType.recordSize(h.Dimension)
+	if h.Checksums {
+		size += checksumSize
+	}
+	return size
+}
+
+// Whether this describes a headerless file from before versioning
+func (h VectorHeader) Legacy() bool {
+	return h.Size == 0
+}
+
+func newVectorHeader(dim int, dtype DType, model string) VectorHeader {
+	size := headerFixedSize + len(model)
+	size = (size + headerAlign - 1) / headerAlign * headerAlign
+
+	return VectorHeader{
+		Version:   headerVersion,
+		DType:     dtype,
+		Dimension: dim,
+		Model:     model,
+		Size:      size,
+		Checksums: true,
+	}
+}
+
+func (h VectorHeader) encode() []byte {
+	out := make([]byte, h.Size)
+	copy(out[0:4], headerMagic)
+	binary.LittleEndian.PutUint16(out[4:6], h.Version)
+	out[6] = byte(h.DType)
+	if h.Float32Copy {
+		out[7] |= flagFloat32Copy
+	}
+	if h.Checksums {
+		out[7] |= flagChecksums
+	}
+	binary.LittleEndian.PutUint32(out[8:12], uint32(h.Dimension))
+	binary.LittleEndian.PutUint32(out[12:16], uint32(h.Size))
+	binary.LittleEndian.PutUint16(out[16:18], uint16(len(h.Model)))
+	copy(out[headerFixedSize:], h.Model)
+	return out
+}
+
+// Reads the header at the start of file. Files without the magic bytes are
+// treated as legacy raw float32 vectors of dimension legacyDim.
+func readVectorHeader(file *os.File, legacyDim int) (VectorHeader, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return VectorHeader{}, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	fixed := make([]byte, headerFixedSize)
+	n, err := file.ReadAt(fixed, 0)
+	if err != nil && err != io.EOF {
+		return VectorHeader{}, fmt.Errorf("failed to read vector file header: %w", err)
+	}
+
+	if n < len(headerMagic) || string(fixed[0:4]) != string(headerMagic) {
+		if info.Size()%int64(legacyDim*4) != 0 {
+			return VectorHeader{}, fmt.Errorf("%w: %d bytes is not a whole number of %d-dim vectors", ErrUnrecognisedFile, info.Size(), legacyDim)
+		}
+		return VectorHeader{Version: 0, DType: DTypeFloat32, Dimension: legacyDim}, nil
+	}
+	if n < headerFixedSize {
+		return VectorHeader{}, fmt.Errorf("%w: truncated header", ErrUnrecognisedFile)
+	}
+
+	h := VectorHeader{
+		Version:   binary.LittleEndian.Uint16(fixed[4:6]),
+		DType:     DType(fixed[6]),
+		Dimension: int(binary.LittleEndian.Uint32(fixed[8:12])),
+		Size:      int(binary.LittleEndian.Uint32(fixed[12:16])),
+
+		Float32Copy: fixed[7]&flagFloat32Copy != 0,
+		Checksums:   fixed[7]&flagChecksums != 0,
+	}
+	if h.Version == 0 || h.Version > headerVersion {
+		return VectorHeader{}, fmt.Errorf("%w: unsupported format version %d", ErrUnrecognisedFile, h.Version)
+	}
+	if h.DType.Size() == 0 {
+		return VectorHeader{}, fmt.Errorf("%w: unknown element type %d", ErrUnrecognisedFile, h.DType)
+	}
+	if h.Dimension <= 0 {
+		return VectorHeader{}, fmt.Errorf("%w: invalid dimension %d", ErrUnrecognisedFile, h.Dimension)
+	}
+
+	modelLen := int(binary.LittleEndian.Uint16(fixed[16:18]))
+	if h.Size < headerFixedSize+modelLen || int64(h.Size) > info.Size() {
+		return VectorHeader{}, fmt.Errorf("%w: invalid header size %d", ErrUnrecognisedFile, h.Size)
+	}
+
+	model := make([]byte, modelLen)
+	_, err = file.ReadAt(model, headerFixedSize)
+	if err != nil {
+		return VectorHeader{}, fmt.Errorf("failed to read model identity: %w", err)
+	}
+	h.Model = string(model)
+
+	return h, nil
+}
+
+// Checks a header read from disk against the options the store was opened with
+func (h VectorHeader) validate(opts Options) error {
+	if opts.Dimension != 0 && h.Dimension != opts.Dimension {
+		return fmt.Errorf("%w: file holds %d-dim vectors, store opened for %d", ErrIncompatibleHeader, h.Dimension, opts.Dimension)
+	}
+	if opts.DType != 0 && h.DType != opts.DType {
+		return fmt.Errorf("%w: file holds %s vectors, store opened for %s", ErrIncompatibleHeader, h.DType, opts.DType)
+	}
+	if opts.Model != "" && h.Model != "" && h.Model != opts.Model {
+		return fmt.Errorf("%w: file was written by model %q, store opened for %q", ErrIncompatibleHeader, h.Model, opts.Model)
+	}
+	return nil
+}
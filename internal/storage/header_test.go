@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, Options{Dimension: 8, Model: "test/model-v1"})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	store.Close()
+
+	f, err := os.Open(filepath.Join(dir, vectorFileName))
+	if err != nil {
+		t.Fatalf("open data file: %v", err)
+	}
+	defer f.Close()
+
+	h, err := readVectorHeader(f, defaultDimension)
+	if err != nil {
+		t.Fatalf("readVectorHeader: %v", err)
+	}
+	if h.Version != headerVersion || h.DType != DTypeFloat32 || h.Dimension != 8 || h.Model != "test/model-v1" {
+		t.Fatalf("unexpected header %+v", h)
+	}
+	if h.Size%headerAlign != 0 {
+		t.Fatalf("expected header size to be %d-byte aligned, got %d", headerAlign, h.Size)
+	}
+}
+
+func TestOpenTakesDimensionFromHeader(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, Options{Dimension: 8})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	store.Close()
+
+	reopened, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+
+	if reopened.Dimension() != 8 {
+		t.Fatalf("expected dimension 8 from header, got %d", reopened.Dimension())
+	}
+}
+
+func TestOpenRejectsMismatchedHeader(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, Options{Dimension: 8, Model: "test/model-v1"})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	store.Close()
+
+	for _, opts := range []Options{
+		{Dimension: 16, Model: "test/model-v1"},
+		{Dimension: 8, Model: "test/model-v2"},
+	} {
+		if _, err := Open(dir, opts); !errors.Is(err, ErrIncompatibleHeader) {
+			t.Fatalf("opts %+v: expected ErrIncompatibleHeader, got %v", opts, err)
+		}
+	}
+}
+
+func TestOpenRejectsGarbage(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, vectorFileName), []byte("definitely not vectors"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if _, err := Open(dir, Options{Dimension: embeddingSize}); !errors.Is(err, ErrUnrecognisedFile) {
+		t.Fatalf("expected ErrUnrecognisedFile, got %v", err)
+	}
+}
+
+func TestOpenRejectsUnsupportedVersion(t *testing.T) {
+	dir := t.TempDir()
+	h := newVectorHeader(8, DTypeFloat32, "")
+	h.Version = headerVersion + 1
+	if err := os.WriteFile(filepath.Join(dir, vectorFileName), h.encode(), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if _, err := Open(dir, Options{}); !errors.Is(err, ErrUnrecognisedFile) {
+		t.Fatalf("expected ErrUnrecognisedFile, got %v", err)
+	}
+}
+
+// Writes a store in the headerless format used before versioning
+func writeLegacyStore(t *testing.T, dir string, texts []string) {
+	t.Helper()
+
+	var data, md []byte
+	for i, text := range texts {
+		data = append(data, vectorToByteSlice(newSparseVector(map[int]float32{i: 1}))...)
+		line, err := json.Marshal(map[string]any{"Offset": (i + 1) * embeddingSize * 4, "Text": text})
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		md = append(append(md, line...), '\n')
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, vectorFileName), data, 0o644); err != nil {
+		t.Fatalf("write data: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, metadataFileName), md, 0o644); err != nil {
+		t.Fatalf("write metadata: %v", err)
+	}
+}
+
+func TestLegacyHeaderlessStoreIsReadable(t *testing.T) {
+	dir := t.TempDir()
+	writeLegacyStore(t, dir, []string{"zero", "one"})
+
+	store, err := Open(dir, Options{Dimension: embeddingSize})
+	if err != nil {
+		t.Fatalf("open legacy store: %v", err)
+	}
+	defer store.Close()
+
+	if !store.Header().Legacy() {
+		t.Fatalf("expected legacy header, got %+v", store.Header())
+	}
+
+	rec, err := store.Get(1)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if rec.Meta.Text != "one" || rec.Vector[1] != 1 {
+		t.Fatalf("unexpected legacy record %+v", rec.Meta)
+	}
+
+	if _, err := store.Append(newSparseVector(map[int]float32{2: 1}), "two"); err != nil {
+		t.Fatalf("append to legacy store: %v", err)
+	}
+
+	// Compaction upgrades the file to the headered format
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if store.Header().Legacy() {
+		t.Fatalf("expected compaction to write a header")
+	}
+	rec, err = store.Get(2)
+	if err != nil {
+		t.Fatalf("Get after upgrade: %v", err)
+	}
+	if rec.Meta.Text != "two" || rec.Vector[2] != 1 {
+		t.Fatalf("unexpected record after upgrade %+v", rec.Meta)
+	}
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+// An Index is a secondary structure over the vectors of a store, such as an
+// ANN graph, that the store keeps in step as records are appended. Positions
+// are the same positions used by Get and Iterate.
+type Index interface {
+	// Number of leading positions the index already covers
+	Len() int
+	// Adds the vector at pos. v may alias the data file and must be copied
+	// if it is retained.
+	Add(pos int, v embedding.EmbeddingVector) error
+	// Drops everything, ready to be rebuilt from position 0
+	Reset() error
+	// Persists the index next to the data file
+	Save() error
+}
+
+// Attaches an index to the store. Any positions the index doesn't cover yet
+// are added straight away, so an index that was saved before a crash or
+// before more records were appended catches up here. From then on the index
+// is updated on every append, rebuilt after Clear and Compact, and saved on
+// Close.
+func (s *Store) AttachIndex(idx Index) error {
+	err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer s.unlock()
+
+	err = s.catchUp(idx)
+	if err != nil {
+		return err
+	}
+	s.indexes = append(s.indexes, idx)
+	return nil
+}
+
+func (s *Store) catchUp(idx Index) error {
+	view, err := s.view()
+	if err != nil {
+		return err
+	}
+	defer view.Close()
+
+	if idx.Len() > view.Len() {
+		// The store shrank underneath the index
+		err = idx.Reset()
+		if err != nil {
+			return fmt.Errorf("failed to reset index: %w", err)
+		}
+	}
+
+	for pos := idx.Len(); pos < view.Len(); pos++ {
+		err = idx.Add(pos, view.At(pos))
+		if err != nil {
+			return fmt.Errorf("failed to index vector %d: %w", pos, err)
+		}
+	}
+	return nil
+}
+
+// Adds freshly committed vectors starting at position first to every index
+func (s *Store) updateIndexes(first int, vectors []embedding.EmbeddingVector) error {
+	for _, idx := range s.indexes {
+		if idx.Len() != first {
+			// Out of step, e.g. after an earlier failed update
+			err := s.catchUp(idx)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		for i, v := range vectors {
+			err := idx.Add(first+i, v)
+			if err != nil {
+				return fmt.Errorf("failed to index vector %d: %w", first+i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Rebuilds every index after positions have changed
+func (s *Store) rebuildIndexes() error {
+	for _, idx := range s.indexes {
+		err := idx.Reset()
+		if err != nil {
+			return fmt.Errorf("failed to reset index: %w", err)
+		}
+		err = s.catchUp(idx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+// Records the positions it is given
+type recordingIndex struct {
+	positions []int
+	resets    int
+	saves     int
+}
+
+func (r *recordingIndex) Len() int { return len(r.positions) }
+
+func (r *recordingIndex) Add(pos int, v embedding.EmbeddingVector) error {
+	r.positions = append(r.positions, pos)
+	return nil
+}
+
+func (r *recordingIndex) Reset() error {
+	r.positions = nil
+	r.resets++
+	return nil
+}
+
+func (r *recordingIndex) Save() error {
+	r.saves++
+	return nil
+}
+
+func TestAttachedIndexFollowsStore(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+
+	for i := range 3 {
+		if _, err := store.Append(newSparseVector(map[int]float32{i: 1}), "doc"); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	idx := &recordingIndex{}
+	if err := store.AttachIndex(idx); err != nil {
+		t.Fatalf("AttachIndex: %v", err)
+	}
+	if idx.Len() != 3 {
+		t.Fatalf("expected index to catch up to 3 positions, got %d", idx.Len())
+	}
+
+	if _, err := store.AppendBatch([]embedding.EmbeddingVector{newSparseVector(map[int]float32{3: 1})}, []string{"more"}); err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+	if idx.Len() != 4 || idx.positions[3] != 3 {
+		t.Fatalf("expected append to reach the index, got %v", idx.positions)
+	}
+
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+	if idx.Len() != 0 || idx.resets != 1 {
+		t.Fatalf("expected Clear to reset the index, got %v after %d resets", idx.positions, idx.resets)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if idx.saves != 1 {
+		t.Fatalf("expected Close to save the index once, got %d", idx.saves)
+	}
+}
@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+Concurrency control, within a process and across processes.
+
+Inside a process a Store is guarded by a sync.RWMutex. Appends, deletes,
+Clear, Compact and Restore hold it for writing; Get, MetaData, Iterate, View
+and Snapshot hold it for reading, so goroutines can search while another is
+ingesting. ID and IsDeleted only take a second, innermost lock over the
+record IDs, because indexes call them with their own locks held.
+
+Across processes the store directory holds a LOCK file locked with flock(2),
+exclusively around every write and shared around every read. Only one writer
+runs at a time and readers stay concurrent. The lock is taken per operation
+rather than for the life of a Store, so the TUI and a script can both have a
+store open. Every operation first checks whether the files have changed since
+the Store last saw them: another process appended or deleted, compacted
+(replacing the files), or crashed part way through an append (leaving a WAL
+entry). If so the Store replays the WAL, reloads its positions and catches
+its indexes up before going on.
+
+Views are used after the lock is released. They stay valid because records in
+data.bin are never rewritten in place: the file only grows, and compaction,
+Clear and Restore replace it by renaming. Positions do move on compaction, so
+positions held across one refer to different records.
+
+Locks are advisory and only taken on platforms with flock(2).
+*/
+
+const lockFileName = "LOCK"
+
+// The flock on a store directory. Exclusive holders also hold Store.mu for
+// writing, while shared holders within a process share one flock.
+type dirLock struct {
+	file *os.File
+
+	mu      sync.Mutex
+	readers int // Holders of the shared lock in this process
+}
+
+func openDirLock(dir string) (*dirLock, error) {
+	file, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	return &dirLock{file: file}, nil
+}
+
+// Takes the lock exclusively, waiting for other processes to let go
+func (l *dirLock) lock() error {
+	err := flock(l.file, true)
+	if err != nil {
+		return fmt.Errorf("failed to lock store: %w", err)
+	}
+	return nil
+}
+
+func (l *dirLock) unlock() error {
+	return funlock(l.file)
+}
+
+// Takes the lock shared. Only the first of several concurrent readers in the
+// process waits for it.
+func (l *dirLock) rlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.readers == 0 {
+		err := flock(l.file, false)
+		if err != nil {
+			return fmt.Errorf("failed to lock store: %w", err)
+		}
+	}
+	l.readers++
+	return nil
+}
+
+func (l *dirLock) runlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.readers--
+	if l.readers > 0 {
+		return nil
+	}
+	return funlock(l.file)
+}
+
+func (l *dirLock) close() error {
+	return l.file.Close()
+}
+
+// Locks the store in dir for the length of an offline operation such as
+// fsck. Without create a directory with no lock file is not locked, so a
+// read-only check leaves it untouched.
+func lockDir(dir string, exclusive, create bool) (release func() error, err error) {
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	file, err := os.OpenFile(filepath.Join(dir, lockFileName), flags, 0o644)
+	if os.IsNotExist(err) && !create {
+		return func() error { return nil }, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	err = flock(file, exclusive)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock store: %w", err)
+	}
+	return func() error {
+		return errors.Join(funlock(file), file.Close())
+	}, nil
+}
+
+// Sizes of the files a Store writes to, as it last left them
+type fileState struct {
+	vec, md, ts int64
+}
+
+func (s *Store) fileState() (fileState, error) {
+	var st fileState
+	for _, f := range []struct {
+		file *os.File
+		size *int64
+	}{
+		{s.vecFile, &st.vec},
+		{s.mdFile, &st.md},
+		{s.tsFile, &st.ts},
+	} {
+		info, err := f.file.Stat()
+		if err != nil {
+			return fileState{}, fmt.Errorf("failed to get file info: %w", err)
+		}
+		*f.size = info.Size()
+	}
+	return st, nil
+}
+
+// Reports whether the files were replaced since they were opened, by a
+// compaction or restore in another process
+func (s *Store) replaced() (bool, error) {
+	for _, f := range []*os.File{s.vecFile, s.mdFile, s.tsFile} {
+		opened, err := f.Stat()
+		if err != nil {
+			return false, fmt.Errorf("failed to get file info: %w", err)
+		}
+		current, err := os.Stat(filepath.Join(s.dir, opened.Name()))
+		if os.IsNotExist(err) {
+			// Removed by a restore that has yet to put its own in place
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to get file info: %w", err)
+		}
+		if !os.SameFile(opened, current) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Reports whether another process has changed the store since this Store
+// last looked
+func (s *Store) stale() (bool, error) {
+	st, err := s.fileState()
+	if err != nil {
+		return false, err
+	}
+	if st != s.seen {
+		return true, nil
+	}
+
+	info, err := s.wal.file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to get file info: %w", err)
+	}
+	if info.Size() > 0 {
+		// A writer died part way through an append
+		return true, nil
+	}
+	_, err = os.Stat(filepath.Join(s.dir, restoreMarkerFileName))
+	if err == nil {
+		// Or part way through a restore
+		return true, nil
+	}
+	return s.replaced()
+}
+
+// Catches up with whatever other processes have written. Called with the
+// store locked for writing.
+func (s *Store) refresh() error {
+	// Another process may have died part way through a compaction or restore
+	err := finishCompaction(s.dir)
+	if err == nil {
+		err = finishRestore(s.dir)
+	}
+	if err != nil {
+		return err
+	}
+	replaced, err := s.replaced()
+	if err != nil {
+		return err
+	}
+	model := s.header.Model
+	if replaced {
+		err = s.closeFiles()
+		if err != nil {
+			return fmt.Errorf("failed to close replaced files: %w", err)
+		}
+		err = s.openFiles()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.recover()
+	if err != nil {
+		return fmt.Errorf("failed to recover from wal: %w", err)
+	}
+	if replaced {
+		err = s.initHeader(Options{Dimension: s.dim, Model: model})
+		if err != nil {
+			return err
+		}
+	}
+
+	nextID := s.nextID
+	err = s.load()
+	s.nextID = max(s.nextID, nextID)
+	if err != nil {
+		return err
+	}
+
+	if replaced {
+		return s.rebuildIndexes()
+	}
+	for _, idx := range s.indexes {
+		err = s.catchUp(idx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Locks the store for writing, after catching up with other processes
+func (s *Store) lock() error {
+	return s.lockRefreshing(false)
+}
+
+// Like lock, but goes ahead when what other processes wrote cannot be
+// reloaded. For Clear, which throws it away.
+func (s *Store) lockDiscarding() error {
+	return s.lockRefreshing(true)
+}
+
+func (s *Store) lockRefreshing(discard bool) error {
+	s.mu.Lock()
+	err := s.dirLock.lock()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	stale, err := s.stale()
+	if err == nil && stale {
+		err = s.refresh()
+	}
+	if err != nil && !discard {
+		// seen is left as it was so the next operation tries again
+		s.dirLock.unlock()
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Remembers what the files look like now and releases the write lock
+func (s *Store) unlock() {
+	st, err := s.fileState()
+	if err != nil {
+		// Forces a reload next time
+		st = fileState{vec: -1}
+	}
+	s.seen = st
+	s.dirLock.unlock()
+	s.mu.Unlock()
+}
+
+// Locks the store for reading. If another process has changed the store the
+// read waits for the write lock to catch up first.
+func (s *Store) rlock() error {
+	for {
+		s.mu.RLock()
+		err := s.dirLock.rlock()
+		if err != nil {
+			s.mu.RUnlock()
+			return err
+		}
+
+		stale, err := s.stale()
+		if err == nil && !stale {
+			return nil
+		}
+		s.runlock()
+		if err != nil {
+			return err
+		}
+
+		err = s.lock()
+		if err != nil {
+			return err
+		}
+		s.unlock()
+	}
+}
+
+func (s *Store) runlock() {
+	s.dirLock.runlock()
+	s.mu.RUnlock()
+}
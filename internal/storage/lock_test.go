@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+func openShared(t *testing.T, dir string) *Store {
+	t.Helper()
+	store, err := Open(dir, Options{Dimension: embeddingSize})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// Readers run alongside appends and deletes. Run with -race.
+func TestConcurrentReadsDuringWrites(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+	const batches, batchSize = 20, 5
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for b := range batches {
+			vecs := make([]embedding.EmbeddingVector, batchSize)
+			texts := make([]string, batchSize)
+			for i := range vecs {
+				vecs[i] = newSparseVector(map[int]float32{(b*batchSize + i) % embeddingSize: 1})
+				texts[i] = fmt.Sprintf("doc-%d", b*batchSize+i)
+			}
+			ids, err := store.AppendBatch(vecs, texts)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := store.Delete(ids[0]); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				seen := 0
+				err := store.Iterate(func(pos int, v embedding.EmbeddingVector) error {
+					seen++
+					if _, ok := store.ID(pos); !ok {
+						return fmt.Errorf("no ID at iterated position %d", pos)
+					}
+					return nil
+				})
+				if err == nil {
+					var metas []EmbeddingMetaData
+					metas, err = store.MetaData()
+					if err == nil && len(metas) < seen {
+						err = fmt.Errorf("iterated %d records but found metadata for %d", seen, len(metas))
+					}
+				}
+				if err == nil {
+					var table *MetaTable
+					table, err = store.MetaTable()
+					if err == nil && table.Len() > 0 {
+						if md, ok := table.At(table.Len() - 1); !ok || md.Text != fmt.Sprintf("doc-%d", table.Len()-1) {
+							err = fmt.Errorf("unexpected metadata %+v at the end of the table", md)
+						}
+					}
+				}
+				if err == nil && seen > 0 {
+					_, err = store.Get(1)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if n, _ := store.Len(); n != batches*batchSize {
+		t.Fatalf("expected %d records, got %d", batches*batchSize, n)
+	}
+}
+
+// Two stores on one directory behave like two processes: each flock is its
+// own open file description
+func TestStoresShareDirectory(t *testing.T) {
+	dir := t.TempDir()
+	a, b := openShared(t, dir), openShared(t, dir)
+
+	var wg sync.WaitGroup
+	ids := make([][]uint64, 2)
+	errs := make([]error, 2)
+	for i, store := range []*Store{a, b} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 25 {
+				id, err := store.Append(newSparseVector(map[int]float32{j: 1}), fmt.Sprintf("store-%d-%d", i, j))
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				ids[i] = append(ids[i], id)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[uint64]bool{}
+	for _, id := range append(ids[0], ids[1]...) {
+		if seen[id] {
+			t.Fatalf("ID %d handed out twice", id)
+		}
+		seen[id] = true
+	}
+
+	for _, store := range []*Store{a, b} {
+		metas, err := store.MetaData()
+		if err != nil {
+			t.Fatalf("MetaData: %v", err)
+		}
+		if len(metas) != 50 {
+			t.Fatalf("expected both stores to see 50 records, got %d", len(metas))
+		}
+		for pos, md := range metas {
+			rec, err := store.Get(pos)
+			if err != nil {
+				t.Fatalf("Get(%d): %v", pos, err)
+			}
+			if rec.Meta.ID != md.ID || rec.Meta.Offset != (pos+1)*testRecordSize {
+				t.Fatalf("position %d: unexpected record %+v", pos, rec.Meta)
+			}
+		}
+	}
+
+	reopened := openShared(t, dir)
+	if n, _ := reopened.Len(); n != 50 {
+		t.Fatalf("expected 50 records after reopening, got %d", n)
+	}
+}
+
+func TestStoreCatchesUpWithOtherWriters(t *testing.T) {
+	dir := t.TempDir()
+	a, b := openShared(t, dir), openShared(t, dir)
+
+	for i := range 3 {
+		if _, err := a.Append(newSparseVector(map[int]float32{i: 1}), fmt.Sprintf("doc-%d", i)); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if err := b.Delete(1); err != nil {
+		t.Fatalf("expected b to see a's records, got %v", err)
+	}
+	if removed, err := b.Compact(); err != nil || removed != 1 {
+		t.Fatalf("Compact: removed %d, %v", removed, err)
+	}
+
+	// a reopens the compacted files and sees the new positions
+	rec, err := a.Get(0)
+	if err != nil || rec.Meta.Text != "doc-1" {
+		t.Fatalf("expected doc-1 at position 0 after b compacted, got %+v, %v", rec.Meta, err)
+	}
+	id, err := a.Append(newSparseVector(map[int]float32{5: 1}), "later")
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if id != 4 {
+		t.Fatalf("expected ID 4, got %d", id)
+	}
+
+	// A writer dying part way through an append leaves a WAL entry, which the
+	// other store replays before reading
+	crashAt = func(step txStep) bool { return step == txVectorsSynced }
+	t.Cleanup(func() { crashAt = nil })
+	if _, err := b.Append(newSparseVector(map[int]float32{6: 1}), "crashed"); !errors.Is(err, errSimulatedCrash) {
+		t.Fatalf("expected a simulated crash, got %v", err)
+	}
+	crashAt = nil
+
+	rec, err = a.Get(3)
+	if err != nil || rec.Meta.Text != "crashed" {
+		t.Fatalf("expected the logged append to be replayed, got %+v, %v", rec.Meta, err)
+	}
+}
+
+func TestWritersWaitForTheDirectoryLock(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+	release, err := lockDir(store.Dir(), true, false)
+	if err != nil {
+		t.Fatalf("lockDir: %v", err)
+	}
+
+	appended := make(chan error)
+	go func() {
+		_, err := store.Append(newSparseVector(map[int]float32{0: 1}), "waits")
+		appended <- err
+	}()
+
+	select {
+	case err := <-appended:
+		t.Fatalf("expected the append to wait for the lock, it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := release(); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if err := <-appended; err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+}
+
+func TestClearLeavesOpenViewsReadable(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+	if _, err := store.Append(newSparseVector(map[int]float32{3: 1}), "kept in view"); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	view, err := store.View()
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	defer view.Close()
+
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+	if view.Len() != 1 || view.At(0)[3] != 1 {
+		t.Fatalf("expected the view to still hold the cleared vector")
+	}
+	if n, _ := store.Len(); n != 0 {
+		t.Fatalf("expected an empty store, got %d records", n)
+	}
+}
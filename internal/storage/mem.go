@@ -0,0 +1,616 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"unsafe"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+/*
+An in-memory store, for tests and for ephemeral searches that shouldn't touch
+disk, such as searching only some pasted text.
+
+A MemStore behaves like a Store opened on an empty directory. Records are
+encoded as they would be in data.bin, checksums and quantization included,
+and metadata is kept as the JSON lines metadata.jsonl would hold, so IDs,
+offsets, deletes, Clear and iteration all match the file-backed store. It
+additionally keeps the vectors as they were appended, which is what lets Save
+write a quantized store out exactly.
+
+What a MemStore lacks are the parts of a Store that only make sense on disk:
+the WAL, compaction, snapshots, upserts and attached indexes.
+*/
+
+var errStoreClosed = errors.New("storage: store is closed")
+
+// The operations shared by the file-backed Store and the in-memory MemStore,
+// which is all search and ingestion need
+type VectorStore interface {
+	Dimension() int
+	Header() VectorHeader
+	Lenient() bool
+
+	Append(ev embedding.EmbeddingVector, text string) (uint64, error)
+	AppendBatch(embeddings []embedding.EmbeddingVector, texts []string) ([]uint64, error)
+	AppendBatchMeta(embeddings []embedding.EmbeddingVector, metas []EmbeddingMetaData) ([]uint64, error)
+	Delete(id uint64) error
+	Clear() error
+	PutDocument(doc Document) error
+
+	ID(pos int) (uint64, bool)
+	IsDeleted(pos int) bool
+	Len() (int, error)
+	Get(pos int) (Record, error)
+	MetaData() ([]EmbeddingMetaData, error)
+	MetaTable() (*MetaTable, error)
+	Float32(pos int) (embedding.EmbeddingVector, error)
+	HasFloat32() bool
+	Iterate(fn func(pos int, v embedding.EmbeddingVector) error) error
+	IterateRecords(fn func(rec Record) error) error
+	View() (*VectorView, error)
+	Document(id string) (Document, error)
+	DocumentChunks(docID string, first, last int) (map[int]EmbeddingMetaData, error)
+
+	Close() error
+}
+
+var (
+	_ VectorStore = (*Store)(nil)
+	_ VectorStore = (*MemStore)(nil)
+)
+
+// A store held entirely in memory. It is safe for concurrent use.
+type MemStore struct {
+	mu     sync.RWMutex
+	header VectorHeader
+	verify VerifyMode
+	closed bool
+
+	records []byte                      // As data.bin holds them after its header
+	vectors []embedding.EmbeddingVector // Full precision, as they were appended
+	lines   [][]byte                    // Metadata as JSON, one per position
+	docs    map[string]Document
+
+	ids       []uint64
+	positions map[uint64]int
+	deleted   map[uint64]struct{}
+	nextID    uint64
+
+	lastOffset int
+	metaCache  metaCache
+}
+
+// Creates an empty in-memory store. Options are applied as when a Store is
+// created in an empty directory.
+func NewMemStore(opts Options) (*MemStore, error) {
+	if opts.Dimension < 0 {
+		return nil, fmt.Errorf("storage: invalid dimension %d", opts.Dimension)
+	}
+	dim := opts.Dimension
+	if dim == 0 {
+		dim = defaultDimension
+	}
+	dtype := opts.DType
+	if dtype == 0 {
+		dtype = DTypeFloat32
+	}
+	if dtype.Size() == 0 {
+		return nil, fmt.Errorf("storage: unsupported element type %s", dtype)
+	}
+
+	h := newVectorHeader(dim, dtype, opts.Model)
+	h.Float32Copy = opts.KeepFloat32 && dtype != DTypeFloat32
+	return &MemStore{
+		header:    h,
+		verify:    opts.Verify,
+		positions: map[uint64]int{},
+		deleted:   map[uint64]struct{}{},
+		docs:      map[string]Document{},
+		nextID:    1,
+	}, nil
+}
+
+func (m *MemStore) Dimension() int {
+	return m.header.Dimension
+}
+
+// The header a data file holding this store would start with
+func (m *MemStore) Header() VectorHeader {
+	return m.header
+}
+
+// Whether search leaves corrupt records out rather than failing
+func (m *MemStore) Lenient() bool {
+	return m.verify == VerifyLenient
+}
+
+// Appends an embedding and its text, returning the ID assigned to the new
+// record
+func (m *MemStore) Append(ev embedding.EmbeddingVector, text string) (uint64, error) {
+	ids, err := m.AppendBatch([]embedding.EmbeddingVector{ev}, []string{text})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// Appends a batch of embeddings and their texts, returning the IDs assigned to
+// the new records in order
+func (m *MemStore) AppendBatch(embeddings []embedding.EmbeddingVector, texts []string) ([]uint64, error) {
+	if len(embeddings) != len(texts) {
+		return nil, fmt.Errorf("got %d embeddings but %d texts", len(embeddings), len(texts))
+	}
+
+	metas := make([]EmbeddingMetaData, len(texts))
+	for i, text := range texts {
+		metas[i] = EmbeddingMetaData{Text: text}
+	}
+	return m.AppendBatchMeta(embeddings, metas)
+}
+
+// Like AppendBatch but stores the full metadata of each record. ID and Offset
+// are assigned by the store and ignored if set. The batch is added whole or
+// not at all.
+func (m *MemStore) AppendBatchMeta(embeddings []embedding.EmbeddingVector, metas []EmbeddingMetaData) ([]uint64, error) {
+	if len(embeddings) != len(metas) {
+		return nil, fmt.Errorf("got %d embeddings but %d metadata records", len(embeddings), len(metas))
+	}
+	if len(embeddings) == 0 {
+		return []uint64{}, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, errStoreClosed
+	}
+
+	dim := m.header.Dimension
+	var records []byte
+	vectors := make([]embedding.EmbeddingVector, len(embeddings))
+	lines := make([][]byte, len(embeddings))
+	ids := make([]uint64, len(embeddings))
+	ofs := m.lastOffset
+	for i, e := range embeddings {
+		if len(e) != dim {
+			return nil, fmt.Errorf("embedding vector must be of length %d, got %d", dim, len(e))
+		}
+		vectors[i] = append(embedding.EmbeddingVector(nil), e...)
+		e.Normalise()
+
+		rec := encodeVector(m.header.DType, e)
+		if m.header.Checksums {
+			rec = appendRecordChecksum(rec)
+		}
+		records = append(records, rec...)
+		ofs += len(rec)
+
+		ids[i] = m.nextID + uint64(i)
+		md := metas[i]
+		md.ID, md.Offset = ids[i], ofs
+		line, err := json.Marshal(md)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode embedding metadata: %w", err)
+		}
+		lines[i] = line
+	}
+
+	// Earlier views keep the old backing array, so appending never changes
+	// what they see
+	m.records = append(m.records, records...)
+	m.vectors = append(m.vectors, vectors...)
+	m.lines = append(m.lines, lines...)
+	for _, id := range ids {
+		m.positions[id] = len(m.ids)
+		m.ids = append(m.ids, id)
+	}
+	m.nextID += uint64(len(ids))
+	m.lastOffset = ofs
+	return ids, nil
+}
+
+// Marks the record with the given ID as deleted, so Get and Iterate skip it
+func (m *MemStore) Delete(id uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errStoreClosed
+	}
+	if _, ok := m.positions[id]; !ok {
+		return ErrNotFound
+	}
+	m.deleted[id] = struct{}{}
+	return nil
+}
+
+// Drops every record. As with a Store, IDs keep counting up from where they
+// were rather than being handed out again.
+func (m *MemStore) Clear() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errStoreClosed
+	}
+
+	m.records, m.vectors, m.lines = nil, nil, nil
+	m.ids = nil
+	m.positions = map[uint64]int{}
+	m.deleted = map[uint64]struct{}{}
+	m.docs = map[string]Document{}
+	m.lastOffset = 0
+	m.metaCache.drop()
+	return nil
+}
+
+// Stores doc as the parent of the chunks whose DocID is doc.ID
+func (m *MemStore) PutDocument(doc Document) error {
+	if doc.ID == "" {
+		return ErrEmptyDocumentID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errStoreClosed
+	}
+	m.docs[doc.ID] = doc
+	return nil
+}
+
+// The document stored under id, or ErrNotFound
+func (m *MemStore) Document(id string) (Document, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return Document{}, errStoreClosed
+	}
+	doc, ok := m.docs[id]
+	if !ok {
+		return Document{}, ErrNotFound
+	}
+	return doc, nil
+}
+
+// The live chunks of the document docID with ordinals from first to last,
+// as Store.DocumentChunks returns them
+func (m *MemStore) DocumentChunks(docID string, first, last int) (map[int]EmbeddingMetaData, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, errStoreClosed
+	}
+
+	table, err := m.metaTable()
+	if err != nil {
+		return nil, err
+	}
+	return m.metaCache.chunks(table, docID, first, last, m.isDeleted), nil
+}
+
+// ID of the record at position pos
+func (m *MemStore) ID(pos int) (uint64, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if pos < 0 || pos >= len(m.ids) {
+		return 0, false
+	}
+	return m.ids[pos], true
+}
+
+// Reports whether the record at position pos has been deleted
+func (m *MemStore) IsDeleted(pos int) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.isDeleted(pos)
+}
+
+func (m *MemStore) isDeleted(pos int) bool {
+	if pos < 0 || pos >= len(m.ids) {
+		return false
+	}
+	_, ok := m.deleted[m.ids[pos]]
+	return ok
+}
+
+// Number of records, including deleted ones
+func (m *MemStore) Len() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return 0, errStoreClosed
+	}
+	return len(m.ids), nil
+}
+
+// The vector and metadata stored at position pos
+func (m *MemStore) Get(pos int) (Record, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return Record{}, errStoreClosed
+	}
+	if pos < 0 || pos >= len(m.ids) {
+		return Record{}, ErrOutOfRange
+	}
+	if m.isDeleted(pos) {
+		return Record{}, ErrNotFound
+	}
+
+	md, err := m.metadata(pos)
+	if err != nil {
+		return Record{}, err
+	}
+	stride := m.header.recordSize()
+	rec := m.records[pos*stride : (pos+1)*stride]
+	v := decodeVector(m.header.DType, rec[:m.header.DType.recordSize(m.header.Dimension)], m.header.Dimension)
+	return Record{Pos: pos, Vector: v, Meta: md}, nil
+}
+
+func (m *MemStore) metadata(pos int) (EmbeddingMetaData, error) {
+	var md EmbeddingMetaData
+	err := json.Unmarshal(m.lines[pos], &md)
+	if err != nil {
+		return md, fmt.Errorf("failed to decode metadata for vector %d: %w", pos, err)
+	}
+	md.ID = m.ids[pos]
+	return md, nil
+}
+
+// The metadata of every position, deleted ones included
+func (m *MemStore) MetaData() ([]EmbeddingMetaData, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, errStoreClosed
+	}
+
+	out := make([]EmbeddingMetaData, len(m.ids))
+	for pos := range out {
+		md, err := m.metadata(pos)
+		if err != nil {
+			return nil, err
+		}
+		out[pos] = md
+	}
+	return out, nil
+}
+
+// The full-precision vector at position pos. Returns ErrNoFloat32 for
+// quantized stores created without KeepFloat32, like a Store would.
+func (m *MemStore) Float32(pos int) (embedding.EmbeddingVector, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, errStoreClosed
+	}
+	if pos < 0 || pos >= len(m.ids) {
+		return nil, ErrOutOfRange
+	}
+	if m.header.DType != DTypeFloat32 && !m.header.Float32Copy {
+		return nil, ErrNoFloat32
+	}
+	v := append(embedding.EmbeddingVector(nil), m.vectors[pos]...)
+	v.Normalise()
+	return v, nil
+}
+
+// Whether Float32 can return full-precision vectors
+func (m *MemStore) HasFloat32() bool {
+	return m.header.DType == DTypeFloat32 || m.header.Float32Copy
+}
+
+// Calls fn with every live vector in position order, as Store.Iterate does.
+// v must not be modified or kept after fn returns, and fn is free to call
+// back into the store.
+func (m *MemStore) Iterate(fn func(pos int, v embedding.EmbeddingVector) error) error {
+	m.mu.RLock()
+	if m.closed {
+		m.mu.RUnlock()
+		return errStoreClosed
+	}
+	view := m.view()
+	defer view.Close()
+	deleted := make([]bool, view.Len())
+	for pos := range deleted {
+		deleted[pos] = m.isDeleted(pos)
+	}
+	m.mu.RUnlock()
+
+	for pos := range view.Len() {
+		if deleted[pos] {
+			continue
+		}
+		ok, err := view.Verify(pos)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		err = fn(pos, view.At(pos))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls fn with every live record in position order, metadata included,
+// as Store.IterateRecords does
+func (m *MemStore) IterateRecords(fn func(rec Record) error) error {
+	m.mu.RLock()
+	if m.closed {
+		m.mu.RUnlock()
+		return errStoreClosed
+	}
+	view := m.view()
+	defer view.Close()
+	table, err := m.metaTable()
+	if err != nil {
+		m.mu.RUnlock()
+		return err
+	}
+	n := min(view.Len(), table.Len())
+	deleted := make([]bool, n)
+	for pos := range deleted {
+		deleted[pos] = m.isDeleted(pos)
+	}
+	// Kept vectors are never modified, only replaced by Clear
+	var full []embedding.EmbeddingVector
+	if m.header.DType != DTypeFloat32 && m.header.Float32Copy {
+		full = m.vectors[:n:n]
+	}
+	m.mu.RUnlock()
+
+	for pos := range n {
+		if deleted[pos] {
+			continue
+		}
+		ok, err := view.Verify(pos)
+		if err != nil {
+			return err
+		}
+		md, found := table.At(pos)
+		if !ok || !found {
+			continue
+		}
+
+		var v embedding.EmbeddingVector
+		if full != nil {
+			v = slices.Clone(full[pos])
+			v.Normalise()
+		} else {
+			v = slices.Clone(view.At(pos))
+		}
+		err = fn(Record{Pos: pos, Vector: v, Meta: md})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Opens a view over the records currently in the store. Records appended
+// afterwards are not visible through it.
+func (m *MemStore) View() (*VectorView, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, errStoreClosed
+	}
+	return m.view(), nil
+}
+
+func (m *MemStore) view() *VectorView {
+	v := &VectorView{
+		dim:     m.header.Dimension,
+		dtype:   m.header.DType,
+		stride:  m.header.recordSize(),
+		raw:     m.records[:len(m.records):len(m.records)],
+		checked: m.header.Checksums,
+		lenient: m.Lenient(),
+	}
+	if v.dtype == DTypeFloat32 && len(v.raw) > 0 {
+		aligned := uintptr(unsafe.Pointer(&v.raw[0]))%4 == 0
+		if littleEndianHost && aligned {
+			v.data = unsafe.Slice((*float32)(unsafe.Pointer(&v.raw[0])), len(v.raw)/4)
+		} else {
+			// The allocator aligns buffers this size in practice, but it
+			// does not promise to
+			v.data = byteSliceToVector(v.raw)
+		}
+	}
+	return v
+}
+
+// Writes the store out to dir in the file format, as a Store that can be
+// opened there. dir must not hold a store with records in it already.
+// Deleted records are written along with their tombstones.
+func (m *MemStore) Save(dir string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return errStoreClosed
+	}
+
+	s, err := Open(dir, Options{
+		Dimension:   m.header.Dimension,
+		Model:       m.header.Model,
+		DType:       m.header.DType,
+		KeepFloat32: m.header.Float32Copy,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = m.saveTo(s)
+	return errors.Join(err, s.Close())
+}
+
+func (m *MemStore) saveTo(s *Store) error {
+	err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer s.unlock()
+
+	n, err := s.len()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("storage: %s already holds a store", s.dir)
+	}
+
+	if len(m.ids) > 0 {
+		metas := make([]EmbeddingMetaData, len(m.ids))
+		for pos := range metas {
+			metas[pos], err = m.metadata(pos)
+			if err != nil {
+				return err
+			}
+		}
+		vectors := make([]embedding.EmbeddingVector, len(m.vectors))
+		for pos, v := range m.vectors {
+			vectors[pos] = append(embedding.EmbeddingVector(nil), v...)
+		}
+		var remove []uint64
+		for _, id := range m.ids {
+			if _, ok := m.deleted[id]; ok {
+				remove = append(remove, id)
+			}
+		}
+
+		_, err = s.write(vectors, metas, true, remove)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, doc := range m.docs {
+		err = s.putDocument(doc)
+		if err != nil {
+			return err
+		}
+	}
+
+	// IDs given out before a Clear stay used
+	s.nextID = max(s.nextID, m.nextID)
+	return s.keepIDWatermark()
+}
+
+// Drops the records. The store can't be used afterwards.
+func (m *MemStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	m.records, m.vectors, m.lines = nil, nil, nil
+	m.ids, m.positions, m.deleted = nil, nil, nil
+	m.docs = nil
+	return nil
+}
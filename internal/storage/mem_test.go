@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+func newTestMemStore(t *testing.T, opts Options) *MemStore {
+	t.Helper()
+	store, err := NewMemStore(opts)
+	if err != nil {
+		t.Fatalf("NewMemStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// Applies the same writes to a store and returns what it reads back
+func exerciseStore(t *testing.T, store VectorStore) map[string]any {
+	t.Helper()
+	metas := []EmbeddingMetaData{
+		{Text: "alpha", Source: "file:///a.md", Chunk: 0, Attributes: map[string]any{"n": 1}},
+		{Text: "beta", DocID: "b", Span: &Span{ByteStart: 2, ByteEnd: 6, RuneStart: 2, RuneEnd: 6}},
+		{Text: "gamma", IngestedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	vecs := []embedding.EmbeddingVector{
+		newSparseVector(map[int]float32{0: 3, 1: 4}),
+		newSparseVector(map[int]float32{1: 1}),
+		newSparseVector(map[int]float32{2: 2, 5: -1}),
+	}
+	ids, err := store.AppendBatchMeta(vecs, metas)
+	if err != nil {
+		t.Fatalf("AppendBatchMeta: %v", err)
+	}
+	if _, err := store.Append(newSparseVector(map[int]float32{3: 1}), "delta"); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := store.Delete(ids[1]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	out := map[string]any{"ids": ids}
+	n, err := store.Len()
+	out["len"], out["lenErr"] = n, err
+	var records []any
+	for pos := range n + 1 {
+		rec, err := store.Get(pos)
+		records = append(records, rec, errors.Is(err, ErrNotFound), errors.Is(err, ErrOutOfRange))
+	}
+	out["records"] = records
+	out["metadata"], _ = store.MetaData()
+
+	var iterated []any
+	store.Iterate(func(pos int, v embedding.EmbeddingVector) error {
+		iterated = append(iterated, pos, slices.Clone(v))
+		return nil
+	})
+	out["iterated"] = iterated
+
+	view, err := store.View()
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	score := view.Scorer(newSparseVector(map[int]float32{0: 1}))
+	var scores []float32
+	for pos := range view.Len() {
+		scores = append(scores, score(pos))
+	}
+	view.Close()
+	out["scores"] = scores
+	out["float32"], _ = store.Float32(0)
+
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+	out["afterClear"], _ = store.Append(newSparseVector(map[int]float32{0: 1}), "epsilon")
+	out["lenAfterClear"], _ = store.Len()
+	return out
+}
+
+// A MemStore reads back exactly what a Store does after the same writes
+func TestMemStoreMatchesStore(t *testing.T) {
+	for _, opts := range []Options{
+		{Dimension: embeddingSize},
+		{Dimension: embeddingSize, DType: DTypeInt8, KeepFloat32: true},
+		{Dimension: embeddingSize, DType: DTypeFloat16},
+	} {
+		t.Run(opts.DType.String(), func(t *testing.T) {
+			file, err := Open(t.TempDir(), opts)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer file.Close()
+			mem := newTestMemStore(t, opts)
+
+			want, got := exerciseStore(t, file), exerciseStore(t, mem)
+			for k := range want {
+				if !reflect.DeepEqual(got[k], want[k]) {
+					t.Errorf("%s: expected %v, got %v", k, want[k], got[k])
+				}
+			}
+			if mem.Header() != file.Header() || mem.HasFloat32() != file.HasFloat32() {
+				t.Errorf("expected header %+v, got %+v", file.Header(), mem.Header())
+			}
+		})
+	}
+}
+
+func TestMemStoreViewIsASnapshot(t *testing.T) {
+	store := newTestMemStore(t, Options{Dimension: embeddingSize})
+	store.Append(newSparseVector(map[int]float32{0: 1}), "first")
+
+	view, err := store.View()
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	defer view.Close()
+	for i := range 100 {
+		store.Append(newSparseVector(map[int]float32{i % embeddingSize: 1}), "more")
+	}
+	if view.Len() != 1 || view.At(0)[0] != 1 {
+		t.Fatalf("expected the view to keep seeing just the first record, got %d", view.Len())
+	}
+}
+
+func TestMemStoreViewCopiesMisalignedRecords(t *testing.T) {
+	store := newTestMemStore(t, Options{Dimension: embeddingSize})
+	store.Append(newSparseVector(map[int]float32{3: 1}), "first")
+
+	buf := make([]byte, len(store.records)+1)
+	copy(buf[1:], store.records)
+	store.records = buf[1:]
+
+	view := store.view()
+	defer view.Close()
+	if unsafe.Pointer(&view.data[0]) == unsafe.Pointer(&buf[1]) {
+		t.Fatal("expected a misaligned buffer to be copied, not aliased")
+	}
+	if v := view.At(0); v[3] != 1 {
+		t.Fatalf("expected the record read from a misaligned buffer, got %v", v)
+	}
+}
+
+func TestMemStoreIterateVerifiesRecords(t *testing.T) {
+	store := newTestMemStore(t, Options{Dimension: embeddingSize, Verify: VerifyStrict})
+	for i := range 3 {
+		store.Append(newSparseVector(map[int]float32{i: 1}), "text")
+	}
+	store.records[store.header.recordSize()] ^= 0xff
+
+	var corrupt *ErrCorruptRecord
+	err := store.Iterate(func(int, embedding.EmbeddingVector) error { return nil })
+	if !errors.As(err, &corrupt) || corrupt.Pos != 1 {
+		t.Fatalf("expected strict Iterate to report record 1, got %v", err)
+	}
+
+	store.verify = VerifyLenient
+	var seen []int
+	err = store.Iterate(func(pos int, _ embedding.EmbeddingVector) error {
+		seen = append(seen, pos)
+		return nil
+	})
+	if err != nil || !slices.Equal(seen, []int{0, 2}) {
+		t.Fatalf("expected lenient Iterate to skip record 1, got %v, %v", seen, err)
+	}
+}
+
+func TestMemStoreSavesToTheFileFormat(t *testing.T) {
+	opts := Options{Dimension: embeddingSize, DType: DTypeInt8, KeepFloat32: true, Model: "test-model"}
+	mem := newTestMemStore(t, opts)
+	ids, err := mem.AppendBatch([]embedding.EmbeddingVector{
+		newSparseVector(map[int]float32{0: 1}),
+		newSparseVector(map[int]float32{1: 1, 2: 0.5}),
+		newSparseVector(map[int]float32{3: 1}),
+	}, []string{"one", "two", "three"})
+	if err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+	if err := mem.Delete(ids[2]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := mem.Save(dir); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := mem.Save(dir); err == nil {
+		t.Fatal("expected saving over a store with records to fail")
+	}
+
+	file, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("open saved store: %v", err)
+	}
+	defer file.Close()
+	if file.Header() != mem.Header() {
+		t.Fatalf("expected header %+v, got %+v", mem.Header(), file.Header())
+	}
+	for pos := range 3 {
+		want, wantErr := mem.Get(pos)
+		got, gotErr := file.Get(pos)
+		if !reflect.DeepEqual(got, want) || !errors.Is(gotErr, wantErr) {
+			t.Fatalf("position %d: expected %+v, %v, got %+v, %v", pos, want, wantErr, got, gotErr)
+		}
+		want32, _ := mem.Float32(pos)
+		got32, _ := file.Float32(pos)
+		if !slices.Equal(got32, want32) {
+			t.Fatalf("position %d: full-precision vectors differ", pos)
+		}
+	}
+	if id, err := file.Append(newSparseVector(map[int]float32{0: 1}), "four"); err != nil || id != 4 {
+		t.Fatalf("expected the saved store to carry on at ID 4, got %d, %v", id, err)
+	}
+}
+
+func TestMemStoreSaveKeepsIDsUsedBeforeAClear(t *testing.T) {
+	mem := newTestMemStore(t, Options{Dimension: embeddingSize})
+	mem.AppendBatch([]embedding.EmbeddingVector{newSparseVector(map[int]float32{0: 1})}, []string{"gone"})
+	if err := mem.Clear(); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := mem.Save(dir); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	file := openShared(t, dir)
+	if id, err := file.Append(newSparseVector(map[int]float32{0: 1}), "new"); err != nil || id != 2 {
+		t.Fatalf("expected ID 2 after reopening, got %d, %v", id, err)
+	}
+}
@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+/*
+Decoded metadata kept in memory for filtered searches.
+
+A filter has to look at the metadata of every record, and decoding all of
+metadata.jsonl per query would make filtered searches O(N) in JSON decoding.
+A store instead keeps the decoded metadata of its records in a MetaTable and
+only decodes the lines appended since the table was last asked for.
+Metadata lines are never rewritten in place, so appends and deletes leave
+the cached positions valid. Everything that moves positions (compaction,
+Clear, Restore and reloading after another process changed the store) drops
+the table, and the next call decodes it from scratch.
+
+Tables are shared between callers and never modified once handed out: a
+longer table may share the backing array of a shorter one, but only writes
+past its end.
+
+Alongside the table the cache keeps the positions of the records under each
+Upsert key, and of each chunk of each document by DocID and ordinal, so an
+upsert finds the chunks of its document and a search the neighbours of a hit
+without looking at the metadata of every other record.
+*/
+
+// The decoded metadata of a store's records at one moment, deleted ones
+// included. Shared between callers, so neither it nor the metadata it hands
+// out may be modified.
+type MetaTable struct {
+	metas   []EmbeddingMetaData
+	corrupt []int // Positions whose metadata failed its checksum, ascending
+}
+
+// Number of positions in the table
+func (t *MetaTable) Len() int {
+	return len(t.metas)
+}
+
+// The metadata at pos. Reports false for positions out of range and for
+// corrupt metadata left out by a lenient store.
+func (t *MetaTable) At(pos int) (EmbeddingMetaData, bool) {
+	if pos < 0 || pos >= len(t.metas) {
+		return EmbeddingMetaData{}, false
+	}
+	if _, corrupt := slices.BinarySearch(t.corrupt, pos); corrupt {
+		return EmbeddingMetaData{}, false
+	}
+	return t.metas[pos], true
+}
+
+// The latest MetaTable of a store
+type metaCache struct {
+	mu    sync.Mutex
+	table *MetaTable
+	keys  map[string][]int         // Positions in table by Key, deleted ones included
+	docs  map[string]map[int][]int // Positions in table by DocID and Chunk, likewise
+}
+
+// Drops the cached table. Called whenever positions move.
+func (c *metaCache) drop() {
+	c.mu.Lock()
+	c.table, c.keys, c.docs = nil, nil, nil
+	c.mu.Unlock()
+}
+
+// Positions in the cached table whose metadata has the given Key, ascending
+func (c *metaCache) keyed(key string) []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.keys[key])
+}
+
+// The chunks of docID in table with ordinals from first to last, by
+// ordinal, leaving out those deleted reports. When several records claim an
+// ordinal the last one wins.
+func (c *metaCache) chunks(table *MetaTable, docID string, first, last int, deleted func(pos int) bool) map[int]EmbeddingMetaData {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := map[int]EmbeddingMetaData{}
+	byChunk := c.docs[docID]
+	add := func(chunk int) {
+		positions := byChunk[chunk]
+		for i := len(positions) - 1; i >= 0; i-- {
+			md, ok := table.At(positions[i])
+			if ok && !deleted(positions[i]) {
+				out[chunk] = md
+				return
+			}
+		}
+	}
+	if last-first >= len(byChunk) {
+		// Cheaper to look at every chunk of a short document than at every
+		// ordinal of a wide range
+		for chunk := range byChunk {
+			if chunk >= first && chunk <= last {
+				add(chunk)
+			}
+		}
+		return out
+	}
+	for chunk := first; chunk <= last; chunk++ {
+		add(chunk)
+	}
+	return out
+}
+
+// Extends the cached table to the positions of ids, decoding the lines from
+// start on with decode. decode reports false for corrupt lines to leave out.
+func (c *metaCache) extend(ids []uint64, decode func(start int) ([]EmbeddingMetaData, []bool, error)) (*MetaTable, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := c.table
+	if t == nil || t.Len() > len(ids) || (t.Len() > 0 && t.metas[t.Len()-1].ID != ids[t.Len()-1]) {
+		// Positions moved without the table being dropped
+		t, c.keys, c.docs = &MetaTable{}, nil, nil
+	}
+	if t.Len() == len(ids) {
+		c.table = t
+		return t, nil
+	}
+
+	start := t.Len()
+	metas, ok, err := decode(start)
+	if err != nil {
+		return nil, err
+	}
+	next := &MetaTable{metas: append(t.metas, metas...), corrupt: t.corrupt}
+	for i, good := range ok {
+		if !good {
+			next.corrupt = append(next.corrupt, start+i)
+			continue
+		}
+		if key := metas[i].Key; key != "" {
+			if c.keys == nil {
+				c.keys = map[string][]int{}
+			}
+			c.keys[key] = append(c.keys[key], start+i)
+		}
+		if md := metas[i]; md.DocID != "" {
+			if c.docs == nil {
+				c.docs = map[string]map[int][]int{}
+			}
+			if c.docs[md.DocID] == nil {
+				c.docs[md.DocID] = map[int][]int{}
+			}
+			c.docs[md.DocID][md.Chunk] = append(c.docs[md.DocID][md.Chunk], start+i)
+		}
+	}
+	c.table = next
+	return next, nil
+}
+
+// The decoded metadata of every record, as filters read it. Only lines
+// appended since the last call are decoded. In lenient mode corrupt lines are
+// left out of the table rather than failing the call.
+func (s *Store) MetaTable() (*MetaTable, error) {
+	err := s.rlock()
+	if err != nil {
+		return nil, err
+	}
+	defer s.runlock()
+	return s.metaTable()
+}
+
+// Like MetaTable, with the store locked
+func (s *Store) metaTable() (*MetaTable, error) {
+	n := min(len(s.ids), len(s.lines)-1)
+	return s.metaCache.extend(s.ids[:n], func(start int) ([]EmbeddingMetaData, []bool, error) {
+		// One read for all the new lines
+		buf := make([]byte, s.lines[n]-s.lines[start])
+		_, err := s.mdFile.ReadAt(buf, s.lines[start])
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", metadataFileName, err)
+		}
+
+		metas := make([]EmbeddingMetaData, n-start)
+		ok := make([]bool, n-start)
+		for i := range metas {
+			pos := start + i
+			line := strings.TrimSpace(string(buf[s.lines[pos]-s.lines[start] : s.lines[pos+1]-s.lines[start]]))
+			metas[i].ID = s.ids[pos]
+			err := s.checkMetadataLine(pos, line)
+			if err != nil {
+				if s.Lenient() {
+					continue
+				}
+				return nil, nil, err
+			}
+			err = json.Unmarshal([]byte(line), &metas[i])
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to decode metadata for vector %d: %w", pos, err)
+			}
+			metas[i].ID = s.ids[pos]
+			ok[i] = true
+		}
+		return metas, ok, nil
+	})
+}
+
+// The decoded metadata of every record, as filters read it. Only records
+// appended since the last call are decoded.
+func (m *MemStore) MetaTable() (*MetaTable, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, errStoreClosed
+	}
+	return m.metaTable()
+}
+
+// Like MetaTable, with the store locked
+func (m *MemStore) metaTable() (*MetaTable, error) {
+	return m.metaCache.extend(m.ids, func(start int) ([]EmbeddingMetaData, []bool, error) {
+		metas := make([]EmbeddingMetaData, len(m.ids)-start)
+		ok := make([]bool, len(metas))
+		for i := range metas {
+			md, err := m.metadata(start + i)
+			if err != nil {
+				return nil, nil, err
+			}
+			metas[i], ok[i] = md, true
+		}
+		return metas, ok, nil
+	})
+}
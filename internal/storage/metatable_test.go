@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+func tableTexts(t *testing.T, table *MetaTable) []string {
+	t.Helper()
+	texts := make([]string, table.Len())
+	for pos := range texts {
+		md, ok := table.At(pos)
+		if ok {
+			texts[pos] = md.Text
+		}
+	}
+	return texts
+}
+
+func TestMetaTableFollowsAppendsAndCompaction(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+	ids, err := store.AppendBatch([]embedding.EmbeddingVector{
+		newSparseVector(map[int]float32{0: 1}),
+		newSparseVector(map[int]float32{1: 1}),
+	}, []string{"zero", "one"})
+	if err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+
+	first, err := store.MetaTable()
+	if err != nil {
+		t.Fatalf("MetaTable: %v", err)
+	}
+	if again, _ := store.MetaTable(); again != first {
+		t.Fatal("expected an unchanged store to hand out the same table")
+	}
+
+	store.Append(newSparseVector(map[int]float32{2: 1}), "two")
+	second, err := store.MetaTable()
+	if err != nil {
+		t.Fatalf("MetaTable: %v", err)
+	}
+	if got := tableTexts(t, second); len(got) != 3 || got[2] != "two" {
+		t.Fatalf("expected the appended record in the table, got %v", got)
+	}
+	if first.Len() != 2 {
+		t.Fatalf("expected the earlier table to stay as it was, got %d positions", first.Len())
+	}
+
+	if err := store.Delete(ids[0]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	compacted, err := store.MetaTable()
+	if err != nil {
+		t.Fatalf("MetaTable: %v", err)
+	}
+	if got := tableTexts(t, compacted); len(got) != 2 || got[0] != "one" || got[1] != "two" {
+		t.Fatalf("expected the compacted positions, got %v", got)
+	}
+
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+	if cleared, _ := store.MetaTable(); cleared.Len() != 0 {
+		t.Fatalf("expected an empty table after Clear, got %d positions", cleared.Len())
+	}
+}
+
+func TestMetaTableLeavesOutCorruptLines(t *testing.T) {
+	dir := t.TempDir()
+	writeFsckStore(t, dir, 3)
+	editFile(t, filepath.Join(dir, metadataFileName), func(b []byte) []byte {
+		return bytes.Replace(b, []byte(`"doc-1"`), []byte(`"doc-7"`), 1)
+	})
+
+	strict := openChecksumStore(t, dir, VerifyStrict)
+	var corrupt *ErrCorruptRecord
+	if _, err := strict.MetaTable(); !errors.As(err, &corrupt) || corrupt.Pos != 1 {
+		t.Fatalf("expected strict MetaTable to report record 1, got %v", err)
+	}
+	strict.Close()
+
+	table, err := openChecksumStore(t, dir, VerifyLenient).MetaTable()
+	if err != nil {
+		t.Fatalf("MetaTable: %v", err)
+	}
+	if _, ok := table.At(1); ok {
+		t.Fatal("expected the corrupt line to be left out")
+	}
+	if md, ok := table.At(2); !ok || md.Text != "doc-2" {
+		t.Fatalf("expected the lines around it to be kept, got %+v", md)
+	}
+}
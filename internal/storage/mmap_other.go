@@ -0,0 +1,13 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
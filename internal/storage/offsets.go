@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/*
+A fixed-width index from positions to metadata lines.
+
+metadata.jsonl stays the record of truth, and a debug view of it, but reads
+no longer split the whole file to reach one line. metadata.offsets holds the
+byte offset and record ID of every line, so Get fetches a record's metadata
+with a single read and opening a store reads 16 bytes per record instead of
+decoding every line.
+
+Layout (little-endian):
+
+	magic "GMDO" | version u32 | per line: offset u64 | ID u64
+
+The file is derived from metadata.jsonl and kept out of the WAL. It is
+appended after each commit without a sync, and checked on load: entries past
+the end of the metadata are dropped, the last entry must start a line holding
+its ID, and lines beyond the last entry are indexed from the metadata. An
+index that fails the check is rebuilt from scratch. Compaction, Clear,
+Restore and fsck -repair replace metadata.jsonl and delete the index with it.
+*/
+
+const (
+	offsetsFileName    = "metadata.offsets"
+	offsetsHeaderSize  = 8
+	offsetsEntrySize   = 16
+	offsetsFileVersion = 1
+)
+
+var offsetsMagic = []byte("GMDO")
+
+// Where a metadata line starts, and the record it belongs to
+type lineEntry struct {
+	offset int64
+	id     uint64
+}
+
+func (s *Store) offsetsPath() string {
+	return filepath.Join(s.dir, offsetsFileName)
+}
+
+// Indexes metadata.jsonl through metadata.offsets, bringing the offsets file
+// up to date. Returns an entry per line and the end of the last line.
+func (s *Store) indexMetadata() (entries []lineEntry, end int64, err error) {
+	info, err := s.mdFile.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get file info: %w", err)
+	}
+	size := info.Size()
+
+	stored := readOffsets(s.offsetsPath())
+	entries = stored
+	for len(entries) > 0 && entries[len(entries)-1].offset >= size {
+		entries = entries[:len(entries)-1]
+	}
+	if len(entries) > 0 {
+		end, err = s.checkLastEntry(entries, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if end < 0 {
+			entries, end = nil, 0
+		}
+	}
+	kept := len(entries)
+
+	// Lines past the last entry
+	tail := make([]byte, size-end)
+	_, err = s.mdFile.ReadAt(tail, end)
+	if err != nil && err != io.EOF {
+		return nil, 0, fmt.Errorf("failed to read %s: %w", metadataFileName, err)
+	}
+	for len(tail) > 0 {
+		n := bytes.IndexByte(tail, '\n') + 1
+		if n == 0 {
+			n = len(tail)
+		}
+		line := bytes.TrimSpace(tail[:n])
+		if len(line) == 0 && n == len(tail) {
+			break
+		}
+
+		var md EmbeddingMetaData
+		err = json.Unmarshal(line, &md)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to decode metadata line %d: %w", len(entries), err)
+		}
+		id := md.ID
+		if id == 0 {
+			id = uint64(len(entries)) + 1 // Written before records had IDs
+		}
+		entries = append(entries, lineEntry{offset: end, id: id})
+		end += int64(n)
+		tail = tail[n:]
+	}
+
+	if kept == len(stored) && kept == len(entries) {
+		return entries, end, nil
+	}
+	if kept < len(stored) || len(stored) == 0 {
+		err = writeOffsets(s.offsetsPath(), entries)
+	} else {
+		err = appendOffsets(s.offsetsPath(), kept, entries[kept:])
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return entries, end, nil
+}
+
+// Checks that the last entry starts a line holding its ID, returning where
+// that line ends, or -1 if the entries don't describe the metadata
+func (s *Store) checkLastEntry(entries []lineEntry, size int64) (int64, error) {
+	last := entries[len(entries)-1]
+	if entries[0].offset != 0 {
+		return -1, nil
+	}
+	if last.offset > 0 {
+		b := make([]byte, 1)
+		_, err := s.mdFile.ReadAt(b, last.offset-1)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read %s: %w", metadataFileName, err)
+		}
+		if b[0] != '\n' {
+			return -1, nil
+		}
+	}
+
+	line, err := readLineAt(s.mdFile, last.offset, size)
+	if err != nil {
+		return 0, err
+	}
+	var md EmbeddingMetaData
+	if json.Unmarshal(bytes.TrimSpace(line), &md) != nil {
+		return -1, nil
+	}
+	id := md.ID
+	if id == 0 {
+		id = uint64(len(entries))
+	}
+	if id != last.id {
+		return -1, nil
+	}
+	return last.offset + int64(len(line)), nil
+}
+
+// Reads the line starting at off, newline included, from a file of the
+// given size
+func readLineAt(f *os.File, off, size int64) ([]byte, error) {
+	var line []byte
+	buf := make([]byte, 4096)
+	for off < size {
+		n, err := f.ReadAt(buf[:min(int64(len(buf)), size-off)], off)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read %s: %w", filepath.Base(f.Name()), err)
+		}
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return append(line, buf[:i+1]...), nil
+		}
+		line = append(line, buf[:n]...)
+		off += int64(n)
+	}
+	return line, nil
+}
+
+// Reads the entries of an offsets file. A missing or unrecognised file reads
+// as empty, and a torn last entry is left out.
+func readOffsets(path string) []lineEntry {
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) < offsetsHeaderSize || !bytes.Equal(data[:4], offsetsMagic) ||
+		binary.LittleEndian.Uint32(data[4:8]) != offsetsFileVersion {
+		return nil
+	}
+
+	data = data[offsetsHeaderSize:]
+	entries := make([]lineEntry, len(data)/offsetsEntrySize)
+	for i := range entries {
+		e := data[i*offsetsEntrySize:]
+		entries[i] = lineEntry{
+			offset: int64(binary.LittleEndian.Uint64(e[0:8])),
+			id:     binary.LittleEndian.Uint64(e[8:16]),
+		}
+	}
+	return entries
+}
+
+func encodeOffsets(b []byte, entries []lineEntry) []byte {
+	for _, e := range entries {
+		b = binary.LittleEndian.AppendUint64(b, uint64(e.offset))
+		b = binary.LittleEndian.AppendUint64(b, e.id)
+	}
+	return b
+}
+
+// Replaces the offsets file with one holding entries
+func writeOffsets(path string, entries []lineEntry) error {
+	b := make([]byte, offsetsHeaderSize, offsetsHeaderSize+len(entries)*offsetsEntrySize)
+	copy(b, offsetsMagic)
+	binary.LittleEndian.PutUint32(b[4:8], offsetsFileVersion)
+
+	err := os.WriteFile(path+".tmp", encodeOffsets(b, entries), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", offsetsFileName, err)
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return fmt.Errorf("failed to replace %s: %w", offsetsFileName, err)
+	}
+	return nil
+}
+
+// Writes the entries for the lines from position first on. An offsets file
+// that is missing or doesn't reach first is left for the next load to catch
+// up.
+func appendOffsets(path string, first int, entries []lineEntry) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0o644)
+	if os.IsNotExist(err) && first == 0 {
+		return writeOffsets(path, entries)
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", offsetsFileName, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	at := offsetsHeaderSize + int64(first)*offsetsEntrySize
+	if info.Size() < at {
+		return nil
+	}
+
+	b := encodeOffsets(nil, entries)
+	_, err = f.WriteAt(b, at)
+	if err == nil && info.Size() > at+int64(len(b)) {
+		err = f.Truncate(at + int64(len(b)))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", offsetsFileName, err)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+func fillTestStore(t testing.TB, store *Store, n int) {
+	t.Helper()
+	vecs := make([]embedding.EmbeddingVector, n)
+	texts := make([]string, n)
+	for i := range vecs {
+		vecs[i] = newSparseVector(map[int]float32{i % embeddingSize: 1})
+		texts[i] = fmt.Sprintf("doc-%d", i)
+	}
+	if _, err := store.AppendBatch(vecs, texts); err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+}
+
+// Checks every record reads back with the right text and ID
+func assertTexts(t *testing.T, store *Store, n int) {
+	t.Helper()
+	for pos := range n {
+		rec, err := store.Get(pos)
+		if err != nil {
+			t.Fatalf("Get(%d): %v", pos, err)
+		}
+		if rec.Meta.Text != fmt.Sprintf("doc-%d", pos) || rec.Meta.ID != uint64(pos)+1 {
+			t.Fatalf("position %d: unexpected record %+v", pos, rec.Meta)
+		}
+	}
+}
+
+func TestOffsetsFileTracksAppends(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+	dir := store.Dir()
+	fillTestStore(t, store, 3)
+	fillTestStore(t, store, 2)
+
+	info, err := os.Stat(filepath.Join(dir, offsetsFileName))
+	if err != nil {
+		t.Fatalf("stat offsets: %v", err)
+	}
+	if info.Size() != offsetsHeaderSize+5*offsetsEntrySize {
+		t.Fatalf("expected 5 entries, got a %d-byte file", info.Size())
+	}
+
+	entries := readOffsets(filepath.Join(dir, offsetsFileName))
+	md, err := os.ReadFile(filepath.Join(dir, metadataFileName))
+	if err != nil {
+		t.Fatalf("read metadata: %v", err)
+	}
+	for pos, e := range entries {
+		if e.id != uint64(pos)+1 || (e.offset > 0 && md[e.offset-1] != '\n') {
+			t.Fatalf("entry %d does not start line %d: %+v", pos, pos, e)
+		}
+	}
+}
+
+// The offsets file is derived, so whatever state it is left in the store
+// reopens with the right metadata at every position
+func TestOffsetsFileIsRebuiltFromMetadata(t *testing.T) {
+	cases := map[string]func(path string, entries []lineEntry) error{
+		"missing": func(path string, _ []lineEntry) error {
+			return os.Remove(path)
+		},
+		"behind": func(path string, entries []lineEntry) error {
+			return writeOffsets(path, entries[:4])
+		},
+		"torn entry": func(path string, _ []lineEntry) error {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			return os.Truncate(path, info.Size()-5)
+		},
+		"ahead of the metadata": func(path string, entries []lineEntry) error {
+			return writeOffsets(path, append(entries, lineEntry{offset: 1 << 20, id: 99}))
+		},
+		"wrong IDs": func(path string, entries []lineEntry) error {
+			wrong := append([]lineEntry(nil), entries...)
+			for i := range wrong {
+				wrong[i].id += 100
+			}
+			return writeOffsets(path, wrong)
+		},
+		"not line starts": func(path string, entries []lineEntry) error {
+			wrong := append([]lineEntry(nil), entries...)
+			wrong[len(wrong)-1].offset++
+			return writeOffsets(path, wrong)
+		},
+		"garbage": func(path string, _ []lineEntry) error {
+			return os.WriteFile(path, []byte("not an offsets file"), 0o644)
+		},
+	}
+
+	for name, damage := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := openShared(t, dir)
+			fillTestStore(t, store, 10)
+			store.Close()
+
+			path := filepath.Join(dir, offsetsFileName)
+			if err := damage(path, readOffsets(path)); err != nil {
+				t.Fatalf("damage offsets: %v", err)
+			}
+
+			reopened := openShared(t, dir)
+			assertTexts(t, reopened, 10)
+			if n := len(readOffsets(path)); n != 10 {
+				t.Fatalf("expected the offsets file to be rewritten with 10 entries, got %d", n)
+			}
+
+			// Appends carry on from the repaired file
+			fillTestStore(t, reopened, 1)
+			if n := len(readOffsets(path)); n != 11 {
+				t.Fatalf("expected 11 entries after an append, got %d", n)
+			}
+		})
+	}
+}
+
+func TestOffsetsFollowCompactionAndClear(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+	dir := store.Dir()
+	fillTestStore(t, store, 6)
+	for _, id := range []uint64{1, 4} {
+		if err := store.Delete(id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	for pos, want := range []string{"doc-1", "doc-2", "doc-4", "doc-5"} {
+		rec, err := store.Get(pos)
+		if err != nil || rec.Meta.Text != want {
+			t.Fatalf("position %d: expected %s, got %+v, %v", pos, want, rec.Meta, err)
+		}
+	}
+	if n := len(readOffsets(filepath.Join(dir, offsetsFileName))); n != 4 {
+		t.Fatalf("expected 4 entries after compaction, got %d", n)
+	}
+
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+	if n := len(readOffsets(filepath.Join(dir, offsetsFileName))); n != 0 {
+		t.Fatalf("expected no entries after Clear, got %d", n)
+	}
+	id, err := store.Append(newSparseVector(map[int]float32{0: 1}), "after clear")
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	rec, err := store.Get(0)
+	if err != nil || rec.Meta.Text != "after clear" || rec.Meta.ID != id {
+		t.Fatalf("unexpected record after Clear: %+v, %v", rec.Meta, err)
+	}
+}
+
+// Get reads one metadata line however large the store is
+func BenchmarkGet(b *testing.B) {
+	for _, n := range []int{1_000, 100_000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			store, err := Open(b.TempDir(), Options{Dimension: embeddingSize})
+			if err != nil {
+				b.Fatalf("open: %v", err)
+			}
+			defer store.Close()
+			fillTestStore(b, store, n)
+
+			b.ResetTimer()
+			for i := range b.N {
+				if _, err := store.Get(i % n); err != nil {
+					b.Fatalf("Get: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+/*
+Int8 scalar quantization.
+
+Each vector is stored with its own scale and offset, so no training pass is
+needed and the first append is quantized as well as the millionth:
+
+	scale f32 | offset f32 | one int8 code per dimension | zero padding to 4 bytes
+
+A component x is stored as round((x - offset) / scale) and read back as
+offset + scale*code, with offset and scale chosen so the smallest and largest
+components of the vector map to -128 and 127. A 384-dim vector takes 392 bytes
+instead of 1536.
+
+Queries are never quantized. The asymmetric dot product of a float32 query q
+with a stored vector is
+
+	q · x = scale * Σ q[i]*code[i] + offset * Σ q[i]
+
+so only one float × int8 sum is needed per vector, and Σ q[i] once per query.
+*/
+
+const int8RecordPrefix = 8
+
+func int8RecordSize(dim int) int {
+	return int8RecordPrefix + (dim+3)/4*4
+}
+
+// Quantizes v into a record of int8RecordSize(len(v)) bytes
+func quantizeInt8(v []float32) []byte {
+	out := make([]byte, int8RecordSize(len(v)))
+
+	lo, hi := float32(math.Inf(1)), float32(math.Inf(-1))
+	for _, x := range v {
+		lo = min(lo, x)
+		hi = max(hi, x)
+	}
+
+	scale := (hi - lo) / 255
+	offset := lo + 128*scale
+	if scale == 0 {
+		// Every component is the same, the offset alone restores it
+		offset = lo
+	}
+	binary.LittleEndian.PutUint32(out[0:4], math.Float32bits(scale))
+	binary.LittleEndian.PutUint32(out[4:8], math.Float32bits(offset))
+
+	codes := out[int8RecordPrefix:]
+	for i, x := range v {
+		c := 0.0
+		if scale != 0 {
+			c = math.Round(float64((x - offset) / scale))
+		}
+		codes[i] = byte(int8(max(-128, min(127, c))))
+	}
+	return out
+}
+
+// Widens an int8 record back to float32s, writing dim components to out
+func dequantizeInt8(rec []byte, out []float32) {
+	scale, offset := int8Params(rec)
+	codes := rec[int8RecordPrefix:]
+	for i := range out {
+		out[i] = offset + scale*float32(int8(codes[i]))
+	}
+}
+
+func int8Params(rec []byte) (scale, offset float32) {
+	scale = math.Float32frombits(binary.LittleEndian.Uint32(rec[0:4]))
+	offset = math.Float32frombits(binary.LittleEndian.Uint32(rec[4:8]))
+	return scale, offset
+}
+
+// Dot product of a float32 query with an int8 record. qsum is Σ q[i].
+func dotInt8(q []float32, qsum float32, rec []byte) float32 {
+	scale, offset := int8Params(rec)
+	codes := rec[int8RecordPrefix : int8RecordPrefix+len(q)]
+
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(q); i += 4 {
+		s0 += q[i] * float32(int8(codes[i]))
+		s1 += q[i+1] * float32(int8(codes[i+1]))
+		s2 += q[i+2] * float32(int8(codes[i+2]))
+		s3 += q[i+3] * float32(int8(codes[i+3]))
+	}
+	for ; i < len(q); i++ {
+		s0 += q[i] * float32(int8(codes[i]))
+	}
+
+	return scale*(s0+s1+s2+s3) + offset*qsum
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"errors"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+func randomUnitVector(rng *rand.Rand) embedding.EmbeddingVector {
+	v := make(embedding.EmbeddingVector, embeddingSize)
+	for i := range v {
+		v[i] = float32(rng.NormFloat64())
+	}
+	v.Normalise()
+	return v
+}
+
+func TestInt8RoundTripAndKernel(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	v := randomUnitVector(rng)
+	q := randomUnitVector(rng)
+
+	rec := quantizeInt8(v)
+	if len(rec) != 392 {
+		t.Fatalf("expected a 392-byte record for 384 dims, got %d", len(rec))
+	}
+
+	back := make([]float32, len(v))
+	dequantizeInt8(rec, back)
+
+	scale, _ := int8Params(rec)
+	var want, exact, qsum float32
+	for i := range v {
+		if d := abs(back[i] - v[i]); d > scale/2+1e-6 {
+			t.Fatalf("component %d off by %v, more than half a step (%v)", i, d, scale/2)
+		}
+		want += q[i] * back[i]
+		exact += q[i] * v[i]
+		qsum += q[i]
+	}
+
+	got := dotInt8(q, qsum, rec)
+	if abs(got-want) > 1e-4 {
+		t.Fatalf("asymmetric kernel gave %v, dequantized dot gave %v", got, want)
+	}
+	if abs(got-exact) > 5e-3 {
+		t.Fatalf("quantized dot %v too far from exact %v", got, exact)
+	}
+}
+
+func TestInt8ConstantVector(t *testing.T) {
+	v := embedding.EmbeddingVector{0.5, 0.5, 0.5}
+	back := make([]float32, 3)
+	dequantizeInt8(quantizeInt8(v), back)
+	for i := range v {
+		if back[i] != v[i] {
+			t.Fatalf("expected %v, got %v", v, back)
+		}
+	}
+}
+
+func TestInt8StoreIsQuarterSize(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, Options{Dimension: embeddingSize, DType: DTypeInt8})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	rng := rand.New(rand.NewPCG(3, 4))
+	vecs := make([]embedding.EmbeddingVector, 100)
+	texts := make([]string, len(vecs))
+	for i := range vecs {
+		vecs[i] = randomUnitVector(rng)
+		texts[i] = "doc"
+	}
+	if _, err := store.AppendBatch(vecs, texts); err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, vectorFileName))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	vectorBytes := int(info.Size()) - store.Header().Size
+	if vectorBytes != 100*(392+checksumSize) {
+		t.Fatalf("expected %d bytes of vectors, got %d", 100*(392+checksumSize), vectorBytes)
+	}
+	t.Logf("int8: %d bytes per vector vs %d for float32", vectorBytes/100, embeddingSize*4)
+
+	rec, err := store.Get(42)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	sim, _ := rec.Vector.NormedCosineSimilarity(vecs[42])
+	if sim < 0.999 {
+		t.Fatalf("expected widened vector to match the original, similarity %v", sim)
+	}
+
+	if _, err := store.Float32(42); !errors.Is(err, ErrNoFloat32) {
+		t.Fatalf("expected ErrNoFloat32 without KeepFloat32, got %v", err)
+	}
+	store.Close()
+
+	// The element type is taken from the header, and a mismatch is rejected
+	reopened, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if reopened.Header().DType != DTypeInt8 {
+		t.Fatalf("expected int8 header, got %s", reopened.Header().DType)
+	}
+	if n, _ := reopened.Len(); n != 100 {
+		t.Fatalf("expected 100 vectors after reopen, got %d", n)
+	}
+	reopened.Close()
+
+	if _, err := Open(dir, Options{DType: DTypeFloat32}); !errors.Is(err, ErrIncompatibleHeader) {
+		t.Fatalf("expected ErrIncompatibleHeader, got %v", err)
+	}
+}
+
+func TestInt8StoreKeepsFloat32Copies(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, Options{Dimension: embeddingSize, DType: DTypeInt8, KeepFloat32: true})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+
+	rng := rand.New(rand.NewPCG(5, 6))
+	vecs := []embedding.EmbeddingVector{randomUnitVector(rng), randomUnitVector(rng), randomUnitVector(rng)}
+	if _, err := store.AppendBatch(vecs, []string{"a", "b", "c"}); err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+
+	id, _ := store.ID(0)
+	if err := store.Delete(id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	// Copies move with their records through compaction
+	for pos, want := range vecs[1:] {
+		got, err := store.Float32(pos)
+		if err != nil {
+			t.Fatalf("Float32(%d): %v", pos, err)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("position %d: full-precision copy differs at %d", pos, i)
+			}
+		}
+	}
+}
+
+// A crash after logging must replay all three files of a store keeping copies
+func TestInt8StoreReplaysFloat32Copies(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, Options{Dimension: embeddingSize, DType: DTypeInt8, KeepFloat32: true})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	crashAt = func(step txStep) bool { return step == txLogged }
+	t.Cleanup(func() { crashAt = nil })
+
+	v := randomUnitVector(rand.New(rand.NewPCG(7, 8)))
+	if _, err := store.Append(v, "in flight"); err != errSimulatedCrash {
+		t.Fatalf("expected simulated crash, got %v", err)
+	}
+	crashAt = nil
+	store.Close()
+
+	reopened, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+
+	got, err := reopened.Float32(0)
+	if err != nil {
+		t.Fatalf("Float32: %v", err)
+	}
+	if got[0] != v[0] || got[embeddingSize-1] != v[embeddingSize-1] {
+		t.Fatalf("expected replayed full-precision copy")
+	}
+}
@@ -0,0 +1,705 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+/*
+Segmented storage, LSM style.
+
+A segmented store is a directory of segments, each an ordinary Store with its
+own vectors, metadata, tombstones and optional ANN index, listed oldest first
+in segments.json:
+
+	segments.json
+	seg-000001/   data.bin, metadata.jsonl, ..., hnsw.idx
+	seg-000002/
+	seg-000003/   the active segment
+
+New records are appended to the active segment, the last one. Once it holds
+SegmentSize records it is sealed and a fresh active segment takes its place.
+Sealed segments are never appended to again. Deleting a record only adds a
+tombstone to the segment holding it.
+
+A background merger combines MergeFactor sealed segments of the same level
+into one segment of the next level, and rewrites a sealed segment on its own
+once more than MaxDeleted of its records are deleted. Either way deleted
+records are dropped, and each record keeps its ID. The merged segment is
+built next to the others and swapped in by rewriting segments.json, which is
+the commit point: a crash leaves either the old segments or the merged one,
+and directories segments.json doesn't list are removed on open.
+
+Every segment hands out IDs from the one before it left off, so IDs are
+unique across the store. Searches fan out across the segments, see
+search.SearchSegments.
+
+Records moved by a merge from a quantized store without full-precision
+copies are requantized from their dequantized vectors, so they pick up a
+little rounding. A segmented store is used by one process at a time; a
+second process opening it waits for the first to close it.
+*/
+
+const (
+	segmentsFileName = "segments.json"
+	segmentPrefix    = "seg-"
+
+	defaultSegmentSize = 10000
+	defaultMergeFactor = 4
+	defaultMaxDeleted  = 0.3
+
+	// Records copied per transaction by a merge
+	mergeBatchSize = 1024
+)
+
+var errSegmentedClosed = errors.New("storage: segmented store is closed")
+
+// Configures a segmented store when it is opened
+type SegmentOptions struct {
+	Options // Applied to every segment
+
+	SegmentSize int     // Records in the active segment before it is sealed, defaults to 10000
+	MergeFactor int     // Sealed segments of one level merged together, defaults to 4
+	MaxDeleted  float64 // Fraction of deleted records that gets a sealed segment rewritten, defaults to 0.3
+
+	// Opens the ANN index of a segment, attached to its store. Nil for none.
+	OpenIndex func(store *Store) (Index, error)
+
+	// Leaves merging to Merge rather than a background goroutine
+	ManualMerge bool
+}
+
+func (o SegmentOptions) withDefaults() SegmentOptions {
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = defaultSegmentSize
+	}
+	if o.MergeFactor < 2 {
+		o.MergeFactor = defaultMergeFactor
+	}
+	if o.MaxDeleted <= 0 {
+		o.MaxDeleted = defaultMaxDeleted
+	}
+	return o
+}
+
+// One segment of a segmented store
+type Segment struct {
+	Store *Store
+	Index Index // Nil unless SegmentOptions.OpenIndex is set
+	Level int   // 0 for sealed segments, one more than its sources for merged ones
+
+	name    string
+	firstID uint64
+}
+
+// Segment list as saved in segments.json
+type segmentManifest struct {
+	Segments []segmentEntry
+	NextSeq  int // Number of the next segment directory
+}
+
+type segmentEntry struct {
+	Name    string
+	Level   int    `json:",omitempty"`
+	FirstID uint64 `json:",omitempty"` // Lowest ID the segment may hand out
+}
+
+// A store split into immutable segments plus an active one
+type Segmented struct {
+	dir     string
+	opts    SegmentOptions
+	release func() error // Directory lock, held while open
+
+	mu       sync.RWMutex // Held for writing to change the segment list
+	segments []*Segment   // Oldest first, the last is active
+	nextSeq  int
+	closed   bool
+
+	mergeMu  sync.Mutex // One merge at a time
+	wake     chan struct{}
+	mergers  sync.WaitGroup
+	mergeErr error // Last background merge failure, guarded by mu
+}
+
+// Opens (or creates) the segmented store rooted at dir
+func OpenSegmented(dir string, opts SegmentOptions) (*Segmented, error) {
+	if dir == "" {
+		return nil, errors.New("storage: data directory must not be empty")
+	}
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	release, err := lockDir(dir, true, true)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Segmented{dir: dir, opts: opts.withDefaults(), release: release, wake: make(chan struct{}, 1)}
+	m, err := readSegmentManifest(dir)
+	if os.IsNotExist(err) {
+		m = segmentManifest{Segments: []segmentEntry{{Name: segmentName(1), FirstID: 1}}, NextSeq: 2}
+		err = s.writeManifestFile(m)
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	s.nextSeq = m.NextSeq
+
+	for _, e := range m.Segments {
+		seg, err := s.openSegment(e.Name, e.Level, e.FirstID)
+		if err != nil {
+			s.closeSegments()
+			release()
+			return nil, err
+		}
+		s.segments = append(s.segments, seg)
+	}
+	err = s.removeUnlisted()
+	if err != nil {
+		s.closeSegments()
+		release()
+		return nil, err
+	}
+
+	if !s.opts.ManualMerge {
+		s.mergers.Add(1)
+		go s.mergeLoop()
+		s.wakeMerger()
+	}
+	return s, nil
+}
+
+func segmentName(seq int) string {
+	return fmt.Sprintf("%s%06d", segmentPrefix, seq)
+}
+
+func readSegmentManifest(dir string) (segmentManifest, error) {
+	var m segmentManifest
+	data, err := os.ReadFile(filepath.Join(dir, segmentsFileName))
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return m, fmt.Errorf("failed to decode %s: %w", segmentsFileName, err)
+	}
+	if len(m.Segments) == 0 {
+		return m, fmt.Errorf("%s lists no segments", segmentsFileName)
+	}
+	return m, nil
+}
+
+// Saves the segment list. Renaming it into place commits seals and merges.
+func (s *Segmented) writeManifest() error {
+	m := segmentManifest{NextSeq: s.nextSeq}
+	for _, seg := range s.segments {
+		m.Segments = append(m.Segments, segmentEntry{Name: seg.name, Level: seg.Level, FirstID: seg.firstID})
+	}
+	return s.writeManifestFile(m)
+}
+
+func (s *Segmented) writeManifestFile(m segmentManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, segmentsFileName)
+	err = writeFileSynced(path+".tmp", data)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return fmt.Errorf("failed to replace %s: %w", segmentsFileName, err)
+	}
+	return nil
+}
+
+func (s *Segmented) openSegment(name string, level int, firstID uint64) (*Segment, error) {
+	store, err := open(filepath.Join(s.dir, name), s.opts.Options, max(firstID, 1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment %s: %w", name, err)
+	}
+	seg := &Segment{Store: store, Level: level, name: name, firstID: firstID}
+	if s.opts.OpenIndex != nil {
+		seg.Index, err = s.opts.OpenIndex(store)
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("failed to open index of segment %s: %w", name, err)
+		}
+	}
+	return seg, nil
+}
+
+// Removes segment directories left behind by a seal or merge that never
+// reached segments.json
+func (s *Segmented) removeUnlisted() error {
+	listed := map[string]bool{}
+	for _, seg := range s.segments {
+		listed[seg.name] = true
+	}
+	dirs, err := filepath.Glob(filepath.Join(s.dir, segmentPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if listed[filepath.Base(dir)] {
+			continue
+		}
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return fmt.Errorf("failed to remove unlisted segment %s: %w", filepath.Base(dir), err)
+		}
+	}
+	return nil
+}
+
+func (s *Segmented) Dir() string {
+	return s.dir
+}
+
+// Calls fn with the segments, oldest first. Merges wait until fn returns,
+// so the segments stay open while it runs.
+func (s *Segmented) WithSegments(fn func(segs []*Segment) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errSegmentedClosed
+	}
+	return fn(s.segments)
+}
+
+// Number of records in every segment, deleted ones included
+func (s *Segmented) Len() (int, error) {
+	total := 0
+	err := s.WithSegments(func(segs []*Segment) error {
+		for _, seg := range segs {
+			n, err := seg.Store.Len()
+			if err != nil {
+				return err
+			}
+			total += n
+		}
+		return nil
+	})
+	return total, err
+}
+
+// Appends records to the active segment, sealing it once it is full. Returns
+// the IDs assigned to the new records in order.
+func (s *Segmented) AppendBatchMeta(embeddings []embedding.EmbeddingVector, metas []EmbeddingMetaData) ([]uint64, error) {
+	var active *Segment
+	var ids []uint64
+	var n int
+	err := s.WithSegments(func(segs []*Segment) error {
+		active = segs[len(segs)-1]
+		var err error
+		ids, err = active.Store.AppendBatchMeta(embeddings, metas)
+		if err != nil {
+			return err
+		}
+		n, err = active.Store.Len()
+		return err
+	})
+	if err != nil || n < s.opts.SegmentSize {
+		return ids, err
+	}
+	return ids, s.seal(active)
+}
+
+// Seals the active segment if it holds any records, starting a new one
+func (s *Segmented) Seal() error {
+	var active *Segment
+	err := s.WithSegments(func(segs []*Segment) error {
+		active = segs[len(segs)-1]
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.seal(active)
+}
+
+func (s *Segmented) seal(active *Segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.segments[len(s.segments)-1] != active {
+		// Sealed already
+		return nil
+	}
+	n, err := active.Store.Len()
+	if err != nil || n == 0 {
+		return err
+	}
+
+	firstID, err := active.Store.nextFreeID()
+	if err != nil {
+		return err
+	}
+	name := segmentName(s.nextSeq)
+	seg, err := s.openSegment(name, 0, firstID)
+	if err != nil {
+		return err
+	}
+
+	s.segments = append(s.segments, seg)
+	s.nextSeq++
+	err = s.writeManifest()
+	if err != nil {
+		s.segments = s.segments[:len(s.segments)-1]
+		s.nextSeq--
+		return errors.Join(err, seg.Store.Close(), os.RemoveAll(filepath.Join(s.dir, name)))
+	}
+	s.wakeMerger()
+	return nil
+}
+
+// Stores doc in the active segment, as the parent of chunks appended next.
+// Merges carry documents along with their chunks.
+func (s *Segmented) PutDocument(doc Document) error {
+	return s.WithSegments(func(segs []*Segment) error {
+		return segs[len(segs)-1].Store.PutDocument(doc)
+	})
+}
+
+// Marks the record with the given ID as deleted in whichever segment holds it
+func (s *Segmented) Delete(id uint64) error {
+	return s.WithSegments(func(segs []*Segment) error {
+		for _, seg := range segs {
+			if seg.Store.holds(id) {
+				return seg.Store.Delete(id)
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+// Runs one merge if any is due, reporting whether it did. The background
+// merger calls it until nothing is left to merge.
+func (s *Segmented) Merge() (bool, error) {
+	s.mergeMu.Lock()
+	defer s.mergeMu.Unlock()
+
+	var sources []*Segment
+	var level int
+	err := s.WithSegments(func(segs []*Segment) error {
+		sources, level = s.pickMerge(segs[:len(segs)-1])
+		return nil
+	})
+	if err != nil || sources == nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	name := segmentName(s.nextSeq)
+	s.nextSeq++
+	s.mu.Unlock()
+
+	dst, copied, err := s.buildMerged(name, level, sources)
+	if err != nil {
+		os.RemoveAll(filepath.Join(s.dir, name))
+		return false, err
+	}
+
+	err = s.swapMerged(dst, copied, sources)
+	if err != nil {
+		dst.Store.Close()
+		os.RemoveAll(filepath.Join(s.dir, name))
+		return false, err
+	}
+
+	var errs []error
+	for _, src := range sources {
+		errs = append(errs, src.Store.Close(), os.RemoveAll(filepath.Join(s.dir, src.name)))
+	}
+	return true, errors.Join(errs...)
+}
+
+// Picks a run of MergeFactor sealed segments of one level, or else a sealed
+// segment with too many deletes, and the level of the segment they make
+func (s *Segmented) pickMerge(sealed []*Segment) ([]*Segment, int) {
+	f := s.opts.MergeFactor
+	for i := 0; i+f <= len(sealed); i++ {
+		run := sealed[i : i+f]
+		same := true
+		for _, seg := range run[1:] {
+			same = same && seg.Level == run[0].Level
+		}
+		if same {
+			return run, run[0].Level + 1
+		}
+	}
+	for _, seg := range sealed {
+		if seg.Store.deletedFraction() > s.opts.MaxDeleted {
+			return []*Segment{seg}, seg.Level
+		}
+	}
+	return nil, 0
+}
+
+// Copies the live records of sources into a new segment, returning the IDs
+// copied from each source. Deletes may go on in the sources meanwhile.
+func (s *Segmented) buildMerged(name string, level int, sources []*Segment) (*Segment, [][]uint64, error) {
+	store, err := open(filepath.Join(s.dir, name), s.opts.Options, 1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create segment %s: %w", name, err)
+	}
+
+	copied := make([][]uint64, len(sources))
+	docs := map[string]bool{} // Parent documents copied so far
+	for i, src := range sources {
+		n, err := src.Store.Len()
+		for start := 0; err == nil && start < n; start += mergeBatchSize {
+			var vecs []embedding.EmbeddingVector
+			var metas []EmbeddingMetaData
+			vecs, metas, err = src.Store.liveRecords(start, min(start+mergeBatchSize, n))
+			if err == nil && len(metas) > 0 {
+				err = store.appendKeepingIDs(vecs, metas)
+			}
+			for _, md := range metas {
+				copied[i] = append(copied[i], md.ID)
+			}
+			for j := 0; err == nil && j < len(metas); j++ {
+				if id := metas[j].DocID; id != "" && !docs[id] {
+					docs[id] = true
+					err = copyDocument(src.Store, store, id)
+				}
+			}
+		}
+		if err != nil {
+			store.Close()
+			return nil, nil, fmt.Errorf("failed to merge segment %s: %w", src.name, err)
+		}
+	}
+
+	seg := &Segment{Store: store, Level: level, name: name}
+	if s.opts.OpenIndex != nil {
+		seg.Index, err = s.opts.OpenIndex(store)
+		if err != nil {
+			store.Close()
+			return nil, nil, fmt.Errorf("failed to index segment %s: %w", name, err)
+		}
+	}
+	return seg, copied, nil
+}
+
+// Copies a parent document to the segment its chunks move to, if it is
+// stored
+func copyDocument(src, dst *Store, docID string) error {
+	doc, err := src.Document(docID)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return dst.PutDocument(doc)
+}
+
+// Puts the merged segment in place of its sources, carrying over deletes made
+// while it was built
+func (s *Segmented) swapMerged(dst *Segment, copied [][]uint64, sources []*Segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSegmentedClosed
+	}
+
+	for i, src := range sources {
+		for _, id := range copied[i] {
+			if !src.Store.deletedID(id) {
+				continue
+			}
+			err := dst.Store.Delete(id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	at := -1
+	for i, seg := range s.segments {
+		if seg == sources[0] {
+			at = i
+		}
+	}
+	if at < 0 {
+		return errors.New("storage: merged segments are gone")
+	}
+	old := s.segments
+	merged := append([]*Segment{}, old[:at]...)
+	if n, err := dst.Store.Len(); err != nil || n > 0 {
+		merged = append(merged, dst)
+	}
+	merged = append(merged, old[at+len(sources):]...)
+
+	s.segments = merged
+	err := s.writeManifest()
+	if err != nil {
+		s.segments = old
+		return err
+	}
+	if !containsSegment(merged, dst) {
+		// Nothing survived the merge
+		return errors.Join(dst.Store.Close(), os.RemoveAll(filepath.Join(s.dir, dst.name)))
+	}
+	return nil
+}
+
+func containsSegment(segs []*Segment, seg *Segment) bool {
+	for _, s := range segs {
+		if s == seg {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Segmented) wakeMerger() {
+	if s.opts.ManualMerge {
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Segmented) mergeLoop() {
+	defer s.mergers.Done()
+	for range s.wake {
+		for {
+			merged, err := s.Merge()
+			if err != nil && !errors.Is(err, errSegmentedClosed) {
+				s.mu.Lock()
+				s.mergeErr = err
+				s.mu.Unlock()
+			}
+			if err != nil || !merged {
+				break
+			}
+		}
+	}
+}
+
+// Stops the merger and closes every segment. Returns the last background
+// merge failure, if any.
+func (s *Segmented) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.wake)
+	s.mergers.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Join(s.closeSegments(), s.release(), s.mergeErr)
+}
+
+func (s *Segmented) closeSegments() error {
+	var errs []error
+	for _, seg := range s.segments {
+		errs = append(errs, seg.Store.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Next ID the store would hand out
+func (s *Store) nextFreeID() (uint64, error) {
+	err := s.rlock()
+	if err != nil {
+		return 0, err
+	}
+	defer s.runlock()
+	return s.nextID, nil
+}
+
+// Whether a record with the given ID is stored, deleted or not
+func (s *Store) holds(id uint64) bool {
+	s.idsMu.RLock()
+	defer s.idsMu.RUnlock()
+	_, ok := s.positions[id]
+	return ok
+}
+
+func (s *Store) deletedID(id uint64) bool {
+	s.idsMu.RLock()
+	defer s.idsMu.RUnlock()
+	_, ok := s.deleted[id]
+	return ok
+}
+
+// Fraction of the records that are deleted
+func (s *Store) deletedFraction() float64 {
+	s.idsMu.RLock()
+	defer s.idsMu.RUnlock()
+	if len(s.ids) == 0 {
+		return 0
+	}
+	return float64(s.deletedRecords()) / float64(len(s.ids))
+}
+
+// Reads the live records from position start up to end, with full-precision
+// vectors where the store keeps them
+func (s *Store) liveRecords(start, end int) ([]embedding.EmbeddingVector, []EmbeddingMetaData, error) {
+	err := s.rlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.runlock()
+
+	var vecs []embedding.EmbeddingVector
+	var metas []EmbeddingMetaData
+	for pos := start; pos < end; pos++ {
+		if s.isDeleted(pos) {
+			continue
+		}
+		md, err := s.metadataAt(pos)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, err := s.float32(pos)
+		if errors.Is(err, ErrNoFloat32) {
+			v, err = s.readVector(pos)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		vecs = append(vecs, v)
+		metas = append(metas, md)
+	}
+	return vecs, metas, nil
+}
+
+// Appends records under the IDs in metas
+func (s *Store) appendKeepingIDs(embeddings []embedding.EmbeddingVector, metas []EmbeddingMetaData) error {
+	err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer s.unlock()
+
+	for _, md := range metas {
+		if md.ID == 0 {
+			return errors.New("storage: record to copy has no ID")
+		}
+		if s.holds(md.ID) {
+			return fmt.Errorf("storage: record ID %d is already stored", md.ID)
+		}
+	}
+	_, err = s.write(embeddings, metas, true, nil)
+	return err
+}
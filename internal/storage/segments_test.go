@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+func openSegmented(t *testing.T, dir string, opts SegmentOptions) *Segmented {
+	t.Helper()
+	opts.Dimension = embeddingSize
+	segs, err := OpenSegmented(dir, opts)
+	if err != nil {
+		t.Fatalf("OpenSegmented: %v", err)
+	}
+	t.Cleanup(func() { segs.Close() })
+	return segs
+}
+
+func appendSegmented(t *testing.T, segs *Segmented, texts ...string) []uint64 {
+	t.Helper()
+	var ids []uint64
+	for _, text := range texts {
+		got, err := segs.AppendBatchMeta([]embedding.EmbeddingVector{newSparseVector(map[int]float32{len(text): 1})},
+			[]EmbeddingMetaData{{Text: text}})
+		if err != nil {
+			t.Fatalf("AppendBatchMeta: %v", err)
+		}
+		ids = append(ids, got...)
+	}
+	return ids
+}
+
+// Level and live "ID:text" records of every segment, oldest first
+func segmentLayout(t *testing.T, segs *Segmented) []string {
+	t.Helper()
+	var layout []string
+	err := segs.WithSegments(func(list []*Segment) error {
+		for _, seg := range list {
+			metas, err := seg.Store.MetaData()
+			if err != nil {
+				return err
+			}
+			desc := fmt.Sprintf("L%d", seg.Level)
+			for pos, md := range metas {
+				if !seg.Store.IsDeleted(pos) {
+					desc += fmt.Sprintf(" %d:%s", md.ID, md.Text)
+				}
+			}
+			layout = append(layout, desc)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WithSegments: %v", err)
+	}
+	return layout
+}
+
+func TestSegmentsSealAndMerge(t *testing.T) {
+	dir := t.TempDir()
+	segs := openSegmented(t, dir, SegmentOptions{SegmentSize: 3, MergeFactor: 2, ManualMerge: true})
+
+	ids := appendSegmented(t, segs, "a", "b", "c", "d", "e", "f", "g")
+	if !slices.Equal(ids, []uint64{1, 2, 3, 4, 5, 6, 7}) {
+		t.Fatalf("expected IDs to run on across segments, got %v", ids)
+	}
+	want := []string{"L0 1:a 2:b 3:c", "L0 4:d 5:e 6:f", "L0 7:g"}
+	if got := segmentLayout(t, segs); !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	if err := segs.Delete(2); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := segs.Delete(99); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for an unknown ID, got %v", err)
+	}
+	merged, err := segs.Merge()
+	if err != nil || !merged {
+		t.Fatalf("expected a merge, got %v, %v", merged, err)
+	}
+	want = []string{"L1 1:a 3:c 4:d 5:e 6:f", "L0 7:g"}
+	if got := segmentLayout(t, segs); !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if merged, err := segs.Merge(); err != nil || merged {
+		t.Fatalf("expected nothing left to merge, got %v, %v", merged, err)
+	}
+	if n, err := segs.Len(); err != nil || n != 6 {
+		t.Fatalf("expected 6 records, got %d, %v", n, err)
+	}
+
+	// The old segment directories are gone and the layout survives a reopen
+	dirs, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+	if len(dirs) != 2 {
+		t.Fatalf("expected 2 segment directories, got %v", dirs)
+	}
+	segs.Close()
+	reopened := openSegmented(t, dir, SegmentOptions{SegmentSize: 3, MergeFactor: 2, ManualMerge: true})
+	if got := segmentLayout(t, reopened); !slices.Equal(got, want) {
+		t.Fatalf("expected %v after reopening, got %v", want, got)
+	}
+	if ids := appendSegmented(t, reopened, "h"); ids[0] != 8 {
+		t.Fatalf("expected ID 8 after reopening, got %d", ids[0])
+	}
+}
+
+func TestSegmentsRewriteHeavilyDeletedSegment(t *testing.T) {
+	segs := openSegmented(t, t.TempDir(), SegmentOptions{SegmentSize: 4, MaxDeleted: 0.5, ManualMerge: true})
+	appendSegmented(t, segs, "a", "b", "c", "d", "e")
+
+	for _, id := range []uint64{1, 2} {
+		if err := segs.Delete(id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+	if merged, _ := segs.Merge(); merged {
+		t.Fatal("expected half deleted to be within MaxDeleted")
+	}
+	if err := segs.Delete(3); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if merged, err := segs.Merge(); err != nil || !merged {
+		t.Fatalf("expected a rewrite, got %v, %v", merged, err)
+	}
+	want := []string{"L0 4:d", "L0 5:e"}
+	if got := segmentLayout(t, segs); !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	// A segment with nothing left is dropped
+	if err := segs.Delete(4); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if merged, err := segs.Merge(); err != nil || !merged {
+		t.Fatalf("expected a rewrite, got %v, %v", merged, err)
+	}
+	want = []string{"L0 5:e"}
+	if got := segmentLayout(t, segs); !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+// A record deleted while its segment is being merged stays deleted
+func TestSegmentMergeKeepsDeletesMadeDuringIt(t *testing.T) {
+	segs := openSegmented(t, t.TempDir(), SegmentOptions{SegmentSize: 2, MergeFactor: 2, ManualMerge: true})
+	appendSegmented(t, segs, "a", "b", "c", "d", "e")
+
+	var sources []*Segment
+	segs.WithSegments(func(list []*Segment) error {
+		sources = list[:2]
+		return nil
+	})
+	dst, copied, err := segs.buildMerged(segmentName(99), 1, sources)
+	if err != nil {
+		t.Fatalf("buildMerged: %v", err)
+	}
+	if err := segs.Delete(3); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := segs.swapMerged(dst, copied, sources); err != nil {
+		t.Fatalf("swapMerged: %v", err)
+	}
+
+	want := []string{"L1 1:a 2:b 4:d", "L0 5:e"}
+	if got := segmentLayout(t, segs); !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestSegmentsRemoveUnlistedDirectories(t *testing.T) {
+	dir := t.TempDir()
+	segs := openSegmented(t, dir, SegmentOptions{ManualMerge: true})
+	appendSegmented(t, segs, "a")
+	segs.Close()
+
+	// Left by a merge that crashed before segments.json was replaced
+	stray := filepath.Join(dir, segmentName(42))
+	if err := os.Mkdir(stray, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	reopened := openSegmented(t, dir, SegmentOptions{ManualMerge: true})
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Fatalf("expected the stray segment to be removed, got %v", err)
+	}
+	if got := segmentLayout(t, reopened); !slices.Equal(got, []string{"L0 1:a"}) {
+		t.Fatalf("unexpected layout %v", got)
+	}
+}
+
+func TestSegmentsMergeInTheBackground(t *testing.T) {
+	segs := openSegmented(t, t.TempDir(), SegmentOptions{SegmentSize: 2, MergeFactor: 2})
+	appendSegmented(t, segs, "a", "b", "c", "d", "e")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		layout := segmentLayout(t, segs)
+		if slices.Equal(layout, []string{"L1 1:a 2:b 3:c 4:d", "L0 5:e"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("segments were not merged, layout %v", layout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := segs.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
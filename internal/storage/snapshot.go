@@ -0,0 +1,472 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+Snapshots are point-in-time copies of a store in a directory of their own.
+
+The data, metadata and tombstone files only ever grow between compactions, so
+a snapshot records their sizes when it starts and copies just that much. The
+copy is consistent however many records are appended while it is being made.
+Index files are replaced whole by renaming when saved, so they are hard
+linked where the file system allows it and copied otherwise. Indexes that end
+up covering more or fewer records than the snapshot catch up or rebuild when
+they are next opened.
+
+manifest.json is written last and lists every file with its size and SHA-256,
+so a directory without one is not a finished snapshot. It must list the data
+and metadata files, and may only list the store's own data files and
+indexes.
+
+Restore stages every file of the snapshot next to the store before touching
+it, then writes restore.pending listing them and swaps them in. A restore cut
+short before the marker is written left the store as it was, and its staged
+files are removed; one cut short after is finished. Either happens when the
+store is next opened or catches up with the process that crashed.
+*/
+
+const (
+	manifestFileName = "manifest.json"
+	snapshotVersion  = 1
+
+	restoreSuffix         = ".restore"
+	restoreMarkerFileName = "restore.pending"
+	indexPattern          = "*.idx"
+)
+
+var (
+	ErrSnapshotCorrupt  = errors.New("storage: snapshot does not match its manifest")
+	ErrSnapshotMismatch = errors.New("storage: snapshot does not match the store")
+)
+
+// An append-only store file and how much of it goes into a snapshot
+type snapshotSource struct {
+	name string
+	file *os.File
+	size int64
+}
+
+// Describes a snapshot, as written to its manifest.json
+type Manifest struct {
+	Version   int
+	Created   time.Time
+	Dimension int
+	DType     string
+	Model     string // Identity of the embedding model that produced the vectors
+	Vectors   int    // Records in data.bin, deleted ones included
+	Files     []ManifestFile
+}
+
+type ManifestFile struct {
+	Name   string
+	Size   int64
+	SHA256 string
+}
+
+// Writes a consistent copy of the store, its indexes included, to dir, which
+// must not exist yet. Attached indexes are saved first so their files are
+// current. Writes wait only while the files to copy are being opened.
+func (s *Store) Snapshot(dir string) (Manifest, error) {
+	err := s.rlock()
+	if err != nil {
+		return Manifest{}, err
+	}
+	m, sources, err := s.snapshotSources()
+	s.runlock()
+	defer func() {
+		for _, src := range sources {
+			src.file.Close()
+		}
+	}()
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(dir), 0o755)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	err = os.Mkdir(dir, 0o755)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	err = s.writeSnapshot(dir, &m, sources)
+	if err != nil {
+		os.RemoveAll(dir)
+		return Manifest{}, err
+	}
+	return m, nil
+}
+
+// Saves the indexes and opens every file to copy, noting how much of each
+// belongs in the snapshot. Files are opened afresh so the copy is unaffected
+// by compactions that replace them while it runs.
+func (s *Store) snapshotSources() (Manifest, []snapshotSource, error) {
+	for _, idx := range s.indexes {
+		err := idx.Save()
+		if err != nil {
+			return Manifest{}, nil, fmt.Errorf("failed to save index: %w", err)
+		}
+	}
+
+	// Everything committed so far, appends from here on are left out
+	var sources []snapshotSource
+	for _, src := range []snapshotSource{
+		{name: vectorFileName, file: s.vecFile},
+		{name: metadataFileName, file: s.mdFile},
+		{name: tombstoneFileName, file: s.tsFile},
+		{name: float32FileName, file: s.f32File},
+	} {
+		if src.file == nil {
+			continue
+		}
+		info, err := src.file.Stat()
+		if err != nil {
+			return Manifest{}, sources, fmt.Errorf("failed to get file info: %w", err)
+		}
+		src.size = info.Size()
+		src.file, err = os.Open(filepath.Join(s.dir, src.name))
+		if err != nil {
+			return Manifest{}, sources, fmt.Errorf("failed to open %s: %w", src.name, err)
+		}
+		sources = append(sources, src)
+	}
+
+	// Only written once documents are stored
+	docs, err := os.Open(s.documentsPath())
+	if err == nil {
+		info, err := docs.Stat()
+		if err != nil {
+			docs.Close()
+			return Manifest{}, sources, fmt.Errorf("failed to get file info: %w", err)
+		}
+		sources = append(sources, snapshotSource{name: documentsFileName, file: docs, size: info.Size()})
+	} else if !os.IsNotExist(err) {
+		return Manifest{}, sources, fmt.Errorf("failed to open %s: %w", documentsFileName, err)
+	}
+
+	m := Manifest{
+		Version:   snapshotVersion,
+		Created:   time.Now().UTC(),
+		Dimension: s.dim,
+		DType:     s.header.DType.String(),
+		Model:     s.header.Model,
+		Vectors:   int(sources[0].size-int64(s.header.Size)) / s.bytesPerVector(),
+	}
+	return m, sources, nil
+}
+
+func (s *Store) writeSnapshot(dir string, m *Manifest, sources []snapshotSource) error {
+	for _, src := range sources {
+		sum, err := copyFile(filepath.Join(dir, src.name), io.NewSectionReader(src.file, 0, src.size))
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, ManifestFile{Name: src.name, Size: src.size, SHA256: sum})
+	}
+
+	indexes, err := filepath.Glob(filepath.Join(s.dir, indexPattern))
+	if err != nil {
+		return err
+	}
+	for _, path := range indexes {
+		f, err := linkOrCopy(path, filepath.Join(dir, filepath.Base(path)))
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, f)
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	return writeFileSynced(filepath.Join(dir, manifestFileName), append(b, '\n'))
+}
+
+// Copies src to a new file at path, returning the SHA-256 of what was copied
+func copyFile(path string, src io.Reader) (string, error) {
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", filepath.Base(path), err)
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), src)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to copy %s: %w", filepath.Base(path), err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Hard links a file that is only ever replaced whole, copying it when the
+// link fails, e.g. across file systems
+func linkOrCopy(src, dst string) (ManifestFile, error) {
+	name := filepath.Base(dst)
+	err := os.Link(src, dst)
+	if err == nil {
+		f, err := os.Open(dst)
+		if err != nil {
+			return ManifestFile{}, fmt.Errorf("failed to open %s: %w", name, err)
+		}
+		defer f.Close()
+		return hashFile(name, f)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return ManifestFile{}, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer in.Close()
+	sum, err := copyFile(dst, in)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		return ManifestFile{}, fmt.Errorf("failed to get file info: %w", err)
+	}
+	return ManifestFile{Name: name, Size: info.Size(), SHA256: sum}, nil
+}
+
+func hashFile(name string, f *os.File) (ManifestFile, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return ManifestFile{}, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return ManifestFile{Name: name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// Reads the manifest of the snapshot in dir and checks every file it lists
+// against its size and checksum
+func ReadManifest(dir string) (Manifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to read snapshot manifest: %w", err)
+	}
+
+	var m Manifest
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("%w: invalid manifest: %v", ErrSnapshotCorrupt, err)
+	}
+	if m.Version == 0 || m.Version > snapshotVersion {
+		return Manifest{}, fmt.Errorf("%w: unsupported manifest version %d", ErrSnapshotCorrupt, m.Version)
+	}
+	for _, name := range []string{vectorFileName, metadataFileName} {
+		if !slices.ContainsFunc(m.Files, func(f ManifestFile) bool { return f.Name == name }) {
+			return Manifest{}, fmt.Errorf("%w: no %s", ErrSnapshotCorrupt, name)
+		}
+	}
+
+	for _, want := range m.Files {
+		if !snapshotFile(want.Name) {
+			return Manifest{}, fmt.Errorf("%w: invalid file name %q", ErrSnapshotCorrupt, want.Name)
+		}
+		f, err := os.Open(filepath.Join(dir, want.Name))
+		if err != nil {
+			return Manifest{}, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+		}
+		got, err := hashFile(want.Name, f)
+		f.Close()
+		if err != nil {
+			return Manifest{}, err
+		}
+		if got != want {
+			return Manifest{}, fmt.Errorf("%w: %s has changed", ErrSnapshotCorrupt, want.Name)
+		}
+	}
+	return m, nil
+}
+
+// Whether name is a file a snapshot may hold. Anything else, the lock file
+// and WAL above all, must never be put in place by a restore.
+func snapshotFile(name string) bool {
+	switch name {
+	case vectorFileName, metadataFileName, float32FileName, tombstoneFileName, offsetsFileName, documentsFileName:
+		return true
+	}
+	index, _ := filepath.Match(indexPattern, name)
+	return index && name == filepath.Base(name) && !strings.HasPrefix(name, ".")
+}
+
+// Replaces the contents of the store with the snapshot in dir. Snapshots of
+// vectors with another dimension or element type, or from another embedding
+// model, are refused with ErrSnapshotMismatch. Attached indexes are rebuilt
+// over the restored records, and IDs handed out since the snapshot are not
+// handed out again. A restore interrupted by a crash is finished or rolled
+// back when the store is next opened.
+func (s *Store) Restore(dir string) error {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	err = s.lock()
+	if err != nil {
+		return err
+	}
+	defer s.unlock()
+
+	if m.Dimension != s.dim {
+		return fmt.Errorf("%w: snapshot holds %d-dim vectors, store is configured for %d", ErrSnapshotMismatch, m.Dimension, s.dim)
+	}
+	if m.DType != s.header.DType.String() {
+		return fmt.Errorf("%w: snapshot holds %s vectors, store is configured for %s", ErrSnapshotMismatch, m.DType, s.header.DType)
+	}
+	if m.Model != "" && s.header.Model != "" && m.Model != s.header.Model {
+		return fmt.Errorf("%w: snapshot was written by model %q, store is configured for %q", ErrSnapshotMismatch, m.Model, s.header.Model)
+	}
+
+	// Stage every file next to the store before touching it
+	names := make([]string, 0, len(m.Files))
+	for _, f := range m.Files {
+		err = stageFile(filepath.Join(dir, f.Name), filepath.Join(s.dir, f.Name+restoreSuffix))
+		if err != nil {
+			// Without the marker this only removes what was staged
+			return errors.Join(err, finishRestore(s.dir))
+		}
+		names = append(names, f.Name)
+	}
+	b, err := json.Marshal(names)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", restoreMarkerFileName, err)
+	}
+	marker := filepath.Join(s.dir, restoreMarkerFileName)
+	err = writeFileSynced(marker+restoreSuffix, b)
+	if err == nil {
+		err = os.Rename(marker+restoreSuffix, marker)
+	}
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write %s: %w", restoreMarkerFileName, err), finishRestore(s.dir))
+	}
+
+	model, dtype, nextID := s.header.Model, s.header.DType, s.nextID
+	err = s.closeFiles()
+	if err != nil {
+		return fmt.Errorf("failed to close store before restoring: %w", err)
+	}
+	err = finishRestore(s.dir)
+	if err != nil {
+		return err
+	}
+	s.docs.mu.Lock()
+	s.docs.reset()
+	s.docs.mu.Unlock()
+
+	err = s.openFiles()
+	if err != nil {
+		return err
+	}
+	err = s.initHeader(Options{Dimension: s.dim, Model: model, DType: dtype})
+	if err != nil {
+		return err
+	}
+	err = s.load()
+	if err != nil {
+		return err
+	}
+
+	s.nextID = max(s.nextID, nextID)
+	err = s.keepIDWatermark()
+	if err != nil {
+		return err
+	}
+	return s.rebuildIndexes()
+}
+
+// Copies a snapshot file to path, replacing whatever an earlier attempt left
+func stageFile(src, path string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", filepath.Base(src), err)
+	}
+	defer in.Close()
+	os.Remove(path)
+	_, err = copyFile(path, in)
+	return err
+}
+
+// Resolves a restore that stopped part way. With restore.pending in place
+// every staged file is swapped in and the files the snapshot doesn't have are
+// removed. Without it the staged files are from a restore that never touched
+// the store, and are removed. Restore swaps its own files through it, and
+// opening a store and catching up with other processes call it with the
+// store locked for writing.
+func finishRestore(dir string) error {
+	marker := filepath.Join(dir, restoreMarkerFileName)
+	b, err := os.ReadFile(marker)
+	if os.IsNotExist(err) {
+		staged, err := filepath.Glob(filepath.Join(dir, "*"+restoreSuffix))
+		if err != nil {
+			return err
+		}
+		for _, path := range staged {
+			err = os.Remove(path)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove %s: %w", filepath.Base(path), err)
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", restoreMarkerFileName, err)
+	}
+	var names []string
+	err = json.Unmarshal(b, &names)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", restoreMarkerFileName, err)
+	}
+
+	restored := map[string]bool{}
+	for _, name := range names {
+		restored[name] = true
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, indexPattern))
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{float32FileName, tombstoneFileName, offsetsFileName, documentsFileName} {
+		stale = append(stale, filepath.Join(dir, name))
+	}
+	for _, path := range stale {
+		if restored[filepath.Base(path)] {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", filepath.Base(path), err)
+		}
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		err = os.Rename(path+restoreSuffix, path)
+		// Already swapped in before the crash
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to replace %s: %w", name, err)
+		}
+	}
+
+	err = os.Remove(marker)
+	if err != nil {
+		return fmt.Errorf("failed to remove %s: %w", restoreMarkerFileName, err)
+	}
+	return nil
+}
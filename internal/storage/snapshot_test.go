@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+func TestSnapshotIsPointInTime(t *testing.T) {
+	dir := t.TempDir()
+	writeFsckStore(t, dir, 3)
+	if err := os.WriteFile(filepath.Join(dir, "hnsw.idx"), []byte("graph"), 0o644); err != nil {
+		t.Fatalf("write index: %v", err)
+	}
+
+	store := openChecksumStore(t, dir, VerifyStrict)
+	snap := filepath.Join(t.TempDir(), "snaps", "first")
+	m, err := store.Snapshot(snap)
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if m.Vectors != 3 || m.Dimension != embeddingSize || len(m.Files) != 4 {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+	if _, err := store.Snapshot(snap); err == nil {
+		t.Fatalf("expected an existing snapshot not to be overwritten")
+	}
+
+	// Appends after the snapshot stay out of it
+	if _, err := store.Append(newSparseVector(map[int]float32{7: 1}), "later"); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ivf.idx"), []byte("lists"), 0o644); err != nil {
+		t.Fatalf("write index: %v", err)
+	}
+	if _, err := ReadManifest(snap); err != nil {
+		t.Fatalf("expected the snapshot to still match its manifest, got %v", err)
+	}
+
+	if err := store.Restore(snap); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if n, _ := store.Len(); n != 3 {
+		t.Fatalf("expected 3 records after restoring, got %d", n)
+	}
+	if rec, err := store.Get(2); err != nil || rec.Meta.Text != "doc-2" {
+		t.Fatalf("expected the snapshot's records, got %+v, %v", rec.Meta, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ivf.idx")); !os.IsNotExist(err) {
+		t.Fatalf("expected the index written after the snapshot to be removed, got %v", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "hnsw.idx")); err != nil || string(b) != "graph" {
+		t.Fatalf("expected the snapshot's index to be restored, got %q, %v", b, err)
+	}
+
+	// The ID handed out after the snapshot is not handed out again
+	id, err := store.Append(newSparseVector(map[int]float32{8: 1}), "after restore")
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if id != 5 {
+		t.Fatalf("expected ID 5, got %d", id)
+	}
+	store.Close()
+
+	reopened := openChecksumStore(t, dir, VerifyStrict)
+	if n, _ := reopened.Len(); n != 4 {
+		t.Fatalf("expected the restored store to survive a reopen, got %d records", n)
+	}
+}
+
+func TestRestoreRefusesCorruptSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	writeFsckStore(t, dir, 2)
+	store := openChecksumStore(t, dir, VerifyStrict)
+
+	snap := filepath.Join(t.TempDir(), "snap")
+	if _, err := store.Snapshot(snap); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	flipBit(t, filepath.Join(snap, metadataFileName), 3)
+
+	if err := store.Restore(snap); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("expected ErrSnapshotCorrupt, got %v", err)
+	}
+	if n, _ := store.Len(); n != 2 {
+		t.Fatalf("expected the store to be left alone, got %d records", n)
+	}
+}
+
+func TestRestoreRefusesManifestsNamingOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFsckStore(t, dir, 2)
+	store := openChecksumStore(t, dir, VerifyStrict)
+
+	for _, edit := range []func(m *Manifest, snap string){
+		func(m *Manifest, snap string) {
+			m.Files = slices.DeleteFunc(m.Files, func(f ManifestFile) bool { return f.Name == metadataFileName })
+		},
+		func(m *Manifest, snap string) {
+			if err := os.WriteFile(filepath.Join(snap, lockFileName), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			m.Files = append(m.Files, ManifestFile{Name: lockFileName, SHA256: ContentHash("")})
+		},
+	} {
+		snap := filepath.Join(t.TempDir(), "snap")
+		m, err := store.Snapshot(snap)
+		if err != nil {
+			t.Fatalf("Snapshot: %v", err)
+		}
+		edit(&m, snap)
+		b, _ := json.Marshal(m)
+		if err := os.WriteFile(filepath.Join(snap, manifestFileName), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.Restore(snap); !errors.Is(err, ErrSnapshotCorrupt) {
+			t.Fatalf("expected ErrSnapshotCorrupt, got %v", err)
+		}
+	}
+	if n, _ := store.Len(); n != 2 {
+		t.Fatalf("expected the store to be left alone, got %d records", n)
+	}
+}
+
+func TestRestoreRefusesOtherConfigurations(t *testing.T) {
+	src, err := Open(t.TempDir(), Options{Dimension: 8, Model: "model-a"})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer src.Close()
+	snap := filepath.Join(t.TempDir(), "snap")
+	if _, err := src.Snapshot(snap); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	for _, opts := range []Options{
+		{Dimension: 4, Model: "model-a"},
+		{Dimension: 8, Model: "model-b"},
+		{Dimension: 8, Model: "model-a", DType: DTypeInt8},
+	} {
+		dst, err := Open(t.TempDir(), opts)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		if err := dst.Restore(snap); !errors.Is(err, ErrSnapshotMismatch) {
+			t.Fatalf("%+v: expected ErrSnapshotMismatch, got %v", opts, err)
+		}
+		dst.Close()
+	}
+
+	dst, err := Open(t.TempDir(), Options{Dimension: 8, Model: "model-a"})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer dst.Close()
+	if err := dst.Restore(snap); err != nil {
+		t.Fatalf("expected a matching store to restore, got %v", err)
+	}
+}
+
+// Stages the files of a snapshot in dir as Restore would, with or without
+// the marker that commits the restore
+func stageRestore(t *testing.T, snap, dir string, commit bool) []string {
+	t.Helper()
+	m, err := ReadManifest(snap)
+	if err != nil {
+		t.Fatalf("ReadManifest: %v", err)
+	}
+	var names []string
+	for _, f := range m.Files {
+		if err := stageFile(filepath.Join(snap, f.Name), filepath.Join(dir, f.Name+restoreSuffix)); err != nil {
+			t.Fatalf("stage %s: %v", f.Name, err)
+		}
+		names = append(names, f.Name)
+	}
+	if commit {
+		b, _ := json.Marshal(names)
+		if err := os.WriteFile(filepath.Join(dir, restoreMarkerFileName), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return names
+}
+
+func TestOpenFinishesInterruptedRestore(t *testing.T) {
+	dir := t.TempDir()
+	writeFsckStore(t, dir, 3)
+	store := openChecksumStore(t, dir, VerifyStrict)
+	snap := filepath.Join(t.TempDir(), "snap")
+	if _, err := store.Snapshot(snap); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	ids, err := store.AppendBatch([]embedding.EmbeddingVector{newSparseVector(map[int]float32{7: 1})}, []string{"later"})
+	if err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+	store.Delete(ids[0])
+
+	// Crash after the data file was swapped in but before the rest were
+	stageRestore(t, snap, dir, true)
+	if err := os.Rename(filepath.Join(dir, vectorFileName+restoreSuffix), filepath.Join(dir, vectorFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := store.Len(); err != nil || n != 3 {
+		t.Fatalf("expected the open store to finish the restore, got %d, %v", n, err)
+	}
+	store.Close()
+
+	reopened := openChecksumStore(t, dir, VerifyStrict)
+	if rec, err := reopened.Get(2); err != nil || rec.Meta.Text != "doc-2" {
+		t.Fatalf("expected the snapshot's records, got %+v, %v", rec.Meta, err)
+	}
+	for _, name := range []string{restoreMarkerFileName, metadataFileName + restoreSuffix} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be gone, got %v", name, err)
+		}
+	}
+}
+
+func TestOpenDropsUncommittedRestore(t *testing.T) {
+	dir := t.TempDir()
+	writeFsckStore(t, dir, 3)
+	store := openChecksumStore(t, dir, VerifyStrict)
+	snap := filepath.Join(t.TempDir(), "snap")
+	if _, err := store.Snapshot(snap); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	store.Append(newSparseVector(map[int]float32{7: 1}), "later")
+	store.Close()
+
+	// Crash while staging, before the marker
+	names := stageRestore(t, snap, dir, false)
+	reopened := openChecksumStore(t, dir, VerifyStrict)
+	if n, _ := reopened.Len(); n != 4 {
+		t.Fatalf("expected the store to be left as it was, got %d records", n)
+	}
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name+restoreSuffix)); !os.IsNotExist(err) {
+			t.Fatalf("expected staged %s to be removed, got %v", name, err)
+		}
+	}
+}
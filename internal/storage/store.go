@@ -3,151 +3,1430 @@ package storage
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mateosanchezl/go-vect/internal/embedding"
 )
 
-// Appends embedding to data file
-func StoreEmbedding(embedding embedding.EmbeddingVector, text string) error {
-	embedding.Normalise()
+const (
+	vectorFileName    = "data.bin"
+	metadataFileName  = "metadata.jsonl"
+	tombstoneFileName = "tombstones.jsonl"
+	float32FileName   = "data.f32"
 
-	bs := vectorToByteSlice(embedding)
+	defaultDimension = 384
 
-	ofs, err := calculateOffset(embedding)
+	clearSuffix = ".clear"
+)
+
+var (
+	ErrOutOfRange = errors.New("storage: record position out of range")
+	ErrNotFound   = errors.New("storage: record not found")
+	ErrNoFloat32  = errors.New("storage: store keeps no full-precision vectors")
+)
+
+// Options configures a store when it is opened. Zero values are taken from the
+// vector file header when the store already exists.
+type Options struct {
+	Dimension int    // Length of every stored vector, defaults to 384
+	Model     string // Identity of the embedding model, checked against the header
+	DType     DType  // Element type of data.bin, defaults to float32
+
+	// Keep full-precision copies of quantized vectors in data.f32 so search
+	// results can be rescored. Only applies when the store is created.
+	KeepFloat32 bool
+
+	// What reads do with records that fail their checksum, strict by default
+	Verify VerifyMode
+}
+
+// A Store owns the vector and metadata files inside a single data directory.
+// Vectors are appended to data.bin after its header as little-endian float32s,
+// or as quantized records, and each one gets a line in metadata.jsonl at the
+// same position. Deletes are recorded as tombstones in tombstones.jsonl until
+// the store is compacted. metadata.offsets indexes the metadata lines, see
+// offsets.go, and documents.jsonl holds the documents the chunks came from,
+// see documents.go.
+//
+// A Store is safe for concurrent use, and several processes may open the same
+// directory. See lock.go for how the two are kept apart.
+type Store struct {
+	dir    string
+	dim    int
+	header VectorHeader
+
+	mu      sync.RWMutex
+	idsMu   sync.RWMutex // Innermost, guards ids, positions and deleted for ID and IsDeleted
+	dirLock *dirLock
+	seen    fileState // Files as this Store last left them
+
+	vecFile *os.File
+	mdFile  *os.File
+	tsFile  *os.File
+	f32File *os.File // Full-precision copies of quantized vectors, nil if not kept
+	wal     *wal
+	verify  VerifyMode
+
+	ids       []uint64            // Record ID at each position
+	positions map[uint64]int      // Position of each record ID
+	deleted   map[uint64]struct{} // Tombstoned record IDs
+	nextID    uint64
+	firstID   uint64 // Lowest ID handed out, so the segments of a store never share IDs
+
+	lastOffset int     // Offset recorded by the last metadata line
+	lines      []int64 // Where each metadata line starts, followed by the end of the last
+
+	indexes   []Index
+	docs      docIndex
+	metaCache metaCache
+}
+
+// A stored embedding together with its metadata
+type Record struct {
+	Pos    int
+	Vector embedding.EmbeddingVector
+	Meta   EmbeddingMetaData
+}
+
+// Opens (or creates) the store rooted at dir
+func Open(dir string, opts Options) (*Store, error) {
+	return open(dir, opts, 1)
+}
+
+// Like Open, handing out IDs from firstID on
+func open(dir string, opts Options, firstID uint64) (*Store, error) {
+	if dir == "" {
+		return nil, errors.New("storage: data directory must not be empty")
+	}
+	if opts.Dimension < 0 {
+		return nil, fmt.Errorf("storage: invalid dimension %d", opts.Dimension)
+	}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	s := &Store{dir: dir, verify: opts.Verify, firstID: firstID}
+	s.dirLock, err = openDirLock(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = s.dirLock.lock()
+	if err != nil {
+		s.dirLock.close()
+		return nil, err
+	}
+	defer s.dirLock.unlock()
+
+	err = finishCompaction(dir)
+	if err == nil {
+		err = finishRestore(dir)
+	}
+	if err != nil {
+		s.dirLock.close()
+		return nil, err
+	}
+
+	err = s.openFiles()
+	if err != nil {
+		s.dirLock.close()
+		return nil, err
+	}
+
+	err = s.recover()
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to recover from wal: %w", err)
+	}
+
+	err = s.initHeader(opts)
 	if err != nil {
-		return fmt.Errorf("failed to calculate offset: %w", err)
+		s.Close()
+		return nil, err
 	}
 
-	file, err := os.OpenFile(os.Getenv("VECTOR_DB_PATH"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	err = s.load()
 	if err != nil {
-		return fmt.Errorf("failed to open data file: %w", err)
+		s.Close()
+		return nil, err
+	}
+
+	s.seen, err = s.fileState()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reads the header of the store in dir and counts the vectors on disk,
+// deleted ones included, without opening it for writing or replaying its WAL
+func Describe(dir string) (VectorHeader, int, error) {
+	file, err := os.Open(filepath.Join(dir, vectorFileName))
+	if err != nil {
+		return VectorHeader{}, 0, fmt.Errorf("failed to open %s: %w", vectorFileName, err)
 	}
 	defer file.Close()
 
-	vFileInfo, err := file.Stat()
+	info, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
+		return VectorHeader{}, 0, fmt.Errorf("failed to get file info: %w", err)
+	}
+	if info.Size() == 0 {
+		return VectorHeader{}, 0, fmt.Errorf("%w: empty data file", ErrUnrecognisedFile)
+	}
+
+	h, err := readVectorHeader(file, defaultDimension)
+	if err != nil {
+		return VectorHeader{}, 0, err
+	}
+	n := int(info.Size()-int64(h.Size)) / h.recordSize()
+	return h, n, nil
+}
+
+func (s *Store) openFiles() error {
+	files := []struct {
+		name string
+		dst  **os.File
+	}{
+		{vectorFileName, &s.vecFile},
+		{metadataFileName, &s.mdFile},
+		{tombstoneFileName, &s.tsFile},
+	}
+
+	for _, f := range files {
+		file, err := os.OpenFile(filepath.Join(s.dir, f.name), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			s.closeFiles()
+			return fmt.Errorf("failed to open %s: %w", f.name, err)
+		}
+		*f.dst = file
+	}
+
+	// Only quantized stores created with KeepFloat32 have one
+	file, err := os.OpenFile(filepath.Join(s.dir, float32FileName), os.O_RDWR|os.O_APPEND, 0o644)
+	if err == nil {
+		s.f32File = file
+	} else if !os.IsNotExist(err) {
+		s.closeFiles()
+		return fmt.Errorf("failed to open %s: %w", float32FileName, err)
+	}
+
+	w, err := openWAL(s.dir)
+	if err != nil {
+		s.closeFiles()
+		return err
 	}
-	originalSize := vFileInfo.Size()
+	s.wal = w
+
+	return nil
+}
 
-	_, err = file.Write(bs)
+// Rebuilds the in-memory ID index, line offsets and tombstone set from disk
+func (s *Store) load() error {
+	entries, end, err := s.indexMetadata()
 	if err != nil {
-		return fmt.Errorf("failed to write embedding to data file: %w", err)
+		return err
+	}
+
+	ids := make([]uint64, len(entries))
+	positions := make(map[uint64]int, len(entries))
+	deleted := map[uint64]struct{}{}
+	lines := make([]int64, len(entries)+1)
+	s.nextID = max(s.firstID, 1)
+	s.lastOffset = 0
+
+	for pos, e := range entries {
+		ids[pos] = e.id
+		positions[e.id] = pos
+		lines[pos] = e.offset
+		s.nextID = max(s.nextID, e.id+1)
 	}
-	file.Sync()
+	lines[len(entries)] = end
+	s.lines = lines
 
-	mdFile, err := os.OpenFile(os.Getenv("METADATA_DB_PATH"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if len(entries) > 0 {
+		line, err := s.metadataLine(len(entries) - 1)
+		if err != nil {
+			return err
+		}
+		var md EmbeddingMetaData
+		err = json.Unmarshal([]byte(line), &md)
+		if err != nil {
+			return fmt.Errorf("failed to decode metadata line %d: %w", len(entries)-1, err)
+		}
+		s.lastOffset = md.Offset
+	}
+
+	tombstones, err := readLines(s.tsFile)
 	if err != nil {
 		return err
 	}
-	defer mdFile.Close()
-	mdFileInfo, err := mdFile.Stat()
+	for i, line := range tombstones {
+		var ts tombstone
+		err = json.Unmarshal([]byte(line), &ts)
+		if err != nil {
+			return fmt.Errorf("failed to decode tombstone line %d: %w", i, err)
+		}
+		deleted[ts.ID] = struct{}{}
+		s.nextID = max(s.nextID, ts.ID+1)
+	}
+
+	s.idsMu.Lock()
+	s.ids, s.positions, s.deleted = ids, positions, deleted
+	s.idsMu.Unlock()
+	s.metaCache.drop()
+	return nil
+}
+
+// Writes a header to a fresh data file, or reads and validates the existing one
+func (s *Store) initHeader(opts Options) error {
+	dim := opts.Dimension
+	if dim == 0 {
+		dim = defaultDimension
+	}
+
+	info, err := s.vecFile.Stat()
 	if err != nil {
 		return fmt.Errorf("failed to get file info: %w", err)
 	}
-	mdFileOriginalSize := mdFileInfo.Size()
 
-	err = storeEmbeddingMetaData(mdFile, text, ofs)
+	fresh := info.Size() == 0
+	if !fresh && info.Size() < headerFixedSize {
+		// A header torn on creation, before any records were written
+		mdInfo, err := s.mdFile.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to get file info: %w", err)
+		}
+		prefix := make([]byte, min(info.Size(), int64(len(headerMagic))))
+		_, err = s.vecFile.ReadAt(prefix, 0)
+		if err != nil {
+			return fmt.Errorf("failed to read vector file header: %w", err)
+		}
+		fresh = mdInfo.Size() == 0 && string(prefix) == string(headerMagic[:len(prefix)])
+	}
+	if fresh {
+		dtype := opts.DType
+		if dtype == 0 {
+			dtype = DTypeFloat32
+		}
+		if dtype.Size() == 0 {
+			return fmt.Errorf("storage: unsupported element type %s", dtype)
+		}
+		h := newVectorHeader(dim, dtype, opts.Model)
+		h.Float32Copy = opts.KeepFloat32 && dtype != DTypeFloat32
+
+		err = s.writeHeader(h)
+		if err != nil {
+			return err
+		}
+		if h.Float32Copy {
+			// Drop anything left behind by an earlier store
+			return s.createFloat32File()
+		}
+		return s.openFloat32File()
+	}
+
+	h, err := readVectorHeader(s.vecFile, dim)
 	if err != nil {
-		file.Truncate(originalSize)
-		mdFile.Truncate(mdFileOriginalSize)
-		return fmt.Errorf("failed to store embedding metadata: %w", err)
+		return err
+	}
+	err = h.validate(opts)
+	if err != nil {
+		return err
 	}
 
+	s.header = h
+	s.dim = h.Dimension
+	if h.Model == "" {
+		s.header.Model = opts.Model
+	}
+	return s.openFloat32File()
+}
+
+// Makes sure data.f32 is open exactly when the header says copies are kept
+func (s *Store) openFloat32File() error {
+	if s.header.Float32Copy && s.f32File == nil {
+		return s.createFloat32File()
+	}
+	if !s.header.Float32Copy && s.f32File != nil {
+		err := s.f32File.Close()
+		s.f32File = nil
+		return err
+	}
 	return nil
 }
 
-// Turns an embedding vector into a single byte slice
-func vectorToByteSlice(v embedding.EmbeddingVector) []byte {
-	out := make([]byte, len(v)*4) // Allocate 4 bytes to each float in vector
+func (s *Store) createFloat32File() error {
+	if s.f32File != nil {
+		return truncateAndSync(s.f32File, 0)
+	}
 
-	for i := range len(v) {
-		bits := math.Float32bits(v[i])                        // Turn the float to bits
-		binary.LittleEndian.PutUint32(out[i*4:(i+1)*4], bits) // Put it in the byte slice
+	file, err := os.OpenFile(filepath.Join(s.dir, float32FileName), os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", float32FileName, err)
 	}
+	s.f32File = file
+	return nil
+}
 
-	return out
+// A header for an empty data file of the same shape as the current one
+func (s *Store) freshHeader() VectorHeader {
+	h := newVectorHeader(s.dim, s.header.DType, s.header.Model)
+	h.Float32Copy = s.header.Float32Copy
+	return h
 }
 
-// Store metadata
-type EmbeddingMetaData struct {
-	Offset int
-	Text   string
+// Replaces the contents of the data file with just a header
+func (s *Store) writeHeader(h VectorHeader) error {
+	err := s.vecFile.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("failed to reset data file: %w", err)
+	}
+
+	err = writeAndSync(s.vecFile, h.encode())
+	if err != nil {
+		return fmt.Errorf("failed to write vector file header: %w", err)
+	}
+
+	s.header = h
+	s.dim = h.Dimension
+	return nil
+}
+
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+func (s *Store) Dimension() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.dim
+}
+
+// The header of the vector file, with Size 0 for legacy headerless files
+func (s *Store) Header() VectorHeader {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.header
+}
+
+// Number of bytes a single vector takes up in the data file, checksum
+// included
+func (s *Store) bytesPerVector() int {
+	return s.header.recordSize()
+}
+
+// Decodes a record read from the data file, dropping its checksum
+func (s *Store) decodeRecord(rec []byte) embedding.EmbeddingVector {
+	return decodeVector(s.header.DType, rec[:s.header.DType.recordSize(s.dim)], s.dim)
+}
+
+// Byte offset of the vector at position pos in the data file
+func (s *Store) vectorOffset(pos int) int64 {
+	return int64(s.header.Size) + int64(pos)*int64(s.bytesPerVector())
+}
+
+// Appends embedding to data file and its text to the metadata file, returning
+// the ID assigned to the new record. Both writes go through the WAL so they
+// land together or not at all.
+func (s *Store) Append(ev embedding.EmbeddingVector, text string) (uint64, error) {
+	ids, err := s.AppendBatch([]embedding.EmbeddingVector{ev}, []string{text})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
 }
 
-func storeEmbeddingMetaData(file *os.File, text string, offset int) (err error) {
-	md := EmbeddingMetaData{
-		Offset: offset,
-		Text:   text,
+// Appends a whole batch of embeddings and their texts as one transaction, with
+// a single WAL entry and one sync per file. Returns the IDs assigned to the new
+// records in order.
+func (s *Store) AppendBatch(embeddings []embedding.EmbeddingVector, texts []string) ([]uint64, error) {
+	if len(embeddings) != len(texts) {
+		return nil, fmt.Errorf("got %d embeddings but %d texts", len(embeddings), len(texts))
 	}
 
-	mdJson, err := json.Marshal(md)
+	metas := make([]EmbeddingMetaData, len(texts))
+	for i, text := range texts {
+		metas[i] = EmbeddingMetaData{Text: text}
+	}
+	return s.AppendBatchMeta(embeddings, metas)
+}
+
+// Like AppendBatch but stores the full metadata of each record. ID and Offset
+// are assigned by the store and ignored if set.
+func (s *Store) AppendBatchMeta(embeddings []embedding.EmbeddingVector, metas []EmbeddingMetaData) ([]uint64, error) {
+	if len(embeddings) != len(metas) {
+		return nil, fmt.Errorf("got %d embeddings but %d metadata records", len(embeddings), len(metas))
+	}
+	if len(embeddings) == 0 {
+		return []uint64{}, nil
+	}
+
+	err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer s.unlock()
+
+	return s.write(embeddings, metas, false, nil)
+}
+
+// Appends records and tombstones the records in remove as one transaction.
+// With keepIDs the records keep the IDs in metas, which must be unused, rather
+// than being given new ones. Called with the store locked for writing.
+func (s *Store) write(embeddings []embedding.EmbeddingVector, metas []EmbeddingMetaData, keepIDs bool, remove []uint64) ([]uint64, error) {
+	vecBytes := make([]byte, 0, len(embeddings)*s.bytesPerVector())
+	var mdBytes, f32Bytes []byte
+
+	ids := make([]uint64, len(embeddings))
+	lineStarts := make([]int64, len(embeddings)) // Relative to the end of the metadata
+	ofs := s.lastOffset
+	for i, e := range embeddings {
+		if len(e) != s.dim {
+			return nil, fmt.Errorf("embedding vector must be of length %d, got %d", s.dim, len(e))
+		}
+		e.Normalise()
+
+		rec := encodeVector(s.header.DType, e)
+		if s.header.Checksums {
+			rec = appendRecordChecksum(rec)
+		}
+		vecBytes = append(vecBytes, rec...)
+		if s.f32File != nil {
+			f32Bytes = append(f32Bytes, vectorToByteSlice(e)...)
+		}
+		ofs = s.calculateOffset(ofs, e)
+
+		ids[i] = s.nextID + uint64(i)
+		if keepIDs {
+			ids[i] = metas[i].ID
+		}
+		md := metas[i]
+		md.ID, md.Offset = ids[i], ofs
+		mdLine, err := encodeMetaData(md)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode embedding metadata: %w", err)
+		}
+		lineStarts[i] = int64(len(mdBytes))
+		mdBytes = append(mdBytes, mdLine...)
+	}
+
+	vFileInfo, err := s.vecFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	mdFileInfo, err := s.mdFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	entry := walEntry{
+		vecStart: vFileInfo.Size(),
+		mdStart:  mdFileInfo.Size(),
+		vecBytes: vecBytes,
+		mdBytes:  mdBytes,
+	}
+	if s.f32File != nil {
+		f32FileInfo, err := s.f32File.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file info: %w", err)
+		}
+		entry.f32Start = f32FileInfo.Size()
+		entry.f32Bytes = f32Bytes
+	}
+	if len(remove) > 0 {
+		tsFileInfo, err := s.tsFile.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file info: %w", err)
+		}
+		entry.tsStart = tsFileInfo.Size()
+		for _, id := range remove {
+			b, err := json.Marshal(tombstone{ID: id})
+			if err != nil {
+				return nil, err
+			}
+			entry.tsBytes = append(append(entry.tsBytes, b...), '\n')
+		}
+	}
+
+	err = s.commit(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	first := len(s.ids)
+	s.idsMu.Lock()
+	for _, id := range ids {
+		s.positions[id] = len(s.ids)
+		s.ids = append(s.ids, id)
+	}
+	for _, id := range remove {
+		s.deleted[id] = struct{}{}
+	}
+	s.idsMu.Unlock()
+	for _, id := range ids {
+		s.nextID = max(s.nextID, id+1)
+	}
+	s.lastOffset = ofs
+
+	s.lines = s.lines[:first]
+	offsets := make([]lineEntry, len(ids))
+	for i, id := range ids {
+		offsets[i] = lineEntry{offset: entry.mdStart + lineStarts[i], id: id}
+		s.lines = append(s.lines, offsets[i].offset)
+	}
+	s.lines = append(s.lines, entry.mdStart+int64(len(mdBytes)))
+	offsetsErr := appendOffsets(s.offsetsPath(), first, offsets)
+
+	err = s.updateIndexes(first, embeddings)
+	if err != nil {
+		// The records are committed, the index catches up when next attached
+		return ids, fmt.Errorf("stored records but failed to update index: %w", err)
+	}
+	if offsetsErr != nil {
+		// metadata.offsets catches up from the metadata on the next load
+		return ids, fmt.Errorf("stored records but failed to index their metadata: %w", offsetsErr)
+	}
+
+	return ids, nil
+}
+
+// Marks the record with the given ID as deleted. The record stays on disk
+// until Compact is called but is skipped by Get and Iterate.
+func (s *Store) Delete(id uint64) error {
+	err := s.lock()
 	if err != nil {
 		return err
 	}
+	defer s.unlock()
+
+	if _, ok := s.positions[id]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := s.deleted[id]; ok {
+		return nil
+	}
 
-	_, err = file.WriteString(string(mdJson) + "\n")
+	err = s.writeTombstone(id)
 	if err != nil {
 		return err
 	}
-	file.Sync()
 
+	s.markDeleted(id)
 	return nil
 }
 
-func calculateOffset(embedding embedding.EmbeddingVector) (int, error) {
-	last, err := getLastOffset()
+func (s *Store) markDeleted(id uint64) {
+	s.idsMu.Lock()
+	s.deleted[id] = struct{}{}
+	s.idsMu.Unlock()
+}
+
+// ID of the record at position pos
+func (s *Store) ID(pos int) (uint64, bool) {
+	s.idsMu.RLock()
+	defer s.idsMu.RUnlock()
+	if pos < 0 || pos >= len(s.ids) {
+		return 0, false
+	}
+	return s.ids[pos], true
+}
+
+// Reports whether the record at position pos has been deleted
+func (s *Store) IsDeleted(pos int) bool {
+	s.idsMu.RLock()
+	defer s.idsMu.RUnlock()
+	return s.isDeleted(pos)
+}
+
+// Like IsDeleted, with the store or the ID lock already held
+func (s *Store) isDeleted(pos int) bool {
+	if pos < 0 || pos >= len(s.ids) {
+		return false
+	}
+	_, ok := s.deleted[s.ids[pos]]
+	return ok
+}
+
+// Number of deleted records still on disk, with the store or the ID lock
+// held. Tombstones without a record, like the one keepIDWatermark keeps, are
+// left out.
+func (s *Store) deletedRecords() int {
+	n := 0
+	for id := range s.deleted {
+		if _, ok := s.positions[id]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+type tombstone struct {
+	ID uint64
+}
+
+func (s *Store) writeTombstone(id uint64) error {
+	b, err := json.Marshal(tombstone{ID: id})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.tsFile.Write(append(b, '\n'))
 	if err != nil {
-		return 0, fmt.Errorf("failed to get last offset: %w", err)
+		return fmt.Errorf("failed to write tombstone: %w", err)
 	}
 
-	byteCount := len(embedding) * 4
-	return last + byteCount, nil
+	err = s.tsFile.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync tombstones: %w", err)
+	}
+	return nil
 }
 
-// Gets the last offset recorded in metadata if available
-func getLastOffset() (offset int, err error) {
-	data, err := os.ReadFile(os.Getenv("METADATA_DB_PATH"))
+// Number of vectors in the data file
+func (s *Store) Len() (int, error) {
+	err := s.rlock()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return 0, nil // File doesn't exist, start at 0
-		}
-		return 0, err // Real error
+		return 0, err
 	}
+	defer s.runlock()
+	return s.len()
+}
 
-	if len(data) == 0 {
-		return 0, nil
+func (s *Store) len() (int, error) {
+	info, err := s.vecFile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get file info: %w", err)
 	}
+	return int(info.Size()-int64(s.header.Size)) / s.bytesPerVector(), nil
+}
 
-	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
-	if len(lines) == 0 {
-		return 0, nil
+// Reads the vector and metadata stored at position pos
+func (s *Store) Get(pos int) (Record, error) {
+	err := s.rlock()
+	if err != nil {
+		return Record{}, err
 	}
+	defer s.runlock()
 
-	last := lines[len(lines)-1]
+	n, err := s.len()
+	if err != nil {
+		return Record{}, err
+	}
+	if pos < 0 || pos >= n {
+		return Record{}, ErrOutOfRange
+	}
+	if s.isDeleted(pos) {
+		return Record{}, ErrNotFound
+	}
 
-	var lastMd EmbeddingMetaData
+	buf := make([]byte, s.bytesPerVector())
+	_, err = s.vecFile.ReadAt(buf, s.vectorOffset(pos))
+	if err != nil {
+		return Record{}, fmt.Errorf("failed to read vector %d: %w", pos, err)
+	}
+	err = s.checkRecord(pos, buf)
+	if err != nil {
+		return Record{}, err
+	}
 
-	err = json.Unmarshal([]byte(last), &lastMd)
+	md, err := s.metadataAt(pos)
 	if err != nil {
-		return 0, err
+		return Record{}, err
 	}
 
-	return lastMd.Offset, nil
+	return Record{Pos: pos, Vector: s.decodeRecord(buf), Meta: md}, nil
 }
 
-func ClearData() error {
-	paths := []string{os.Getenv("VECTOR_DB_PATH"), os.Getenv("METADATA_DB_PATH")}
-	for _, p := range paths {
-		f, err := os.OpenFile(p, os.O_RDWR|os.O_TRUNC, 0o644)
+// Decodes the metadata of every position, deleted ones included, in a single
+// read of the metadata file. In lenient mode corrupt lines are left with
+// only their ID set.
+func (s *Store) MetaData() ([]EmbeddingMetaData, error) {
+	err := s.rlock()
+	if err != nil {
+		return nil, err
+	}
+	defer s.runlock()
+
+	lines, err := s.readMetadataLines()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]EmbeddingMetaData, min(len(lines), len(s.ids)))
+	for pos := range out {
+		out[pos].ID = s.ids[pos]
+		err = s.checkMetadataLine(pos, lines[pos])
+		if err != nil {
+			if s.Lenient() {
+				continue
+			}
+			return nil, err
+		}
+
+		err = json.Unmarshal([]byte(lines[pos]), &out[pos])
 		if err != nil {
-			return fmt.Errorf("failed to clear data file %s: %w", p, err)
+			return nil, fmt.Errorf("failed to decode metadata for vector %d: %w", pos, err)
 		}
-		defer f.Close()
+		out[pos].ID = s.ids[pos]
 	}
-	return nil
+	return out, nil
+}
+
+// Reads the full-precision vector at position pos, for rescoring results
+// found through quantized vectors. Returns ErrNoFloat32 for quantized stores
+// created without KeepFloat32.
+func (s *Store) Float32(pos int) (embedding.EmbeddingVector, error) {
+	err := s.rlock()
+	if err != nil {
+		return nil, err
+	}
+	defer s.runlock()
+
+	n, err := s.len()
+	if err != nil {
+		return nil, err
+	}
+	if pos < 0 || pos >= n {
+		return nil, ErrOutOfRange
+	}
+
+	return s.float32(pos)
+}
+
+// Like Float32, with the store locked and pos in range
+func (s *Store) float32(pos int) (embedding.EmbeddingVector, error) {
+	if s.header.DType == DTypeFloat32 {
+		return s.readVector(pos)
+	}
+	if s.f32File == nil {
+		return nil, ErrNoFloat32
+	}
+
+	buf := make([]byte, s.dim*4)
+	_, err := s.f32File.ReadAt(buf, int64(pos)*int64(s.dim)*4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vector %d: %w", pos, err)
+	}
+	return byteSliceToVector(buf), nil
+}
+
+// Reads and decodes the record at pos in data.bin, checking its checksum
+func (s *Store) readVector(pos int) (embedding.EmbeddingVector, error) {
+	buf := make([]byte, s.bytesPerVector())
+	_, err := s.vecFile.ReadAt(buf, s.vectorOffset(pos))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vector %d: %w", pos, err)
+	}
+	err = s.checkRecord(pos, buf)
+	if err != nil {
+		return nil, err
+	}
+	return s.decodeRecord(buf), nil
+}
+
+// Whether Float32 can return full-precision vectors
+func (s *Store) HasFloat32() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.header.DType == DTypeFloat32 || s.f32File != nil
+}
+
+// Calls fn with every live vector in position order. Iteration stops at the
+// first error returned by fn, or at a corrupt record in strict mode, while
+// lenient mode skips corrupt records. Vectors are read through a VectorView,
+// so v aliases the data file and must not be modified or kept after fn
+// returns. The records iterated over are those in the store when Iterate was
+// called, and fn is free to call back into the store.
+func (s *Store) Iterate(fn func(pos int, v embedding.EmbeddingVector) error) error {
+	err := s.rlock()
+	if err != nil {
+		return err
+	}
+	view, err := s.view()
+	if err != nil {
+		s.runlock()
+		return err
+	}
+	defer view.Close()
+	deleted := make([]bool, view.Len())
+	for pos := range deleted {
+		deleted[pos] = s.isDeleted(pos)
+	}
+	s.runlock()
+
+	for pos := range view.Len() {
+		if deleted[pos] {
+			continue
+		}
+		ok, err := view.Verify(pos)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		err = fn(pos, view.At(pos))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls fn with every live record in position order, metadata included,
+// as the store was when called. Vectors are the full-precision copies when
+// the store keeps them, and are fn's to keep; metadata is shared with the
+// MetaTable and must not be modified. Like Iterate, corrupt records are
+// skipped in lenient mode and stop the iteration in strict mode.
+func (s *Store) IterateRecords(fn func(rec Record) error) error {
+	err := s.rlock()
+	if err != nil {
+		return err
+	}
+	view, err := s.view()
+	if err != nil {
+		s.runlock()
+		return err
+	}
+	defer view.Close()
+	table, err := s.metaTable()
+	if err != nil {
+		s.runlock()
+		return err
+	}
+	n := min(view.Len(), table.Len())
+	deleted := make([]bool, n)
+	for pos := range deleted {
+		deleted[pos] = s.isDeleted(pos)
+	}
+	// A file of its own, so a compaction renaming another into place
+	// cannot change the copies under us
+	var f32 *os.File
+	if s.header.DType != DTypeFloat32 && s.f32File != nil {
+		f32, err = os.Open(filepath.Join(s.dir, float32FileName))
+		if err != nil {
+			s.runlock()
+			return fmt.Errorf("failed to open %s: %w", float32FileName, err)
+		}
+		defer f32.Close()
+	}
+	dim := s.dim
+	s.runlock()
+
+	for pos := range n {
+		if deleted[pos] {
+			continue
+		}
+		ok, err := view.Verify(pos)
+		if err != nil {
+			return err
+		}
+		md, found := table.At(pos)
+		if !ok || !found {
+			continue
+		}
+
+		var v embedding.EmbeddingVector
+		if f32 != nil {
+			buf := make([]byte, dim*4)
+			_, err = f32.ReadAt(buf, int64(pos)*int64(dim)*4)
+			if err != nil {
+				return fmt.Errorf("failed to read vector %d: %w", pos, err)
+			}
+			v = byteSliceToVector(buf)
+		} else {
+			v = slices.Clone(view.At(pos))
+		}
+		err = fn(Record{Pos: pos, Vector: v, Meta: md})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Empties the data, metadata and tombstone files, leaving a fresh header in
+// the data file
+func (s *Store) Clear() error {
+	err := s.lockDiscarding()
+	if err != nil {
+		return err
+	}
+	defer s.unlock()
+
+	// data.bin is replaced rather than truncated, views may still map it
+	h := s.freshHeader()
+	path := filepath.Join(s.dir, vectorFileName)
+	err = writeFileSynced(path+clearSuffix, h.encode())
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+clearSuffix, path)
+	if err != nil {
+		return fmt.Errorf("failed to replace data file: %w", err)
+	}
+	vecFile, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", vectorFileName, err)
+	}
+	s.vecFile.Close()
+	s.vecFile = vecFile
+	s.header = h
+
+	for _, f := range []*os.File{s.mdFile, s.tsFile, s.f32File} {
+		if f == nil {
+			continue
+		}
+		err := f.Truncate(0)
+		if err != nil {
+			return fmt.Errorf("failed to clear data file %s: %w", f.Name(), err)
+		}
+	}
+
+	s.idsMu.Lock()
+	s.ids = nil
+	s.positions = map[uint64]int{}
+	s.deleted = map[uint64]struct{}{}
+	s.idsMu.Unlock()
+	s.metaCache.drop()
+	s.lastOffset = 0
+	s.lines = []int64{0}
+
+	err = writeOffsets(s.offsetsPath(), nil)
+	if err != nil {
+		return err
+	}
+
+	err = s.clearDocuments()
+	if err != nil {
+		return err
+	}
+
+	err = s.keepIDWatermark()
+	if err != nil {
+		return err
+	}
+	return s.rebuildIndexes()
+}
+
+// Rewrites the data and metadata files without deleted records, fixing up the
+// offsets of the records that remain. Legacy headerless files and files
+// without checksums are upgraded to the current format on the way. Corrupt
+// records stop the compaction rather than being rewritten with fresh
+// checksums. Returns the number of records removed.
+func (s *Store) Compact() (removed int, err error) {
+	err = s.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer s.unlock()
+
+	if s.deletedRecords() == 0 && !s.header.Legacy() && s.header.Checksums {
+		return 0, nil
+	}
+
+	vecTmpPath := filepath.Join(s.dir, vectorFileName+compactSuffix)
+	mdTmpPath := filepath.Join(s.dir, metadataFileName+compactSuffix)
+	f32TmpPath := filepath.Join(s.dir, float32FileName+compactSuffix)
+
+	err = s.writeCompacted(vecTmpPath, mdTmpPath, f32TmpPath)
+	if err != nil {
+		os.Remove(vecTmpPath)
+		os.Remove(mdTmpPath)
+		os.Remove(f32TmpPath)
+		return 0, err
+	}
+
+	removed = len(s.ids)
+	for _, id := range s.ids {
+		if _, ok := s.deleted[id]; !ok {
+			removed--
+		}
+	}
+
+	err = s.closeFiles()
+	if err != nil {
+		return 0, fmt.Errorf("failed to close store before compaction: %w", err)
+	}
+
+	// Removed first, so a crash part way through never pairs it with the
+	// compacted metadata
+	err = os.Remove(s.offsetsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to remove %s: %w", offsetsFileName, err)
+	}
+	err = os.Rename(vecTmpPath, filepath.Join(s.dir, vectorFileName))
+	if err != nil {
+		return 0, fmt.Errorf("failed to replace data file: %w", err)
+	}
+	err = os.Rename(mdTmpPath, filepath.Join(s.dir, metadataFileName))
+	if err != nil {
+		return 0, fmt.Errorf("failed to replace metadata file: %w", err)
+	}
+	if s.header.Float32Copy {
+		err = os.Rename(f32TmpPath, filepath.Join(s.dir, float32FileName))
+		if err != nil {
+			return 0, fmt.Errorf("failed to replace %s: %w", float32FileName, err)
+		}
+	}
+
+	err = s.openFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.initHeader(Options{Dimension: s.dim, Model: s.header.Model, DType: s.header.DType})
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.tsFile.Truncate(0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to clear tombstones: %w", err)
+	}
+
+	nextID := s.nextID
+	err = s.load()
+	if err != nil {
+		return 0, err
+	}
+	s.nextID = nextID
+
+	err = s.keepIDWatermark()
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.compactDocuments()
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.rebuildIndexes()
+	if err != nil {
+		return 0, err
+	}
+
+	return removed, nil
+}
+
+func (s *Store) writeCompacted(vecPath, mdPath, f32Path string) error {
+	vecOut, err := os.OpenFile(vecPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create compacted data file: %w", err)
+	}
+	defer vecOut.Close()
+
+	mdOut, err := os.OpenFile(mdPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create compacted metadata file: %w", err)
+	}
+	defer mdOut.Close()
+
+	var f32Out *os.File
+	if s.f32File != nil {
+		f32Out, err = os.OpenFile(f32Path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to create compacted %s: %w", float32FileName, err)
+		}
+		defer f32Out.Close()
+	}
+
+	lines, err := s.readMetadataLines()
+	if err != nil {
+		return err
+	}
+
+	h := s.freshHeader()
+	_, err = vecOut.Write(h.encode())
+	if err != nil {
+		return fmt.Errorf("failed to write compacted header: %w", err)
+	}
+
+	buf := make([]byte, s.bytesPerVector())
+	f32Buf := make([]byte, s.dim*4)
+	ofs := 0
+	for pos, id := range s.ids {
+		if _, ok := s.deleted[id]; ok {
+			continue
+		}
+
+		_, err = s.vecFile.ReadAt(buf, s.vectorOffset(pos))
+		if err != nil {
+			return fmt.Errorf("failed to read vector %d: %w", pos, err)
+		}
+		err = errors.Join(s.checkRecord(pos, buf), s.checkMetadataLine(pos, lines[pos]))
+		if err != nil {
+			return err
+		}
+		rec := buf
+		if h.Checksums && !s.header.Checksums {
+			rec = appendRecordChecksum(buf[:len(buf):len(buf)])
+		}
+
+		var md EmbeddingMetaData
+		err = json.Unmarshal([]byte(lines[pos]), &md)
+		if err != nil {
+			return fmt.Errorf("failed to decode metadata line %d: %w", pos, err)
+		}
+		ofs += len(rec)
+		md.ID = id
+		md.Offset = ofs
+
+		_, err = vecOut.Write(rec)
+		if err != nil {
+			return fmt.Errorf("failed to write compacted vector: %w", err)
+		}
+		if f32Out != nil {
+			_, err = s.f32File.ReadAt(f32Buf, int64(pos)*int64(len(f32Buf)))
+			if err != nil {
+				return fmt.Errorf("failed to read full-precision vector %d: %w", pos, err)
+			}
+			_, err = f32Out.Write(f32Buf)
+			if err != nil {
+				return fmt.Errorf("failed to write compacted vector: %w", err)
+			}
+		}
+		mdBytes, err := encodeMetaData(md)
+		if err != nil {
+			return fmt.Errorf("failed to encode compacted metadata: %w", err)
+		}
+		_, err = mdOut.Write(mdBytes)
+		if err != nil {
+			return fmt.Errorf("failed to write compacted metadata: %w", err)
+		}
+	}
+
+	err = errors.Join(vecOut.Sync(), mdOut.Sync())
+	if f32Out != nil {
+		err = errors.Join(err, f32Out.Sync())
+	}
+	return err
+}
+
+// IDs are never reused. When the newest record no longer exists on disk a
+// tombstone for it is kept so the next ID survives a reopen.
+func (s *Store) keepIDWatermark() error {
+	last := s.nextID - 1
+	if last == 0 {
+		return nil
+	}
+	if _, ok := s.positions[last]; ok {
+		return nil
+	}
+
+	err := s.writeTombstone(last)
+	if err != nil {
+		return err
+	}
+	s.markDeleted(last)
+	return nil
+}
+
+// Saves any attached indexes and closes the underlying files
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, idx := range s.indexes {
+		err := idx.Save()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to save index: %w", err))
+		}
+	}
+	s.indexes = nil
+
+	errs = append(errs, s.closeFiles())
+	if s.dirLock != nil {
+		errs = append(errs, s.dirLock.close())
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) closeFiles() error {
+	var errs []error
+	for _, f := range []*os.File{s.vecFile, s.mdFile, s.tsFile, s.f32File} {
+		if f != nil {
+			errs = append(errs, f.Close())
+		}
+	}
+	s.f32File = nil
+	if s.wal != nil {
+		errs = append(errs, s.wal.close())
+	}
+	return errors.Join(errs...)
+}
+
+// Turns an embedding vector into a single byte slice
+func vectorToByteSlice(v embedding.EmbeddingVector) []byte {
+	out := make([]byte, len(v)*4) // Allocate 4 bytes to each float in vector
+
+	for i := range len(v) {
+		bits := math.Float32bits(v[i])                        // Turn the float to bits
+		binary.LittleEndian.PutUint32(out[i*4:(i+1)*4], bits) // Put it in the byte slice
+	}
+
+	return out
+}
+
+// Encodes a vector as a record of the given element type
+func encodeVector(dtype DType, v embedding.EmbeddingVector) []byte {
+	switch dtype {
+	case DTypeInt8:
+		return quantizeInt8(v)
+	case DTypeFloat16:
+		return encodeFloat16(v)
+	case DTypeBFloat16:
+		return encodeBFloat16(v)
+	default:
+		return vectorToByteSlice(v)
+	}
+}
+
+// Decodes a record of the given element type into a new vector of length dim
+func decodeVector(dtype DType, b []byte, dim int) embedding.EmbeddingVector {
+	switch dtype {
+	case DTypeInt8:
+		out := make(embedding.EmbeddingVector, dim)
+		dequantizeInt8(b, out)
+		return out
+	case DTypeFloat16:
+		out := make(embedding.EmbeddingVector, dim)
+		decodeFloat16(b, out)
+		return out
+	case DTypeBFloat16:
+		out := make(embedding.EmbeddingVector, dim)
+		decodeBFloat16(b, out)
+		return out
+	default:
+		return byteSliceToVector(b)
+	}
+}
+
+// Turns a byte slice of little-endian floats back into a vector
+func byteSliceToVector(b []byte) embedding.EmbeddingVector {
+	out := make(embedding.EmbeddingVector, len(b)/4)
+
+	for i := range out {
+		bits := binary.LittleEndian.Uint32(b[i*4 : (i+1)*4])
+		out[i] = math.Float32frombits(bits)
+	}
+
+	return out
+}
+
+// Store metadata. Everything after Text is optional and left out of
+// metadata.jsonl when unset, so lines written before it existed still decode.
+type EmbeddingMetaData struct {
+	ID     uint64
+	Offset int
+	Text   string
+
+	Source     string         `json:",omitempty"` // URI of the document the chunk came from, e.g. file:///notes/a.md
+	DocID      string         `json:",omitempty"` // Identifies the document, shared by all of its chunks
+	Key        string         `json:",omitempty"` // External key of the document, set by Upsert
+	Hash       string         `json:",omitempty"` // ContentHash of Text, set by Upsert
+	Chunk      int            `json:",omitempty"` // Ordinal of the chunk within its document, from 0
+	Span       *Span          `json:",omitempty"` // Where the chunk sits in the original document
+	IngestedAt time.Time      `json:",omitzero"`
+	Attributes map[string]any `json:",omitempty"` // Free-form user attributes, numbers come back as float64
+}
+
+// Location of a chunk in its original document, as half-open ranges
+type Span struct {
+	ByteStart int
+	ByteEnd   int
+	RuneStart int
+	RuneEnd   int
+}
+
+// Encodes metadata as a single JSONL line ending in its checksum
+func encodeMetaData(md EmbeddingMetaData) ([]byte, error) {
+	mdJson, err := json.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(appendLineChecksum(mdJson), '\n'), nil
+}
+
+// Offset recorded for an embedding appended after one ending at last
+func (s *Store) calculateOffset(last int, embedding embedding.EmbeddingVector) int {
+	byteCount := s.header.DType.recordSize(len(embedding))
+	if s.header.Checksums {
+		byteCount += checksumSize
+	}
+	return last + byteCount
+}
+
+// Reads the metadata line at pos with a single seek, without its newline
+func (s *Store) metadataLine(pos int) (string, error) {
+	if pos < 0 || pos+1 >= len(s.lines) {
+		return "", fmt.Errorf("no metadata recorded for vector %d", pos)
+	}
+	buf := make([]byte, s.lines[pos+1]-s.lines[pos])
+	_, err := s.mdFile.ReadAt(buf, s.lines[pos])
+	if err != nil {
+		return "", fmt.Errorf("failed to read metadata for vector %d: %w", pos, err)
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// Reads and checks the metadata at pos
+func (s *Store) metadataAt(pos int) (EmbeddingMetaData, error) {
+	line, err := s.metadataLine(pos)
+	if err != nil {
+		return EmbeddingMetaData{}, err
+	}
+	err = s.checkMetadataLine(pos, line)
+	if err != nil {
+		return EmbeddingMetaData{}, err
+	}
+
+	var md EmbeddingMetaData
+	err = json.Unmarshal([]byte(line), &md)
+	if err != nil {
+		return EmbeddingMetaData{}, fmt.Errorf("failed to decode metadata for vector %d: %w", pos, err)
+	}
+	md.ID = s.ids[pos]
+	return md, nil
+}
+
+func (s *Store) readMetadataLines() (lines []string, err error) {
+	return readLines(s.mdFile)
+}
+
+// Reads every non-empty line of a JSONL file
+func readLines(file *os.File) (lines []string, err error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	data := make([]byte, info.Size())
+	_, err = file.ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read %s: %w", file.Name(), err)
+	}
+
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return []string{}, nil
+	}
+
+	return strings.Split(strings.TrimSpace(string(data)), "\n"), nil
 }
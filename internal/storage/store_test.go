@@ -3,25 +3,36 @@ package storage
 import (
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"math"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/mateosanchezl/go-vect/internal/embedding"
 )
 
 const embeddingSize = 384
 
-func setupTempDB(t *testing.T) (string, string) {
+// Size of the header written for stores opened without a model identity
+var testHeaderSize = newVectorHeader(embeddingSize, DTypeFloat32, "").Size
+
+// Bytes each float32 record takes up in data.bin, checksum included
+const testRecordSize = embeddingSize*4 + checksumSize
+
+func setupTempDB(t *testing.T) (*Store, string, string) {
 	t.Helper()
 	dir := t.TempDir()
-	vectorPath := filepath.Join(dir, "vectors.bin")
-	metaPath := filepath.Join(dir, "metadata.jsonl")
-	t.Setenv("VECTOR_DB_PATH", vectorPath)
-	t.Setenv("METADATA_DB_PATH", metaPath)
-	return vectorPath, metaPath
+	store, err := Open(dir, Options{Dimension: embeddingSize})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	vectorPath := filepath.Join(dir, vectorFileName)
+	metaPath := filepath.Join(dir, metadataFileName)
+	return store, vectorPath, metaPath
 }
 
 func newSparseVector(entries map[int]float32) embedding.EmbeddingVector {
@@ -49,13 +60,13 @@ func TestVectorToByteSliceRoundTrip(t *testing.T) {
 }
 
 func TestStoreEmbeddingWritesDataAndMetadata(t *testing.T) {
-	vectorPath, metaPath := setupTempDB(t)
+	store, vectorPath, metaPath := setupTempDB(t)
 	vec := newSparseVector(map[int]float32{0: 3, 1: 4})
 
-	if err := StoreEmbedding(vec, "first"); err != nil {
+	if _, err := store.Append(vec, "first"); err != nil {
 		t.Fatalf("store embedding (first): %v", err)
 	}
-	if err := StoreEmbedding(vec, "second"); err != nil {
+	if _, err := store.Append(vec, "second"); err != nil {
 		t.Fatalf("store embedding (second): %v", err)
 	}
 
@@ -63,13 +74,14 @@ func TestStoreEmbeddingWritesDataAndMetadata(t *testing.T) {
 	if err != nil {
 		t.Fatalf("reading vector db: %v", err)
 	}
-	expectedBytes := len(vec) * 4 * 2
+	expectedBytes := testHeaderSize + testRecordSize*2
 	if len(data) != expectedBytes {
 		t.Fatalf("expected %d bytes stored, got %d", expectedBytes, len(data))
 	}
 
-	firstVal := mathFromBytes(data[0:4])
-	secondVal := mathFromBytes(data[4:8])
+	vectors := data[testHeaderSize:]
+	firstVal := mathFromBytes(vectors[0:4])
+	secondVal := mathFromBytes(vectors[4:8])
 	if diff := abs(firstVal - 0.6); diff > 1e-5 {
 		t.Fatalf("expected normalised first value 0.6, got %v", firstVal)
 	}
@@ -94,7 +106,7 @@ func TestStoreEmbeddingWritesDataAndMetadata(t *testing.T) {
 		t.Fatalf("unmarshal second metadata: %v", err)
 	}
 
-	vecBytes := len(vec) * 4
+	vecBytes := len(vec)*4 + checksumSize
 	if first.Offset != vecBytes {
 		t.Fatalf("expected first offset %d, got %d", vecBytes, first.Offset)
 	}
@@ -104,7 +116,7 @@ func TestStoreEmbeddingWritesDataAndMetadata(t *testing.T) {
 }
 
 func TestCalculateOffsetUsesMetadata(t *testing.T) {
-	_, metaPath := setupTempDB(t)
+	store, _, metaPath := setupTempDB(t)
 
 	entry := EmbeddingMetaData{Offset: 12, Text: "existing"}
 	b, err := json.Marshal(entry)
@@ -115,36 +127,41 @@ func TestCalculateOffsetUsesMetadata(t *testing.T) {
 		t.Fatalf("write metadata: %v", err)
 	}
 
-	vec := embedding.EmbeddingVector{1, 2, 3}
-
-	offset, err := calculateOffset(vec)
+	// The tail offset is read from metadata once, when the store is opened
+	store.Close()
+	store, err = Open(store.Dir(), Options{Dimension: embeddingSize})
 	if err != nil {
-		t.Fatalf("calculate offset: %v", err)
+		t.Fatalf("reopen: %v", err)
 	}
+	defer store.Close()
+
+	vec := embedding.EmbeddingVector{1, 2, 3}
 
-	expected := entry.Offset + len(vec)*4
+	offset := store.calculateOffset(store.lastOffset, vec)
+
+	expected := entry.Offset + len(vec)*4 + checksumSize
 	if offset != expected {
 		t.Fatalf("expected offset %d, got %d", expected, offset)
 	}
 }
 
-func TestGetLastOffsetMissingFile(t *testing.T) {
-	_, metaPath := setupTempDB(t)
-	if _, err := os.Stat(metaPath); !os.IsNotExist(err) {
-		t.Fatalf("expected metadata file to not exist initially")
-	}
-
-	offset, err := getLastOffset()
+func TestLastOffsetEmptyStore(t *testing.T) {
+	store, _, metaPath := setupTempDB(t)
+	info, err := os.Stat(metaPath)
 	if err != nil {
-		t.Fatalf("getLastOffset: %v", err)
+		t.Fatalf("expected Open to create metadata file: %v", err)
 	}
-	if offset != 0 {
-		t.Fatalf("expected offset 0 for missing metadata, got %d", offset)
+	if info.Size() != 0 {
+		t.Fatalf("expected empty metadata file, size %d", info.Size())
+	}
+
+	if store.lastOffset != 0 {
+		t.Fatalf("expected offset 0 for empty metadata, got %d", store.lastOffset)
 	}
 }
 
 func TestClearData(t *testing.T) {
-	vectorPath, metaPath := setupTempDB(t)
+	store, vectorPath, metaPath := setupTempDB(t)
 
 	if err := os.WriteFile(vectorPath, []byte("vector-data"), 0o644); err != nil {
 		t.Fatalf("write vector: %v", err)
@@ -153,17 +170,422 @@ func TestClearData(t *testing.T) {
 		t.Fatalf("write metadata: %v", err)
 	}
 
-	if err := ClearData(); err != nil {
-		t.Fatalf("ClearData: %v", err)
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Clear: %v", err)
 	}
 
-	for _, path := range []string{vectorPath, metaPath} {
+	for path, size := range map[string]int64{vectorPath: int64(testHeaderSize), metaPath: 0} {
 		info, err := os.Stat(path)
 		if err != nil {
 			t.Fatalf("stat %s: %v", path, err)
 		}
-		if info.Size() != 0 {
-			t.Fatalf("expected %s to be truncated, size %d", path, info.Size())
+		if info.Size() != size {
+			t.Fatalf("expected %s to be truncated to %d bytes, size %d", path, size, info.Size())
+		}
+	}
+}
+
+func TestGetAndIterate(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+
+	texts := []string{"zero", "one", "two"}
+	for i, text := range texts {
+		if _, err := store.Append(newSparseVector(map[int]float32{i: 1}), text); err != nil {
+			t.Fatalf("append %s: %v", text, err)
+		}
+	}
+
+	rec, err := store.Get(1)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if rec.Meta.Text != "one" || rec.Vector[1] != 1 {
+		t.Fatalf("unexpected record at position 1: %+v", rec.Meta)
+	}
+
+	if _, err := store.Get(len(texts)); err != ErrOutOfRange {
+		t.Fatalf("expected ErrOutOfRange, got %v", err)
+	}
+
+	seen := 0
+	err = store.Iterate(func(pos int, v embedding.EmbeddingVector) error {
+		if v[pos] != 1 {
+			t.Fatalf("vector %d: expected basis vector, got %v at index %d", pos, v[pos], pos)
+		}
+		seen++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Iterate: %v", err)
+	}
+	if seen != len(texts) {
+		t.Fatalf("expected to iterate %d vectors, got %d", len(texts), seen)
+	}
+}
+
+func TestStoresAreIndependent(t *testing.T) {
+	a, _, _ := setupTempDB(t)
+	b, _, _ := setupTempDB(t)
+
+	if _, err := a.Append(newSparseVector(map[int]float32{0: 1}), "only in a"); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	if n, _ := a.Len(); n != 1 {
+		t.Fatalf("expected 1 vector in a, got %d", n)
+	}
+	if n, _ := b.Len(); n != 0 {
+		t.Fatalf("expected 0 vectors in b, got %d", n)
+	}
+}
+
+func TestAppendRejectsWrongDimension(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+
+	if _, err := store.Append(embedding.EmbeddingVector{1, 2, 3}, "short"); err == nil {
+		t.Fatalf("expected error for mismatched dimension")
+	}
+}
+
+func TestAppendAssignsStableIDs(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+
+	first, err := store.Append(newSparseVector(map[int]float32{0: 1}), "first")
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	second, err := store.Append(newSparseVector(map[int]float32{1: 1}), "second")
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if first == 0 || second <= first {
+		t.Fatalf("expected increasing non-zero IDs, got %d then %d", first, second)
+	}
+
+	reopened, err := Open(store.Dir(), Options{Dimension: embeddingSize})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+
+	third, err := reopened.Append(newSparseVector(map[int]float32{2: 1}), "third")
+	if err != nil {
+		t.Fatalf("append after reopen: %v", err)
+	}
+	if third <= second {
+		t.Fatalf("expected ID after reopen to exceed %d, got %d", second, third)
+	}
+
+	rec, err := reopened.Get(1)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if rec.Meta.ID != second {
+		t.Fatalf("expected record ID %d, got %d", second, rec.Meta.ID)
+	}
+}
+
+func TestDeleteWritesTombstone(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+
+	ids := make([]uint64, 3)
+	for i := range ids {
+		id, err := store.Append(newSparseVector(map[int]float32{i: 1}), "doc")
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		ids[i] = id
+	}
+
+	if err := store.Delete(ids[1]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := store.Delete(ids[1]); err != nil {
+		t.Fatalf("Delete should be idempotent, got %v", err)
+	}
+	if err := store.Delete(12345); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound for unknown ID, got %v", err)
+	}
+
+	if _, err := store.Get(1); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound for deleted record, got %v", err)
+	}
+
+	var seen []int
+	store.Iterate(func(pos int, v embedding.EmbeddingVector) error {
+		seen = append(seen, pos)
+		return nil
+	})
+	if len(seen) != 2 || seen[0] != 0 || seen[1] != 2 {
+		t.Fatalf("expected iteration to skip deleted position 1, got %v", seen)
+	}
+
+	reopened, err := Open(store.Dir(), Options{Dimension: embeddingSize})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	if !reopened.IsDeleted(1) {
+		t.Fatalf("expected tombstone to survive reopen")
+	}
+}
+
+func TestCompactDropsDeletedRecords(t *testing.T) {
+	store, vectorPath, metaPath := setupTempDB(t)
+
+	texts := []string{"zero", "one", "two", "three"}
+	ids := make([]uint64, len(texts))
+	for i, text := range texts {
+		id, err := store.Append(newSparseVector(map[int]float32{i: 1}), text)
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		ids[i] = id
+	}
+
+	for _, id := range []uint64{ids[0], ids[3]} {
+		if err := store.Delete(id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+
+	removed, err := store.Compact()
+	if err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if removed != 2 {
+		t.Fatalf("expected 2 records removed, got %d", removed)
+	}
+
+	info, err := os.Stat(vectorPath)
+	if err != nil {
+		t.Fatalf("stat data: %v", err)
+	}
+	if info.Size() != int64(testHeaderSize+2*testRecordSize) {
+		t.Fatalf("expected compacted data file of %d bytes, got %d", testHeaderSize+2*testRecordSize, info.Size())
+	}
+
+	mdBytes, err := os.ReadFile(metaPath)
+	if err != nil {
+		t.Fatalf("read metadata: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(mdBytes)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 metadata lines, got %d", len(lines))
+	}
+	for i, line := range lines {
+		var md EmbeddingMetaData
+		if err := json.Unmarshal([]byte(line), &md); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if md.Offset != (i+1)*testRecordSize {
+			t.Fatalf("line %d: expected offset %d, got %d", i, (i+1)*testRecordSize, md.Offset)
+		}
+		if md.ID != ids[i+1] || md.Text != texts[i+1] {
+			t.Fatalf("line %d: unexpected record %+v", i, md)
+		}
+	}
+
+	rec, err := store.Get(0)
+	if err != nil {
+		t.Fatalf("Get after compaction: %v", err)
+	}
+	if rec.Meta.Text != "one" || rec.Vector[1] != 1 {
+		t.Fatalf("unexpected record after compaction: %+v", rec.Meta)
+	}
+
+	// The deleted ID must not be handed out again, even after a reopen.
+	store.Close()
+	reopened, err := Open(store.Dir(), Options{Dimension: embeddingSize})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+
+	next, err := reopened.Append(newSparseVector(map[int]float32{5: 1}), "five")
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if next <= ids[3] {
+		t.Fatalf("expected new ID above %d, got %d", ids[3], next)
+	}
+}
+
+// The tombstone keeping the ID watermark is not a record left to compact
+func TestCompactTwiceAfterDeletingTheLastRecord(t *testing.T) {
+	store, vectorPath, _ := setupTempDB(t)
+	ids, err := store.AppendBatch([]embedding.EmbeddingVector{
+		newSparseVector(map[int]float32{0: 1}),
+		newSparseVector(map[int]float32{1: 1}),
+	}, []string{"kept", "last"})
+	if err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+	if err := store.Delete(ids[1]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if removed, err := store.Compact(); err != nil || removed != 1 {
+		t.Fatalf("expected 1 record removed, got %d, %v", removed, err)
+	}
+
+	before, err := os.Stat(vectorPath)
+	if err != nil {
+		t.Fatalf("stat data: %v", err)
+	}
+	if removed, err := store.Compact(); err != nil || removed != 0 {
+		t.Fatalf("expected nothing removed, got %d, %v", removed, err)
+	}
+	after, err := os.Stat(vectorPath)
+	if err != nil {
+		t.Fatalf("stat data: %v", err)
+	}
+	if !os.SameFile(before, after) {
+		t.Fatal("expected the second compaction to leave the data file alone")
+	}
+}
+
+// A compaction that died between renames is finished before the files are
+// read, both by a fresh Open and by a Store that was already open
+func TestOpenFinishesInterruptedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, Options{Dimension: embeddingSize})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ids, err := store.AppendBatch([]embedding.EmbeddingVector{
+		newSparseVector(map[int]float32{0: 1}),
+		newSparseVector(map[int]float32{1: 1}),
+	}, []string{"gone", "kept"})
+	if err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+	if err := store.Delete(ids[0]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	other := openShared(t, dir)
+
+	// Crash after data.bin was replaced but before metadata.jsonl was
+	vecTmp := filepath.Join(dir, vectorFileName+compactSuffix)
+	mdTmp := filepath.Join(dir, metadataFileName+compactSuffix)
+	if err := store.writeCompacted(vecTmp, mdTmp, ""); err != nil {
+		t.Fatalf("writeCompacted: %v", err)
+	}
+	store.Close()
+	if err := os.Rename(vecTmp, filepath.Join(dir, vectorFileName)); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+
+	rec, err := other.Get(0)
+	if err != nil || rec.Meta.Text != "kept" || rec.Vector[1] != 1 {
+		t.Fatalf("expected the open store to finish the compaction, got %+v, %v", rec.Meta, err)
+	}
+	if _, err := os.Stat(mdTmp); !os.IsNotExist(err) {
+		t.Fatalf("expected the compacted metadata to be moved into place, got %v", err)
+	}
+	docTmp := filepath.Join(dir, documentsFileName+compactSuffix)
+	if err := os.WriteFile(docTmp, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reopened := openShared(t, dir)
+	if n, _ := reopened.Len(); n != 1 {
+		t.Fatalf("expected 1 record after reopening, got %d", n)
+	}
+	if _, err := os.Stat(docTmp); !os.IsNotExist(err) {
+		t.Fatalf("expected the unfinished documents rewrite to be removed, got %v", err)
+	}
+}
+
+func TestAppendBatchWritesAllRecords(t *testing.T) {
+	store, vectorPath, metaPath := setupTempDB(t)
+
+	if _, err := store.Append(newSparseVector(map[int]float32{0: 1}), "single"); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	vecs := []embedding.EmbeddingVector{
+		newSparseVector(map[int]float32{1: 2}),
+		newSparseVector(map[int]float32{2: 3}),
+		newSparseVector(map[int]float32{3: 4}),
+	}
+	ids, err := store.AppendBatch(vecs, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatalf("AppendBatch: %v", err)
+	}
+	if len(ids) != 3 || ids[0] != 2 || ids[2] != 4 {
+		t.Fatalf("expected IDs 2..4, got %v", ids)
+	}
+
+	info, err := os.Stat(vectorPath)
+	if err != nil {
+		t.Fatalf("stat data: %v", err)
+	}
+	if info.Size() != int64(testHeaderSize+4*testRecordSize) {
+		t.Fatalf("expected %d bytes, got %d", testHeaderSize+4*testRecordSize, info.Size())
+	}
+
+	mdBytes, err := os.ReadFile(metaPath)
+	if err != nil {
+		t.Fatalf("read metadata: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(mdBytes)), "\n")
+	for i, line := range lines {
+		var md EmbeddingMetaData
+		if err := json.Unmarshal([]byte(line), &md); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if md.Offset != (i+1)*testRecordSize {
+			t.Fatalf("line %d: expected offset %d, got %d", i, (i+1)*testRecordSize, md.Offset)
+		}
+	}
+
+	rec, err := store.Get(3)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if rec.Meta.Text != "c" || rec.Vector[3] != 1 {
+		t.Fatalf("expected normalised record c, got %+v", rec.Meta)
+	}
+}
+
+func TestAppendBatchRejectsMismatchedInput(t *testing.T) {
+	store, vectorPath, _ := setupTempDB(t)
+
+	vecs := []embedding.EmbeddingVector{newSparseVector(map[int]float32{0: 1}), {1, 2}}
+	if _, err := store.AppendBatch(vecs, []string{"ok", "short"}); err == nil {
+		t.Fatalf("expected error for wrong dimension")
+	}
+	if _, err := store.AppendBatch(vecs[:1], []string{"a", "b"}); err == nil {
+		t.Fatalf("expected error for mismatched lengths")
+	}
+
+	info, err := os.Stat(vectorPath)
+	if err != nil {
+		t.Fatalf("stat data: %v", err)
+	}
+	if info.Size() != int64(testHeaderSize) {
+		t.Fatalf("expected nothing written for a rejected batch, got %d bytes", info.Size())
+	}
+}
+
+func BenchmarkAppendBatch(b *testing.B) {
+	store, err := Open(b.TempDir(), Options{Dimension: embeddingSize})
+	if err != nil {
+		b.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+
+	const batchSize = 1000
+	vecs := make([]embedding.EmbeddingVector, batchSize)
+	texts := make([]string, batchSize)
+	for i := range vecs {
+		vecs[i] = newSparseVector(map[int]float32{i % embeddingSize: 1})
+		texts[i] = "chunk"
+	}
+
+	b.ResetTimer()
+	for range b.N {
+		if _, err := store.AppendBatch(vecs, texts); err != nil {
+			b.Fatalf("AppendBatch: %v", err)
 		}
 	}
 }
@@ -182,3 +604,94 @@ func abs(f float32) float32 {
 	}
 	return f
 }
+
+func TestAppendBatchMetaKeepsRichMetadata(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, Options{Dimension: embeddingSize})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+
+	ingested := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	metas := []EmbeddingMetaData{
+		{Text: "first", ID: 99, Offset: 7},
+		{
+			Text:       "second",
+			Source:     "file:///notes/a.md",
+			DocID:      "doc-a",
+			Chunk:      1,
+			Span:       &Span{ByteStart: 6, ByteEnd: 12, RuneStart: 6, RuneEnd: 12},
+			IngestedAt: ingested,
+			Attributes: map[string]any{"lang": "en", "page": 3},
+		},
+	}
+	vecs := []embedding.EmbeddingVector{
+		newSparseVector(map[int]float32{0: 1}),
+		newSparseVector(map[int]float32{1: 1}),
+	}
+	ids, err := store.AppendBatchMeta(vecs, metas)
+	if err != nil {
+		t.Fatalf("AppendBatchMeta: %v", err)
+	}
+
+	rec, err := store.Get(0)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if rec.Meta.ID != ids[0] || rec.Meta.Offset != testRecordSize {
+		t.Fatalf("expected ID and offset to be assigned by the store, got %+v", rec.Meta)
+	}
+	if rec.Meta.Span != nil || !rec.Meta.IngestedAt.IsZero() {
+		t.Fatalf("expected unset fields to stay unset, got %+v", rec.Meta)
+	}
+
+	// Survives a compaction and a reopen
+	if err := store.Delete(ids[0]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	store.Close()
+
+	store, err = Open(dir, Options{Dimension: embeddingSize})
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	defer store.Close()
+
+	rec, err = store.Get(0)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	md := rec.Meta
+	if md.Text != "second" || md.Source != "file:///notes/a.md" || md.DocID != "doc-a" || md.Chunk != 1 {
+		t.Fatalf("unexpected metadata %+v", md)
+	}
+	if md.Span == nil || *md.Span != *metas[1].Span {
+		t.Fatalf("expected span %+v, got %+v", metas[1].Span, md.Span)
+	}
+	if !md.IngestedAt.Equal(ingested) {
+		t.Fatalf("expected ingestion time %v, got %v", ingested, md.IngestedAt)
+	}
+	if md.Attributes["lang"] != "en" || md.Attributes["page"] != float64(3) {
+		t.Fatalf("unexpected attributes %v", md.Attributes)
+	}
+}
+
+func TestMetadataLinesOmitUnsetFields(t *testing.T) {
+	store, _, metaPath := setupTempDB(t)
+
+	if _, err := store.Append(newSparseVector(map[int]float32{0: 1}), "plain"); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	mdBytes, err := os.ReadFile(metaPath)
+	if err != nil {
+		t.Fatalf("read metadata: %v", err)
+	}
+	expected := fmt.Sprintf(`{"ID":1,"Offset":%d,"Text":"plain","CRC":`, testRecordSize)
+	if got := strings.TrimSpace(string(mdBytes)); !strings.HasPrefix(got, expected) {
+		t.Fatalf("expected %s...}, got %s", expected, got)
+	}
+}
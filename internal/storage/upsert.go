@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+/*
+Upserts replace the chunks of a document in place of appending next to them.
+
+Every chunk written by Upsert carries the caller's key for its document and a
+hash of its text. Upserting the document again compares the new chunks with
+the live records under the key:
+
+  - a chunk whose text and metadata are unchanged keeps its record
+  - a chunk whose text is unchanged but whose metadata moved, e.g. to another
+    ordinal or span after an edit above it, is stored again with the vector of
+    its old record, so it is not re-embedded
+  - a chunk with new text is embedded and appended
+  - old records left over are tombstoned
+
+The appends and tombstones go through one WAL entry, so readers see either the
+old version of the document or the new one. Embedding happens without the
+store locked. If another writer changes the document meanwhile, whatever that
+leaves unembedded is embedded in a second round. UpsertDocument also stores
+the document the chunks came from, see documents.go, once the chunks are
+committed: a crash in between leaves chunks without their document, which
+searches handle, but never a document that compaction would take for an
+orphan.
+
+The live records under a key are found through the store's MetaTable, which
+keeps the positions of every key, see metatable.go.
+
+Vectors reused from quantized stores without full-precision copies are the
+dequantized ones, so they pick up a little rounding each time they move.
+*/
+
+var ErrEmptyKey = errors.New("storage: upsert key must not be empty")
+
+// Embeds the texts of new chunks, returning one vector per text in order, as
+// embedding.EmbeddingModel.EmbedBatch does
+type EmbedFunc func(texts []string) ([]embedding.EmbeddingVector, error)
+
+// What an upsert did with each chunk
+type UpsertResult struct {
+	IDs       []uint64 // Record ID of each chunk, in order
+	Embedded  int      // Chunks with new text, embedded and appended
+	Rewritten int      // Unchanged text under new metadata, stored again with its old vector
+	Kept      int      // Unchanged chunks left as they were
+	Removed   int      // Old chunks no longer in the document, tombstoned
+}
+
+// Hash Upsert records for a chunk's text, to tell whether it needs
+// embedding again
+func ContentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// Replaces the chunks stored under key with metas, in one transaction. Only
+// chunks whose text isn't already stored under key are passed to embed. Key
+// and Hash are set by the store, and ID and Offset are ignored as for
+// AppendBatchMeta. Upserting no chunks deletes the document.
+func (s *Store) Upsert(key string, metas []EmbeddingMetaData, embed EmbedFunc) (UpsertResult, error) {
+	return s.upsert(key, nil, metas, embed)
+}
+
+// Like Upsert, also storing doc as the parent document of the chunks, whose
+// DocID is set to doc.ID. The document is written under the same lock as the
+// chunks and after them, so compaction never sees it without them.
+func (s *Store) UpsertDocument(key string, doc Document, metas []EmbeddingMetaData, embed EmbedFunc) (UpsertResult, error) {
+	if doc.ID == "" {
+		return UpsertResult{}, ErrEmptyDocumentID
+	}
+	return s.upsert(key, &doc, metas, embed)
+}
+
+func (s *Store) upsert(key string, doc *Document, metas []EmbeddingMetaData, embed EmbedFunc) (UpsertResult, error) {
+	if key == "" {
+		return UpsertResult{}, ErrEmptyKey
+	}
+
+	chunks := make([]EmbeddingMetaData, len(metas))
+	for i, md := range metas {
+		md.ID, md.Offset = 0, 0
+		md.Key, md.Hash = key, ContentHash(md.Text)
+		if doc != nil {
+			md.DocID = doc.ID
+		}
+		chunks[i] = md
+	}
+
+	embedded := map[string]embedding.EmbeddingVector{}
+	for {
+		res, missing, err := s.tryUpsert(key, doc, chunks, embedded)
+		if err != nil || len(missing) == 0 {
+			return res, err
+		}
+
+		vecs, err := embed(missing)
+		if err != nil {
+			return UpsertResult{}, fmt.Errorf("failed to embed chunks: %w", err)
+		}
+		if len(vecs) != len(missing) {
+			return UpsertResult{}, fmt.Errorf("embedded %d texts but got %d vectors", len(missing), len(vecs))
+		}
+		for i, text := range missing {
+			embedded[ContentHash(text)] = vecs[i]
+		}
+	}
+}
+
+// Writes the upsert if every chunk is either stored under key already or in
+// embedded. Otherwise writes nothing and returns the texts still to embed.
+func (s *Store) tryUpsert(key string, doc *Document, chunks []EmbeddingMetaData, embedded map[string]embedding.EmbeddingVector) (UpsertResult, []string, error) {
+	err := s.lock()
+	if err != nil {
+		return UpsertResult{}, nil, err
+	}
+	defer s.unlock()
+
+	existing, err := s.keyed(key)
+	if err != nil {
+		return UpsertResult{}, nil, err
+	}
+	byHash := map[string][]Record{}
+	for _, rec := range existing {
+		byHash[rec.Meta.Hash] = append(byHash[rec.Meta.Hash], rec)
+	}
+
+	var missing []string
+	for _, md := range chunks {
+		_, ok := embedded[md.Hash]
+		if !ok && len(byHash[md.Hash]) == 0 && !slices.Contains(missing, md.Text) {
+			missing = append(missing, md.Text)
+		}
+	}
+	if len(missing) > 0 {
+		return UpsertResult{}, missing, nil
+	}
+	res := UpsertResult{IDs: make([]uint64, len(chunks))}
+	var vecs []embedding.EmbeddingVector
+	var appended []EmbeddingMetaData
+	var at []int // Chunk each appended record belongs to
+	var remove []uint64
+	matched := map[uint64]bool{}
+	for i, md := range chunks {
+		if old := byHash[md.Hash]; len(old) > 0 {
+			rec := old[0]
+			byHash[md.Hash] = old[1:]
+			matched[rec.Meta.ID] = true
+			if sameChunk(rec.Meta, md) {
+				res.IDs[i] = rec.Meta.ID
+				res.Kept++
+				continue
+			}
+
+			v, err := s.float32(rec.Pos)
+			if errors.Is(err, ErrNoFloat32) {
+				v, err = s.readVector(rec.Pos)
+			}
+			if err != nil {
+				return UpsertResult{}, nil, err
+			}
+			vecs = append(vecs, v)
+			remove = append(remove, rec.Meta.ID)
+			res.Rewritten++
+		} else {
+			// Copied, as the same text may appear in several chunks and
+			// appending normalises in place
+			vecs = append(vecs, append(embedding.EmbeddingVector(nil), embedded[md.Hash]...))
+			res.Embedded++
+		}
+		appended = append(appended, md)
+		at = append(at, i)
+	}
+	for _, rec := range existing {
+		if !matched[rec.Meta.ID] {
+			remove = append(remove, rec.Meta.ID)
+			res.Removed++
+		}
+	}
+
+	if len(appended) > 0 || len(remove) > 0 {
+		ids, err := s.write(vecs, appended, false, remove)
+		if ids == nil {
+			// Nothing was committed
+			return UpsertResult{}, nil, err
+		}
+		for j, id := range ids {
+			res.IDs[at[j]] = id
+		}
+		if err != nil {
+			// A failed index update still leaves the upsert committed
+			return res, nil, errors.Join(err, s.putUpsertedDocument(doc, chunks))
+		}
+	}
+	return res, nil, s.putUpsertedDocument(doc, chunks)
+}
+
+// Stores the document of committed chunks, if there is one and it still has
+// chunks
+func (s *Store) putUpsertedDocument(doc *Document, chunks []EmbeddingMetaData) error {
+	if doc == nil || len(chunks) == 0 {
+		return nil
+	}
+	return s.putDocument(*doc)
+}
+
+// Live records stored under key, in position order, without their vectors.
+// Called with the store locked.
+func (s *Store) keyed(key string) ([]Record, error) {
+	table, err := s.metaTable()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Record
+	for _, pos := range s.metaCache.keyed(key) {
+		if s.isDeleted(pos) {
+			continue
+		}
+		md, _ := table.At(pos)
+		out = append(out, Record{Pos: pos, Meta: md})
+	}
+	return out, nil
+}
+
+// Whether a stored chunk already matches md in everything but ID, Offset and
+// IngestedAt
+func sameChunk(stored, md EmbeddingMetaData) bool {
+	stored.ID, stored.Offset, stored.IngestedAt = 0, 0, md.IngestedAt
+	a, errA := json.Marshal(stored)
+	b, errB := json.Marshal(md)
+	return errA == nil && errB == nil && bytes.Equal(a, b)
+}
@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+// Embeds each distinct text as its own axis and records what it was asked to
+// embed
+type fakeEmbedder struct {
+	axes  map[string]int
+	calls [][]string
+}
+
+func (f *fakeEmbedder) embed(texts []string) ([]embedding.EmbeddingVector, error) {
+	if f.axes == nil {
+		f.axes = map[string]int{}
+	}
+	f.calls = append(f.calls, texts)
+	out := make([]embedding.EmbeddingVector, len(texts))
+	for i, text := range texts {
+		axis, ok := f.axes[text]
+		if !ok {
+			axis = len(f.axes)
+			f.axes[text] = axis
+		}
+		out[i] = newSparseVector(map[int]float32{axis: 1})
+	}
+	return out, nil
+}
+
+func chunkMetas(texts ...string) []EmbeddingMetaData {
+	metas := make([]EmbeddingMetaData, len(texts))
+	for i, text := range texts {
+		metas[i] = EmbeddingMetaData{Text: text, DocID: "doc", Chunk: i}
+	}
+	return metas
+}
+
+// Texts of the live records stored under key, in position order
+func keyedTexts(t *testing.T, store *Store, key string) []string {
+	t.Helper()
+	metas, err := store.MetaData()
+	if err != nil {
+		t.Fatalf("MetaData: %v", err)
+	}
+	var texts []string
+	for pos, md := range metas {
+		if md.Key == key && !store.IsDeleted(pos) {
+			texts = append(texts, md.Text)
+		}
+	}
+	return texts
+}
+
+func TestUpsertReplacesADocument(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+	var emb fakeEmbedder
+
+	first, err := store.Upsert("notes.md", chunkMetas("alpha", "beta", "gamma"), emb.embed)
+	if err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if first.Embedded != 3 || len(first.IDs) != 3 {
+		t.Fatalf("expected 3 chunks embedded, got %+v", first)
+	}
+	if _, err := store.Append(newSparseVector(map[int]float32{100: 1}), "unkeyed"); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	// A chunk is inserted at the top, so alpha moves, gamma stays put and
+	// beta disappears
+	second, err := store.Upsert("notes.md", chunkMetas("new", "alpha", "gamma"), emb.embed)
+	if err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if second.Embedded != 1 || second.Rewritten != 1 || second.Kept != 1 || second.Removed != 1 {
+		t.Fatalf("unexpected result %+v", second)
+	}
+	if len(emb.calls) != 2 || !slices.Equal(emb.calls[1], []string{"new"}) {
+		t.Fatalf("expected only the new chunk to be embedded, got %v", emb.calls)
+	}
+	if second.IDs[2] != first.IDs[2] {
+		t.Fatalf("expected gamma to keep ID %d, got %d", first.IDs[2], second.IDs[2])
+	}
+	if !slices.Equal(keyedTexts(t, store, "notes.md"), []string{"gamma", "new", "alpha"}) {
+		t.Fatalf("unexpected live chunks %v", keyedTexts(t, store, "notes.md"))
+	}
+
+	pos := store.positions[second.IDs[1]]
+	rec, err := store.Get(pos)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if rec.Meta.Chunk != 1 || rec.Meta.Hash != ContentHash("alpha") || rec.Vector[emb.axes["alpha"]] != 1 {
+		t.Fatalf("expected alpha at chunk 1 with its old vector, got %+v", rec.Meta)
+	}
+	if _, err := store.Get(3); err != nil {
+		t.Fatalf("expected the unkeyed record to be left alone, got %v", err)
+	}
+
+	// Upserting the same chunks again changes nothing
+	third, err := store.Upsert("notes.md", chunkMetas("new", "alpha", "gamma"), emb.embed)
+	if err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if third.Kept != 3 || !slices.Equal(third.IDs, second.IDs) || len(emb.calls) != 2 {
+		t.Fatalf("expected an unchanged document to be kept as is, got %+v", third)
+	}
+
+	gone, err := store.Upsert("notes.md", nil, emb.embed)
+	if err != nil || gone.Removed != 3 {
+		t.Fatalf("expected upserting no chunks to delete the document, got %+v, %v", gone, err)
+	}
+	if texts := keyedTexts(t, store, "notes.md"); len(texts) != 0 {
+		t.Fatalf("expected no live chunks, got %v", texts)
+	}
+}
+
+func TestUpsertEmbedsRepeatedTextOnce(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+	var emb fakeEmbedder
+
+	res, err := store.Upsert("faq", chunkMetas("same", "other", "same"), emb.embed)
+	if err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if !slices.Equal(emb.calls[0], []string{"same", "other"}) {
+		t.Fatalf("expected each text to be embedded once, got %v", emb.calls)
+	}
+
+	res, err = store.Upsert("faq", chunkMetas("same", "other", "same"), emb.embed)
+	if err != nil || res.Kept != 3 {
+		t.Fatalf("expected all three chunks to be kept, got %+v, %v", res, err)
+	}
+}
+
+func TestUpsertChecksItsInput(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+	if _, err := store.Upsert("", chunkMetas("a"), (&fakeEmbedder{}).embed); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("expected ErrEmptyKey, got %v", err)
+	}
+
+	short := func(texts []string) ([]embedding.EmbeddingVector, error) { return nil, nil }
+	if _, err := store.Upsert("doc", chunkMetas("a"), short); err == nil {
+		t.Fatal("expected an error when embed returns too few vectors")
+	}
+	if n, _ := store.Len(); n != 0 {
+		t.Fatalf("expected nothing to be written, got %d records", n)
+	}
+}
+
+// The new chunks and the tombstones for the old ones share a WAL entry, so a
+// crash leaves either version of the document but never both
+func TestUpsertIsAtomic(t *testing.T) {
+	for _, tc := range []struct {
+		step txStep
+		want []string
+	}{
+		{txBegin, []string{"one", "two"}},
+		{txVectorsSynced, []string{"three"}},
+		{txMetadataSynced, []string{"three"}},
+	} {
+		dir := t.TempDir()
+		store, err := Open(dir, Options{Dimension: embeddingSize})
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		var emb fakeEmbedder
+		if _, err := store.Upsert("doc", chunkMetas("one", "two"), emb.embed); err != nil {
+			t.Fatalf("Upsert: %v", err)
+		}
+
+		crashAt = func(step txStep) bool { return step == tc.step }
+		_, err = store.Upsert("doc", chunkMetas("three"), emb.embed)
+		crashAt = nil
+		if !errors.Is(err, errSimulatedCrash) {
+			t.Fatalf("expected a simulated crash, got %v", err)
+		}
+		store.Close()
+
+		reopened, err := Open(dir, Options{Dimension: embeddingSize})
+		if err != nil {
+			t.Fatalf("reopen: %v", err)
+		}
+		if got := keyedTexts(t, reopened, "doc"); !slices.Equal(got, tc.want) {
+			t.Fatalf("crash at step %d: expected %v, got %v", tc.step, tc.want, got)
+		}
+		reopened.Close()
+	}
+}
+
+func TestUpsertDocumentWaitsForItsChunks(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+	var emb fakeEmbedder
+
+	crashAt = func(step txStep) bool { return step == txBegin }
+	_, err := store.UpsertDocument("k", Document{ID: "d", Text: "one."}, chunkMetas("one."), emb.embed)
+	crashAt = nil
+	if !errors.Is(err, errSimulatedCrash) {
+		t.Fatalf("expected a simulated crash, got %v", err)
+	}
+	if _, err := store.Document("d"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected no document without its chunks, got %v", err)
+	}
+}
+
+func TestUpsertFindsKeysAfterPositionsMove(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+	var emb fakeEmbedder
+	for _, key := range []string{"a", "b"} {
+		if _, err := store.Upsert(key, chunkMetas(key+"1", key+"2"), emb.embed); err != nil {
+			t.Fatalf("Upsert: %v", err)
+		}
+	}
+	if _, err := store.Upsert("a", nil, emb.embed); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	// b's chunks moved down to the start of the store
+	res, err := store.Upsert("b", chunkMetas("b1", "b3"), emb.embed)
+	if err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if res.Kept != 1 || res.Embedded != 1 || res.Removed != 1 {
+		t.Fatalf("expected one chunk kept, embedded and removed, got %+v", res)
+	}
+
+	// Another handle's upsert is picked up on refresh
+	other := openShared(t, store.dir)
+	if _, err := other.Upsert("c", chunkMetas("c1"), emb.embed); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if res, err := store.Upsert("c", chunkMetas("c1"), emb.embed); err != nil || res.Kept != 1 {
+		t.Fatalf("expected the other handle's chunk to be kept, got %+v, %v", res, err)
+	}
+}
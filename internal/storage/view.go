@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+
+	"github.com/mateosanchezl/go-vect/internal/embedding"
+)
+
+var errMmapUnsupported = errors.New("storage: mmap is not supported on this platform")
+
+// Whether float32s in memory have the same byte order as the data file
+var littleEndianHost = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+/*
+A read-only view over every vector in the data file.
+
+Where possible the file is memory-mapped and viewed as []float32 in place, so
+reading the corpus costs no allocation and no copy. Files that can't be viewed
+in place (unaligned data, a big-endian host or no mmap support) are decoded
+into memory instead. Vectors returned by At alias the view and are only valid
+until Close.
+
+Quantized files are viewed as raw records. At widens them into a fresh
+vector, while Scorer scores a query against them without widening.
+
+Checksums are not checked by At or Scorer. Callers that read every record ask
+Verify first.
+*/
+type VectorView struct {
+	dim     int
+	dtype   DType
+	stride  int       // Bytes per record on disk, checksum included
+	data    []float32 // Vectors of float32 files, with stride/4 floats per record
+	raw     []byte    // Records as they are on disk
+	mapped  []byte    // Whole mapping, nil when the vectors were read instead
+	checked bool      // Records carry checksums
+	lenient bool
+}
+
+// Opens a view over the vectors currently in the data file. Vectors appended
+// afterwards are not visible through it.
+func (s *Store) View() (*VectorView, error) {
+	err := s.rlock()
+	if err != nil {
+		return nil, err
+	}
+	defer s.runlock()
+	return s.view()
+}
+
+func (s *Store) view() (*VectorView, error) {
+	info, err := s.vecFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	n := int(info.Size()-int64(s.header.Size)) / s.bytesPerVector()
+	end := s.vectorOffset(n)
+	v := &VectorView{
+		dim:     s.dim,
+		dtype:   s.header.DType,
+		stride:  s.bytesPerVector(),
+		checked: s.header.Checksums,
+		lenient: s.Lenient(),
+	}
+	if n == 0 {
+		return v, nil
+	}
+
+	inPlace := s.header.DType != DTypeFloat32 || (littleEndianHost && s.header.Size%4 == 0)
+	if inPlace {
+		mapped, err := mmapFile(s.vecFile, int(end))
+		if err == nil {
+			v.raw, v.mapped = mapped[s.header.Size:end], mapped
+			if v.dtype == DTypeFloat32 {
+				v.data = unsafe.Slice((*float32)(unsafe.Pointer(&v.raw[0])), len(v.raw)/4)
+			}
+			return v, nil
+		}
+		if !errors.Is(err, errMmapUnsupported) {
+			return nil, fmt.Errorf("failed to map data file: %w", err)
+		}
+	}
+
+	v.raw = make([]byte, end-int64(s.header.Size))
+	_, err = s.vecFile.ReadAt(v.raw, int64(s.header.Size))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read data file: %w", err)
+	}
+	if v.dtype == DTypeFloat32 {
+		v.data = byteSliceToVector(v.raw)
+	}
+	return v, nil
+}
+
+// Number of vectors in the view, including deleted ones
+func (v *VectorView) Len() int {
+	if v.stride == 0 {
+		return 0
+	}
+	return len(v.raw) / v.stride
+}
+
+func (v *VectorView) Dimension() int {
+	return v.dim
+}
+
+// Element type of the viewed file
+func (v *VectorView) DType() DType {
+	return v.dtype
+}
+
+// The vector at position pos. For float32 files it aliases the view, for
+// other element types it is widened into a new vector.
+func (v *VectorView) At(pos int) embedding.EmbeddingVector {
+	if v.dtype != DTypeFloat32 {
+		return decodeVector(v.dtype, v.record(pos), v.dim)
+	}
+	return v.floats(pos)
+}
+
+func (v *VectorView) floats(pos int) []float32 {
+	start := pos * v.stride / 4
+	return v.data[start : start+v.dim : start+v.dim]
+}
+
+// The record at pos without its checksum
+func (v *VectorView) record(pos int) []byte {
+	start := pos * v.stride
+	return v.raw[start : start+v.dtype.recordSize(v.dim)]
+}
+
+// Reports whether the record at pos can be used. A record failing its
+// checksum is an *ErrCorruptRecord in strict mode, and is reported as false
+// so the caller skips it in lenient mode.
+func (v *VectorView) Verify(pos int) (bool, error) {
+	if !v.checked || validRecord(v.raw[pos*v.stride:(pos+1)*v.stride]) {
+		return true, nil
+	}
+	if v.lenient {
+		return false, nil
+	}
+	return false, &ErrCorruptRecord{Pos: pos, File: vectorFileName}
+}
+
+// Returns a function giving the dot product of query with the vector at a
+// position, which for normalised vectors is their cosine similarity.
+// Quantized and half precision vectors are scored in place, without widening
+// them first.
+func (v *VectorView) Scorer(query embedding.EmbeddingVector) func(pos int) float32 {
+	switch v.dtype {
+	case DTypeInt8:
+		var qsum float32
+		for _, x := range query {
+			qsum += x
+		}
+		return func(pos int) float32 {
+			return dotInt8(query, qsum, v.record(pos))
+		}
+	case DTypeFloat16:
+		table := float16Table()
+		return func(pos int) float32 {
+			return dotFloat16(query, v.record(pos), table)
+		}
+	case DTypeBFloat16:
+		return func(pos int) float32 {
+			return dotBFloat16(query, v.record(pos))
+		}
+	default:
+		return func(pos int) float32 {
+			var t float32
+			for i, x := range v.floats(pos) {
+				t += query[i] * x
+			}
+			return t
+		}
+	}
+}
+
+// Whether the view reads the file in place rather than from a decoded copy
+func (v *VectorView) Mapped() bool {
+	return v.mapped != nil
+}
+
+func (v *VectorView) Close() error {
+	v.data = nil
+	v.raw = nil
+	if v.mapped == nil {
+		return nil
+	}
+	err := munmapFile(v.mapped)
+	v.mapped = nil
+	return err
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestViewMatchesStoredVectors(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+
+	for i := range 5 {
+		if _, err := store.Append(newSparseVector(map[int]float32{i: 1, i + 1: 1}), "doc"); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	view, err := store.View()
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	defer view.Close()
+
+	if runtime.GOOS == "linux" && !view.Mapped() {
+		t.Fatalf("expected the view to be memory-mapped on linux")
+	}
+	if view.Len() != 5 {
+		t.Fatalf("expected 5 vectors in view, got %d", view.Len())
+	}
+
+	for pos := range view.Len() {
+		rec, err := store.Get(pos)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		v := view.At(pos)
+		if len(v) != embeddingSize {
+			t.Fatalf("expected vector of length %d, got %d", embeddingSize, len(v))
+		}
+		for i := range v {
+			if v[i] != rec.Vector[i] {
+				t.Fatalf("vector %d index %d: view has %v, file has %v", pos, i, v[i], rec.Vector[i])
+			}
+		}
+	}
+}
+
+func TestViewIsASnapshot(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+
+	if _, err := store.Append(newSparseVector(map[int]float32{0: 1}), "before"); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	view, err := store.View()
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	defer view.Close()
+
+	if _, err := store.Append(newSparseVector(map[int]float32{1: 1}), "after"); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if view.Len() != 1 {
+		t.Fatalf("expected appends after View to be invisible, got %d vectors", view.Len())
+	}
+}
+
+func TestViewOfEmptyAndLegacyStores(t *testing.T) {
+	store, _, _ := setupTempDB(t)
+
+	view, err := store.View()
+	if err != nil {
+		t.Fatalf("View of empty store: %v", err)
+	}
+	if view.Len() != 0 {
+		t.Fatalf("expected empty view, got %d vectors", view.Len())
+	}
+	view.Close()
+
+	dir := t.TempDir()
+	writeLegacyStore(t, dir, []string{"zero", "one", "two"})
+	legacy, err := Open(dir, Options{Dimension: embeddingSize})
+	if err != nil {
+		t.Fatalf("open legacy: %v", err)
+	}
+	defer legacy.Close()
+
+	view, err = legacy.View()
+	if err != nil {
+		t.Fatalf("View of legacy store: %v", err)
+	}
+	defer view.Close()
+	if view.Len() != 3 || view.At(2)[2] != 1 {
+		t.Fatalf("unexpected legacy view contents")
+	}
+}
@@ -0,0 +1,378 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/*
+A single-entry write-ahead log that keeps data.bin and metadata.jsonl in step.
+
+Every append is described by one entry holding the bytes destined for each
+file and the size each file had before the append. The entry is made durable
+before either file is touched and cleared once both files are synced. On open,
+a complete entry is replayed (both files are cut back to their logged sizes and
+rewritten) and a torn entry is discarded, so a vector and its metadata are
+either both committed or both absent.
+
+Stores that keep full-precision copies of quantized vectors log the bytes for
+data.f32 in the same entry, so all three files move together. An upsert also
+logs the tombstones for the chunks it replaces, so the old chunks of a
+document disappear exactly when the new ones appear.
+
+Entry layout (little-endian):
+
+	magic "GWAL" | payload length u32 | payload crc32 u32 | payload
+	payload: vecStart u64 | mdStart u64 | vecLen u32 | vec bytes | mdLen u32 | md bytes
+	         [f32Start u64 | f32Len u32 | f32 bytes]   when data.f32 is kept or tombstones follow
+	         [tsStart u64 | tsLen u32 | ts bytes]      only when the entry deletes records
+
+An empty f32 section is written ahead of the tombstones of a store without
+data.f32, and decodes as no section at all.
+*/
+
+const walFileName = "wal.log"
+
+const walHeaderSize = 12
+
+var walMagic = []byte("GWAL")
+
+var errTornWAL = errors.New("wal: torn or corrupt entry")
+
+// The steps of a transaction, used to simulate crashes in tests
+type txStep int
+
+const (
+	txBegin          txStep = iota // Nothing written yet
+	txLogged                       // WAL entry is durable
+	txVectorsSynced                // Vector bytes, and their float32 copies, are durable
+	txMetadataSynced               // Metadata bytes, and any tombstones, are durable, WAL not yet cleared
+)
+
+// Test hook: when it returns true the transaction stops dead at that step,
+// leaving the files exactly as a crash would
+var crashAt func(step txStep) bool
+
+var errSimulatedCrash = errors.New("wal: simulated crash")
+
+type walEntry struct {
+	vecStart int64
+	mdStart  int64
+	vecBytes []byte
+	mdBytes  []byte
+
+	f32Start int64
+	f32Bytes []byte // nil unless the store keeps data.f32
+
+	tsStart int64
+	tsBytes []byte // nil unless the entry deletes records
+}
+
+func (e walEntry) encode() []byte {
+	payloadLen := 8 + 8 + 4 + len(e.vecBytes) + 4 + len(e.mdBytes)
+	if e.f32Bytes != nil || e.tsBytes != nil {
+		payloadLen += 8 + 4 + len(e.f32Bytes)
+	}
+	if e.tsBytes != nil {
+		payloadLen += 8 + 4 + len(e.tsBytes)
+	}
+	out := make([]byte, walHeaderSize+payloadLen)
+
+	p := out[walHeaderSize:]
+	binary.LittleEndian.PutUint64(p[0:8], uint64(e.vecStart))
+	binary.LittleEndian.PutUint64(p[8:16], uint64(e.mdStart))
+	binary.LittleEndian.PutUint32(p[16:20], uint32(len(e.vecBytes)))
+	n := 20 + copy(p[20:], e.vecBytes)
+	binary.LittleEndian.PutUint32(p[n:n+4], uint32(len(e.mdBytes)))
+	n += 4 + copy(p[n+4:], e.mdBytes)
+
+	if e.f32Bytes != nil || e.tsBytes != nil {
+		binary.LittleEndian.PutUint64(p[n:n+8], uint64(e.f32Start))
+		binary.LittleEndian.PutUint32(p[n+8:n+12], uint32(len(e.f32Bytes)))
+		n += 12 + copy(p[n+12:], e.f32Bytes)
+	}
+	if e.tsBytes != nil {
+		binary.LittleEndian.PutUint64(p[n:n+8], uint64(e.tsStart))
+		binary.LittleEndian.PutUint32(p[n+8:n+12], uint32(len(e.tsBytes)))
+		copy(p[n+12:], e.tsBytes)
+	}
+
+	copy(out[0:4], walMagic)
+	binary.LittleEndian.PutUint32(out[4:8], uint32(payloadLen))
+	binary.LittleEndian.PutUint32(out[8:12], crc32.ChecksumIEEE(p))
+
+	return out
+}
+
+func decodeWALEntry(b []byte) (walEntry, error) {
+	if len(b) < walHeaderSize || string(b[0:4]) != string(walMagic) {
+		return walEntry{}, errTornWAL
+	}
+
+	payloadLen := int(binary.LittleEndian.Uint32(b[4:8]))
+	if len(b) < walHeaderSize+payloadLen || payloadLen < 24 {
+		return walEntry{}, errTornWAL
+	}
+
+	p := b[walHeaderSize : walHeaderSize+payloadLen]
+	if crc32.ChecksumIEEE(p) != binary.LittleEndian.Uint32(b[8:12]) {
+		return walEntry{}, errTornWAL
+	}
+
+	e := walEntry{
+		vecStart: int64(binary.LittleEndian.Uint64(p[0:8])),
+		mdStart:  int64(binary.LittleEndian.Uint64(p[8:16])),
+	}
+
+	vecLen := int(binary.LittleEndian.Uint32(p[16:20]))
+	if 20+vecLen+4 > len(p) {
+		return walEntry{}, errTornWAL
+	}
+	e.vecBytes = p[20 : 20+vecLen]
+
+	n := 20 + vecLen
+	mdLen := int(binary.LittleEndian.Uint32(p[n : n+4]))
+	if n+4+mdLen > len(p) {
+		return walEntry{}, errTornWAL
+	}
+	e.mdBytes = p[n+4 : n+4+mdLen]
+
+	n += 4 + mdLen
+	if n == len(p) {
+		return e, nil
+	}
+	if n+12 > len(p) {
+		return walEntry{}, errTornWAL
+	}
+	f32Len := int(binary.LittleEndian.Uint32(p[n+8 : n+12]))
+	if n+12+f32Len > len(p) {
+		return walEntry{}, errTornWAL
+	}
+	if f32Len > 0 {
+		e.f32Start = int64(binary.LittleEndian.Uint64(p[n : n+8]))
+		e.f32Bytes = p[n+12 : n+12+f32Len]
+	}
+
+	n += 12 + f32Len
+	if n == len(p) {
+		return e, nil
+	}
+	if n+12 > len(p) {
+		return walEntry{}, errTornWAL
+	}
+	e.tsStart = int64(binary.LittleEndian.Uint64(p[n : n+8]))
+	tsLen := int(binary.LittleEndian.Uint32(p[n+8 : n+12]))
+	if n+12+tsLen != len(p) {
+		return walEntry{}, errTornWAL
+	}
+	e.tsBytes = p[n+12 : n+12+tsLen]
+
+	return e, nil
+}
+
+type wal struct {
+	file *os.File
+}
+
+func openWAL(dir string) (*wal, error) {
+	file, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal: %w", err)
+	}
+	return &wal{file: file}, nil
+}
+
+// Makes the entry durable, replacing whatever was logged before
+func (w *wal) write(e walEntry) error {
+	err := w.file.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("failed to reset wal: %w", err)
+	}
+
+	_, err = w.file.WriteAt(e.encode(), 0)
+	if err != nil {
+		return fmt.Errorf("failed to write wal entry: %w", err)
+	}
+
+	err = w.file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync wal: %w", err)
+	}
+	return nil
+}
+
+// Reads the pending entry. ok is false if the log is empty.
+func (w *wal) read() (e walEntry, ok bool, err error) {
+	data, err := io.ReadAll(io.NewSectionReader(w.file, 0, 1<<62))
+	if err != nil {
+		return walEntry{}, false, fmt.Errorf("failed to read wal: %w", err)
+	}
+	if len(data) == 0 {
+		return walEntry{}, false, nil
+	}
+
+	e, err = decodeWALEntry(data)
+	if err != nil {
+		return walEntry{}, false, err
+	}
+	return e, true, nil
+}
+
+func (w *wal) clear() error {
+	err := w.file.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("failed to clear wal: %w", err)
+	}
+
+	err = w.file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync wal: %w", err)
+	}
+	return nil
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
+
+// Applies an entry to the files, syncing each. The WAL is cleared only once
+// both writes are durable.
+func (s *Store) commit(e walEntry) error {
+	if crashAt != nil && crashAt(txBegin) {
+		return errSimulatedCrash
+	}
+
+	err := s.wal.write(e)
+	if err != nil {
+		return err
+	}
+	if crashAt != nil && crashAt(txLogged) {
+		return errSimulatedCrash
+	}
+
+	err = writeAndSync(s.vecFile, e.vecBytes)
+	if err != nil {
+		return s.rollback(e, fmt.Errorf("failed to write embedding to data file: %w", err))
+	}
+	if e.f32Bytes != nil {
+		err = writeAndSync(s.f32File, e.f32Bytes)
+		if err != nil {
+			return s.rollback(e, fmt.Errorf("failed to write full-precision embedding: %w", err))
+		}
+	}
+	if crashAt != nil && crashAt(txVectorsSynced) {
+		return errSimulatedCrash
+	}
+
+	err = writeAndSync(s.mdFile, e.mdBytes)
+	if err != nil {
+		return s.rollback(e, fmt.Errorf("failed to store embedding metadata: %w", err))
+	}
+	if e.tsBytes != nil {
+		err = writeAndSync(s.tsFile, e.tsBytes)
+		if err != nil {
+			return s.rollback(e, fmt.Errorf("failed to write tombstones: %w", err))
+		}
+	}
+	if crashAt != nil && crashAt(txMetadataSynced) {
+		return errSimulatedCrash
+	}
+
+	return s.wal.clear()
+}
+
+// Undoes a failed commit. If the files cannot be cut back the WAL entry is
+// left in place so the next open replays it instead.
+func (s *Store) rollback(e walEntry, cause error) error {
+	err := errors.Join(
+		truncateAndSync(s.vecFile, e.vecStart),
+		truncateAndSync(s.mdFile, e.mdStart),
+	)
+	if e.f32Bytes != nil {
+		err = errors.Join(err, truncateAndSync(s.f32File, e.f32Start))
+	}
+	if e.tsBytes != nil {
+		err = errors.Join(err, truncateAndSync(s.tsFile, e.tsStart))
+	}
+	if err != nil {
+		return errors.Join(cause, fmt.Errorf("failed to roll back, will replay on next open: %w", err))
+	}
+
+	return errors.Join(cause, s.wal.clear())
+}
+
+// Replays or discards whatever the WAL holds after an unclean shutdown
+func (s *Store) recover() error {
+	e, ok, err := s.wal.read()
+	if errors.Is(err, errTornWAL) {
+		// The entry never became durable, so neither file was touched
+		return s.wal.clear()
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	type logged struct {
+		file  *os.File
+		start int64
+		data  []byte
+	}
+	files := []logged{
+		{s.vecFile, e.vecStart, e.vecBytes},
+		{s.mdFile, e.mdStart, e.mdBytes},
+	}
+	if e.f32Bytes != nil {
+		if s.f32File == nil {
+			return fmt.Errorf("wal: entry has full-precision vectors but %s is missing", float32FileName)
+		}
+		files = append(files, logged{s.f32File, e.f32Start, e.f32Bytes})
+	}
+	if e.tsBytes != nil {
+		files = append(files, logged{s.tsFile, e.tsStart, e.tsBytes})
+	}
+
+	for _, f := range files {
+		info, err := f.file.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to get file info: %w", err)
+		}
+		if info.Size() < f.start {
+			return fmt.Errorf("wal: %s is shorter than its logged start offset %d", f.file.Name(), f.start)
+		}
+
+		err = f.file.Truncate(f.start)
+		if err != nil {
+			return fmt.Errorf("failed to replay wal: %w", err)
+		}
+		err = writeAndSync(f.file, f.data)
+		if err != nil {
+			return fmt.Errorf("failed to replay wal: %w", err)
+		}
+	}
+
+	return s.wal.clear()
+}
+
+func writeAndSync(f *os.File, b []byte) error {
+	_, err := f.Write(b)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func truncateAndSync(f *os.File, size int64) error {
+	err := f.Truncate(size)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
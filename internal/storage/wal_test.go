@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWALEntryRoundTrip(t *testing.T) {
+	e := walEntry{vecStart: 1536, mdStart: 42, vecBytes: []byte{1, 2, 3, 4}, mdBytes: []byte("{}\n")}
+
+	got, err := decodeWALEntry(e.encode())
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.vecStart != e.vecStart || got.mdStart != e.mdStart {
+		t.Fatalf("expected starts %d/%d, got %d/%d", e.vecStart, e.mdStart, got.vecStart, got.mdStart)
+	}
+	if string(got.vecBytes) != string(e.vecBytes) || string(got.mdBytes) != string(e.mdBytes) {
+		t.Fatalf("payload mismatch: %+v", got)
+	}
+}
+
+func TestWALEntryRoundTripWithFloat32Copy(t *testing.T) {
+	e := walEntry{vecBytes: []byte{1}, mdBytes: []byte("{}\n"), f32Start: 64, f32Bytes: []byte{5, 6, 7, 8}}
+
+	got, err := decodeWALEntry(e.encode())
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.f32Start != 64 || string(got.f32Bytes) != string(e.f32Bytes) || string(got.mdBytes) != "{}\n" {
+		t.Fatalf("payload mismatch: %+v", got)
+	}
+}
+
+func TestWALEntryRoundTripWithTombstones(t *testing.T) {
+	for _, f32 := range [][]byte{nil, {5, 6, 7, 8}} {
+		e := walEntry{mdBytes: []byte("{}\n"), f32Start: 64, f32Bytes: f32, tsStart: 12, tsBytes: []byte("{\"ID\":3}\n")}
+
+		got, err := decodeWALEntry(e.encode())
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if string(got.f32Bytes) != string(f32) || (f32 == nil) != (got.f32Bytes == nil) {
+			t.Fatalf("expected float32 bytes %v, got %v", f32, got.f32Bytes)
+		}
+		if got.tsStart != 12 || string(got.tsBytes) != string(e.tsBytes) {
+			t.Fatalf("payload mismatch: %+v", got)
+		}
+	}
+}
+
+func TestWALEntryDetectsTornAndCorruptEntries(t *testing.T) {
+	b := walEntry{vecStart: 0, mdStart: 0, vecBytes: []byte{9, 9, 9, 9}, mdBytes: []byte("x\n")}.encode()
+
+	for cut := range len(b) {
+		if _, err := decodeWALEntry(b[:cut]); err != errTornWAL {
+			t.Fatalf("cut at %d: expected errTornWAL, got %v", cut, err)
+		}
+	}
+
+	b[len(b)-1] ^= 0xff
+	if _, err := decodeWALEntry(b); err != errTornWAL {
+		t.Fatalf("expected checksum mismatch to be detected, got %v", err)
+	}
+}
+
+// Simulates a crash at every step of an append, optionally tearing the write
+// that was in flight, and checks the store reopens with both files in step.
+func TestAppendSurvivesCrashAtEveryStep(t *testing.T) {
+	cases := []struct {
+		name      string
+		step      txStep
+		tear      func(t *testing.T, dir string)
+		committed bool
+	}{
+		{name: "before logging", step: txBegin, committed: false},
+		{name: "torn wal entry", step: txBegin, tear: tearWAL, committed: false},
+		{name: "after logging", step: txLogged, committed: true},
+		{name: "torn vector write", step: txLogged, tear: appendGarbage(vectorFileName, 700), committed: true},
+		{name: "after vectors", step: txVectorsSynced, committed: true},
+		{name: "torn metadata write", step: txVectorsSynced, tear: appendGarbage(metadataFileName, 11), committed: true},
+		{name: "after metadata", step: txMetadataSynced, committed: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := Open(dir, Options{Dimension: embeddingSize})
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			if _, err := store.Append(newSparseVector(map[int]float32{0: 1}), "committed"); err != nil {
+				t.Fatalf("append: %v", err)
+			}
+
+			crashAt = func(step txStep) bool { return step == tc.step }
+			t.Cleanup(func() { crashAt = nil })
+
+			if _, err := store.Append(newSparseVector(map[int]float32{1: 1}), "in flight"); err != errSimulatedCrash {
+				t.Fatalf("expected simulated crash, got %v", err)
+			}
+			crashAt = nil
+			store.Close()
+
+			if tc.tear != nil {
+				tc.tear(t, dir)
+			}
+
+			reopened, err := Open(dir, Options{Dimension: embeddingSize})
+			if err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			defer reopened.Close()
+
+			want := 1
+			if tc.committed {
+				want = 2
+			}
+			assertConsistent(t, dir, want)
+
+			last, err := reopened.Get(want - 1)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if tc.committed && (last.Meta.Text != "in flight" || last.Vector[1] != 1) {
+				t.Fatalf("expected replayed record, got %+v", last.Meta)
+			}
+
+			// The store must keep working after recovery
+			if _, err := reopened.Append(newSparseVector(map[int]float32{2: 1}), "after"); err != nil {
+				t.Fatalf("append after recovery: %v", err)
+			}
+			assertConsistent(t, dir, want+1)
+		})
+	}
+}
+
+func assertConsistent(t *testing.T, dir string, want int) {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(dir, vectorFileName))
+	if err != nil {
+		t.Fatalf("read data: %v", err)
+	}
+	if len(data) != testHeaderSize+want*testRecordSize {
+		t.Fatalf("expected %d vectors in data file, found %d bytes", want, len(data))
+	}
+
+	md, err := os.ReadFile(filepath.Join(dir, metadataFileName))
+	if err != nil {
+		t.Fatalf("read metadata: %v", err)
+	}
+	if !strings.HasSuffix(string(md), "\n") {
+		t.Fatalf("metadata file ends with a torn line: %q", md)
+	}
+	lines := strings.Split(strings.TrimSpace(string(md)), "\n")
+	if len(lines) != want {
+		t.Fatalf("expected %d metadata lines, got %d", want, len(lines))
+	}
+
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatalf("stat wal: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Fatalf("expected wal to be cleared after recovery, size %d", info.Size())
+	}
+}
+
+// Leaves half of a WAL entry behind, as if the crash hit mid-write
+func tearWAL(t *testing.T, dir string) {
+	t.Helper()
+	e := walEntry{vecStart: int64(testHeaderSize + embeddingSize*4), vecBytes: make([]byte, embeddingSize*4), mdBytes: []byte("{}\n")}.encode()
+	if err := os.WriteFile(filepath.Join(dir, walFileName), e[:len(e)/2], 0o644); err != nil {
+		t.Fatalf("write torn wal: %v", err)
+	}
+}
+
+func appendGarbage(name string, n int) func(t *testing.T, dir string) {
+	return func(t *testing.T, dir string) {
+		t.Helper()
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatalf("open %s: %v", name, err)
+		}
+		defer f.Close()
+		if _, err := f.Write(make([]byte, n)); err != nil {
+			t.Fatalf("write garbage: %v", err)
+		}
+	}
+}